@@ -0,0 +1,252 @@
+// bridges.go - Bridge line routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package bridges provides routines for parsing, validating and importing
+// tor bridge lines.
+package bridges
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/tor"
+)
+
+const fingerprintLen = 40
+
+// transportArgs is the map of transports to the arguments that each bridge
+// line must include.
+var transportArgs = map[string][]string{
+	"obfs2":        nil,
+	"obfs3":        nil,
+	"obfs4":        []string{"cert", "iat-mode"},
+	"scramblesuit": []string{"password"},
+	"meek_lite":    []string{"url"},
+	"snowflake":    nil,
+}
+
+// Bridge is a parsed bridge line.
+type Bridge struct {
+	// Transport is the pluggable transport, or "" for a vanilla bridge.
+	Transport string
+
+	// Addr is the bridge's `address:port`.
+	Addr string
+
+	// Fingerprint is the bridge's identity key fingerprint, in upper case
+	// hex, if specified.
+	Fingerprint string
+
+	// Args is the list of `key=value` transport arguments, in the order
+	// that they were specified.
+	Args []string
+}
+
+// String returns the bridge as a torrc `Bridge` line.
+func (b *Bridge) String() string {
+	sp := []string{"Bridge"}
+	if b.Transport != "" {
+		sp = append(sp, b.Transport)
+	}
+	sp = append(sp, b.Addr)
+	if b.Fingerprint != "" {
+		sp = append(sp, b.Fingerprint)
+	}
+	sp = append(sp, b.Args...)
+	return strings.Join(sp, " ")
+}
+
+// LineError is the error for a single malformed bridge line.
+type LineError struct {
+	// Line is the 1 indexed line number of the malformed line.
+	Line int
+
+	// Err is the reason why the line is malformed.
+	Err error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// ParseError is the error returned when one or more bridge lines are
+// malformed.
+type ParseError []*LineError
+
+func (e ParseError) Error() string {
+	var s []string
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return "invalid Bridge(s): " + strings.Join(s, ", ")
+}
+
+// Parse parses the newline separated bridge lines, skipping blank lines.
+// All of the well formed bridges are returned, along with a ParseError if
+// any of the lines are malformed.
+func Parse(s string) ([]*Bridge, error) {
+	var ret []*Bridge
+	var errs ParseError
+	for i, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if b, err := ParseLine(l); err != nil {
+			errs = append(errs, &LineError{Line: i + 1, Err: err})
+		} else {
+			ret = append(ret, b)
+		}
+	}
+	if errs != nil {
+		return ret, errs
+	}
+	return ret, nil
+}
+
+// ParseLine parses and validates a single bridge line, with or without the
+// leading `Bridge`.
+func ParseLine(l string) (*Bridge, error) {
+	sp := strings.Fields(l)
+	if len(sp) > 0 && strings.ToLower(sp[0]) == "bridge" {
+		sp = sp[1:]
+	}
+	if len(sp) == 0 {
+		return nil, fmt.Errorf("missing address")
+	}
+
+	b := new(Bridge)
+
+	// A transport name can never contain a `:`, while the address always
+	// will.
+	if !strings.Contains(sp[0], ":") {
+		if net.ParseIP(sp[0]) != nil {
+			return nil, fmt.Errorf("missing port: %v", sp[0])
+		}
+		b.Transport = sp[0]
+		if _, ok := transportArgs[b.Transport]; !ok || tor.Transports[b.Transport] == "" {
+			return nil, fmt.Errorf("unknown transport: %v", b.Transport)
+		}
+		sp = sp[1:]
+		if len(sp) == 0 {
+			return nil, fmt.Errorf("missing address")
+		}
+	}
+
+	if err := validateAddr(sp[0]); err != nil {
+		return nil, err
+	}
+	b.Addr = sp[0]
+	sp = sp[1:]
+
+	if len(sp) > 0 && !strings.Contains(sp[0], "=") {
+		fpr := strings.TrimPrefix(sp[0], "$")
+		if _, err := hex.DecodeString(fpr); err != nil || len(fpr) != fingerprintLen {
+			return nil, fmt.Errorf("malformed fingerprint: %v", sp[0])
+		}
+		b.Fingerprint = strings.ToUpper(fpr)
+		sp = sp[1:]
+	}
+
+	args := make(map[string]string)
+	for _, v := range sp {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed argument: %v", v)
+		}
+		if _, ok := args[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate argument: %v", kv[0])
+		}
+		args[kv[0]] = kv[1]
+		b.Args = append(b.Args, v)
+	}
+	if b.Transport == "" && len(args) != 0 {
+		return nil, fmt.Errorf("arguments specified for a vanilla bridge")
+	}
+	for _, k := range transportArgs[b.Transport] {
+		if args[k] == "" {
+			return nil, fmt.Errorf("missing %v argument: %v", b.Transport, k)
+		}
+	}
+	if err := validateArgs(b.Transport, args); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Dedupe removes duplicate bridges, keeping the first occurrence.  Bridges
+// are considered duplicates if they share a fingerprint, or if they lack
+// one, the same transport and address.
+func Dedupe(bs []*Bridge) []*Bridge {
+	var ret []*Bridge
+	seen := make(map[string]bool)
+	for _, b := range bs {
+		k := b.Fingerprint
+		if k == "" {
+			k = b.Transport + " " + b.Addr
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		ret = append(ret, b)
+	}
+	return ret
+}
+
+// Format returns the newline separated torrc `Bridge` lines for the bridges.
+func Format(bs []*Bridge) string {
+	var s []string
+	for _, b := range bs {
+		s = append(s, b.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func validateAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("malformed address: %v", addr)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("address is not an IP address: %v", host)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("malformed port: %v", port)
+	}
+	return nil
+}
+
+func validateArgs(transport string, args map[string]string) error {
+	switch transport {
+	case "obfs4":
+		switch args["iat-mode"] {
+		case "0", "1", "2":
+		default:
+			return fmt.Errorf("malformed obfs4 iat-mode: %v", args["iat-mode"])
+		}
+	case "meek_lite":
+		u, err := url.Parse(args["url"])
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("malformed meek_lite url: %v", args["url"])
+		}
+	}
+	return nil
+}
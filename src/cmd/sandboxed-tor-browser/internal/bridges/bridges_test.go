@@ -0,0 +1,310 @@
+// bridges_test.go - Bridge line tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bridges
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testFpr  = "0123456789ABCDEF0123456789ABCDEF01234567"
+	testFpr2 = "89ABCDEF0123456789ABCDEF0123456789ABCDEF"
+	testCert = "cert=ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw"
+)
+
+func TestParseLine(t *testing.T) {
+	for _, v := range []struct {
+		descr    string
+		line     string
+		expected *Bridge
+		errStr   string
+	}{
+		{
+			descr:    "vanilla",
+			line:     "192.0.2.1:9001 " + testFpr,
+			expected: &Bridge{Addr: "192.0.2.1:9001", Fingerprint: testFpr},
+		},
+		{
+			descr:    "vanilla with prefix, lower case, and $",
+			line:     "  Bridge 192.0.2.1:9001 $" + strings.ToLower(testFpr),
+			expected: &Bridge{Addr: "192.0.2.1:9001", Fingerprint: testFpr},
+		},
+		{
+			descr:    "vanilla IPv6 without fingerprint",
+			line:     "bridge [2001:db8::1]:443",
+			expected: &Bridge{Addr: "[2001:db8::1]:443"},
+		},
+		{
+			descr:  "vanilla with arguments",
+			line:   "192.0.2.1:9001 " + testFpr + " foo=bar",
+			errStr: "arguments specified for a vanilla bridge",
+		},
+		{
+			descr:    "obfs4",
+			line:     "obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0",
+			expected: &Bridge{Transport: "obfs4", Addr: "192.0.2.2:443", Fingerprint: testFpr, Args: []string{testCert, "iat-mode=0"}},
+		},
+		{
+			descr:  "obfs4 missing cert",
+			line:   "obfs4 192.0.2.2:443 " + testFpr + " iat-mode=0",
+			errStr: "missing obfs4 argument: cert",
+		},
+		{
+			descr:  "obfs4 missing iat-mode",
+			line:   "obfs4 192.0.2.2:443 " + testFpr + " " + testCert,
+			errStr: "missing obfs4 argument: iat-mode",
+		},
+		{
+			descr:  "obfs4 bad iat-mode",
+			line:   "obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=3",
+			errStr: "malformed obfs4 iat-mode",
+		},
+		{
+			descr:  "obfs4 duplicate argument",
+			line:   "obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0 iat-mode=1",
+			errStr: "duplicate argument: iat-mode",
+		},
+		{
+			descr:  "obfs4 malformed argument",
+			line:   "obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0 =foo",
+			errStr: "malformed argument",
+		},
+		{
+			descr:    "meek_lite",
+			line:     "meek_lite 0.0.2.0:2 " + testFpr + " url=https://meek.azureedge.net/ front=ajax.aspnetcdn.com",
+			expected: &Bridge{Transport: "meek_lite", Addr: "0.0.2.0:2", Fingerprint: testFpr, Args: []string{"url=https://meek.azureedge.net/", "front=ajax.aspnetcdn.com"}},
+		},
+		{
+			descr:  "meek_lite missing url",
+			line:   "meek_lite 0.0.2.0:2 " + testFpr + " front=ajax.aspnetcdn.com",
+			errStr: "missing meek_lite argument: url",
+		},
+		{
+			descr:  "meek_lite bad url",
+			line:   "meek_lite 0.0.2.0:2 url=ftp://example.com/",
+			errStr: "malformed meek_lite url",
+		},
+		{
+			descr:    "snowflake",
+			line:     "snowflake 0.0.3.0:1",
+			expected: &Bridge{Transport: "snowflake", Addr: "0.0.3.0:1"},
+		},
+		{
+			descr:  "unknown transport",
+			line:   "fte 192.0.2.3:80 " + testFpr,
+			errStr: "unknown transport: fte",
+		},
+		{
+			descr:  "transport without address",
+			line:   "obfs4",
+			errStr: "missing address",
+		},
+		{
+			descr:  "empty",
+			line:   "Bridge",
+			errStr: "missing address",
+		},
+		{
+			descr:  "missing port",
+			line:   "192.0.2.1 " + testFpr,
+			errStr: "missing port",
+		},
+		{
+			descr:  "hostname",
+			line:   "bridge.example.com:443 " + testFpr,
+			errStr: "not an IP address",
+		},
+		{
+			descr:  "zero port",
+			line:   "192.0.2.1:0",
+			errStr: "malformed port",
+		},
+		{
+			descr:  "large port",
+			line:   "192.0.2.1:65536",
+			errStr: "malformed port",
+		},
+		{
+			descr:  "short fingerprint",
+			line:   "192.0.2.1:9001 0123456789ABCDEF",
+			errStr: "malformed fingerprint",
+		},
+		{
+			descr:  "non-hex fingerprint",
+			line:   "192.0.2.1:9001 " + strings.Repeat("G", fingerprintLen),
+			errStr: "malformed fingerprint",
+		},
+	} {
+		b, err := ParseLine(v.line)
+		switch {
+		case v.errStr != "":
+			if err == nil || !strings.Contains(err.Error(), v.errStr) {
+				t.Errorf("%v: expected '%v', got: %v", v.descr, v.errStr, err)
+			}
+		case err != nil:
+			t.Errorf("%v: %v", v.descr, err)
+		case !reflect.DeepEqual(b, v.expected):
+			t.Errorf("%v: got %+v, expected %+v", v.descr, b, v.expected)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	s := strings.Join([]string{
+		"192.0.2.1:9001 " + testFpr,
+		"",
+		"   ",
+		"obfs4 192.0.2.2:443 " + testFpr2 + " iat-mode=0", // Missing cert.
+		"snowflake 0.0.3.0:1",
+		"not a bridge line",
+	}, "\n")
+
+	bs, err := Parse(s)
+	if len(bs) != 2 || bs[0].Addr != "192.0.2.1:9001" || bs[1].Transport != "snowflake" {
+		t.Errorf("well formed bridges: %v", bs)
+	}
+	pe, ok := err.(ParseError)
+	if !ok {
+		t.Fatalf("expected a ParseError, got: %v", err)
+	}
+	var lines []int
+	for _, e := range pe {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{4, 6}) {
+		t.Errorf("error line numbers: %v", lines)
+	}
+	if !strings.Contains(pe.Error(), "line 4: missing obfs4 argument: cert") {
+		t.Errorf("error: %v", pe)
+	}
+
+	if bs, err = Parse("\n\n"); err != nil || len(bs) != 0 {
+		t.Errorf("blank lines: %v %v", bs, err)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	bs, err := Parse(strings.Join([]string{
+		"obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0",
+		"192.0.2.1:9001 " + testFpr,  // Same fingerprint.
+		"192.0.2.1:9001 " + testFpr2, // Same address, different fingerprint.
+		"192.0.2.3:9001",             // No fingerprint.
+		"Bridge 192.0.2.3:9001",      // Same address, no fingerprint.
+		"snowflake 192.0.2.3:9001",   // Same address, different transport.
+		"192.0.2.2:443 $" + testFpr,  // Same fingerprint, differently specified.
+	}, "\n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	var addrs []string
+	for _, b := range Dedupe(bs) {
+		addrs = append(addrs, b.Transport+" "+b.Addr)
+	}
+	expected := []string{"obfs4 192.0.2.2:443", " 192.0.2.1:9001", " 192.0.2.3:9001", "snowflake 192.0.2.3:9001"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("deduped: %q, expected %q", addrs, expected)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	bs, err := Parse("obfs4 192.0.2.2:443 $" + strings.ToLower(testFpr) + " " + testCert + " iat-mode=0\n192.0.2.1:9001")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	expected := "Bridge obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0\nBridge 192.0.2.1:9001"
+	if s := Format(bs); s != expected {
+		t.Errorf("Format: %v", s)
+	}
+}
+
+func TestImport(t *testing.T) {
+	obfs4Line := "obfs4 192.0.2.2:443 " + testFpr + " " + testCert + " iat-mode=0"
+	obfs4Line2 := "obfs4 192.0.2.4:443 " + testFpr2 + " " + testCert + " iat-mode=1"
+
+	for _, v := range []struct {
+		descr    string
+		text     string
+		expected []string
+		errStr   string
+	}{
+		{
+			descr:    "QR code",
+			text:     "['" + obfs4Line + "', '" + obfs4Line2 + "']",
+			expected: []string{obfs4Line, obfs4Line2},
+		},
+		{
+			descr:    "QR code, double quoted, and duplicated",
+			text:     "  [\"" + obfs4Line + "\", \"" + obfs4Line + "\"]\n",
+			expected: []string{obfs4Line},
+		},
+		{
+			descr:  "QR code with a malformed entry",
+			text:   "['" + obfs4Line + "', 'obfs4 192.0.2.4:443']",
+			errStr: "QR code entry 2",
+		},
+		{
+			descr: "e-mail",
+			text: strings.Join([]string{
+				"Here are your bridges:",
+				"",
+				"  " + obfs4Line,
+				"  " + obfs4Line2,
+				"",
+				"To enter bridges into Tor Browser, follow the instructions on the Tor",
+				"Browser download page [0] to start Tor Browser.",
+			}, "\n"),
+			expected: []string{obfs4Line, obfs4Line2},
+		},
+		{
+			descr:    "quoted e-mail reply",
+			text:     "On Monday, BridgeDB wrote:\n> Here are your bridges:\n>\n>   " + obfs4Line + "\n> \n",
+			expected: []string{obfs4Line},
+		},
+		{
+			descr:    "web page",
+			text:     "Your bridgeline is:\n" + strings.Replace(strings.Replace(obfs4Line, "/", "&#x2F;", -1), "+", "&#43;", -1) + "\nSelect All\nShow QRCode",
+			expected: []string{obfs4Line},
+		},
+		{
+			descr:  "no bridges",
+			text:   "BridgeDB is unavailable, please try again later.",
+			errStr: ErrNoBridges.Error(),
+		},
+	} {
+		bs, err := Import(v.text)
+		if v.errStr != "" {
+			if err == nil || !strings.Contains(err.Error(), v.errStr) {
+				t.Errorf("%v: expected '%v', got: %v", v.descr, v.errStr, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: %v", v.descr, err)
+			continue
+		}
+
+		var lines []string
+		for _, b := range bs {
+			lines = append(lines, strings.TrimPrefix(b.String(), "Bridge "))
+		}
+		if !reflect.DeepEqual(lines, v.expected) {
+			t.Errorf("%v: got %q, expected %q", v.descr, lines, v.expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// import.go - BridgeDB bridge import routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package bridges
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// ErrNoBridges is the error returned when an import finds no bridge lines.
+var ErrNoBridges = errors.New("bridges: no bridge lines found")
+
+// qrEntryRe matches the individual bridge lines in a BridgeDB QR code
+// payload, which is a Python list of strings.
+var qrEntryRe = regexp.MustCompile(`'([^']*)'|"([^"]*)"`)
+
+// Import extracts the bridges from a BridgeDB response, which may either be
+// the body of an e-mail, the text from the web page, or the payload of a QR
+// code.  The returned bridges are de-duplicated.
+func Import(s string) ([]*Bridge, error) {
+	var bs []*Bridge
+
+	if t := strings.TrimSpace(s); strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+		// QR code payloads are machine generated, so every entry is
+		// expected to be well formed.
+		for i, m := range qrEntryRe.FindAllStringSubmatch(t, -1) {
+			l := m[1] + m[2]
+			b, err := ParseLine(l)
+			if err != nil {
+				return nil, fmt.Errorf("bridges: QR code entry %d: %v", i+1, err)
+			}
+			bs = append(bs, b)
+		}
+	} else {
+		// E-mails and the web page have the bridge lines surrounded by
+		// prose, so anything that doesn't parse is skipped.
+		for _, l := range strings.Split(html.UnescapeString(s), "\n") {
+			l = strings.TrimSpace(strings.TrimLeft(l, "> \t")) // Quoted replies.
+			if l == "" {
+				continue
+			}
+			if b, err := ParseLine(l); err == nil {
+				bs = append(bs, b)
+			}
+		}
+	}
+
+	if len(bs) == 0 {
+		return nil, ErrNoBridges
+	}
+	return Dedupe(bs), nil
+}
@@ -0,0 +1,240 @@
+// moat.go - BridgeDB moat client.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package moat implements a client for BridgeDB's moat bridge distribution
+// API.
+package moat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURL is the BridgeDB moat API endpoint.
+	DefaultURL = "https://bridges.torproject.org/moat"
+
+	apiVersion      = "0.1.0"
+	contentType     = "application/vnd.api+json"
+	maxResponseSize = 1024 * 1024
+	requestTimeout  = 2 * time.Minute
+
+	typeClientTransports = "client-transports"
+	typeChallenge        = "moat-challenge"
+	typeSolution         = "moat-solution"
+	typeBridges          = "moat-bridges"
+
+	codeBadSolution = 419
+)
+
+// ErrBadSolution is the error returned when the CAPTCHA solution is
+// incorrect.  A new challenge must be fetched before trying again.
+var ErrBadSolution = errors.New("moat: incorrect CAPTCHA solution")
+
+// Error is an error returned by the moat server.
+type Error struct {
+	Code   int    `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("moat: server error %d: %v", e.Code, e.Detail)
+}
+
+// Challenge is a CAPTCHA challenge.
+type Challenge struct {
+	// Transport is the transport that the bridges will be for.
+	Transport string
+
+	// Image is the JPEG encoded CAPTCHA image.
+	Image []byte
+
+	challenge string
+}
+
+// Client is a moat client.
+type Client struct {
+	url    string
+	client *http.Client
+}
+
+type request struct {
+	Data []interface{} `json:"data"`
+}
+
+type fetchData struct {
+	Version   string   `json:"version"`
+	Type      string   `json:"type"`
+	Supported []string `json:"supported"`
+}
+
+type checkData struct {
+	ID        string `json:"id"`
+	Version   string `json:"version"`
+	Type      string `json:"type"`
+	Transport string `json:"transport"`
+	Challenge string `json:"challenge"`
+	Solution  string `json:"solution"`
+	QRCode    string `json:"qrcode"`
+}
+
+type response struct {
+	Data []struct {
+		Type      string   `json:"type"`
+		Version   string   `json:"version"`
+		Transport string   `json:"transport"`
+		Image     string   `json:"image"`
+		Challenge string   `json:"challenge"`
+		Bridges   []string `json:"bridges"`
+	} `json:"data"`
+	Errors []*Error `json:"errors"`
+}
+
+// Fetch requests a CAPTCHA challenge, for bridges that use one of the
+// supported transports.
+func (c *Client) Fetch(supported []string) (*Challenge, error) {
+	req := &fetchData{
+		Version:   apiVersion,
+		Type:      typeClientTransports,
+		Supported: supported,
+	}
+	resp, err := c.do("fetch", req, typeChallenge)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &Challenge{
+		Transport: resp.Data[0].Transport,
+		challenge: resp.Data[0].Challenge,
+	}
+	if ch.Image, err = base64.StdEncoding.DecodeString(resp.Data[0].Image); err != nil {
+		return nil, fmt.Errorf("moat: malformed CAPTCHA image: %v", err)
+	}
+	return ch, nil
+}
+
+// Check submits the solution to a CAPTCHA challenge, and returns the bridge
+// lines on success.
+func (c *Client) Check(ch *Challenge, solution string) ([]string, error) {
+	req := &checkData{
+		ID:        "2",
+		Version:   apiVersion,
+		Type:      typeSolution,
+		Transport: ch.Transport,
+		Challenge: ch.challenge,
+		Solution:  solution,
+		QRCode:    "false",
+	}
+	resp, err := c.do("check", req, typeBridges)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data[0].Bridges) == 0 {
+		return nil, fmt.Errorf("moat: no bridges received")
+	}
+	return resp.Data[0].Bridges, nil
+}
+
+func (c *Client) do(endpoint string, data interface{}, expectedType string) (*response, error) {
+	b, err := json.Marshal(&request{Data: []interface{}{data}})
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.url+"/"+endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("User-Agent", "")
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	b, err = ioutil.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything that isn't JSON-API is from something other than the moat
+	// server, such as a captive portal or a broken front.
+	if mt, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); mt != contentType {
+		if httpResp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("moat: HTTP status: %v", httpResp.Status)
+		}
+		return nil, fmt.Errorf("moat: unexpected content type: '%v'", mt)
+	}
+
+	// Errors are returned with a non-200 status code, but with a JSON-API
+	// body, so attempt to decode the body first.
+	resp := new(response)
+	if err = json.Unmarshal(b, resp); err != nil {
+		if httpResp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("moat: HTTP status: %v", httpResp.Status)
+		}
+		return nil, fmt.Errorf("moat: malformed response: %v", err)
+	}
+	if len(resp.Errors) > 0 {
+		if resp.Errors[0].Code == codeBadSolution {
+			return nil, ErrBadSolution
+		}
+		return nil, resp.Errors[0]
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("moat: HTTP status: %v", httpResp.Status)
+	}
+	if len(resp.Data) != 1 {
+		return nil, fmt.Errorf("moat: unexpected number of responses: %d", len(resp.Data))
+	}
+	if resp.Data[0].Type != expectedType {
+		return nil, fmt.Errorf("moat: unexpected response type: %v", resp.Data[0].Type)
+	}
+	if resp.Data[0].Version != apiVersion {
+		return nil, fmt.Errorf("moat: unsupported version: %v", resp.Data[0].Version)
+	}
+
+	return resp, nil
+}
+
+// NewClient creates a new moat client, that will issue requests to the API
+// endpoint at url.  If dialFn is non-nil, it will be used to establish all
+// connections, which is how the domain fronted transport is used.
+func NewClient(url string, dialFn func(string, string) (net.Conn, error)) *Client {
+	transport := &http.Transport{
+		Proxy: nil,
+		Dial:  dialFn,
+	}
+	return &Client{
+		url: strings.TrimSuffix(url, "/"),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   requestTimeout,
+		},
+	}
+}
@@ -0,0 +1,218 @@
+// moat_test.go - BridgeDB moat client tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package moat
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testChallenge = "opaque-challenge"
+	testSolution  = "t3st"
+	testImage     = "/9j/4AAQ" // Base64 of a JPEG SOI, and APP0 marker.
+)
+
+var testBridges = []string{
+	"obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=AAAA iat-mode=0",
+	"obfs4 192.0.2.2:443 89ABCDEF0123456789ABCDEF0123456789ABCDEF cert=BBBB iat-mode=0",
+}
+
+// fakeHandler is the response of the fake moat server, given the endpoint,
+// and the request's data object.
+type fakeHandler func(t *testing.T, endpoint string, data map[string]interface{}) (int, string, string)
+
+func newFakeServer(t *testing.T, fn fakeHandler) (*httptest.Server, *Client) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("method: %v", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != contentType {
+			t.Errorf("request content type: %v", ct)
+		}
+		if !strings.HasPrefix(r.URL.Path, "/moat/") {
+			t.Errorf("path: %v", r.URL.Path)
+		}
+
+		var req struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Data) != 1 {
+			t.Errorf("malformed request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if v := req.Data[0]["version"]; v != apiVersion {
+			t.Errorf("request version: %v", v)
+		}
+
+		status, ct, body := fn(t, strings.TrimPrefix(r.URL.Path, "/moat/"), req.Data[0])
+		w.Header().Set("Content-Type", ct)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return srv, NewClient(srv.URL+"/moat/", nil)
+}
+
+func jsonBody(t *testing.T, v interface{}) string {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(v); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	return b.String()
+}
+
+// moatHandler is a well behaved moat server.
+func moatHandler(t *testing.T, endpoint string, data map[string]interface{}) (int, string, string) {
+	switch endpoint {
+	case "fetch":
+		if data["type"] != typeClientTransports {
+			t.Errorf("fetch type: %v", data["type"])
+		}
+		if s, ok := data["supported"].([]interface{}); !ok || len(s) != 1 || s[0] != "obfs4" {
+			t.Errorf("fetch supported: %v", data["supported"])
+		}
+		return http.StatusOK, contentType, jsonBody(t, map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"id":        "1",
+				"type":      typeChallenge,
+				"version":   apiVersion,
+				"transport": "obfs4",
+				"image":     testImage,
+				"challenge": testChallenge,
+			}},
+		})
+	case "check":
+		if data["type"] != typeSolution || data["transport"] != "obfs4" || data["challenge"] != testChallenge {
+			t.Errorf("check request: %v", data)
+		}
+		if data["solution"] != testSolution {
+			return http.StatusOK, contentType, `{"errors":[{"code":419,"detail":"The CAPTCHA solution was incorrect."}]}`
+		}
+		return http.StatusOK, contentType, jsonBody(t, map[string]interface{}{
+			"data": []map[string]interface{}{{
+				"id":      "3",
+				"type":    typeBridges,
+				"version": apiVersion,
+				"bridges": testBridges,
+				"qrcode":  nil,
+			}},
+		})
+	}
+	t.Errorf("unknown endpoint: %v", endpoint)
+	return http.StatusNotFound, "text/plain", "not found"
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv, c := newFakeServer(t, moatHandler)
+	defer srv.Close()
+
+	ch, err := c.Fetch([]string{"obfs4"})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if ch.Transport != "obfs4" || !bytes.Equal(ch.Image, []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10}) {
+		t.Errorf("challenge: %v %x", ch.Transport, ch.Image)
+	}
+
+	if _, err = c.Check(ch, "wrong"); err != ErrBadSolution {
+		t.Errorf("Check with a bad solution: %v", err)
+	}
+	bridges, err := c.Check(ch, testSolution)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !reflect.DeepEqual(bridges, testBridges) {
+		t.Errorf("bridges: %v", bridges)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	validChallenge := func(mutate func(map[string]interface{})) string {
+		d := map[string]interface{}{
+			"type":      typeChallenge,
+			"version":   apiVersion,
+			"transport": "obfs4",
+			"image":     testImage,
+			"challenge": testChallenge,
+		}
+		mutate(d)
+		b, _ := json.Marshal(map[string]interface{}{"data": []interface{}{d}})
+		return string(b)
+	}
+
+	for _, v := range []struct {
+		descr  string
+		status int
+		ct     string
+		body   string
+		errStr string
+	}{
+		{"content type", http.StatusOK, "text/html", "<html>Captive portal</html>", "unexpected content type"},
+		{"content type parameters", http.StatusOK, contentType + "; charset=utf-8", validChallenge(func(map[string]interface{}) {}), ""},
+		{"HTTP status", http.StatusBadGateway, "text/html", "<html>Bad gateway</html>", "HTTP status: 502"},
+		{"HTTP status JSON-API", http.StatusInternalServerError, contentType, `{"data":[]}`, "HTTP status: 500"},
+		{"malformed", http.StatusOK, contentType, `{"data":[{"type":`, "malformed response"},
+		{"version", http.StatusOK, contentType, validChallenge(func(d map[string]interface{}) { d["version"] = "0.2.0" }), "unsupported version"},
+		{"type", http.StatusOK, contentType, validChallenge(func(d map[string]interface{}) { d["type"] = typeBridges }), "unexpected response type"},
+		{"image", http.StatusOK, contentType, validChallenge(func(d map[string]interface{}) { d["image"] = "!!!" }), "malformed CAPTCHA image"},
+		{"no data", http.StatusOK, contentType, `{"data":[]}`, "unexpected number of responses"},
+	} {
+		srv, c := newFakeServer(t, func(*testing.T, string, map[string]interface{}) (int, string, string) {
+			return v.status, v.ct, v.body
+		})
+		_, err := c.Fetch([]string{"obfs4"})
+		srv.Close()
+
+		switch {
+		case v.errStr == "" && err != nil:
+			t.Errorf("%v: %v", v.descr, err)
+		case v.errStr != "" && (err == nil || !strings.Contains(err.Error(), v.errStr)):
+			t.Errorf("%v: expected '%v', got: %v", v.descr, v.errStr, err)
+		}
+	}
+}
+
+func TestErrorObject(t *testing.T) {
+	srv, c := newFakeServer(t, func(*testing.T, string, map[string]interface{}) (int, string, string) {
+		return http.StatusNotFound, contentType, `{"errors":[{"code":404,"detail":"Not Found"}]}`
+	})
+	defer srv.Close()
+
+	_, err := c.Fetch([]string{"obfs4"})
+	if e, ok := err.(*Error); !ok {
+		t.Fatalf("expected *Error, got: %v", err)
+	} else if e.Code != 404 || e.Detail != "Not Found" {
+		t.Errorf("error: %+v", e)
+	}
+}
+
+func TestNoBridges(t *testing.T) {
+	srv, c := newFakeServer(t, func(*testing.T, string, map[string]interface{}) (int, string, string) {
+		return http.StatusOK, contentType, `{"data":[{"type":"moat-bridges","version":"0.1.0","bridges":[]}]}`
+	})
+	defer srv.Close()
+
+	if _, err := c.Check(&Challenge{Transport: "obfs4"}, testSolution); err == nil || !strings.Contains(err.Error(), "no bridges") {
+		t.Errorf("Check: %v", err)
+	}
+}
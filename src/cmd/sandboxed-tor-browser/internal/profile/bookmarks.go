@@ -0,0 +1,282 @@
+// bookmarks.go - Bookmark import/export routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	placesFile = "places.sqlite"
+
+	// BookmarksHTMLFile is the file in the profile directory that Firefox
+	// imports bookmarks from when `browser.places.importBookmarksHTML` is set.
+	BookmarksHTMLFile = "bookmarks.html"
+
+	bookmarkTypeBookmark  = 1
+	bookmarkTypeFolder    = 2
+	bookmarkTypeSeparator = 3
+
+	maxBookmarkDepth = 32
+)
+
+// Bookmark is a bookmark, folder or separator.
+type Bookmark struct {
+	// Type is one of `bookmark`, `folder` or `separator`.
+	Type string `json:"type"`
+
+	// Title is the title of the bookmark or folder.
+	Title string `json:"title,omitempty"`
+
+	// URI is the URI of a bookmark.
+	URI string `json:"uri,omitempty"`
+
+	// DateAdded is when the entry was added, in seconds since the epoch.
+	DateAdded int64 `json:"dateAdded,omitempty"`
+
+	// Children are the entries in a folder.
+	Children []*Bookmark `json:"children,omitempty"`
+}
+
+// Bookmarks are the bookmark roots.
+type Bookmarks struct {
+	Menu    []*Bookmark `json:"menu,omitempty"`
+	Toolbar []*Bookmark `json:"toolbar,omitempty"`
+	Unfiled []*Bookmark `json:"unfiled,omitempty"`
+}
+
+// rootGUIDs are the well known GUIDs of the bookmark roots that get exported.
+// The mobile bookmarks are folded into the unfiled bookmarks, and the tags
+// are not exported at all.
+var rootGUIDs = []string{"menu________", "toolbar_____", "unfiled_____", "mobile______"}
+
+func (b *Bookmarks) root(guid string) *[]*Bookmark {
+	switch guid {
+	case "menu________":
+		return &b.Menu
+	case "toolbar_____":
+		return &b.Toolbar
+	default:
+		return &b.Unfiled
+	}
+}
+
+type bookmarkRow struct {
+	id, parent, position int64
+	b                    *Bookmark
+	fk                   int64
+	guid                 string
+}
+
+// readBookmarks reads the bookmarks, and nothing else (in particular not the
+// browsing history) from a `places.sqlite` file.
+func readBookmarks(path string) (*Bookmarks, error) {
+	// The reader only looks at the main database file, so refuse to use a
+	// database that has changes that have not been checkpointed yet.
+	if fi, err := os.Stat(path + "-wal"); err == nil && fi.Size() > 0 {
+		return nil, fmt.Errorf("profile: bookmark database is in use, exit the browser first")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db, err := openSQLite(f)
+	if err != nil {
+		return nil, err
+	}
+	s, err := db.readSchema()
+	if err != nil {
+		return nil, err
+	}
+	bTbl, pTbl := s["moz_bookmarks"], s["moz_places"]
+	if bTbl == nil || pTbl == nil {
+		return nil, fmt.Errorf("profile: bookmark tables missing from database")
+	}
+
+	// Pull out all of the entries in moz_bookmarks.
+	rows := make(map[int64]*bookmarkRow)
+	urls := make(map[int64]string)
+	if err = db.scanTable(bTbl.rootPage, func(rowid int64, rec []interface{}) error {
+		r := &bookmarkRow{id: rowid, b: new(Bookmark)}
+		typ, _ := bTbl.column(rec, "type").(int64)
+		r.fk, _ = bTbl.column(rec, "fk").(int64)
+		r.parent, _ = bTbl.column(rec, "parent").(int64)
+		r.position, _ = bTbl.column(rec, "position").(int64)
+		r.guid, _ = bTbl.column(rec, "guid").(string)
+		r.b.Title, _ = bTbl.column(rec, "title").(string)
+		if added, ok := bTbl.column(rec, "dateAdded").(int64); ok {
+			r.b.DateAdded = added / 1000000 // PRTime is in microseconds.
+		}
+		switch typ {
+		case bookmarkTypeBookmark:
+			r.b.Type = "bookmark"
+			urls[r.fk] = ""
+		case bookmarkTypeFolder:
+			r.b.Type = "folder"
+		case bookmarkTypeSeparator:
+			r.b.Type = "separator"
+		default:
+			return nil
+		}
+		rows[rowid] = r
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Look up the URLs of the bookmarks in moz_places, ignoring the visits.
+	if err = db.scanTable(pTbl.rootPage, func(rowid int64, rec []interface{}) error {
+		if _, ok := urls[rowid]; ok {
+			urls[rowid], _ = pTbl.column(rec, "url").(string)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Build the tree.
+	children := make(map[int64][]*bookmarkRow)
+	for _, r := range rows {
+		if r.b.Type == "bookmark" {
+			r.b.URI = urls[r.fk]
+			if r.b.URI == "" || strings.HasPrefix(r.b.URI, "place:") {
+				// Skip the "smart bookmarks", which are history queries.
+				continue
+			}
+		}
+		children[r.parent] = append(children[r.parent], r)
+	}
+	for _, v := range children {
+		sort.Slice(v, func(i, j int) bool { return v[i].position < v[j].position })
+	}
+
+	var build func(id int64, depth int) []*Bookmark
+	build = func(id int64, depth int) []*Bookmark {
+		if depth > maxBookmarkDepth {
+			return nil
+		}
+		var l []*Bookmark
+		for _, r := range children[id] {
+			if r.b.Type == "folder" {
+				r.b.Children = build(r.id, depth+1)
+			}
+			l = append(l, r.b)
+		}
+		return l
+	}
+
+	rootIDs := make(map[string]int64)
+	for _, r := range rows {
+		rootIDs[r.guid] = r.id
+	}
+	bm := new(Bookmarks)
+	for _, guid := range rootGUIDs {
+		if id, ok := rootIDs[guid]; ok {
+			root := bm.root(guid)
+			*root = append(*root, build(id, 0)...)
+		}
+	}
+	return bm, nil
+}
+
+func (b *Bookmark) validate(depth int) error {
+	if depth > maxBookmarkDepth {
+		return fmt.Errorf("profile: bookmarks nested too deeply")
+	}
+	switch b.Type {
+	case "bookmark":
+		if b.URI == "" || strings.HasPrefix(b.URI, "place:") || strings.HasPrefix(b.URI, "javascript:") {
+			return fmt.Errorf("profile: invalid bookmark URI: '%v'", b.URI)
+		}
+	case "folder":
+	case "separator":
+	default:
+		return fmt.Errorf("profile: invalid bookmark type: '%v'", b.Type)
+	}
+	for _, c := range b.Children {
+		if b.Type != "folder" {
+			return fmt.Errorf("profile: bookmark '%v' is not a folder", b.Title)
+		}
+		if err := c.validate(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bookmarks) validate() error {
+	for _, l := range [][]*Bookmark{b.Menu, b.Toolbar, b.Unfiled} {
+		for _, v := range l {
+			if err := v.validate(1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// netscapeHTML serializes the bookmarks to the Netscape bookmark file format
+// that Firefox knows how to import.
+func (b *Bookmarks) netscapeHTML() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	buf.WriteString("<META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=UTF-8\">\n")
+	buf.WriteString("<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks Menu</H1>\n\n<DL><p>\n")
+
+	writeList(&buf, b.Menu, 1)
+	if len(b.Toolbar) > 0 {
+		buf.WriteString("    <DT><H3 PERSONAL_TOOLBAR_FOLDER=\"true\">Bookmarks Toolbar</H3>\n    <DL><p>\n")
+		writeList(&buf, b.Toolbar, 2)
+		buf.WriteString("    </DL><p>\n")
+	}
+	if len(b.Unfiled) > 0 {
+		buf.WriteString("    <DT><H3 UNFILED_BOOKMARKS_FOLDER=\"true\">Other Bookmarks</H3>\n    <DL><p>\n")
+		writeList(&buf, b.Unfiled, 2)
+		buf.WriteString("    </DL><p>\n")
+	}
+
+	buf.WriteString("</DL>\n")
+	return buf.Bytes()
+}
+
+func writeList(buf *bytes.Buffer, l []*Bookmark, depth int) {
+	indent := strings.Repeat("    ", depth)
+	for _, v := range l {
+		addDate := ""
+		if v.DateAdded > 0 {
+			addDate = fmt.Sprintf(" ADD_DATE=\"%d\"", v.DateAdded)
+		}
+		switch v.Type {
+		case "bookmark":
+			fmt.Fprintf(buf, "%s<DT><A HREF=\"%s\"%s>%s</A>\n", indent, html.EscapeString(v.URI), addDate, html.EscapeString(v.Title))
+		case "folder":
+			fmt.Fprintf(buf, "%s<DT><H3%s>%s</H3>\n%s<DL><p>\n", indent, addDate, html.EscapeString(v.Title), indent)
+			writeList(buf, v.Children, depth+1)
+			fmt.Fprintf(buf, "%s</DL><p>\n", indent)
+		case "separator":
+			fmt.Fprintf(buf, "%s<HR>\n", indent)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// prefs.go - Preference import/export routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package profile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	prefsFile = "prefs.js"
+
+	importBookmarksHTMLPref = "browser.places.importBookmarksHTML"
+)
+
+// The preferences that are exported are restricted to the security related
+// ones, since the rest of the profile is either fingerprintable or managed
+// by the bundle.
+var (
+	exportedPrefPrefixes = []string{
+		"noscript.",
+	}
+	exportedPrefs = map[string]bool{
+		"extensions.torbutton.security_slider": true,
+		"extensions.torbutton.security_custom": true,
+	}
+
+	userPrefRe = regexp.MustCompile(`^\s*user_pref\(("(?:[^"\\]|\\.)*")\s*,\s*(.*)\)\s*;\s*$`)
+)
+
+func isExportedPref(name string) bool {
+	if exportedPrefs[name] {
+		return true
+	}
+	for _, prefix := range exportedPrefPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefLine parses a `user_pref("name", value);` line, returning the
+// name and value, or "" if the line is not a preference that could be
+// parsed.
+func parsePrefLine(l string) (string, interface{}) {
+	m := userPrefRe.FindStringSubmatch(l)
+	if m == nil {
+		return "", nil
+	}
+
+	var name string
+	if err := json.Unmarshal([]byte(m[1]), &name); err != nil {
+		return "", nil
+	}
+	v, err := decodePrefValue([]byte(m[2]))
+	if err != nil {
+		return "", nil
+	}
+	return name, v
+}
+
+func decodePrefValue(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return normalizePrefValue(v)
+}
+
+// normalizePrefValue ensures that a value is something that is valid as a
+// preference (bool, integer or string).
+func normalizePrefValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case json.Number:
+		i, err := t.Int64()
+		if err != nil || i != int64(int32(i)) {
+			return nil, fmt.Errorf("profile: invalid integer preference: %v", t)
+		}
+		return i, nil
+	case int64:
+		if t != int64(int32(t)) {
+			return nil, fmt.Errorf("profile: invalid integer preference: %v", t)
+		}
+		return t, nil
+	case string:
+		if strings.IndexFunc(t, unicode.IsControl) != -1 {
+			return nil, fmt.Errorf("profile: invalid string preference")
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("profile: invalid preference type: %T", v)
+	}
+}
+
+func encodePrefLine(name string, v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(name); err != nil {
+		return "", err
+	}
+	n := strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("user_pref(%s, %s);", n, strings.TrimSpace(buf.String())), nil
+}
+
+// readPrefs returns the exported preferences from a `prefs.js` file.
+func readPrefs(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefs := make(map[string]interface{})
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if name, v := parsePrefLine(scanner.Text()); name != "" && isExportedPref(name) {
+			prefs[name] = v
+		}
+	}
+	return prefs, scanner.Err()
+}
+
+// writePrefs rewrites a `prefs.js` file, replacing existing values of the
+// provided preferences, and appending those that are not present.
+func writePrefs(path string, prefs map[string]interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	if len(b) > 0 {
+		for _, l := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			if name, _ := parsePrefLine(l); name != "" {
+				if _, ok := prefs[name]; ok {
+					continue
+				}
+			}
+			lines = append(lines, l)
+		}
+	}
+	names := make([]string, 0, len(prefs))
+	for name := range prefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l, err := encodePrefLine(name, prefs[name])
+		if err != nil {
+			return err
+		}
+		lines = append(lines, l)
+	}
+
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), utils.FileMode); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// profile.go - Portable profile data routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package profile exports and imports the portable parts of a Tor Browser
+// profile (the bookmarks, and the security settings).
+//
+// The browser's databases are parsed by a small pure Go read-only SQLite
+// reader with bounds checked access to the file, rather than by linking
+// SQLite, so untrusted profile data never reaches C code outside of the
+// sandbox.
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	dataVersion = 1
+
+	// MaxDataSize is the maximum size of a serialized Data.
+	MaxDataSize = 16 * 1024 * 1024
+)
+
+// Data is the portable profile data.
+type Data struct {
+	// Version is the format version.
+	Version int `json:"version"`
+
+	// Bookmarks are the bookmarks, excluding the browsing history.
+	Bookmarks *Bookmarks `json:"bookmarks,omitempty"`
+
+	// Prefs are the security related preferences.
+	Prefs map[string]interface{} `json:"prefs,omitempty"`
+}
+
+// Export reads the portable data from the profile directory dir.  The
+// browser must not be running.
+func Export(dir string) (*Data, error) {
+	d := &Data{Version: dataVersion}
+
+	var err error
+	if d.Bookmarks, err = readBookmarks(filepath.Join(dir, placesFile)); err != nil {
+		return nil, err
+	}
+	if d.Prefs, err = readPrefs(filepath.Join(dir, prefsFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Import writes the portable data into the profile directory dir.  The
+// browser must not be running.
+//
+// The bookmarks get imported by the browser on the next launch, and will
+// replace all of the existing bookmarks.
+func Import(dir string, d *Data) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, utils.DirMode); err != nil {
+		return err
+	}
+
+	prefs := make(map[string]interface{})
+	for k, v := range d.Prefs {
+		prefs[k] = v
+	}
+	if d.Bookmarks != nil {
+		if err := ioutil.WriteFile(filepath.Join(dir, BookmarksHTMLFile), d.Bookmarks.netscapeHTML(), utils.FileMode); err != nil {
+			return err
+		}
+		prefs[importBookmarksHTMLPref] = true
+	}
+	return writePrefs(filepath.Join(dir, prefsFile), prefs)
+}
+
+// Marshal serializes the portable data.
+func (d *Data) Marshal() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// Unmarshal deserializes and validates portable data.
+func Unmarshal(b []byte) (*Data, error) {
+	if len(b) > MaxDataSize {
+		return nil, fmt.Errorf("profile: data too large")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	d := new(Data)
+	if err := dec.Decode(d); err != nil {
+		return nil, err
+	}
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Data) validate() error {
+	if d.Version != dataVersion {
+		return fmt.Errorf("profile: unsupported data version: %v", d.Version)
+	}
+	if d.Bookmarks != nil {
+		if err := d.Bookmarks.validate(); err != nil {
+			return err
+		}
+	}
+	for k, v := range d.Prefs {
+		if !isExportedPref(k) {
+			return fmt.Errorf("profile: unsupported preference: '%v'", k)
+		}
+		nv, err := normalizePrefValue(v)
+		if err != nil {
+			return err
+		}
+		d.Prefs[k] = nv
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// sqlite.go - Minimal read-only SQLite table reader.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package profile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// This only implements enough of the file format to walk table b-trees,
+// which is all that is needed to pull the bookmarks out of `places.sqlite`.
+// See: https://www.sqlite.org/fileformat2.html
+
+const (
+	sqliteHeaderLen = 100
+	sqliteMagic     = "SQLite format 3\x00"
+	sqliteEncUTF8   = 1
+
+	pageTypeInteriorTable = 0x05
+	pageTypeLeafTable     = 0x0d
+
+	maxTreeDepth = 64
+)
+
+var errMalformedDB = errors.New("profile: malformed database")
+
+type sqliteDB struct {
+	r        io.ReaderAt
+	pageSize int
+	usable   int
+	nPages   int
+}
+
+func openSQLite(f *os.File) (*sqliteDB, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [sqliteHeaderLen]byte
+	if _, err = f.ReadAt(hdr[:], 0); err != nil {
+		return nil, errMalformedDB
+	}
+	if !bytes.Equal(hdr[0:16], []byte(sqliteMagic)) {
+		return nil, fmt.Errorf("profile: not a SQLite database")
+	}
+
+	db := &sqliteDB{r: f}
+	db.pageSize = int(binary.BigEndian.Uint16(hdr[16:18]))
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize > 65536 || db.pageSize&(db.pageSize-1) != 0 {
+		return nil, errMalformedDB
+	}
+	if hdr[19] > 2 {
+		return nil, fmt.Errorf("profile: unsupported database read version: %d", hdr[19])
+	}
+	db.usable = db.pageSize - int(hdr[20])
+	if db.usable < 480 {
+		return nil, errMalformedDB
+	}
+	if enc := binary.BigEndian.Uint32(hdr[56:60]); enc != sqliteEncUTF8 {
+		return nil, fmt.Errorf("profile: unsupported database text encoding: %d", enc)
+	}
+	db.nPages = int(fi.Size() / int64(db.pageSize))
+
+	return db, nil
+}
+
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	if n < 1 || n > db.nPages {
+		return nil, errMalformedDB
+	}
+	b := make([]byte, db.pageSize)
+	if _, err := db.r.ReadAt(b, int64(n-1)*int64(db.pageSize)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// scanTable calls fn with each row of the table b-tree rooted at root, in
+// rowid order.
+func (db *sqliteDB) scanTable(root int, fn func(rowid int64, rec []interface{}) error) error {
+	visited := make(map[int]bool)
+	return db.scanPage(root, 0, visited, fn)
+}
+
+func (db *sqliteDB) scanPage(n, depth int, visited map[int]bool, fn func(int64, []interface{}) error) error {
+	if depth > maxTreeDepth || visited[n] {
+		return errMalformedDB
+	}
+	visited[n] = true
+
+	b, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	hdrOff := 0
+	if n == 1 {
+		hdrOff = sqliteHeaderLen
+	}
+	if len(b) < hdrOff+12 {
+		return errMalformedDB
+	}
+	pageType := b[hdrOff]
+	nCells := int(binary.BigEndian.Uint16(b[hdrOff+3:]))
+
+	ptrOff := hdrOff + 8
+	if pageType == pageTypeInteriorTable {
+		ptrOff = hdrOff + 12
+	} else if pageType != pageTypeLeafTable {
+		return errMalformedDB
+	}
+	if ptrOff+2*nCells > db.usable {
+		return errMalformedDB
+	}
+
+	for i := 0; i < nCells; i++ {
+		cellOff := int(binary.BigEndian.Uint16(b[ptrOff+2*i:]))
+		if cellOff >= db.usable {
+			return errMalformedDB
+		}
+		cell := b[cellOff:db.usable]
+
+		if pageType == pageTypeInteriorTable {
+			if len(cell) < 4 {
+				return errMalformedDB
+			}
+			if err = db.scanPage(int(binary.BigEndian.Uint32(cell)), depth+1, visited, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payloadLen, l1 := readVarint(cell)
+		rowid, l2 := readVarint(cell[l1:])
+		if l1 == 0 || l2 == 0 || payloadLen < 0 || payloadLen > int64(db.nPages)*int64(db.pageSize) {
+			return errMalformedDB
+		}
+		payload, err := db.readPayload(cell[l1+l2:], int(payloadLen))
+		if err != nil {
+			return err
+		}
+		rec, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+		if err = fn(rowid, rec); err != nil {
+			return err
+		}
+	}
+
+	if pageType == pageTypeInteriorTable {
+		return db.scanPage(int(binary.BigEndian.Uint32(b[hdrOff+8:])), depth+1, visited, fn)
+	}
+	return nil
+}
+
+func (db *sqliteDB) readPayload(cell []byte, payloadLen int) ([]byte, error) {
+	// Figure out how much of the payload is stored on the b-tree page, per
+	// the file format specification.
+	maxLocal := db.usable - 35
+	localLen := payloadLen
+	if payloadLen > maxLocal {
+		minLocal := ((db.usable-12)*32)/255 - 23
+		localLen = minLocal + (payloadLen-minLocal)%(db.usable-4)
+		if localLen > maxLocal {
+			localLen = minLocal
+		}
+	}
+	if localLen > len(cell) {
+		return nil, errMalformedDB
+	}
+
+	payload := make([]byte, 0, payloadLen)
+	payload = append(payload, cell[:localLen]...)
+	if localLen == payloadLen {
+		return payload, nil
+	}
+
+	// Follow the overflow page chain for the rest.
+	if len(cell) < localLen+4 {
+		return nil, errMalformedDB
+	}
+	next := int(binary.BigEndian.Uint32(cell[localLen:]))
+	visited := make(map[int]bool)
+	for len(payload) < payloadLen {
+		if next == 0 || visited[next] {
+			return nil, errMalformedDB
+		}
+		visited[next] = true
+
+		b, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = int(binary.BigEndian.Uint32(b))
+		toCopy := payloadLen - len(payload)
+		if toCopy > db.usable-4 {
+			toCopy = db.usable - 4
+		}
+		payload = append(payload, b[4:4+toCopy]...)
+	}
+	return payload, nil
+}
+
+// readVarint decodes a SQLite variable length integer, returning the value
+// and the number of bytes consumed, or 0 bytes on failure.
+func readVarint(b []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			v = (v << 8) | uint64(b[i])
+			return int64(v), 9
+		}
+		v = (v << 7) | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(v), i + 1
+		}
+	}
+	panic("profile: varint decode overflowed")
+}
+
+// decodeRecord decodes a record into a slice of nil, int64, float64, string
+// and []byte values.
+func decodeRecord(b []byte) ([]interface{}, error) {
+	hdrLen, n := readVarint(b)
+	if n == 0 || hdrLen < int64(n) || hdrLen > int64(len(b)) {
+		return nil, errMalformedDB
+	}
+
+	var types []int64
+	for off := n; off < int(hdrLen); {
+		t, l := readVarint(b[off:int(hdrLen)])
+		if l == 0 || t < 0 {
+			return nil, errMalformedDB
+		}
+		types = append(types, t)
+		off += l
+	}
+
+	var rec []interface{}
+	body := b[hdrLen:]
+	for _, t := range types {
+		var sz int
+		switch {
+		case t == 0, t == 8, t == 9:
+			sz = 0
+		case t >= 1 && t <= 4:
+			sz = int(t)
+		case t == 5:
+			sz = 6
+		case t == 6, t == 7:
+			sz = 8
+		case t >= 12:
+			sz = int((t - 12) / 2)
+		default:
+			return nil, errMalformedDB
+		}
+		if sz > len(body) {
+			return nil, errMalformedDB
+		}
+		v := body[:sz]
+		body = body[sz:]
+
+		switch {
+		case t == 0:
+			rec = append(rec, nil)
+		case t == 8:
+			rec = append(rec, int64(0))
+		case t == 9:
+			rec = append(rec, int64(1))
+		case t >= 1 && t <= 6:
+			// Big endian two's complement, sign extended.
+			i := int64(int8(v[0]))
+			for _, c := range v[1:] {
+				i = (i << 8) | int64(c)
+			}
+			rec = append(rec, i)
+		case t == 7:
+			rec = append(rec, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case t%2 == 0:
+			rec = append(rec, append([]byte{}, v...))
+		default:
+			rec = append(rec, string(v))
+		}
+	}
+	return rec, nil
+}
+
+// schema is a table name to root page and column names map, from the
+// `sqlite_master` table.
+type schema map[string]*tableInfo
+
+type tableInfo struct {
+	rootPage int
+	columns  map[string]int
+}
+
+func (db *sqliteDB) readSchema() (schema, error) {
+	// sqlite_master (type, name, tbl_name, rootpage, sql) is rooted at page 1.
+	s := make(schema)
+	err := db.scanTable(1, func(rowid int64, rec []interface{}) error {
+		if len(rec) < 5 {
+			return nil
+		}
+		if typ, _ := rec[0].(string); typ != "table" {
+			return nil
+		}
+		name, _ := rec[1].(string)
+		root, _ := rec[3].(int64)
+		sql, _ := rec[4].(string)
+		cols, err := tableColumns(sql)
+		if err != nil {
+			return err
+		}
+		s[name] = &tableInfo{rootPage: int(root), columns: cols}
+		return nil
+	})
+	return s, err
+}
+
+// tableColumns extracts the column names from a `CREATE TABLE` statement,
+// returning a map of name to column index.
+func tableColumns(sql string) (map[string]int, error) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start == -1 || end < start {
+		return nil, errMalformedDB
+	}
+
+	// Split the definitions on the top level commas.
+	var defs []string
+	depth, last := 0, start+1
+	var quote byte
+	for i := start + 1; i < end; i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, sql[last:i])
+			last = i + 1
+		}
+	}
+	defs = append(defs, sql[last:end])
+
+	cols := make(map[string]int)
+	for _, d := range defs {
+		f := strings.Fields(d)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			// Table constraints always come after the columns.
+			continue
+		}
+		name := strings.Trim(f[0], "\"'`[]")
+		cols[name] = len(cols)
+	}
+	return cols, nil
+}
+
+// column returns the named column of rec, or nil if the record predates the
+// column being added.
+func (t *tableInfo) column(rec []interface{}, name string) interface{} {
+	if idx, ok := t.columns[name]; ok && idx < len(rec) {
+		return rec[idx]
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+// quarantine.go - Download quarantine.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package quarantine implements the download quarantine, a directory that
+// only the sandbox and the launcher have access to, that files must be
+// explicitly exported from to be visible on the host.
+package quarantine
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// partSuffix is the suffix that Tor Browser gives to incomplete downloads.
+const partSuffix = ".part"
+
+type format int
+
+const (
+	formatUnknown format = iota
+	formatPDF
+	formatJPEG
+	formatPNG
+	formatOOXML
+	formatODF
+)
+
+// originXattrs are the extended attributes that record where a download
+// came from.
+var originXattrs = []string{
+	"user.xdg.origin.url",
+	"user.xdg.referrer.url",
+}
+
+// ooxmlMainParts are the MIME types of Office Open XML documents, by the
+// name of the main part.
+var ooxmlMainParts = map[string]string{
+	"word/document.xml":    "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xl/workbook.xml":      "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ppt/presentation.xml": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// Entry is a completed download in the quarantine.
+type Entry struct {
+	// Name is the file name.
+	Name string
+
+	// Size is the file size in bytes.
+	Size int64
+
+	// SHA256 is the hex encoded SHA-256 digest of the file.
+	SHA256 string
+
+	// Type is a human readable description of the file type.
+	Type string
+
+	// MIMEType is the MIME type of the file.
+	MIMEType string
+
+	// ModTime is the modification time of the file.
+	ModTime time.Time
+}
+
+// Quarantine is a download quarantine directory.
+type Quarantine struct {
+	sync.Mutex
+
+	dir         string
+	cache       map[string]*Entry
+	inotify     *os.File
+	completedCh chan string
+}
+
+// Open opens the quarantine directory dir, creating it if needed, and starts
+// watching it for completed downloads.
+func Open(dir string) (*Quarantine, error) {
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	q := &Quarantine{
+		dir:         dir,
+		cache:       make(map[string]*Entry),
+		inotify:     os.NewFile(uintptr(fd), "inotify"),
+		completedCh: make(chan string, 16),
+	}
+	go q.watchLoop()
+
+	return q, nil
+}
+
+// Dir returns the quarantine directory.
+func (q *Quarantine) Dir() string {
+	return q.dir
+}
+
+// Completed returns the channel that the names of downloads are written to
+// as they complete.
+func (q *Quarantine) Completed() <-chan string {
+	return q.completedCh
+}
+
+// Close stops watching the quarantine directory.
+func (q *Quarantine) Close() {
+	q.inotify.Close()
+}
+
+func (q *Quarantine) watchLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := q.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameOff := off + syscall.SizeofInotifyEvent
+			off = nameOff + int(ev.Len)
+			if off > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[nameOff:off], "\x00"))
+			if !q.isComplete(name) {
+				continue
+			}
+
+			Debugf("quarantine: Download completed: %v", name)
+			select {
+			case q.completedCh <- name:
+			default:
+			}
+		}
+	}
+}
+
+// isComplete returns true if name is a non-empty regular file that isn't
+// still being downloaded.  Tor Browser creates an empty placeholder with the
+// final name when a download starts, and writes to a `.part` file, which is
+// renamed over the placeholder when the download completes.
+func (q *Quarantine) isComplete(name string) bool {
+	if name == "" || strings.HasSuffix(name, partSuffix) {
+		return false
+	}
+	if _, err := os.Lstat(filepath.Join(q.dir, name+partSuffix)); err == nil {
+		return false
+	}
+	fi, err := os.Lstat(filepath.Join(q.dir, name))
+	if err != nil {
+		return false
+	}
+	return fi.Mode().IsRegular() && fi.Size() > 0
+}
+
+// Entries returns the completed downloads in the quarantine, most recent
+// first.
+func (q *Quarantine) Entries() ([]*Entry, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	fis, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	seen := make(map[string]bool)
+	for _, fi := range fis {
+		name := fi.Name()
+		if !q.isComplete(name) {
+			continue
+		}
+		seen[name] = true
+
+		e := q.cache[name]
+		if e == nil || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) {
+			if e, err = q.newEntry(name); err != nil {
+				log.Printf("quarantine: Failed to examine '%v': %v", name, err)
+				continue
+			}
+			q.cache[name] = e
+		}
+		entries = append(entries, e)
+	}
+	for name := range q.cache {
+		if !seen[name] {
+			delete(q.cache, name)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.After(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+func (q *Quarantine) newEntry(name string) (*Entry, error) {
+	path := filepath.Join(q.dir, name)
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Where the file came from is nobody's business.
+	stripOriginXattrs(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	e := &Entry{
+		Name:    name,
+		Size:    fi.Size(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+		ModTime: fi.ModTime(),
+	}
+	_, e.MIMEType, e.Type = detectFormat(f, fi.Size())
+	return e, nil
+}
+
+// detectFormat sniffs the format and MIME type of the file, based on the
+// content rather than the file name, and returns them along with a
+// description.
+func detectFormat(f *os.File, size int64) (format, string, string) {
+	var hdr [512]byte
+	n, _ := f.ReadAt(hdr[:], 0)
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(hdr[:n]))
+
+	switch mimeType {
+	case "application/pdf":
+		return formatPDF, mimeType, "PDF document"
+	case "image/jpeg":
+		return formatJPEG, mimeType, "JPEG image"
+	case "image/png":
+		return formatPNG, mimeType, "PNG image"
+	case "application/zip":
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			break
+		}
+		isOOXML := false
+		for _, zf := range zr.File {
+			switch zf.Name {
+			case "[Content_Types].xml":
+				isOOXML = true
+			case "mimetype":
+				if zf.UncompressedSize64 > 128 {
+					continue
+				}
+				r, err := zf.Open()
+				if err != nil {
+					continue
+				}
+				b, _ := ioutil.ReadAll(r)
+				r.Close()
+				if bytes.HasPrefix(b, []byte("application/vnd.oasis.opendocument.")) {
+					return formatODF, string(bytes.TrimSpace(b)), "OpenDocument document"
+				}
+			}
+		}
+		if isOOXML {
+			// The type of the document is determined by the main part.
+			for _, zf := range zr.File {
+				if t, ok := ooxmlMainParts[zf.Name]; ok {
+					return formatOOXML, t, "Office Open XML document"
+				}
+			}
+			return formatOOXML, mimeType, "Office Open XML document"
+		}
+		return formatUnknown, mimeType, "ZIP archive"
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return formatUnknown, mimeType, mimeType
+}
+
+// Remove deletes the download name from the quarantine.
+func (q *Quarantine) Remove(name string) error {
+	path, err := q.Path(name)
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	delete(q.cache, name)
+	q.Unlock()
+	return os.Remove(path)
+}
+
+// Path returns the path of the download name in the quarantine.
+func (q *Quarantine) Path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("quarantine: invalid name: '%v'", name)
+	}
+	path := filepath.Join(q.dir, name)
+	if fi, err := os.Lstat(path); err != nil {
+		return "", err
+	} else if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("quarantine: not a regular file: '%v'", name)
+	}
+	return path, nil
+}
+
+// open opens the download name for reading.  The browser can write to the
+// quarantine, so the file is checked to be regular after it is opened,
+// without following symlinks.
+func (q *Quarantine) open(name string) (*os.File, os.FileInfo, error) {
+	path, err := q.Path(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	} else if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("quarantine: not a regular file: '%v'", name)
+	}
+	return f, fi, nil
+}
+
+// Export copies the download name out of the quarantine into destDir,
+// without overwriting existing files, optionally removing the metadata from
+// the formats that support it.  The path of the exported file is returned.
+func (q *Quarantine) Export(name, destDir string, scrub bool) (string, error) {
+	dest, err := q.copyOut(name, destDir, scrub)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("quarantine: Exported '%v' to '%v'", name, dest)
+	return dest, nil
+}
+
+// Stage copies the download name out of the quarantine into the private
+// directory dir, so that it can be bind mounted into a sandbox without the
+// browser being able to replace it, and returns the path of the copy.
+func (q *Quarantine) Stage(name, dir string) (string, error) {
+	return q.copyOut(name, dir, false)
+}
+
+func (q *Quarantine) copyOut(name, destDir string, scrub bool) (string, error) {
+	in, fi, err := q.open(name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	dest := filepath.Join(destDir, name)
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, FileMode)
+	if err != nil {
+		return "", err
+	}
+	if scrub {
+		f, _, _ := detectFormat(in, fi.Size())
+		err = scrubMetadata(f, in, fi.Size(), out)
+	} else {
+		_, err = io.Copy(out, in)
+	}
+
+	// Copying doesn't carry over extended attributes, but be certain.
+	stripOriginXattrs(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, nil
+}
+
+func stripOriginXattrs(f *os.File) {
+	for _, attr := range originXattrs {
+		p, err := syscall.BytePtrFromString(attr)
+		if err != nil {
+			panic(err)
+		}
+		_, _, e := syscall.Syscall(syscall.SYS_FREMOVEXATTR, f.Fd(), uintptr(unsafe.Pointer(p)), 0)
+		if e != 0 && e != syscall.ENODATA && e != syscall.ENOTSUP {
+			Debugf("quarantine: Failed to remove '%v' from '%v': %v", attr, f.Name(), e)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// scrub.go - Metadata removal.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package quarantine
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+const xmlDecl = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+
+var (
+	errMalformedJPEG = errors.New("quarantine: malformed JPEG image")
+	errMalformedPNG  = errors.New("quarantine: malformed PNG image")
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	// pngMetadataChunks are the ancillary chunks that are removed.
+	pngMetadataChunks = map[string]bool{
+		"tEXt": true,
+		"zTXt": true,
+		"iTXt": true,
+		"tIME": true,
+		"eXIf": true,
+	}
+
+	pdfInfoRefRe = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+
+	// ooxmlMetadata and odfMetadata are the document properties parts of
+	// the respective formats, and the empty documents that replace them.
+	ooxmlMetadata = map[string]string{
+		"docProps/core.xml":   xmlDecl + `<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:dcmitype="http://purl.org/dc/dcmitype/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"/>`,
+		"docProps/app.xml":    xmlDecl + `<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties" xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes"/>`,
+		"docProps/custom.xml": xmlDecl + `<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties" xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes"/>`,
+	}
+	odfMetadata = map[string]string{
+		"meta.xml": xmlDecl + `<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" office:version="1.2"><office:meta/></office:document-meta>`,
+	}
+)
+
+// scrubMetadata copies the file in to w, removing the metadata if the format
+// is one that is supported.  Anything else is copied as is.
+//
+// This only deals with the metadata that identifies the author, the software
+// and the times (EXIF, XMP, document properties and the like), and not with
+// the content itself.
+func scrubMetadata(f format, in *os.File, size int64, w io.Writer) error {
+	switch f {
+	case formatJPEG:
+		return scrubJPEG(in, w)
+	case formatPNG:
+		return scrubPNG(in, w)
+	case formatPDF:
+		return scrubPDF(in, w)
+	case formatOOXML:
+		return scrubZip(in, size, w, ooxmlMetadata)
+	case formatODF:
+		return scrubZip(in, size, w, odfMetadata)
+	}
+	_, err := io.Copy(w, in)
+	return err
+}
+
+// scrubJPEG removes the comments and all of the application segments other
+// than JFIF, the ICC profile, and Adobe's (which affects the decoding).
+func scrubJPEG(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return errMalformedJPEG
+	}
+	bw.Write(soi[:])
+
+	m, err := nextJPEGMarker(br)
+	for err == nil {
+		switch {
+		case m == 0xd9: // EOI, anything trailing is discarded.
+			bw.Write([]byte{0xff, m})
+			return bw.Flush()
+		case m == 0x01 || (m >= 0xd0 && m <= 0xd7): // No payload.
+			bw.Write([]byte{0xff, m})
+			m, err = nextJPEGMarker(br)
+			continue
+		case m == 0x00 || m == 0xd8:
+			return errMalformedJPEG
+		}
+
+		var l [2]byte
+		if _, err = io.ReadFull(br, l[:]); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(l[:]))
+		if n < 2 {
+			return errMalformedJPEG
+		}
+		seg := make([]byte, n-2)
+		if _, err = io.ReadFull(br, seg); err != nil {
+			break
+		}
+		if keepJPEGSegment(m, seg) {
+			bw.Write([]byte{0xff, m})
+			bw.Write(l[:])
+			bw.Write(seg)
+		}
+
+		if m == 0xda {
+			// Start of scan, copy the entropy coded data that follows.
+			m, err = copyJPEGScan(br, bw)
+		} else {
+			m, err = nextJPEGMarker(br)
+		}
+	}
+	return errMalformedJPEG
+}
+
+func nextJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	} else if b != 0xff {
+		return 0, errMalformedJPEG
+	}
+	for b == 0xff { // Skip the fill bytes.
+		if b, err = br.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func copyJPEGScan(br *bufio.Reader, bw *bufio.Writer) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			bw.WriteByte(b)
+			continue
+		}
+		for b == 0xff {
+			if b, err = br.ReadByte(); err != nil {
+				return 0, err
+			}
+		}
+		if b == 0x00 || (b >= 0xd0 && b <= 0xd7) {
+			// Stuffed 0xff, or a restart marker.
+			bw.Write([]byte{0xff, b})
+			continue
+		}
+		return b, nil
+	}
+}
+
+func keepJPEGSegment(m byte, seg []byte) bool {
+	switch {
+	case m == 0xfe: // COM
+		return false
+	case m == 0xe0: // APP0, also used for JFXX thumbnails.
+		return bytes.HasPrefix(seg, []byte("JFIF\x00"))
+	case m == 0xe2: // APP2, also used for FlashPix.
+		return bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00"))
+	case m == 0xee: // APP14
+		return bytes.HasPrefix(seg, []byte("Adobe"))
+	case m >= 0xe1 && m <= 0xef: // APP1 (EXIF, XMP), APP13 (IPTC), etc.
+		return false
+	}
+	return true
+}
+
+// scrubPNG removes the textual, time and EXIF chunks.
+func scrubPNG(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return errMalformedPNG
+	}
+	bw.Write(sig)
+
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return errMalformedPNG
+		}
+		l := binary.BigEndian.Uint32(hdr[:4])
+		if l > 0x7fffffff {
+			return errMalformedPNG
+		}
+		typ := string(hdr[4:])
+
+		dst := io.Writer(bw)
+		if pngMetadataChunks[typ] {
+			dst = ioutil.Discard
+		} else {
+			bw.Write(hdr[:])
+		}
+		if _, err := io.CopyN(dst, br, int64(l)+4); err != nil { // Data + CRC.
+			return errMalformedPNG
+		}
+		if typ == "IEND" {
+			return bw.Flush()
+		}
+	}
+}
+
+// scrubPDF blanks out the strings in the document information dictionaries,
+// and any XMP metadata packets.  Everything is overwritten in place, so that
+// the cross-reference tables remain valid.  Metadata in compressed streams
+// is left as is.
+func scrubPDF(r io.Reader, w io.Writer) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range pdfInfoRefRe.FindAllSubmatch(b, -1) {
+		objRe := regexp.MustCompile(`(?:^|[^0-9])` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj\b`)
+		for _, loc := range objRe.FindAllIndex(b, -1) {
+			end := bytes.Index(b[loc[1]:], []byte("endobj"))
+			if end < 0 {
+				continue
+			}
+			blankPDFStrings(b[loc[1] : loc[1]+end])
+		}
+	}
+
+	for off := 0; ; {
+		begin := bytes.Index(b[off:], []byte("<?xpacket begin"))
+		if begin < 0 {
+			break
+		}
+		begin += off
+		end := bytes.Index(b[begin:], []byte("<?xpacket end"))
+		if end < 0 {
+			break
+		}
+		end += begin
+		if piEnd := bytes.Index(b[end:], []byte("?>")); piEnd < 0 {
+			break
+		} else {
+			end += piEnd + 2
+		}
+		for i := begin; i < end; i++ {
+			b[i] = ' '
+		}
+		off = end
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// blankPDFStrings overwrites the contents of the literal and hexadecimal
+// strings in b with whitespace.
+func blankPDFStrings(b []byte) {
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '(':
+			depth := 1
+			for i++; i < len(b) && depth > 0; i++ {
+				switch b[i] {
+				case '\\':
+					b[i] = ' '
+					if i+1 < len(b) {
+						i++
+					}
+				case '(':
+					depth++
+				case ')':
+					depth--
+				}
+				if depth > 0 {
+					b[i] = ' '
+				}
+			}
+			i--
+		case '<':
+			if i+1 < len(b) && b[i+1] == '<' {
+				i++
+				continue
+			}
+			for i++; i < len(b) && b[i] != '>'; i++ {
+				b[i] = ' '
+			}
+		}
+	}
+}
+
+// scrubZip rewrites a zip archive, replacing the named metadata parts, and
+// dropping the extra fields and comments.
+func scrubZip(r io.ReaderAt, size int64, w io.Writer, replacements map[string]string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, zf := range zr.File {
+		fh := zf.FileHeader
+		fh.Extra = nil
+		fh.Comment = ""
+		out, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+
+		if s, ok := replacements[zf.Name]; ok {
+			if _, err = io.WriteString(out, s); err != nil {
+				return err
+			}
+			continue
+		}
+
+		in, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
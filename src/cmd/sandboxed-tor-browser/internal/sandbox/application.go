@@ -31,319 +31,357 @@ import (
 	"syscall"
 
 	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/sandbox/egress"
+	"cmd/sandboxed-tor-browser/internal/sandbox/portal"
 	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
-	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
 	"cmd/sandboxed-tor-browser/internal/tor"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-const restrictedLibDir = "/usr/lib"
+const (
+	restrictedLibDir = "/usr/lib"
+	profileSubDir    = "TorBrowser/Data/Browser/profile.default"
+	quarantineDir    = "quarantine"
+
+	bookmarksFile         = "bookmarks.html"
+	pristineBookmarksFile = "bookmarks.pristine.html"
+)
 
 var distributionDependentLibSearchPath []string
 
-// RunTorBrowser launches sandboxed Tor Browser.
-func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (process *Process, err error) {
-	const (
-		profileSubDir = "TorBrowser/Data/Browser/profile.default"
-		cachesSubDir  = "TorBrowser/Data/Browser/Caches"
-		stubPath      = "/home/amnesia/.tbb_stub.so"
-		controlSocket = "control"
-		socksSocket   = "socks"
-		x11Socket     = "xorg"
-	)
+// ProfileDir returns the host path of the session's Tor Browser profile
+// directory, or "" for disposable sessions, that have no profile on disk.
+// Encrypted profiles are only usable once they have been unlocked.
+func ProfileDir(cfg *config.Config) string {
+	switch {
+	case cfg.Disposable:
+		return ""
+	case cfg.UnlockedProfileDir != "":
+		return cfg.UnlockedProfileDir
+	case cfg.SessionDataDir != "":
+		return filepath.Join(cfg.SessionDataDir, "profile")
+	default:
+		return filepath.Join(cfg.BundleInstallDir, "Browser", profileSubDir)
+	}
+}
 
+// SavePristineBookmarks keeps a copy of the freshly installed bundle's
+// bookmarks outside of the bundle's profile, for seeding disposable sessions.
+func SavePristineBookmarks(cfg *config.Config) error {
+	b, err := ioutil.ReadFile(filepath.Join(cfg.BundleInstallDir, "Browser", profileSubDir, bookmarksFile))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(cfg.BundleInstallDir, pristineBookmarksFile), b, FileMode)
+}
+
+// QuarantineDir returns the host path of the session's download quarantine,
+// which is only ever bind mounted into the sandbox.  Disposable sessions
+// already keep their downloads out of reach of the host, and use the same
+// directory, so that it can be exported from on exit as well.  With storage
+// encryption enabled, the quarantine is kept in the runtime directory.
+func QuarantineDir(cfg *config.Config) string {
+	switch {
+	case cfg.Disposable:
+		return filepath.Join(cfg.SessionDataDir, "Downloads")
+	case cfg.UnlockedQuarantineDir != "":
+		return cfg.UnlockedQuarantineDir
+	case cfg.SessionDataDir != "":
+		return filepath.Join(cfg.SessionDataDir, quarantineDir)
+	default:
+		return filepath.Join(cfg.UserDataDir, quarantineDir)
+	}
+}
+
+// RunTorBrowser launches sandboxed Tor Browser.
+// File chooser requests from the browser are sent to fileChooserCh if it is
+// not nil, and crash reports are sent to crashCh if local crash reports are
+// enabled.
+func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor, fileChooserCh chan<- *portal.Request, crashCh chan<- *CrashReport) (process *Process, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%v", r)
 		}
 	}()
 
-	h, err := newHugbox()
+	l, err := prepareTorBrowser(cfg, manif, tor, fileChooserCh, launchNormal)
+	if err != nil {
+		return nil, err
+	}
+	proc, err := l.run()
 	if err != nil {
 		return nil, err
 	}
 
-	logger := newConsoleLogger("firefox")
-	h.stdout = logger
-	h.stderr = logger
-	h.seccompFn = installTorBrowserSeccompProfile
-	h.fakeDbus = true
-	h.mountProc = false
-	h.fakeProc = true
-
-	if manif.Channel == "alpha" && !manif.BundleVersionAtLeast("7.5a4") {
-		// SelfRando prior to c619441e1ceec3599bc81bf9bbaf4d17c68b54b7 has a
-		// bug in how it handles system call return values, leading to a
-		// infinite loop if `/proc/self/environ` doesn't exist.
-		//
-		// Despite the fix for this being available upstream, the browser
-		// people didn't pull it in for the 7.5a3 release.
-		//
-		// See: https://trac.torproject.org/projects/tor/ticket/22853
-		Debugf("sandbox: SelfRando /proc/self/environ workaround enabled")
-		h.file("/proc/self/environ", []byte{})
+	// The crash report is collected once the browser has exited, and is
+	// dropped if nothing is around to receive it.
+	if cfg.Sandbox.EnableCrashReports {
+		proc.AddTermHook(func() {
+			r := collectCrashReport(cfg, proc.Signal())
+			if r == nil {
+				return
+			}
+			log.Printf("sandbox: Tor Browser crashed:\n%v", r)
+			select {
+			case crashCh <- r:
+			default:
+			}
+		})
 	}
+	return proc, nil
+}
+
+// ExplainTorBrowser describes the Tor Browser sandbox, as RunTorBrowser would
+// launch it, with the file chooser portal enabled.
+func ExplainTorBrowser(cfg *config.Config, manif *config.Manifest) (e *Explanation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
 
-	// Gtk+ and PulseAudio.
-	hasAdwaita := h.appendGtk2Theme()
-	h.roBind("/usr/share/icons/hicolor", "/usr/share/icons/hicolor", true)
-	h.roBind("/usr/share/mime", "/usr/share/mime", false)
+	l, err := prepareTorBrowser(cfg, manif, nil, nil, launchDryRun)
+	if err != nil {
+		return nil, err
+	}
+	return l.explain()
+}
 
-	pulseAudioWorks := false
-	if cfg.Sandbox.EnablePulseAudio {
-		if err = h.enablePulseAudio(); err != nil {
-			log.Printf("sandbox: failed to proxy PulseAudio: %v", err)
-		} else {
-			pulseAudioWorks = true
+// ensureDirs creates the host directories that get bind mounted into the
+// sandbox, unless the sandbox is only being described, since a dry run must
+// not change anything on the host.  Self-tests actually launch the sandbox,
+// so they need the directories.
+func ensureDirs(mode launchMode, dirs ...string) error {
+	if mode == launchDryRun {
+		return nil
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, DirMode); err != nil {
+			return err
 		}
 	}
-	h.roBind("/usr/share/libthai/thbrk.tri", "/usr/share/libthai/thbrk.tri", true) // Thai language support (Optional).
+	return nil
+}
+
+func prepareTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor, fileChooserCh chan<- *portal.Request, mode launchMode) (l *profileLaunch, err error) {
+	const (
+		cachesSubDir     = "TorBrowser/Data/Browser/Caches"
+		portalSocket     = "portal"
+		portalStagingDir = "portal-files"
+	)
+
+	p, err := builtinProfile("torbrowser")
+	if err != nil {
+		return nil, err
+	}
 
-	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
+	browserHome := "/home/amnesia/sandboxed-tor-browser/tor-browser/Browser"
 	realBrowserHome := filepath.Join(cfg.BundleInstallDir, "Browser")
 	realCachesDir := filepath.Join(realBrowserHome, cachesSubDir)
-	realProfileDir := filepath.Join(realBrowserHome, profileSubDir)
+	realBundleProfileDir := filepath.Join(realBrowserHome, profileSubDir)
+	realProfileDir := realBundleProfileDir
 	realDesktopDir := filepath.Join(realBrowserHome, "Desktop")
 	realDownloadsDir := filepath.Join(realBrowserHome, "Downloads")
-	realExtensionsDir := filepath.Join(realProfileDir, "extensions")
 
-	// Ensure that the `Caches`, `Downloads` and `Desktop` mount points exist.
-	if err = os.MkdirAll(realCachesDir, DirMode); err != nil {
-		return
+	// Named sessions have their own profile, `Desktop` and `Downloads`
+	// directories, and only share the read-only parts of the bundle.
+	// Disposable sessions keep the latter under `XDG_RUNTIME_DIR`, which is
+	// a tmpfs, and the profile is never backed by anything on disk.
+	if cfg.SessionDataDir != "" {
+		realDesktopDir = filepath.Join(cfg.SessionDataDir, "Desktop")
+		realDownloadsDir = filepath.Join(cfg.SessionDataDir, "Downloads")
 	}
-	if err = os.MkdirAll(realDesktopDir, DirMode); err != nil {
-		return
+	if !cfg.Disposable && ProfileDir(cfg) != realBundleProfileDir {
+		realProfileDir = ProfileDir(cfg)
+
+		// The bundle's preferences and extensions get mounted over these.
+		if err = ensureDirs(mode, filepath.Join(realProfileDir, "preferences"), filepath.Join(realProfileDir, "extensions")); err != nil {
+			return
+		}
 	}
-	if err = os.MkdirAll(realDownloadsDir, DirMode); err != nil {
+
+	// Ensure that the `Caches`, `Downloads` and `Desktop` mount points exist.
+	if err = ensureDirs(mode, realCachesDir, realDesktopDir, realDownloadsDir); err != nil {
 		return
 	}
 
-	// Apply directory overrides.
-	if cfg.Sandbox.DesktopDir != "" {
+	// Apply directory overrides, which would defeat the point of a
+	// disposable session.
+	if cfg.Sandbox.DesktopDir != "" && !cfg.Disposable {
 		realDesktopDir = cfg.Sandbox.DesktopDir
 	}
-	if cfg.Sandbox.DownloadsDir != "" {
+	if cfg.Sandbox.DownloadsDir != "" && !cfg.Disposable {
 		realDownloadsDir = cfg.Sandbox.DownloadsDir
 	}
 
+	// The download quarantine takes precedence over everything, since the
+	// launcher is responsible for exporting the downloads.
+	if cfg.Sandbox.EnableDownloadQuarantine {
+		realDownloadsDir = QuarantineDir(cfg)
+		if err = ensureDirs(mode, realDownloadsDir); err != nil {
+			return
+		}
+	}
+
 	profileDir := filepath.Join(browserHome, profileSubDir)
-	cachesDir := filepath.Join(browserHome, cachesSubDir)
-	downloadsDir := filepath.Join(browserHome, "Downloads")
-	desktopDir := filepath.Join(browserHome, "Desktop")
-	extensionsDir := filepath.Join(profileDir, "extensions")
-
-	// Filesystem stuff.
-	h.roBind(cfg.BundleInstallDir, filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser"), false)
-	if cfg.Sandbox.EnableAmnesiacProfileDirectory {
-		excludes := []string{
-			filepath.Join(realProfileDir, "preferences"),
-			realExtensionsDir,
-		}
-		h.shadowDir(profileDir, realProfileDir, excludes)
-	} else {
-		h.bind(realProfileDir, profileDir, false)
+	l, err = newProfileLaunch(cfg, p, map[string]string{
+		"BrowserHome":          browserHome,
+		"ProfileDir":           profileDir,
+		"RealBrowserHome":      realBrowserHome,
+		"RealBundleProfileDir": realBundleProfileDir,
+		"RealDesktopDir":       realDesktopDir,
+		"RealDownloadsDir":     realDownloadsDir,
+	}, tor, mode)
+	if err != nil {
+		return nil, err
 	}
-	h.roBind(filepath.Join(realProfileDir, "preferences"), filepath.Join(profileDir, "preferences"), false)
-	h.bind(realDesktopDir, desktopDir, false)
-	h.bind(realDownloadsDir, downloadsDir, false)
-	h.tmpfs(cachesDir)
-	h.chdir = browserHome
+	h := l.h
 
-	// Explicitly bind mount the expected extensions in.
+	if manif.Channel == "alpha" && !manif.BundleVersionAtLeast("7.5a4") {
+		// SelfRando prior to c619441e1ceec3599bc81bf9bbaf4d17c68b54b7 has a
+		// bug in how it handles system call return values, leading to a
+		// infinite loop if `/proc/self/environ` doesn't exist.
+		//
+		// Despite the fix for this being available upstream, the browser
+		// people didn't pull it in for the 7.5a3 release.
+		//
+		// See: https://trac.torproject.org/projects/tor/ticket/22853
+		Debugf("sandbox: SelfRando /proc/self/environ workaround enabled")
+		h.file("/proc/self/environ", []byte{})
+	}
+
+	// The profile directory is the only part of the filesystem that depends
+	// on the kind of session.
 	//
+	// The extensions are explicitly bind mounted in over it by the profile.
 	// If the Tor Browser developers ever decide to do something sensible like
 	// sign their XPI files, then the whitelist could be public key based, till
 	// then this may be somewhat fragile.
-	h.tmpfs(extensionsDir)
-	for _, extName := range []string{
-		"{73a6fe31-595d-460b-a920-fcc0f8843232}.xpi", // NoScript
-		"torbutton@torproject.org.xpi",
-		"https-everywhere-eff@eff.org.xpi",
-		"tor-launcher@torproject.org.xpi",
-	} {
-		h.roBind(filepath.Join(realExtensionsDir, extName), filepath.Join(extensionsDir, extName), false)
+	profileHook := func() error {
+		if cfg.Disposable {
+			// Start from a fresh profile, seeded with the bookmarks that the
+			// bundle shipped with, since the bundle's profile is used by the
+			// default session.  The preferences and extensions get mounted
+			// over it like with any other profile.
+			h.tmpfs(profileDir)
+			if b, err := ioutil.ReadFile(filepath.Join(cfg.BundleInstallDir, pristineBookmarksFile)); err == nil {
+				h.file(filepath.Join(profileDir, bookmarksFile), b)
+			}
+		} else if cfg.Sandbox.EnableAmnesiacProfileDirectory {
+			excludes := []string{
+				filepath.Join(realProfileDir, "preferences"),
+				filepath.Join(realProfileDir, "extensions"),
+			}
+			h.shadowDir(profileDir, realProfileDir, excludes)
+		} else {
+			h.bind(realProfileDir, profileDir, false)
+		}
+		return nil
+	}
+	if err = l.appendFilesystem(map[string]func() error{"profile": profileHook}); err != nil {
+		return nil, err
 	}
-
-	// Env vars taken from start-tor-browser.
-	// h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor"))
-	h.setenv("FONTCONFIG_PATH", filepath.Join(browserHome, "TorBrowser", "Data", "fontconfig"))
-	h.setenv("FONTCONFIG_FILE", "fonts.conf")
-
-	// This used to be for `hardened` but may eventually be required for
-	// `alpha`, though according to trac, newer versions of selfrando fix the
-	// problem.
-	//
-	// https://trac.torproject.org/projects/tor/ticket/20683#comment:13
-	//
-	// if manif.Channel == "alpha" {
-	//	h.setenv("NSS_DISABLE_HW_AES", "1") // For selfrando.
-	// }
-
-	// GNOME systems will puke with a read-only home, so instead of setting
-	// $HOME to point to inside the browser bundle, setup a bunch of
-	// symlinks.
-	//
-	// `XDG_[DOWNLOAD,DESKTOP]_DIR` appear to be honored if they are in
-	// `~/.config/user-dirs.dirs`, but are ignored if specified as env
-	// vars.  The symlink approach is probably more user friendly anyway.
-	//
-	// h.setenv("HOME", browserHome)
-	h.symlink(desktopDir, "/home/amnesia/Desktop")
-	h.symlink(downloadsDir, "/home/amnesia/Downloads")
-
-	// Set the same env vars that Tor Browser would expect when using a system
-	// tor, since the launcher is responsible for managing the Tor process, and
-	// it will be talking to the surrogates anyway.
-	h.setenv("TOR_SOCKS_PORT", "9150")
-	h.setenv("TOR_CONTROL_PORT", "9151")
-	h.setenv("TOR_SKIP_LAUNCH", "1")
-	h.setenv("TOR_NO_DISPLAY_NETWORK_SETTINGS", "1")
-	h.setenv("TOR_HIDE_UPDATE_CHECK_UI", "1")
-
-	// Inject the AF_LOCAL compatibility hack stub into the filesystem, and
-	// supply the relevant args required for functionality.
-	ctrlPath := filepath.Join(h.runtimeDir, controlSocket)
-	socksPath := filepath.Join(h.runtimeDir, socksSocket)
-	h.setenv("TOR_STUB_CONTROL_SOCKET", ctrlPath)
-	h.setenv("TOR_STUB_SOCKS_SOCKET", socksPath)
-	h.bind(tor.CtrlSurrogatePath(), ctrlPath, false)
-	h.bind(tor.SocksSurrogatePath(), socksPath, false)
-	h.assetFile(stubPath, "tbb_stub.so")
-
-	ldPreload := stubPath
-	h.setenv("LD_PRELOAD", ldPreload)
-
-	// Hardware accelerated OpenGL will not work, and never will.
-	h.setenv("LIBGL_ALWAYS_SOFTWARE", "1")
-
-	// Crashdumps regardless of being sanitized or not, not to be trusted.
-	h.setenv("MOZ_CRASHREPORTER_DISABLE", "1")
 
 	// Tor Browser currently is incompatible with PaX MPROTECT, apply the
-	// override if needed.
-	realFirefoxPath := filepath.Join(realBrowserHome, "firefox")
-	needsPaXPaths := []string{
-		realFirefoxPath,
-		filepath.Join(realBrowserHome, "plugin-container"),
-	}
-	for _, p := range needsPaXPaths {
-		err := applyPaXAttributes(manif, p)
-		if err != nil {
-			log.Printf("sandbox: Failed to apply PaX attributes to `%v`: %v", p, err)
+	// override if needed, unless the browser isn't going to be launched.
+	if mode == launchNormal {
+		needsPaXPaths := []string{
+			filepath.Join(realBrowserHome, "firefox"),
+			filepath.Join(realBrowserHome, "plugin-container"),
+		}
+		for _, p := range needsPaXPaths {
+			err := applyPaXAttributes(manif, p)
+			if err != nil {
+				log.Printf("sandbox: Failed to apply PaX attributes to `%v`: %v", p, err)
+			}
 		}
 	}
 
-	extraLdLibraryPath := ""
-	if dynlib.IsSupported() {
-		cache, err := dynlib.LoadCache()
-		if err != nil {
-			return nil, err
-		}
-
-		// XXX: It's probably safe to assume that firefox will always link
-		// against libc and libpthread that are required by `tbb_stub.so`.
-		binaries := []string{realFirefoxPath}
-		matches, err := filepath.Glob(realBrowserHome + "/*.so")
+	// XXX: It's probably safe to assume that firefox will always link
+	// against libc and libpthread that are required by `tbb_stub.so`.
+	var extraLibs []string
+	allowFfmpeg := false
+	if cfg.Sandbox.EnableAVCodec && dynlib.IsSupported() {
+		cache, err := l.libraryCache()
 		if err != nil {
 			return nil, err
 		}
-		binaries = append(binaries, matches...)
-		ldLibraryPath := realBrowserHome + ":" + filepath.Join(realBrowserHome, "TorBrowser", "Tor")
-
-		// Extra libraries that firefox dlopen()s.
-		extraLdLibraryPath = extraLdLibraryPath + ":" + restrictedLibDir
-		extraLibs := []string{
-			// These are absolutely required, or libxul.so will crash
-			// the firefox process.  Perhapbs wayland will deliver us
-			// from this evil.
-			"libxcb.so.1",
-			"libXau.so.6",
-			"libXdmcp.so.6",
-
-			// "libXss.so.1", - Not ubiquitous? nsIdleService uses this.
-			// "libc.so", - Uhhhhh.... wtf?
-			// "libcanberra.so.0", - Not ubiquitous.
+		if codec := findBestCodec(cache); codec != "" {
+			extraLibs = append(extraLibs, codec)
+			allowFfmpeg = true
 		}
+	}
+	filterFn := func(fn string) error {
+		return filterCodecs(fn, allowFfmpeg)
+	}
+	if err = l.appendLibraries(extraLibs, filterFn); err != nil {
+		return nil, err
+	}
 
-		glExtraLibs, glLibPaths := h.appendRestrictedOpenGL()
-		extraLibs = append(extraLibs, glExtraLibs...)
-		ldLibraryPath = ldLibraryPath + glLibPaths
-
-		if cfg.Sandbox.EnablePulseAudio && pulseAudioWorks {
-			paLibs, paPath, paExtraPath, err := h.appendRestrictedPulseAudio(cache)
+	// The file chooser portal surrogate is the only thing on the session
+	// bus, and Gtk+ needs to be told to use it.
+	var landlockWritable []string
+	if fileChooserCh != nil || mode == launchDryRun {
+		portalSurrogatePath := filepath.Join(cfg.RuntimeDir, portalSocket)
+		stagingDir := filepath.Join(cfg.RuntimeDir, portalStagingDir)
+		sandboxStagingDir := filepath.Join(h.homeDir, ".portal")
+		// Saving anywhere on the host would bypass the quarantine, and let a
+		// disposable session leave things behind, so saves go to the
+		// quarantine, and are disabled if there isn't one.
+		var saveDir, sandboxSaveDir string
+		if cfg.Sandbox.EnableDownloadQuarantine || cfg.Disposable {
+			saveDir = QuarantineDir(cfg)
+			sandboxSaveDir = filepath.Join(browserHome, "Downloads")
+		}
+		if mode != launchDryRun {
+			ps, err := portal.New(portalSurrogatePath, stagingDir, sandboxStagingDir, saveDir, sandboxSaveDir, fileChooserCh)
 			if err != nil {
-				log.Printf("sandbox: Failed to find PulseAudio libraries: %v", err)
-			} else {
-				extraLibs = append(extraLibs, paLibs...)
-				ldLibraryPath = ldLibraryPath + paPath
-				extraLdLibraryPath = extraLdLibraryPath + paExtraPath
+				return nil, err
 			}
+			l.addTermHook(func() {
+				Debugf("sandbox: Portal: Cleaning up surrogate")
+				ps.Close()
+			})
 		}
-
-		allowFfmpeg := false
-		if cfg.Sandbox.EnableAVCodec {
-			if codec := findBestCodec(cache); codec != "" {
-				extraLibs = append(extraLibs, codec)
-				allowFfmpeg = true
-			}
-		}
-		filterFn := func(fn string) error {
-			return filterCodecs(fn, allowFfmpeg)
-		}
-
-		// Gtk uses plugin libraries and shit for theming, and expecting
-		// them to be in consistent locations, is too much to ask for.
-		gtkExtraLibs, gtkLibPaths, err := h.appendRestrictedGtk2(hasAdwaita)
-		if err != nil {
-			return nil, err
-		}
-		extraLibs = append(extraLibs, gtkExtraLibs...)
-		ldLibraryPath = ldLibraryPath + gtkLibPaths
-
-		if err := h.appendLibraries(cache, binaries, extraLibs, ldLibraryPath, filterFn); err != nil {
-			return nil, err
-		}
+		busPath := filepath.Join(h.runtimeDir, "bus")
+		h.surrogateBind(portalSurrogatePath, busPath)
+		h.surrogateBind(stagingDir, sandboxStagingDir)
+		h.setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+busPath)
+		h.setenv("GTK_USE_PORTAL", "1")
+		landlockWritable = append(landlockWritable, sandboxStagingDir)
 	}
-	h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor")+extraLdLibraryPath)
-
-	h.cmd = filepath.Join(browserHome, "firefox")
-	h.cmdArgs = []string{"--class", "Tor Browser", "-profile", profileDir}
 
-	// Do X11 last, because of the surrogate.
-	x11SurrogatePath := filepath.Join(cfg.RuntimeDir, x11Socket)
-	x, err := x11.New(cfg.Sandbox.Display, h.hostname, x11SurrogatePath)
-	if err != nil {
-		return nil, err
-	} else {
-		h.setenv("DISPLAY", x.Display)
-		h.dir(x11.SockDir)
-		if x.Xauthority != nil {
-			xauthPath := filepath.Join(h.homeDir, ".Xauthority")
-			h.setenv("XAUTHORITY", xauthPath)
-			h.file(xauthPath, x.Xauthority)
-		}
-		if err = x.LaunchSurrogate(); err != nil {
+	if cfg.Sandbox.EnableCrashReports && mode != launchSelfTest {
+		crashDirs, err := l.appendCrashReporter(profileDir)
+		if err != nil {
 			return nil, err
 		}
-		h.bind(x.Socket(), filepath.Join(x11.SockDir, "X0"), false)
-	}
-	x11TermHook := func() {
-		if x.Surrogate != nil {
-			Debugf("sandbox: X11: Cleaning up surrogate")
-			x.Surrogate.Close()
+		landlockWritable = append(landlockWritable, crashDirs...)
+	}
+
+	// Landlock is applied by `tbb_stub.so`, and only allows writes to the
+	// directories that the browser is meant to write to, and the tmpfs
+	// scratch space that is discarded on exit regardless.
+	if cfg.Sandbox.EnableLandlock {
+		if abi := LandlockABI(); abi > 0 {
+			Debugf("sandbox: Landlock ABI %d detected.", abi)
+			landlockWritable = append(landlockWritable,
+				profileDir,
+				filepath.Join(browserHome, "Desktop"),
+				filepath.Join(browserHome, "Downloads"),
+				filepath.Join(browserHome, cachesSubDir),
+				"/tmp",
+				"/dev",
+				h.runtimeDir,
+			)
+			h.appendLandlock(landlockWritable)
+		} else {
+			log.Printf("sandbox: Landlock is enabled, but the kernel does not support it")
 		}
 	}
 
-	proc, err := h.run()
-	if err != nil {
-		x11TermHook()
-		return nil, err
-	} else {
-		proc.AddTermHook(x11TermHook)
-	}
-
-	return proc, nil
+	return l, nil
 }
 
 func filterCodecs(fn string, allowFfmpeg bool) error {
@@ -436,55 +474,18 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 		}
 	}()
 
-	h, err := newHugbox()
-	if err != nil {
-		return err
-	}
-	logger := newConsoleLogger("update")
-	h.stdout = logger
-	h.stderr = logger
-	h.seccompFn = installTorBrowserSeccompProfile
-
-	// https://wiki.mozilla.org/Software_Update:Manually_Installing_a_MAR_file
-	const (
-		installDir = "/home/amnesia/sandboxed-tor-browser/tor-browser"
-		updateDir  = "/home/amnesia/sandboxed-tor-browser/update"
-	)
-
-	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
-	realInstallDir := cfg.BundleInstallDir
 	realUpdateDir := filepath.Join(cfg.UserDataDir, "update")
-	realUpdateBin := filepath.Join(realInstallDir, "Browser", "updater")
 
 	// Do the work neccecary to make the firefox `updater` happy.
-	if err = stageUpdate(realUpdateDir, realInstallDir, mar); err != nil {
+	if err = stageUpdate(realUpdateDir, cfg.BundleInstallDir, mar); err != nil {
 		return err
 	}
 
-	h.bind(realInstallDir, installDir, false)
-	h.bind(realUpdateDir, updateDir, false)
-	h.chdir = browserHome // Required (Step 5.)
-
-	extraLdLibraryPath := ""
-	if dynlib.IsSupported() {
-		cache, err := dynlib.LoadCache()
-		if err != nil {
-			return err
-		}
-
-		if err := h.appendLibraries(cache, []string{realUpdateBin}, nil, filepath.Join(realInstallDir, "Browser"), nil); err != nil {
-			return err
-		}
-		extraLdLibraryPath = extraLdLibraryPath + ":" + restrictedLibDir
+	l, err := prepareUpdate(cfg, realUpdateDir, launchNormal)
+	if err != nil {
+		return err
 	}
-	h.setenv("LD_LIBRARY_PATH", browserHome+extraLdLibraryPath)
-
-	// 7. For Firefox 40.x and above run the following from the command prompto
-	//    after adding the path to the existing installation directory to the
-	//    LD_LIBRARY_PATH environment variable.
-	h.cmd = filepath.Join(updateDir, "updater")
-	h.cmdArgs = []string{updateDir, browserHome, browserHome}
-	cmd, err := h.run()
+	cmd, err := l.run()
 	if err != nil {
 		return err
 	}
@@ -507,6 +508,38 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 	return nil
 }
 
+func prepareUpdate(cfg *config.Config, realUpdateDir string, mode launchMode) (l *profileLaunch, err error) {
+	p, err := builtinProfile("update")
+	if err != nil {
+		return nil, err
+	}
+
+	// https://wiki.mozilla.org/Software_Update:Manually_Installing_a_MAR_file
+	const (
+		updateDir   = "/home/amnesia/sandboxed-tor-browser/update"
+		browserHome = "/home/amnesia/sandboxed-tor-browser/tor-browser/Browser"
+	)
+
+	// The profile's working directory is the browser directory (Step 5.),
+	// and it runs the `updater` from the outside directory with the path to
+	// the existing installation directory in `LD_LIBRARY_PATH` (Step 7.).
+	l, err = newProfileLaunch(cfg, p, map[string]string{
+		"BrowserHome":   browserHome,
+		"UpdateDir":     updateDir,
+		"RealUpdateDir": realUpdateDir,
+	}, nil, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.appendFilesystem(nil); err != nil {
+		return nil, err
+	}
+	if err = l.appendLibraries(nil, nil); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
 func stageUpdate(updateDir, installDir string, mar []byte) error {
 	copyFile := func(src, dst string) error {
 		// stat() the source file to get the file mode.
@@ -557,82 +590,130 @@ func stageUpdate(updateDir, installDir string, mar []byte) error {
 	return nil
 }
 
-// RunTor launches sandboxeed Tor.
-func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *Process, err error) {
+// RunTor launches sandboxeed Tor.  If tor has a network namespace of it's
+// own, policy is where it may connect to.
+func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte, policy *egress.Policy) (process *Process, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%v", r)
 		}
 	}()
 
-	h, err := newHugbox()
+	l, err := prepareTor(cfg, torrc, policy, launchNormal)
 	if err != nil {
 		return nil, err
 	}
+	return l.run()
+}
+
+// ExplainTor describes the tor sandbox, as RunTor would launch it.
+func ExplainTor(cfg *config.Config, torrc []byte, policy *egress.Policy) (e *Explanation, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	l, err := prepareTor(cfg, torrc, policy, launchDryRun)
+	if err != nil {
+		return nil, err
+	}
+	return l.explain()
+}
 
-	logger := newConsoleLogger("tor")
-	h.stdout = logger
-	h.stderr = logger
-	h.seccompFn = func(fd *os.File) error { return installTorSeccompProfile(fd, cfg.Tor.UseBridges) }
-	h.unshare.net = false // Tor needs host network access.
+func prepareTor(cfg *config.Config, torrc []byte, policy *egress.Policy, mode launchMode) (l *profileLaunch, err error) {
+	const egressSocket = "egress"
 
-	// Regarding `/proc`...
+	// Regarding `/proc`, which the profile does not provide...
 	//
 	// `/proc/meminfo` - tor daemon, used to calculate `MaxMemInQueues`,
 	//    fails gracefully.
-	// `/proc/sys/kernel/hostname` - obfs4proxy, Go runtime uses this to
-	//    determine hostname, 99% sure this is in the binary but not used
-	//    due to the `log` package's syslog target.
-	// `/proc/sys/net/core/somaxconn` - obfs4proxy, Go runtime uses this to
-	//    determine listener backlog, but will default to `128` on errors.
 	//
 	// `/proc/self/maps` - ASAN.  If it's ever enabled again, this mandates
 	//    `/proc`.
 	//
 	// See: https://bugs.torproject.org/20773
-	h.mountProc = false
+	p, err := builtinProfile("tor")
+	if err != nil {
+		return nil, err
+	}
 
-	if err = os.MkdirAll(cfg.TorDataDir, DirMode); err != nil {
+	if err = ensureDirs(mode, cfg.TorDataDir); err != nil {
 		return
 	}
 
-	realTorHome := filepath.Join(cfg.BundleInstallDir, "Browser", "TorBrowser", "Tor")
-	realTorBin := filepath.Join(realTorHome, "tor")
-	realGeoIPDir := filepath.Join(cfg.BundleInstallDir, "Browser", "TorBrowser", "Data", "Tor")
-	torDir := filepath.Join(h.homeDir, "tor")
-	torBinDir := filepath.Join(torDir, "bin")
-	torrcPath := filepath.Join(torDir, "etc", "torrc")
-
-	h.dir(torDir)
-	h.roBind(realTorHome, torBinDir, false)
-	for _, v := range []string{"geoip", "geoip6"} {
-		h.roBind(filepath.Join(realGeoIPDir, v), filepath.Join(torDir, "etc", v), false)
+	l, err = newProfileLaunch(cfg, p, map[string]string{
+		"RealTorHome": filepath.Join(cfg.BundleInstallDir, "Browser", "TorBrowser", "Tor"),
+		"TorDataDir":  cfg.TorDataDir,
+	}, nil, mode)
+	if err != nil {
+		return nil, err
+	}
+	torrcHook := func() error {
+		l.h.file(filepath.Join(l.h.homeDir, "tor", "etc", "torrc"), torrc)
+		return nil
+	}
+	if err = l.appendFilesystem(map[string]func() error{"torrc": torrcHook}); err != nil {
+		return nil, err
+	}
+	if err = l.appendLibraries(nil, nil); err != nil {
+		return nil, err
 	}
-	h.bind(cfg.TorDataDir, filepath.Join(torDir, "data"), false)
-	h.file(torrcPath, torrc)
-
-	// If we have the dynamic linker cache available, only load in the
-	// libraries that matter.
-	extraLdLibraryPath := ""
-	if dynlib.IsSupported() {
-		cache, err := dynlib.LoadCache()
-		if err != nil {
-			return nil, err
-		}
 
-		// XXX: For now assume that PTs will always use a subset of the tor
-		// binaries libraries.
-		if err := h.appendLibraries(cache, []string{realTorBin}, nil, realTorHome, nil); err != nil {
-			return nil, err
+	// With a network namespace of it's own, tor can't connect to anything,
+	// other than via the egress surrogate, that only allows the connections
+	// permitted by policy.
+	//
+	// XXX: Like with Tor Browser, this assumes that tor links against the
+	// libc and libpthread that are required by `tbb_stub.so`.
+	if cfg.IsolatesTorNetwork() {
+		if policy == nil {
+			policy = new(egress.Policy)
+		}
+		l.h.unshare.net = true
+		egressSurrogatePath := filepath.Join(cfg.RuntimeDir, egressSocket)
+		if mode == launchNormal {
+			es, err := egress.New(egressSurrogatePath, policy)
+			if err != nil {
+				return nil, err
+			}
+			l.addTermHook(func() {
+				Debugf("sandbox: Egress: Cleaning up surrogate")
+				es.Close()
+			})
 		}
-		extraLdLibraryPath = extraLdLibraryPath + ":" + restrictedLibDir
+		l.h.appendEgressStub(egressSurrogatePath)
+		l.egressPolicy = policy
 	}
-	h.setenv("LD_LIBRARY_PATH", torBinDir+extraLdLibraryPath)
+	return l, nil
+}
 
-	h.cmd = filepath.Join(torBinDir, "tor")
-	h.cmdArgs = []string{"-f", torrcPath}
+func (h *hugbox) appendNetworkConfig() {
+	// The domain fronted transports need to resolve the front, and validate
+	// the TLS certificate chain, so expose the bare minimum of the host's
+	// network configuration.
+	for _, f := range []string{
+		"/etc/resolv.conf",
+		"/etc/hosts",
+		"/etc/nsswitch.conf",
+	} {
+		h.roBind(f, f, true)
+	}
 
-	return h.run()
+	// Go only needs one CA bundle, so bind the first that exists in the
+	// canonical location, with the symlinks resolved.
+	for _, f := range []string{
+		"/etc/ssl/certs/ca-certificates.crt",                // Debian/Arch
+		"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora
+		"/etc/ssl/ca-bundle.pem",                            // openSUSE
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS
+	} {
+		if realPath, err := filepath.EvalSymlinks(f); err == nil {
+			h.roBind(realPath, f, false)
+			return
+		}
+	}
+	log.Printf("sandbox: Failed to find a CA certificate bundle.")
 }
 
 type consoleLogger struct {
@@ -841,6 +922,7 @@ func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLi
 	if err != nil {
 		return err
 	}
+	h.libraries = toBindMount
 
 	// XXX: This needs one more de-dup pass to see if the sandbox expects two
 	// different versions to share an alias.
@@ -0,0 +1,192 @@
+// bwrap.go - Bubblewrap discovery.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	bwrapBin         = "bwrap"
+	defaultBwrapPath = "/usr/bin/bwrap"
+)
+
+// Bwrap is the bubblewrap binary used to launch the sandboxes.
+type Bwrap struct {
+	// Path is the path to the binary, with all symbolic links resolved.
+	Path string
+
+	// Setuid is set if the binary is setuid root.
+	Setuid bool
+
+	// UserNamespaces is set if unprivileged user namespaces are available.
+	UserNamespaces bool
+
+	// Warnings are problems that do not prevent the binary from being used,
+	// but that the user should be told about.
+	Warnings []string
+
+	version *bwrapVersion
+}
+
+// Version returns the bubblewrap version.
+func (b *Bwrap) Version() string {
+	return b.version.String()
+}
+
+// FindBwrap locates the bubblewrap binary, and checks that it is safe to use.
+// The config override is used if set, otherwise the first `bwrap` in `PATH`,
+// falling back to `/usr/bin/bwrap`.
+func FindBwrap(cfg *config.Config) (*Bwrap, error) {
+	var candidates []string
+	if p := cfg.Sandbox.BwrapPath; p != "" {
+		// The override is used even if it does not exist, so that a typo
+		// doesn't silently fall back to something else.
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("sandbox: bubblewrap path is not absolute: %v", p)
+		}
+		candidates = append(candidates, p)
+	} else {
+		// Relative `PATH` entries are skipped, since they depend on the
+		// working directory.
+		for _, d := range filepath.SplitList(os.Getenv("PATH")) {
+			if filepath.IsAbs(d) {
+				candidates = append(candidates, filepath.Join(d, bwrapBin))
+			}
+		}
+		candidates = append(candidates, defaultBwrapPath)
+	}
+
+	b := new(Bwrap)
+	for _, v := range candidates {
+		if FileExists(v) || cfg.Sandbox.BwrapPath != "" {
+			// Checking and executing the resolved path means that the
+			// symbolic links can't be changed out from under us.
+			var err error
+			if b.Path, err = filepath.EvalSymlinks(v); err != nil {
+				return nil, fmt.Errorf("sandbox: failed to resolve bubblewrap path: %v", err)
+			}
+			break
+		}
+	}
+	if b.Path == "" {
+		return nil, fmt.Errorf("sandbox: unable to find bubblewrap binary")
+	}
+	if err := b.checkPermissions(); err != nil {
+		return nil, err
+	}
+
+	// Query the bubblewrap version.
+	var err error
+	if b.version, err = getBwrapVersion(b.Path); err != nil {
+		return nil, err
+	}
+
+	// Bubblewrap <= 0.1.2-2 (in Debian terms, 0.1.3 for the rest of us),
+	// is a really bad idea because I'm a retard, and didn't expect
+	// bubblewrap to be ptrace-able when I contributed support for setting
+	// the hostname.
+	if !b.version.atLeast(0, 1, 3) {
+		return nil, fmt.Errorf("sandbox: bubblewrap appears to be older than 0.1.3, you MUST upgrade.")
+	}
+
+	b.UserNamespaces = unprivilegedUserNamespaces()
+	if !b.Setuid && !b.UserNamespaces {
+		b.Warnings = append(b.Warnings, fmt.Sprintf("Bubblewrap (%v) is not setuid, and unprivileged user namespaces are disabled, so the sandbox will fail to launch.  Either enable user namespaces, or install bubblewrap setuid root.", b.Path))
+	}
+
+	Debugf("sandbox: bubblewrap '%v' (%v) detected, setuid: %v, user namespaces: %v", b.Path, b.version, b.Setuid, b.UserNamespaces)
+
+	return b, nil
+}
+
+// checkPermissions ensures that the bubblewrap binary, and the directory
+// that it is in can only be modified by root, or the user, and sets Setuid.
+func (b *Bwrap) checkPermissions() error {
+	fi, err := os.Stat(b.Path)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode()
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("sandbox: failed to stat bubblewrap: %v", b.Path)
+	}
+
+	switch {
+	case !mode.IsRegular():
+		return fmt.Errorf("sandbox: bubblewrap is not a regular file: %v", b.Path)
+	case mode.Perm()&0111 == 0:
+		return fmt.Errorf("sandbox: bubblewrap is not executable: %v", b.Path)
+	case mode.Perm()&0002 != 0:
+		return fmt.Errorf("sandbox: bubblewrap is world-writable, refusing to use it: %v", b.Path)
+	case st.Uid != 0 && int(st.Uid) != os.Getuid():
+		return fmt.Errorf("sandbox: bubblewrap is owned by uid %d, refusing to use it: %v", st.Uid, b.Path)
+	}
+
+	b.Setuid = mode&os.ModeSetuid != 0
+	if b.Setuid {
+		switch {
+		case st.Uid != 0:
+			return fmt.Errorf("sandbox: bubblewrap is setuid, but not owned by root, refusing to use it: %v", b.Path)
+		case mode.Perm()&0020 != 0:
+			return fmt.Errorf("sandbox: bubblewrap is setuid and group-writable, refusing to use it: %v", b.Path)
+		}
+	} else if mode.Perm()&0020 != 0 {
+		b.Warnings = append(b.Warnings, fmt.Sprintf("Bubblewrap (%v) is group-writable.", b.Path))
+	}
+
+	// Anyone that can write to the directory can replace the binary, unless
+	// the sticky bit is set.
+	dir := filepath.Dir(b.Path)
+	if fi, err = os.Stat(dir); err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0002 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("sandbox: bubblewrap is in a world-writable directory, refusing to use it: %v", b.Path)
+	}
+
+	return nil
+}
+
+// unprivilegedUserNamespaces returns true if it appears that unprivileged
+// users can create user namespaces.
+func unprivilegedUserNamespaces() bool {
+	if !FileExists("/proc/self/ns/user") {
+		return false
+	}
+
+	// Debian and derivatives have a sysctl of their own, and the upstream
+	// one limits the number of namespaces.
+	for _, f := range []string{
+		"/proc/sys/kernel/unprivileged_userns_clone",
+		"/proc/sys/user/max_user_namespaces",
+	} {
+		if b, err := ioutil.ReadFile(f); err == nil && strings.TrimSpace(string(b)) == "0" {
+			return false
+		}
+	}
+	return true
+}
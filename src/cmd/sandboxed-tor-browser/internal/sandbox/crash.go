@@ -0,0 +1,145 @@
+// crash.go - Local crash reports.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/minidump"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	crashSubDir          = "crashes"
+	crashDataSubDir      = "data"
+	crashMinidumpsSubDir = "minidumps"
+
+	// The Breakpad symbol store, which is not populated by the launcher,
+	// since the symbols are not part of the bundle.
+	crashSymbolsSubDir = "crash_symbols"
+
+	// Crash reports are never submitted, but in case something tries, it
+	// will fail, since neither the stub nor tor allow connecting here.
+	crashReporterURL = "http://127.0.0.1:9/"
+)
+
+// CrashReport is the summary of a Tor Browser crash, which is only ever
+// logged, and shown to the user.
+type CrashReport struct {
+	// Signal is the signal that terminated the browser, or 0 if only a
+	// content process crashed.
+	Signal syscall.Signal `json:"signal,omitempty"`
+
+	// Minidumps are the summaries of the minidumps that the crash reporter
+	// wrote.
+	Minidumps []*minidump.Summary `json:"minidumps,omitempty"`
+}
+
+// String returns the multi-line text form of the crash report.
+func (r *CrashReport) String() string {
+	var lines []string
+	if r.Signal != 0 {
+		lines = append(lines, fmt.Sprintf("Tor Browser was terminated by %v.", r.Signal))
+	}
+	for _, s := range r.Minidumps {
+		lines = append(lines, s.String())
+	}
+	if len(r.Minidumps) == 0 {
+		lines = append(lines, "The crash reporter did not write a minidump.")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// appendCrashReporter has the crash reporter write minidumps to a private
+// directory, that is collected by collectCrashReport, and never submit them.
+// The returned directories are where the browser will write the minidumps.
+func (l *profileLaunch) appendCrashReporter(profileDir string) ([]string, error) {
+	h := l.h
+	realCrashDir := filepath.Join(l.cfg.RuntimeDir, crashSubDir)
+	realDataDir := filepath.Join(realCrashDir, crashDataSubDir)
+	realMinidumpsDir := filepath.Join(realCrashDir, crashMinidumpsSubDir)
+
+	// Nothing from a previous session should be visible.
+	if l.mode == launchNormal {
+		if err := os.RemoveAll(realCrashDir); err != nil {
+			return nil, err
+		}
+		for _, d := range []string{realDataDir, realMinidumpsDir} {
+			if err := os.MkdirAll(d, DirMode); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Content process minidumps are written to the profile, and the rest
+	// to the crash reporter data directory.  They are separate directories
+	// on the host so that renaming between the two works.
+	dataDir := filepath.Join(h.homeDir, ".crashes")
+	minidumpsDir := filepath.Join(profileDir, crashMinidumpsSubDir)
+	h.surrogateBind(realDataDir, dataDir)
+	h.surrogateBind(realMinidumpsDir, minidumpsDir)
+
+	h.setenv("MOZ_CRASHREPORTER_DISABLE", "") // Empty counts as unset.
+	h.setenv("MOZ_CRASHREPORTER", "1")
+	h.setenv("MOZ_CRASHREPORTER_NO_REPORT", "1")
+	h.setenv("MOZ_CRASHREPORTER_DATA_DIRECTORY", dataDir)
+	h.setenv("MOZ_CRASHREPORTER_URL", crashReporterURL)
+
+	return []string{dataDir, minidumpsDir}, nil
+}
+
+// collectCrashReport summarizes and removes the minidumps written by the
+// crash reporter, and returns the crash report, or nil if there was no
+// crash.  sig is the signal that terminated the browser, if any.
+func collectCrashReport(cfg *config.Config, sig syscall.Signal) *CrashReport {
+	realCrashDir := filepath.Join(cfg.RuntimeDir, crashSubDir)
+	defer os.RemoveAll(realCrashDir)
+
+	// Being asked to exit is not a crash.
+	switch sig {
+	case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM:
+		sig = 0
+	}
+
+	r := &CrashReport{Signal: sig}
+	filepath.Walk(realCrashDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || filepath.Ext(path) != ".dmp" {
+			return nil
+		}
+
+		// The minidumps contain the browser's memory, so they are only
+		// ever summarized.
+		s, err := minidump.Summarize(path, filepath.Join(cfg.UserDataDir, crashSymbolsSubDir))
+		if err != nil {
+			log.Printf("sandbox: Failed to summarize minidump '%v': %v", filepath.Base(path), err)
+			return nil
+		}
+		r.Minidumps = append(r.Minidumps, s)
+		return nil
+	})
+	if r.Signal == 0 && len(r.Minidumps) == 0 {
+		return nil
+	}
+	Debugf("sandbox: Collected %d minidump(s)", len(r.Minidumps))
+	return r
+}
@@ -0,0 +1,290 @@
+// egress.go - Outgoing connection surrogate.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package egress implements the launcher side of outgoing TCP connections
+// for a sandbox that has a network namespace of it's own, and thus no
+// network access at all.
+//
+// This is not a userspace TCP/IP stack.  `tbb_stub.so` replaces the
+// sandboxed application's TCP sockets with AF_LOCAL sockets connected to the
+// surrogate, and prefixes each connection with the intended destination.
+// The surrogate checks the destination against the policy, makes the
+// connection itself, and splices the two together.  Only TCP is supported,
+// which is all that tor needs as a client.
+package egress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	// The request header is the address family (4 or 6), the port and the
+	// address, both in network byte order, with IPv4 addresses padded to
+	// the length of an IPv6 address.
+	hdrLen     = 1 + 2 + net.IPv6len
+	familyIPv4 = 4
+	familyIPv6 = 6
+
+	hdrTimeout  = 10 * time.Second
+	dialTimeout = 30 * time.Second
+)
+
+// nonPublicNets are the networks that are not reachable via the internet,
+// or otherwise have no business being connected to by tor.
+var nonPublicNets []*net.IPNet
+
+// Policy is the set of destinations that connections may be made to.
+type Policy struct {
+	// Allowed, if not nil, are the only destinations, as `address:port`,
+	// that are allowed, regardless of if they are public or not.
+	Allowed []string `json:"allowed"`
+
+	// Exceptions are the destinations, as `address:port`, that are allowed
+	// even though they are not public, such as a proxy on the local
+	// network.
+	Exceptions []string `json:"exceptions,omitempty"`
+}
+
+// Check returns an error if connecting to addr is not allowed.
+func (p *Policy) Check(addr *net.TCPAddr) error {
+	if p.Allowed != nil {
+		if !matches(p.Allowed, addr) {
+			return fmt.Errorf("egress: %v is not an allowed destination", addr)
+		}
+		return nil
+	}
+	if matches(p.Exceptions, addr) {
+		return nil
+	}
+
+	if addr.Port == 0 {
+		return fmt.Errorf("egress: invalid port")
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(addr.IP) {
+			return fmt.Errorf("egress: %v is not a public address", addr.IP)
+		}
+	}
+	return nil
+}
+
+func matches(dests []string, addr *net.TCPAddr) bool {
+	for _, v := range dests {
+		if d, err := net.ResolveTCPAddr("tcp", v); err == nil && d.IP.Equal(addr.IP) && d.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// Surrogate is an outgoing connection surrogate instance.
+type Surrogate struct {
+	sync.Mutex
+
+	sock   string
+	policy *Policy
+
+	l      net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// New creates a new surrogate listening on the AF_LOCAL socket sock, that
+// makes the connections allowed by policy.
+func New(sock string, policy *Policy) (*Surrogate, error) {
+	s := &Surrogate{
+		sock:   sock,
+		policy: policy,
+		conns:  make(map[net.Conn]bool),
+	}
+
+	var err error
+	os.Remove(sock)
+	if s.l, err = net.Listen("unix", sock); err != nil {
+		return nil, err
+	}
+
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Close shuts down the surrogate, and all of the connections.
+func (s *Surrogate) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	s.l.Close()
+	os.Remove(s.sock)
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *Surrogate) acceptLoop() {
+	defer s.l.Close()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if !s.track(c) {
+			c.Close()
+			return
+		}
+		go func() {
+			defer s.untrack(c)
+			s.handleConn(c)
+		}()
+	}
+}
+
+func (s *Surrogate) track(c net.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *Surrogate) untrack(c net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *Surrogate) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	// The stub writes the header as part of connect(), so it should be
+	// available immediately.
+	var hdr [hdrLen]byte
+	conn.SetReadDeadline(time.Now().Add(hdrTimeout))
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		Debugf("egress: Failed to read request: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	addr, err := parseHeader(hdr[:])
+	if err != nil {
+		log.Printf("egress: Invalid request: %v", err)
+		return
+	}
+	if err = s.policy.Check(addr); err != nil {
+		log.Printf("egress: Rejected connection to %v: %v", addr, err)
+		return
+	}
+
+	// The sandboxed application thinks that it's connected at this point,
+	// so a failure can only be reported by closing the connection.
+	upConn, err := net.DialTimeout("tcp", addr.String(), dialTimeout)
+	if err != nil {
+		Debugf("egress: Failed to connect to %v: %v", addr, err)
+		return
+	}
+	if !s.track(upConn) {
+		upConn.Close()
+		return
+	}
+	defer s.untrack(upConn)
+
+	copyLoop(upConn, conn)
+}
+
+func parseHeader(hdr []byte) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{Port: int(binary.BigEndian.Uint16(hdr[1:3]))}
+	switch hdr[0] {
+	case familyIPv4:
+		addr.IP = net.IP(append([]byte{}, hdr[3:3+net.IPv4len]...))
+	case familyIPv6:
+		addr.IP = net.IP(append([]byte{}, hdr[3:3+net.IPv6len]...))
+	default:
+		return nil, fmt.Errorf("egress: invalid address family: %d", hdr[0])
+	}
+	return addr, nil
+}
+
+func copyLoop(upConn, downConn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	cpFn := func(a, b net.Conn) {
+		defer wg.Done()
+		defer a.Close()
+		defer b.Close()
+
+		io.Copy(a, b)
+	}
+
+	go cpFn(upConn, downConn)
+	go cpFn(downConn, upConn)
+
+	wg.Wait()
+}
+
+func init() {
+	for _, v := range []string{
+		"0.0.0.0/8",       // "This" network.
+		"10.0.0.0/8",      // RFC 1918.
+		"100.64.0.0/10",   // Carrier-grade NAT.
+		"127.0.0.0/8",     // Loopback.
+		"169.254.0.0/16",  // Link local.
+		"172.16.0.0/12",   // RFC 1918.
+		"192.0.0.0/24",    // IETF protocol assignments.
+		"192.0.2.0/24",    // TEST-NET-1.
+		"192.168.0.0/16",  // RFC 1918.
+		"198.18.0.0/15",   // Benchmarking.
+		"198.51.100.0/24", // TEST-NET-2.
+		"203.0.113.0/24",  // TEST-NET-3.
+		"224.0.0.0/4",     // Multicast.
+		"240.0.0.0/4",     // Reserved, and broadcast.
+		"::/128",          // Unspecified.
+		"::1/128",         // Loopback.
+		"100::/64",        // Discard.
+		"2001:db8::/32",   // Documentation.
+		"fc00::/7",        // Unique local.
+		"fe80::/10",       // Link local.
+		"fec0::/10",       // Site local.
+		"ff00::/8",        // Multicast.
+	} {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+		nonPublicNets = append(nonPublicNets, n)
+	}
+}
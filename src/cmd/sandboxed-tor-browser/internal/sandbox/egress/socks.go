@@ -0,0 +1,179 @@
+// socks.go - Pluggable transport SOCKS shim.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package egress
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"cmd/sandboxed-tor-browser/internal/socks5"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// SocksShim is a SOCKS 5 proxy that sits between tor and a pluggable
+// transport's SOCKS listener.  The pluggable transports have host network
+// access, and connect to whatever they are asked to, so the shim only passes
+// on the requests that are allowed by the policy.
+type SocksShim struct {
+	sync.Mutex
+
+	upAddr string
+	policy *Policy
+
+	l      net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// NewSocksShim creates a new shim listening on a random loopback port, that
+// passes the requests allowed by policy on to the pluggable transport
+// listening on upAddr.
+func NewSocksShim(upAddr string, policy *Policy) (*SocksShim, error) {
+	s := &SocksShim{
+		upAddr: upAddr,
+		policy: policy,
+		conns:  make(map[net.Conn]bool),
+	}
+
+	var err error
+	if s.l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Addr returns the address that the shim is listening on, as `address:port`.
+func (s *SocksShim) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close shuts down the shim, and all of the connections.
+func (s *SocksShim) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	s.l.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *SocksShim) acceptLoop() {
+	defer s.l.Close()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if !s.track(c) {
+			c.Close()
+			return
+		}
+		go func() {
+			defer s.untrack(c)
+			s.handleConn(c)
+		}()
+	}
+}
+
+func (s *SocksShim) track(c net.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *SocksShim) untrack(c net.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *SocksShim) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := socks5.Handshake(conn)
+	if err != nil {
+		Debugf("egress: Failed SOCKS handshake: %v", err)
+		return
+	}
+
+	addr, err := requestAddr(req)
+	if err != nil {
+		log.Printf("egress: Invalid SOCKS request: %v", err)
+		req.Reply(socks5.ReplyAddressNotSupported)
+		return
+	}
+	if err = s.policy.Check(addr); err != nil {
+		log.Printf("egress: Rejected SOCKS request to %v: %v", addr, err)
+		req.Reply(socks5.ReplyConnectionNotAllowed)
+		return
+	}
+
+	// The request is passed on as is, since the authentication fields are
+	// the pluggable transport's per-bridge arguments.
+	upConn, err := socks5.Redispatch("tcp", s.upAddr, req)
+	if err != nil {
+		req.Reply(socks5.ErrorToReplyCode(err))
+		return
+	}
+	if !s.track(upConn) {
+		upConn.Close()
+		return
+	}
+	defer s.untrack(upConn)
+
+	if err = req.Reply(socks5.ReplySucceeded); err != nil {
+		upConn.Close()
+		return
+	}
+
+	copyLoop(upConn, conn)
+}
+
+// requestAddr returns the destination of a SOCKS request, which must be an IP
+// address, since tor never asks the pluggable transports to resolve names.
+func requestAddr(req *socks5.Request) (*net.TCPAddr, error) {
+	host, port := req.Addr.HostPort()
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("egress: not an IP address: '%v'", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("egress: invalid port: '%v'", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
@@ -0,0 +1,331 @@
+// explain.go - Sandbox dry-run descriptions.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/egress"
+)
+
+// bpfInsnSize is the size of a `struct sock_filter`.
+const bpfInsnSize = 8
+
+// bwrapArgArity is the number of values taken by each of the bubblewrap
+// arguments that hugbox uses.
+var bwrapArgArity = map[string]int{
+	"--unshare-user":       0,
+	"--unshare-ipc":        0,
+	"--unshare-pid":        0,
+	"--unshare-net":        0,
+	"--unshare-uts":        0,
+	"--unshare-cgroup-try": 0,
+	"--die-with-parent":    0,
+	"--dev":                1,
+	"--tmpfs":              1,
+	"--dir":                1,
+	"--proc":               1,
+	"--chdir":              1,
+	"--hostname":           1,
+	"--uid":                1,
+	"--gid":                1,
+	"--perms":              1,
+	"--overlay-src":        1,
+	"--tmp-overlay":        1,
+	"--setenv":             2,
+	"--bind":               2,
+	"--ro-bind":            2,
+	"--symlink":            2,
+	"--file":               2,
+}
+
+// Explanation is a description of a sandbox, exactly as it would be
+// launched.
+type Explanation struct {
+	Profile      string             `json:"profile"`
+	Bwrap        string             `json:"bwrap"`
+	BwrapVersion string             `json:"bwrapVersion"`
+	BwrapSetuid  bool               `json:"bwrapSetuid"`
+	Command      []string           `json:"command"`
+	Chdir        string             `json:"chdir,omitempty"`
+	Hostname     string             `json:"hostname,omitempty"`
+	Namespaces   []string           `json:"namespaces"`
+	Mounts       []ExplainedMount   `json:"mounts"`
+	Env          map[string]string  `json:"env"`
+	Seccomp      *ExplainedSeccomp  `json:"seccomp,omitempty"`
+	Libraries    []ExplainedLibrary `json:"libraries,omitempty"`
+
+	// Egress is where the application may connect to, if it has a network
+	// namespace of it's own, and the egress surrogate.
+	Egress *egress.Policy `json:"egress,omitempty"`
+
+	// Missing are the bind mount sources that do not exist, which would
+	// cause the launch to fail.
+	Missing []string `json:"missing,omitempty"`
+
+	// Args is the complete bubblewrap argument vector, other than the
+	// pipes that are only set up at launch time.
+	Args []string `json:"args"`
+}
+
+// ExplainedMount is a single filesystem operation.
+type ExplainedMount struct {
+	// Type is one of `dev`, `proc`, `tmpfs`, `dir`, `bind`, `symlink`,
+	// `file` or `overlay`.
+	Type string `json:"type"`
+
+	// Src is the host path for `bind` and `overlay`, and the target for
+	// `symlink`.
+	Src  string `json:"src,omitempty"`
+	Dest string `json:"dest"`
+
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Size, SHA256 and Perms are only set for `file`.
+	Size   int    `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Perms  string `json:"perms,omitempty"`
+}
+
+// ExplainedSeccomp is the seccomp whitelist, as compiled.
+type ExplainedSeccomp struct {
+	Assets       []string `json:"assets,omitempty"`
+	Instructions int      `json:"instructions"`
+	SHA256       string   `json:"sha256"`
+}
+
+// ExplainedLibrary is a host library, and the names it has in the sandbox.
+type ExplainedLibrary struct {
+	Path    string   `json:"path"`
+	Aliases []string `json:"aliases"`
+}
+
+// explain describes the sandbox instead of launching it.  Like run(), it may
+// only be called once.
+func (h *hugbox) explain() (*Explanation, error) {
+	fdArgs, err := h.baseArgs()
+	if err != nil {
+		return nil, err
+	}
+	args := append(fdArgs, h.args...)
+
+	e := &Explanation{
+		Bwrap:        h.bwrapPath,
+		BwrapVersion: h.bwrapVersion.String(),
+		BwrapSetuid:  h.bwrapSetuid,
+		Command:      append([]string{h.cmd}, h.cmdArgs...),
+		Env:          make(map[string]string),
+		Missing:      h.missing,
+		Args:         args,
+	}
+
+	var perms string
+	var overlaySrcs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		n, ok := bwrapArgArity[arg]
+		if !ok || i+n >= len(args) {
+			return nil, fmt.Errorf("sandbox: unexpected bubblewrap argument: %v", arg)
+		}
+		v := args[i+1 : i+1+n]
+		i += n
+
+		switch arg {
+		case "--setenv":
+			e.Env[v[0]] = v[1]
+		case "--chdir":
+			e.Chdir = v[0]
+		case "--hostname":
+			e.Hostname = v[0]
+		case "--perms":
+			perms = v[0]
+		case "--overlay-src":
+			overlaySrcs = append(overlaySrcs, v[0])
+		case "--tmp-overlay":
+			e.Mounts = append(e.Mounts, ExplainedMount{Type: "overlay", Src: strings.Join(overlaySrcs, ":"), Dest: v[0]})
+			overlaySrcs = nil
+		case "--bind", "--ro-bind":
+			e.Mounts = append(e.Mounts, ExplainedMount{Type: "bind", Src: v[0], Dest: v[1], ReadOnly: arg == "--ro-bind"})
+		case "--symlink":
+			e.Mounts = append(e.Mounts, ExplainedMount{Type: "symlink", Src: v[0], Dest: v[1]})
+		case "--file":
+			idx, err := strconv.Atoi(v[0])
+			if err != nil || idx < 4 || idx-4 >= len(h.fileData) {
+				return nil, fmt.Errorf("sandbox: unexpected file descriptor: %v", v[0])
+			}
+			b := h.fileData[idx-4]
+			digest := sha256.Sum256(b)
+			e.Mounts = append(e.Mounts, ExplainedMount{Type: "file", Dest: v[1], Size: len(b), SHA256: hex.EncodeToString(digest[:]), Perms: perms})
+			perms = ""
+		case "--dev", "--proc", "--tmpfs", "--dir":
+			e.Mounts = append(e.Mounts, ExplainedMount{Type: strings.TrimPrefix(arg, "--"), Dest: v[0]})
+		case "--uid", "--gid", "--die-with-parent":
+		default:
+			ns := strings.TrimPrefix(arg, "--unshare-")
+			e.Namespaces = append(e.Namespaces, strings.TrimSuffix(ns, "-try"))
+		}
+	}
+
+	if h.seccompFn != nil {
+		// Compile the rules exactly as they would be when launching, into
+		// a pipe.
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		bpfCh := make(chan []byte)
+		go func() {
+			b, _ := ioutil.ReadAll(r)
+			r.Close()
+			bpfCh <- b
+		}()
+		err = h.seccompFn(w) // Closes w.
+		bpf := <-bpfCh
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(bpf)
+		e.Seccomp = &ExplainedSeccomp{
+			Instructions: len(bpf) / bpfInsnSize,
+			SHA256:       hex.EncodeToString(digest[:]),
+		}
+	}
+
+	for realLib, aliases := range h.libraries {
+		aliases = append([]string{}, aliases...)
+		sort.Strings(aliases)
+		e.Libraries = append(e.Libraries, ExplainedLibrary{Path: realLib, Aliases: aliases})
+	}
+	sort.Slice(e.Libraries, func(i, j int) bool { return e.Libraries[i].Path < e.Libraries[j].Path })
+
+	return e, nil
+}
+
+// WriteText writes a human readable version of the explanation to w.
+func (e *Explanation) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	var cmd []string
+	for _, v := range e.Command {
+		if v == "" || strings.ContainsAny(v, " \t\"'\\") {
+			v = strconv.Quote(v)
+		}
+		cmd = append(cmd, v)
+	}
+
+	fmt.Fprintf(bw, "== %s ==\n", e.Profile)
+	bwrapMode := "user namespaces"
+	if e.BwrapSetuid {
+		bwrapMode = "setuid"
+	}
+	fmt.Fprintf(bw, "bubblewrap:  %s (%s, %s)\n", e.Bwrap, e.BwrapVersion, bwrapMode)
+	fmt.Fprintf(bw, "command:     %s\n", strings.Join(cmd, " "))
+	if e.Chdir != "" {
+		fmt.Fprintf(bw, "chdir:       %s\n", e.Chdir)
+	}
+	if e.Hostname != "" {
+		fmt.Fprintf(bw, "hostname:    %s\n", e.Hostname)
+	}
+	fmt.Fprintf(bw, "namespaces:  %s\n", strings.Join(e.Namespaces, " "))
+
+	fmt.Fprintf(bw, "\nFilesystem:\n")
+	for _, m := range e.Mounts {
+		switch m.Type {
+		case "bind":
+			mode := "rw"
+			if m.ReadOnly {
+				mode = "ro"
+			}
+			fmt.Fprintf(bw, "  %-10s %s -> %s\n", m.Type+" "+mode, m.Src, m.Dest)
+		case "overlay":
+			fmt.Fprintf(bw, "  %-10s %s -> %s\n", m.Type, m.Src, m.Dest)
+		case "symlink":
+			fmt.Fprintf(bw, "  %-10s %s -> %s\n", m.Type, m.Dest, m.Src)
+		case "file":
+			perms := ""
+			if m.Perms != "" {
+				perms = ", mode " + m.Perms
+			}
+			fmt.Fprintf(bw, "  %-10s %s (%d bytes, sha256 %s%s)\n", m.Type, m.Dest, m.Size, m.SHA256, perms)
+		default:
+			fmt.Fprintf(bw, "  %-10s %s\n", m.Type, m.Dest)
+		}
+	}
+
+	fmt.Fprintf(bw, "\nEnvironment:\n")
+	var keys []string
+	for k := range e.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(bw, "  %s=%s\n", k, e.Env[k])
+	}
+
+	fmt.Fprintf(bw, "\nSeccomp:\n")
+	if e.Seccomp != nil {
+		for _, v := range e.Seccomp.Assets {
+			fmt.Fprintf(bw, "  %s\n", v)
+		}
+		fmt.Fprintf(bw, "  %d instructions, sha256 %s\n", e.Seccomp.Instructions, e.Seccomp.SHA256)
+	} else {
+		fmt.Fprintf(bw, "  none\n")
+	}
+
+	if len(e.Libraries) > 0 {
+		fmt.Fprintf(bw, "\nLibraries:\n")
+		for _, l := range e.Libraries {
+			fmt.Fprintf(bw, "  %s -> %s\n", l.Path, strings.Join(l.Aliases, ", "))
+		}
+	}
+
+	if e.Egress != nil {
+		fmt.Fprintf(bw, "\nEgress:\n")
+		if e.Egress.Allowed != nil {
+			for _, v := range e.Egress.Allowed {
+				fmt.Fprintf(bw, "  allowed    %s\n", v)
+			}
+			if len(e.Egress.Allowed) == 0 {
+				fmt.Fprintf(bw, "  nothing\n")
+			}
+		} else {
+			fmt.Fprintf(bw, "  allowed    any public address\n")
+			for _, v := range e.Egress.Exceptions {
+				fmt.Fprintf(bw, "  exception  %s\n", v)
+			}
+		}
+	}
+
+	if len(e.Missing) > 0 {
+		fmt.Fprintf(bw, "\nMissing (the launch would fail):\n")
+		for _, v := range e.Missing {
+			fmt.Fprintf(bw, "  %s\n", v)
+		}
+	}
+
+	fmt.Fprintf(bw, "\n")
+	return bw.Flush()
+}
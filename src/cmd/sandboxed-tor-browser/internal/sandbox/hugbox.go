@@ -33,6 +33,7 @@ import (
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
@@ -87,14 +88,27 @@ type hugbox struct {
 	stderr    io.Writer
 	seccompFn func(*os.File) error
 	pdeathSig syscall.Signal
+	rlimits   map[int]uint64
 
 	fakeDbus     bool
 	standardLibs bool
 
+	// dryRun tolerates missing bind mount sources, for explain().
+	dryRun bool
+
+	// noSurrogates skips the surrogate bind mounts, for self-tests.
+	noSurrogates bool
+
+	// Internal state only used by explain().
+	missing   []string
+	libraries map[string][]string
+
 	// Internal options, not to be *modified* except via helpers, unless you
 	// know what you are doing.
 	bwrapPath    string
 	bwrapVersion *bwrapVersion
+	bwrapSetuid  bool
+	canOverlay   bool
 	args         []string
 	fileData     [][]byte
 
@@ -114,23 +128,44 @@ func (h *hugbox) symlink(src, dest string) {
 }
 
 func (h *hugbox) bind(src, dest string, optional bool) {
-	if !FileExists(src) {
-		if !optional {
-			panic(fmt.Errorf("sandbox: bind source does not exist: %v", src))
-		}
-		return
+	if h.sourceExists("bind", src, optional) {
+		h.args = append(h.args, "--bind", src, dest)
 	}
-	h.args = append(h.args, "--bind", src, dest)
 }
 
 func (h *hugbox) roBind(src, dest string, optional bool) {
-	if !FileExists(src) {
-		if !optional {
-			panic(fmt.Errorf("sandbox: roBind source does not exist: %v", src))
-		}
+	if h.sourceExists("roBind", src, optional) {
+		h.args = append(h.args, "--ro-bind", src, dest)
+	}
+}
+
+// surrogateBind bind mounts src at dest, where src is created by the launcher
+// right before launch, like the AF_LOCAL surrogate sockets.  In dry-run mode
+// src is not expected to exist.
+func (h *hugbox) surrogateBind(src, dest string) {
+	if h.noSurrogates {
 		return
 	}
-	h.args = append(h.args, "--ro-bind", src, dest)
+	if h.dryRun {
+		h.args = append(h.args, "--bind", src, dest)
+		return
+	}
+	h.bind(src, dest, false)
+}
+
+// sourceExists returns true iff the bind mount source src exists, and panics
+// if it is required, but doesn't.  In dry-run mode required sources that do
+// not exist are recorded instead, so that they can all be reported.
+func (h *hugbox) sourceExists(op, src string, optional bool) bool {
+	if FileExists(src) {
+		return true
+	} else if optional {
+		return false
+	} else if !h.dryRun {
+		panic(fmt.Errorf("sandbox: %v source does not exist: %v", op, src))
+	}
+	h.missing = append(h.missing, src)
+	return true
 }
 
 func (h *hugbox) file(dest string, data []byte) {
@@ -140,15 +175,20 @@ func (h *hugbox) file(dest string, data []byte) {
 
 func (h *hugbox) setupDbus() {
 	const idPath = "/var/lib/dbus/machine-id"
+
+	h.file(idPath, []byte(fakeMachineID()))
+	h.symlink(idPath, "/etc/machine-id") // openSUSE again.
+}
+
+// fakeMachineID returns the D-Bus machine ID given to every sandbox.
+func fakeMachineID() string {
 	var fakeUUID [16]byte
 
 	// That's the kind of thing an idiot would have on his luggage!
 	for i := range fakeUUID {
 		fakeUUID[i] = byte(i)
 	}
-	hexUUID := hex.EncodeToString(fakeUUID[:])
-	h.file(idPath, []byte(hexUUID))
-	h.symlink(idPath, "/etc/machine-id") // openSUSE again.
+	return hex.EncodeToString(fakeUUID[:])
 }
 
 func (h *hugbox) assetFile(dest, asset string) {
@@ -163,7 +203,15 @@ func (h *hugbox) tmpfs(dest string) {
 	h.args = append(h.args, "--tmpfs", dest)
 }
 
+// shadowDir makes the contents of src available at dest, such that any
+// changes are discarded when the sandbox exits.  The paths in exclude are
+// hidden.
 func (h *hugbox) shadowDir(dest, src string, exclude []string) {
+	if h.canOverlay {
+		h.overlayDir(dest, src, exclude)
+		return
+	}
+
 	Debugf("sandbox: shadowDir: %s -> %s", src, dest)
 
 	excludeMap := make(map[string]bool)
@@ -189,27 +237,39 @@ func (h *hugbox) shadowDir(dest, src string, exclude []string) {
 		// Dealing with this is annoying, and it doesn't happen under
 		// normal usage.
 		const (
-			modeIrregular  = os.ModeSymlink | os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
+			modeIrregular  = os.ModeNamedPipe | os.ModeSocket | os.ModeDevice
 			modeExecutable = 0111
 		)
 		mode := info.Mode()
 		if mode&modeIrregular != 0 {
 			Debugf("sandbox: shadowDir: '%s' irregular perm bits: %s", path, mode)
 			return fmt.Errorf("sandbox: shadowDir: '%s' irregular perm bits: %s", path, mode)
-		} else if mode&modeExecutable != 0 && !isDir {
-			// Alas shadowDir has limits, because bwrap doesn't give a easy way
-			// to set this up.
-			Debugf("sandbox: shadowDir: '%s' ignoring executable perm bits: %s", path, mode)
 		}
 
 		relPath := filepath.Clean(strings.TrimPrefix(path, src))
 		destPath := filepath.Join(dest, relPath)
-		if isDir {
+		switch {
+		case isDir:
 			h.dir(destPath)
-		} else {
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			h.symlink(target, destPath)
+		default:
+			if mode&modeExecutable != 0 {
+				if h.bwrapVersion.atLeast(0, 5, 0) {
+					h.args = append(h.args, "--perms", fmt.Sprintf("%04o", mode.Perm()))
+				} else {
+					Debugf("sandbox: shadowDir: '%s' ignoring executable perm bits: %s", path, mode)
+				}
+			}
+
 			// XXX: This guzzles memory, and it'll be easier just to open
 			// the source file, but cleanup on errors would be a huge
-			// nightmare, because Go is too cool for destructors.
+			// nightmare, because Go is too cool for destructors.  This is
+			// only used when overlayfs is unavailable.
 			b, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
@@ -228,39 +288,41 @@ func (h *hugbox) shadowDir(dest, src string, exclude []string) {
 	}
 }
 
-func (h *hugbox) run() (*Process, error) {
-	// Create the command struct for the sandbox.
-	cmd := &exec.Cmd{
-		Path:   h.bwrapPath,
-		Args:   []string{h.bwrapPath, "--args", "3", h.cmd},
-		Env:    []string{},
-		Stdin:  h.stdin,
-		Stdout: h.stdout,
-		Stderr: h.stderr,
-		SysProcAttr: &syscall.SysProcAttr{
-			Setsid:    true,
-			Pdeathsig: h.pdeathSig,
-		},
-	}
-	cmd.Args = append(cmd.Args, h.cmdArgs...)
+func (h *hugbox) overlayDir(dest, src string, exclude []string) {
+	Debugf("sandbox: shadowDir: %s -> %s (overlay)", src, dest)
 
-	defer func() {
-		// Force close the unwritten pipe fd(s), on the off-chance that
-		// something failed before they could be written.
-		for _, f := range cmd.ExtraFiles {
-			f.Close()
+	// The overlay's upper layer is a tmpfs, so nothing gets copied, and the
+	// permissions, symlinks and everything else are preserved as is.
+	h.args = append(h.args, "--overlay-src", src, "--tmp-overlay", dest)
+
+	// overlayfs has no way to exclude paths, so mask them instead.
+	for _, s := range exclude {
+		relPath, err := filepath.Rel(src, s)
+		if err != nil || strings.HasPrefix(relPath, "..") {
+			panic(fmt.Errorf("sandbox: shadowDir: exclude '%s' is not in '%s'", s, src))
+		}
+		fi, err := os.Lstat(s)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			panic(err)
 		}
-	}()
 
-	// Prep the args pipe.
-	var argsWrFd *os.File
-	if r, w, err := os.Pipe(); err != nil {
-		return nil, err
-	} else {
-		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
-		argsWrFd = w
+		Debugf("sandbox: shadowDir: excluding '%s'", s)
+		destPath := filepath.Join(dest, relPath)
+		if fi.IsDir() {
+			h.tmpfs(destPath)
+		} else {
+			h.file(destPath, []byte{})
+		}
 	}
+}
 
+// baseArgs returns the arguments common to all sandboxes, and adds the files
+// that every sandbox gets.  It must only be called once, right before the
+// sandbox is launched (or explained).
+func (h *hugbox) baseArgs() ([]string, error) {
 	// Build up the args to be passed via fd.  This specifies args directly
 	// instead of using accessors since not everything is exposed, and
 	// bubblewrap will fail if the assumptions I need to make about the
@@ -334,6 +396,47 @@ func (h *hugbox) run() (*Process, error) {
 		h.setupDbus()
 	}
 
+	return fdArgs, nil
+}
+
+func (h *hugbox) run() (*Process, error) {
+	// Create the command struct for the sandbox.
+	cmd := &exec.Cmd{
+		Path:   h.bwrapPath,
+		Args:   []string{h.bwrapPath, "--args", "3", h.cmd},
+		Env:    []string{},
+		Stdin:  h.stdin,
+		Stdout: h.stdout,
+		Stderr: h.stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Setsid:    true,
+			Pdeathsig: h.pdeathSig,
+		},
+	}
+	cmd.Args = append(cmd.Args, h.cmdArgs...)
+
+	defer func() {
+		// Force close the unwritten pipe fd(s), on the off-chance that
+		// something failed before they could be written.
+		for _, f := range cmd.ExtraFiles {
+			f.Close()
+		}
+	}()
+
+	// Prep the args pipe.
+	var argsWrFd *os.File
+	if r, w, err := os.Pipe(); err != nil {
+		return nil, err
+	} else {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		argsWrFd = w
+	}
+
+	fdArgs, err := h.baseArgs()
+	if err != nil {
+		return nil, err
+	}
+
 	// Handle the files to be injected via pipes.
 	fdIdx := 4
 	pendingWriteFds := []*os.File{argsWrFd}
@@ -360,6 +463,30 @@ func (h *hugbox) run() (*Process, error) {
 		fdIdx++
 	}
 
+	// Prep the block pipe if required.  The rlimits are applied to the
+	// sandbox's init process, while it is blocked before running the
+	// command, since bubblewrap itself can be setuid.
+	var blockWrFd *os.File
+	if len(h.rlimits) > 0 {
+		// Conservatively only rely on `--block-fd` with the versions that
+		// have `--die-with-parent`.
+		if !h.bwrapVersion.atLeast(0, 1, 8) {
+			return nil, fmt.Errorf("sandbox: bubblewrap %v is too old to apply rlimits", h.bwrapVersion)
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		fdArgs = append(fdArgs, "--block-fd", fmt.Sprintf("%d", fdIdx))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		blockWrFd = w
+		fdIdx++
+
+		// Closing the pipe unblocks the init process, so this must happen
+		// after it is killed on failure.
+		defer blockWrFd.Close()
+	}
+
 	// Prep the info pipe.
 	var infoRdFd *os.File
 	if r, w, err := os.Pipe(); err != nil {
@@ -384,7 +511,9 @@ func (h *hugbox) run() (*Process, error) {
 	Debugf("sandbox: fdArgs: %v", fdArgs)
 
 	// Fork/exec.
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
 
 	// Do the rest of the setup in a go routine, and monitor completion and
 	// a watchdog timer.
@@ -407,8 +536,13 @@ func (h *hugbox) run() (*Process, error) {
 
 		// Write the seccomp rules.
 		if h.seccompFn != nil {
-			// This should be the one and only remaining extra file.
-			if len(cmd.ExtraFiles) != 2 {
+			// This should be the one and only remaining extra file, other
+			// than the block and info pipes.
+			nExpected := 2
+			if blockWrFd != nil {
+				nExpected++
+			}
+			if len(cmd.ExtraFiles) != nExpected {
 				panic("sandbox: unexpected extra files when writing seccomp rules")
 			} else if seccompWrFd == nil {
 				panic("sandbox: missing fd when writing seccomp rules")
@@ -437,10 +571,24 @@ func (h *hugbox) run() (*Process, error) {
 		// namespace.  If people aren't using unshare.pid, bad things happen.
 		process.SetInitPid(info.Pid)
 
+		// Lower the rlimits so that the command inherits them, and let it
+		// run.  If this fails, the command is never run, since running it
+		// without the limits is not an option.
+		if blockWrFd != nil {
+			if err := lowerProcessRlimits(info.Pid, h.rlimits); err != nil {
+				doneCh <- fmt.Errorf("sandbox: failed to lower rlimits: %v", err)
+				return
+			}
+			if _, err := blockWrFd.Write([]byte{0}); err != nil {
+				doneCh <- err
+				return
+			}
+		}
+
 		doneCh <- nil
 	}()
 
-	err := fmt.Errorf("sandbox: timeout waiting for bubblewrap to start")
+	err = fmt.Errorf("sandbox: timeout waiting for bubblewrap to start")
 timeoutLoop:
 	for nTicks := 0; nTicks < 10; { // 10 second timeout, probably excessive.
 		select {
@@ -466,7 +614,7 @@ type bwrapInfo struct {
 	Pid int `json:"child-pid"`
 }
 
-func newHugbox() (*hugbox, error) {
+func newHugbox(cfg *config.Config) (*hugbox, error) {
 	h := &hugbox{
 		unshare: unshareOpts{
 			user:   false,
@@ -484,44 +632,29 @@ func newHugbox() (*hugbox, error) {
 		standardLibs: true,
 	}
 
+	b, err := FindBwrap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.bwrapPath = b.Path
+	h.bwrapVersion = b.version
+	h.bwrapSetuid = b.Setuid
+
 	// This option is considered dangerous and leads to things like
 	// CVE-2016-8655.  But if the user is running with this enabled,
 	// then might as well take advantage of it.
-	if FileExists("/proc/self/ns/user") {
+	if b.UserNamespaces {
 		Debugf("sandbox: User namespace support detected.")
 		h.unshare.user = true
 		h.runtimeDir = "/run/user/1000"
 	}
 
-	// Look for the bwrap binary in sensible locations.
-	bwrapPaths := []string{
-		"/usr/bin/bwrap",
-	}
-	for _, v := range bwrapPaths {
-		if FileExists(v) {
-			h.bwrapPath = v
-			break
-		}
-	}
-	if h.bwrapPath == "" {
-		return nil, fmt.Errorf("sandbox: unable to find bubblewrap binary")
-	}
-
-	// Query and cache the bubblewrap version.
-	var err error
-	if h.bwrapVersion, err = getBwrapVersion(h.bwrapPath); err != nil {
-		return nil, err
-	} else {
-		Debugf("sandbox: bubblewrap '%v' detected.", h.bwrapVersion)
-
-		// Bubblewrap <= 0.1.2-2 (in Debian terms, 0.1.3 for the rest of us),
-		// is a really bad idea because I'm a retard, and didn't expect
-		// bubblewrap to be ptrace-able when I contributed support for setting
-		// the hostname.
-		if !h.bwrapVersion.atLeast(0, 1, 3) {
-			return nil, fmt.Errorf("sandbox: bubblewrap appears to be older than 0.1.3, you MUST upgrade.")
-		}
+	// Bubblewrap >= 0.11.0 can mount overlayfs, but not when setuid, and
+	// unprivileged overlayfs mounts require Linux >= 5.11.
+	if h.bwrapVersion.atLeast(0, 11, 0) && h.unshare.user && !b.Setuid {
+		h.canOverlay = kernelVersionAtLeast(5, 11)
 	}
+	Debugf("sandbox: bubblewrap overlayfs support: %v", h.canOverlay)
 
 	return h, nil
 }
@@ -582,6 +715,29 @@ func getBwrapVersion(f string) (*bwrapVersion, error) {
 	return &bwrapVersion{maj: iVers[0], min: iVers[1], pl: iVers[2]}, nil
 }
 
+func kernelVersionAtLeast(maj, min int) bool {
+	var buf syscall.Utsname
+	if err := syscall.Uname(&buf); err != nil {
+		return false
+	}
+
+	// Parse the leading `major.minor` out of something like `5.11.0-arch1`.
+	var vers [2]int
+	idx := 0
+	for _, v := range buf.Release {
+		switch {
+		case v >= '0' && v <= '9':
+			vers[idx] = vers[idx]*10 + int(v-'0')
+			continue
+		case v == '.' && idx == 0:
+			idx++
+			continue
+		}
+		break
+	}
+	return vers[0] > maj || (vers[0] == maj && vers[1] >= min)
+}
+
 func writeBuffer(w io.WriteCloser, contents []byte) error {
 	defer w.Close()
 	_, err := w.Write(contents)
@@ -0,0 +1,63 @@
+// landlock.go - Landlock support.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/twtiger/gosecco/constants"
+)
+
+// The Landlock system calls are the same on every architecture that got them
+// after the system call table unification, which includes x86_64.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+
+	landlockWritableEnv = "TOR_STUB_LANDLOCK_WRITABLE"
+)
+
+// LandlockABI returns the Landlock ABI version supported by the kernel, or 0
+// if Landlock is unavailable.
+func LandlockABI() int {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+// appendLandlock has `tbb_stub.so` restrict writes to the directories in
+// writable (paths in the sandbox), and their subdirectories.  Everything else
+// is still subject to the mount namespace, so reads are not restricted.
+func (h *hugbox) appendLandlock(writable []string) {
+	h.setenv(landlockWritableEnv, strings.Join(writable, ":"))
+}
+
+func init() {
+	// gosecco's system call table predates Landlock.
+	if runtime.GOARCH == "amd64" {
+		constants.RegisterSyscall("landlock_create_ruleset", sysLandlockCreateRuleset)
+		constants.RegisterSyscall("landlock_add_rule", sysLandlockAddRule)
+		constants.RegisterSyscall("landlock_restrict_self", sysLandlockRestrictSelf)
+	}
+}
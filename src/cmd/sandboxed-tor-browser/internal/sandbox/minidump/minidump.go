@@ -0,0 +1,331 @@
+// minidump.go - Minidump summaries.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package minidump summarizes the Breakpad minidumps written by Firefox's
+// crash reporter, without ever including anything from the environment,
+// command line, or paths from the dump.
+//
+// Only x86_64 dumps are supported.  The frames past the crashing instruction
+// are found by scanning the stack for values that point into a module, like
+// Breakpad does when it lacks call frame information, so they may include
+// stale return addresses.
+//
+// The symbols are not part of the Tor Browser bundle, so the frames are
+// `module+0xoffset`, unless Breakpad symbol files for the module are present
+// in a symbol store, in which case the function names are looked up.
+package minidump
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+)
+
+const (
+	signature = 0x504d444d // "MDMP"
+
+	streamThreadList = 3
+	streamModuleList = 4
+	streamException  = 6
+
+	headerSize    = 32
+	dirEntrySize  = 12
+	threadSize    = 48
+	moduleSize    = 108
+	moduleCVRva   = 76
+	exceptionSize = 168
+
+	// The offsets of the registers in `MDRawContextAMD64`.
+	contextAMD64Size = 1232
+	contextAMD64RSP  = 0x98
+	contextAMD64RIP  = 0xf8
+
+	// MaxFrames is the maximum number of frames in a summary.
+	MaxFrames = 10
+
+	// MaxSize is the size of the largest minidump that will be read.  The
+	// minidumps of a crash without the full memory are far smaller.
+	MaxSize = 32 * 1024 * 1024
+)
+
+var errTruncated = errors.New("minidump: truncated")
+
+var le = binary.LittleEndian
+
+// Summary is the summary of a minidump.
+type Summary struct {
+	// Signal is the signal that caused the crash.
+	Signal syscall.Signal `json:"signal"`
+
+	// Address is the faulting address, for the signals that have one.
+	Address uint64 `json:"address"`
+
+	// Module is the name of the module that the crash happened in, without
+	// the path, or "" if it is unknown.
+	Module string `json:"module,omitempty"`
+
+	// Frames are the stack frames as `module!function+0xoffset` if there
+	// are symbols, or `module+0xoffset` otherwise, starting with the
+	// crashing instruction.
+	Frames []string `json:"frames,omitempty"`
+}
+
+// String returns the multi-line text form of the summary.
+func (s *Summary) String() string {
+	module := s.Module
+	if module == "" {
+		module = "unknown module"
+	}
+	lines := []string{fmt.Sprintf("%v at %#x in %v", s.Signal, s.Address, module)}
+	for i, f := range s.Frames {
+		lines = append(lines, fmt.Sprintf("  #%d %s", i, f))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type module struct {
+	name       string
+	id         string
+	base, size uint64
+}
+
+// frame is a stack frame, with the module that contains it, if any.
+type frame struct {
+	m    *module
+	addr uint64
+}
+
+type dump struct {
+	b       []byte
+	streams map[uint32][]byte
+	modules []module
+}
+
+// Summarize reads the minidump at path, and summarizes it.  If symbolsDir is
+// not "", the names of the functions are looked up in the Breakpad symbol
+// store there.
+//
+// The minidump is written by the browser, so path must be a regular file,
+// and not a symlink, and only MaxSize bytes are read.
+func Summarize(path, symbolsDir string) (*Summary, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("minidump: not a regular file")
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(f, MaxSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(b) > MaxSize {
+		return nil, fmt.Errorf("minidump: larger than %d bytes", MaxSize)
+	}
+	return summarize(b, symbolsDir)
+}
+
+func summarize(b []byte, symbolsDir string) (*Summary, error) {
+	d := &dump{b: b, streams: make(map[uint32][]byte)}
+	if len(b) < headerSize {
+		return nil, errTruncated
+	}
+	if le.Uint32(b[0:]) != signature {
+		return nil, fmt.Errorf("minidump: invalid signature")
+	}
+	nStreams, dirRva := le.Uint32(b[8:]), le.Uint32(b[12:])
+	for i := uint32(0); i < nStreams; i++ {
+		e, err := d.slice(uint64(dirRva)+uint64(i)*dirEntrySize, dirEntrySize)
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.location(e[4:])
+		if err != nil {
+			return nil, err
+		}
+		d.streams[le.Uint32(e[0:])] = s
+	}
+
+	exc := d.streams[streamException]
+	if len(exc) < exceptionSize {
+		return nil, fmt.Errorf("minidump: no exception stream")
+	}
+	if err := d.parseModules(); err != nil {
+		return nil, err
+	}
+
+	// On Linux, the exception code is the signal number.
+	s := &Summary{
+		Signal:  syscall.Signal(le.Uint32(exc[8:])),
+		Address: le.Uint64(exc[24:]),
+	}
+
+	ctx, err := d.location(exc[160:])
+	if err != nil || len(ctx) < contextAMD64Size {
+		return nil, fmt.Errorf("minidump: invalid crashing thread context")
+	}
+	rip, rsp := le.Uint64(ctx[contextAMD64RIP:]), le.Uint64(ctx[contextAMD64RSP:])
+	frames := []frame{{m: d.findModule(rip), addr: rip}}
+	if m := frames[0].m; m != nil {
+		s.Module = m.name
+	}
+
+	// Scan the crashing thread's stack for return addresses.
+	stackBase, stack := d.threadStack(le.Uint32(exc[0:]))
+	if rsp >= stackBase && rsp-stackBase < uint64(len(stack)) {
+		for off := rsp - stackBase; off+8 <= uint64(len(stack)) && len(frames) < MaxFrames; off += 8 {
+			addr := le.Uint64(stack[off:])
+			if m := d.findModule(addr); m != nil {
+				frames = append(frames, frame{m: m, addr: addr})
+			}
+		}
+	}
+
+	s.Frames = formatFrames(frames, symbolsDir)
+	return s, nil
+}
+
+// formatFrames returns the text form of each of the frames, with the function
+// names from the symbol store at symbolsDir, if any.
+func formatFrames(frames []frame, symbolsDir string) []string {
+	names := make(map[*module]map[uint64]string)
+	if symbolsDir != "" {
+		offsets := make(map[*module][]uint64)
+		for _, f := range frames {
+			if f.m != nil {
+				offsets[f.m] = append(offsets[f.m], f.addr-f.m.base)
+			}
+		}
+		for m, offs := range offsets {
+			// Missing symbols are expected, so failures are silent.
+			names[m], _ = lookupSymbols(symbolsDir, m, offs)
+		}
+	}
+
+	var ret []string
+	for _, f := range frames {
+		switch {
+		case f.m == nil:
+			ret = append(ret, fmt.Sprintf("%#x", f.addr))
+		case names[f.m][f.addr-f.m.base] != "":
+			ret = append(ret, f.m.name+"!"+names[f.m][f.addr-f.m.base])
+		default:
+			ret = append(ret, fmt.Sprintf("%s+%#x", f.m.name, f.addr-f.m.base))
+		}
+	}
+	return ret
+}
+
+func (d *dump) slice(rva, size uint64) ([]byte, error) {
+	if rva+size < rva || rva+size > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	return d.b[rva : rva+size], nil
+}
+
+// location returns the data referred to by a `MDLocationDescriptor`.
+func (d *dump) location(b []byte) ([]byte, error) {
+	if len(b) < 8 {
+		return nil, errTruncated
+	}
+	return d.slice(uint64(le.Uint32(b[4:])), uint64(le.Uint32(b[0:])))
+}
+
+func (d *dump) parseModules() error {
+	b := d.streams[streamModuleList]
+	if len(b) < 4 {
+		return nil
+	}
+	n := uint64(le.Uint32(b))
+	if 4+n*moduleSize > uint64(len(b)) {
+		return errTruncated
+	}
+	for i := uint64(0); i < n; i++ {
+		mb := b[4+i*moduleSize:]
+		cv, _ := d.location(mb[moduleCVRva:])
+		d.modules = append(d.modules, module{
+			name: d.moduleName(le.Uint32(mb[20:])),
+			id:   debugID(cv),
+			base: le.Uint64(mb[0:]),
+			size: uint64(le.Uint32(mb[8:])),
+		})
+	}
+	return nil
+}
+
+// moduleName returns the name of a module, with the path removed, given the
+// RVA of the `MDString`.
+func (d *dump) moduleName(rva uint32) string {
+	hdr, err := d.slice(uint64(rva), 4)
+	if err != nil {
+		return "unknown"
+	}
+	b, err := d.slice(uint64(rva)+4, uint64(le.Uint32(hdr)))
+	if err != nil {
+		return "unknown"
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = le.Uint16(b[i*2:])
+	}
+	return path.Base(string(utf16.Decode(u)))
+}
+
+// findModule returns the module containing addr, or nil.
+func (d *dump) findModule(addr uint64) *module {
+	for i := range d.modules {
+		m := &d.modules[i]
+		if addr >= m.base && addr-m.base < m.size {
+			return m
+		}
+	}
+	return nil
+}
+
+// threadStack returns the start address, and the contents of the stack of
+// the thread with the ID tid.
+func (d *dump) threadStack(tid uint32) (uint64, []byte) {
+	b := d.streams[streamThreadList]
+	if len(b) < 4 {
+		return 0, nil
+	}
+	n := uint64(le.Uint32(b))
+	if 4+n*threadSize > uint64(len(b)) {
+		return 0, nil
+	}
+	for i := uint64(0); i < n; i++ {
+		tb := b[4+i*threadSize:]
+		if le.Uint32(tb[0:]) != tid {
+			continue
+		}
+		stack, err := d.location(tb[32:])
+		if err != nil {
+			return 0, nil
+		}
+		return le.Uint64(tb[24:]), stack
+	}
+	return 0, nil
+}
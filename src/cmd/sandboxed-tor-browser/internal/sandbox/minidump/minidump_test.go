@@ -0,0 +1,360 @@
+// minidump_test.go - Minidump summary tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minidump
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	testTid      = 1234
+	testXulBase  = 0x7f0000000000
+	testLibcBase = 0x7f1000000000
+	testStack    = 0x7ffd00000000
+)
+
+var testBuildID = []byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+	0x11, 0x12, 0x13, 0x14,
+}
+
+// testDumpID is the Breakpad debug identifier for testBuildID.
+const testDumpID = "0403020106050807090A0B0C0D0E0F100"
+
+type testModule struct {
+	name       string
+	base, size uint64
+	buildID    []byte
+}
+
+// builder builds a minidump, with the streams appended after the header and
+// the stream directory.
+type builder struct {
+	b []byte
+}
+
+func (bd *builder) u16(v uint16) { bd.b = append(bd.b, byte(v), byte(v>>8)) }
+func (bd *builder) u32(v uint32) { bd.u16(uint16(v)); bd.u16(uint16(v >> 16)) }
+
+func (bd *builder) rva() uint32 { return uint32(len(bd.b)) }
+
+// blob appends b, and returns it's RVA.
+func (bd *builder) blob(b []byte) uint32 {
+	rva := bd.rva()
+	bd.b = append(bd.b, b...)
+	return rva
+}
+
+// putLocation writes a `MDLocationDescriptor` at off.
+func (bd *builder) putLocation(off, size, rva uint32) {
+	le.PutUint32(bd.b[off:], size)
+	le.PutUint32(bd.b[off+4:], rva)
+}
+
+func newTestDump(sig syscall.Signal, rip uint64, stack []uint64, modules []testModule) []byte {
+	bd := new(builder)
+	const nStreams = 3
+	bd.u32(signature)
+	bd.u32(0xa793) // Version.
+	bd.u32(nStreams)
+	bd.u32(headerSize)
+	bd.b = append(bd.b, make([]byte, headerSize-16)...)
+	dirRva := bd.blob(make([]byte, nStreams*dirEntrySize))
+
+	// The crashing thread's context, and stack.
+	ctx := make([]byte, contextAMD64Size)
+	le.PutUint64(ctx[contextAMD64RIP:], rip)
+	le.PutUint64(ctx[contextAMD64RSP:], testStack+8)
+	ctxRva := bd.blob(ctx)
+	stackBytes := make([]byte, 8+len(stack)*8)
+	for i, v := range stack {
+		le.PutUint64(stackBytes[8+i*8:], v)
+	}
+	stackRva := bd.blob(stackBytes)
+
+	// The module names, and CodeView records.
+	var nameRvas, cvRvas []uint32
+	for _, m := range modules {
+		u := utf16.Encode([]rune(m.name))
+		nameRvas = append(nameRvas, bd.rva())
+		bd.u32(uint32(len(u) * 2))
+		for _, c := range u {
+			bd.u16(c)
+		}
+		cvRvas = append(cvRvas, bd.rva())
+		bd.u32(cvSignatureELF)
+		bd.blob(m.buildID)
+	}
+
+	// The exception stream.
+	excRva := bd.blob(make([]byte, exceptionSize))
+	le.PutUint32(bd.b[excRva:], testTid)
+	le.PutUint32(bd.b[excRva+8:], uint32(sig))
+	le.PutUint64(bd.b[excRva+24:], 0xdeadbeef)
+	bd.putLocation(excRva+160, contextAMD64Size, ctxRva)
+
+	// The thread list stream.
+	threadsRva := bd.rva()
+	bd.u32(1)
+	tRva := bd.blob(make([]byte, threadSize))
+	le.PutUint32(bd.b[tRva:], testTid)
+	le.PutUint64(bd.b[tRva+24:], testStack)
+	bd.putLocation(tRva+32, uint32(len(stackBytes)), stackRva)
+	bd.putLocation(tRva+40, contextAMD64Size, ctxRva)
+
+	// The module list stream.
+	modulesRva := bd.rva()
+	bd.u32(uint32(len(modules)))
+	for i, m := range modules {
+		mRva := bd.blob(make([]byte, moduleSize))
+		le.PutUint64(bd.b[mRva:], m.base)
+		le.PutUint32(bd.b[mRva+8:], uint32(m.size))
+		le.PutUint32(bd.b[mRva+20:], nameRvas[i])
+		bd.putLocation(mRva+moduleCVRva, uint32(4+len(m.buildID)), cvRvas[i])
+	}
+
+	for i, s := range [][3]uint32{
+		{streamException, excRva, exceptionSize},
+		{streamThreadList, threadsRva, modulesRva - threadsRva},
+		{streamModuleList, modulesRva, bd.rva() - modulesRva},
+	} {
+		off := dirRva + uint32(i)*dirEntrySize
+		le.PutUint32(bd.b[off:], s[0])
+		bd.putLocation(off+4, s[2], s[1])
+	}
+
+	return bd.b
+}
+
+var testModules = []testModule{
+	{"/home/amnesia/sandboxed-tor-browser/tor-browser/libxul.so", testXulBase, 0x100000, testBuildID},
+	{"libc.so.6", testLibcBase, 0x1000, testBuildID[:8]},
+}
+
+func TestSummarize(t *testing.T) {
+	stack := []uint64{0x41414141, testXulBase + 0x10, 0, testLibcBase + 0x20, testLibcBase + 0x1000}
+	b := newTestDump(syscall.SIGSEGV, testXulBase+0x1234, stack, testModules)
+
+	s, err := summarize(b, "")
+	if err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if s.Signal != syscall.SIGSEGV || s.Address != 0xdeadbeef {
+		t.Errorf("signal, address: %v, %#x", s.Signal, s.Address)
+	}
+	if s.Module != "libxul.so" {
+		t.Errorf("module: '%v'", s.Module)
+	}
+	expected := []string{"libxul.so+0x1234", "libxul.so+0x10", "libc.so.6+0x20"}
+	if !reflect.DeepEqual(s.Frames, expected) {
+		t.Errorf("frames: %v, expected %v", s.Frames, expected)
+	}
+
+	str := s.String()
+	if strings.Contains(str, "amnesia") {
+		t.Errorf("summary contains the module path: %v", str)
+	}
+	if !strings.HasPrefix(str, "segmentation fault at 0xdeadbeef in libxul.so\n  #0 libxul.so+0x1234") {
+		t.Errorf("string: %v", str)
+	}
+}
+
+func TestSummarizeUnknownModule(t *testing.T) {
+	b := newTestDump(syscall.SIGILL, 0x4141, nil, testModules)
+	s, err := summarize(b, "")
+	if err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if s.Module != "" || !reflect.DeepEqual(s.Frames, []string{"0x4141"}) {
+		t.Errorf("module, frames: '%v', %v", s.Module, s.Frames)
+	}
+	if !strings.Contains(s.String(), "in unknown module") {
+		t.Errorf("string: %v", s.String())
+	}
+}
+
+func TestSummarizeMaxFrames(t *testing.T) {
+	var stack []uint64
+	for i := 0; i < MaxFrames*2; i++ {
+		stack = append(stack, testXulBase+uint64(i))
+	}
+	b := newTestDump(syscall.SIGABRT, testXulBase, stack, testModules)
+	s, err := summarize(b, "")
+	if err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if len(s.Frames) != MaxFrames {
+		t.Errorf("%d frames, expected %d", len(s.Frames), MaxFrames)
+	}
+}
+
+func TestSummarizeInvalid(t *testing.T) {
+	b := newTestDump(syscall.SIGSEGV, testXulBase, []uint64{testXulBase}, testModules)
+
+	// Every truncation must fail cleanly, and not panic.
+	for _, n := range []int{0, 4, headerSize - 1} {
+		if _, err := summarize(b[:n], ""); err != errTruncated {
+			t.Errorf("truncated to %d: %v", n, err)
+		}
+	}
+	for n := headerSize; n < len(b); n++ {
+		if _, err := summarize(b[:n], ""); err == nil {
+			t.Errorf("truncated to %d: no error", n)
+		}
+	}
+
+	// The stream directory is past the end of the dump.
+	bad := append([]byte{}, b...)
+	le.PutUint32(bad[12:], uint32(len(bad)))
+	if _, err := summarize(bad, ""); err != errTruncated {
+		t.Errorf("bad stream directory: %v", err)
+	}
+
+	bad = append([]byte{}, b...)
+	bad[0] = 'X'
+	if _, err := summarize(bad, ""); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("bad signature: %v", err)
+	}
+
+	// Without the exception stream, there is no crash to summarize.
+	bad = append([]byte{}, b...)
+	le.PutUint32(bad[headerSize:], 0xffff)
+	if _, err := summarize(bad, ""); err == nil || !strings.Contains(err.Error(), "exception") {
+		t.Errorf("no exception stream: %v", err)
+	}
+}
+
+func TestDebugID(t *testing.T) {
+	cv := append([]byte{0x4c, 0x45, 0x70, 0x42}, testBuildID...)
+	if id := debugID(cv); id != testDumpID {
+		t.Errorf("ELF debug identifier: %v, expected %v", id, testDumpID)
+	}
+
+	// Short build IDs are zero padded.
+	cv = append([]byte{0x4c, 0x45, 0x70, 0x42}, testBuildID[:4]...)
+	if id := debugID(cv); id != "040302010000000000000000000000000" {
+		t.Errorf("short ELF debug identifier: %v", id)
+	}
+
+	if id := debugID([]byte{'N', 'B', '1', '0', 0, 0, 0, 0}); id != "" {
+		t.Errorf("unknown CodeView record: %v", id)
+	}
+}
+
+func TestSummarizeSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minidump")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	symDir := filepath.Join(dir, "libxul.so", testDumpID)
+	if err = os.MkdirAll(symDir, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	sym := strings.Join([]string{
+		"MODULE Linux x86_64 " + testDumpID + " libxul.so",
+		"FILE 0 foo.cpp",
+		"FUNC 1200 100 0 mozilla::Crash(int)",
+		"1200 10 42 0",
+		"PUBLIC 0 0 _init",
+		"FUNC m 2000 10 0 Unused",
+		"",
+	}, "\n")
+	if err = ioutil.WriteFile(filepath.Join(symDir, "libxul.so.sym"), []byte(sym), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	stack := []uint64{testXulBase + 0x10, testLibcBase + 0x20}
+	b := newTestDump(syscall.SIGSEGV, testXulBase+0x1234, stack, testModules)
+	s, err := summarize(b, dir)
+	if err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+
+	// libc has no symbols, so it's frame is unchanged.
+	expected := []string{"libxul.so!mozilla::Crash(int)+0x34", "libxul.so!_init+0x10", "libc.so.6+0x20"}
+	if !reflect.DeepEqual(s.Frames, expected) {
+		t.Errorf("frames: %v, expected %v", s.Frames, expected)
+	}
+
+	// A symbol file for a different build is ignored.
+	modules := append([]testModule{}, testModules...)
+	modules[0].buildID = testBuildID[4:]
+	b = newTestDump(syscall.SIGSEGV, testXulBase+0x1234, nil, modules)
+	os.Rename(symDir, filepath.Join(dir, "libxul.so", debugID(append([]byte{0x4c, 0x45, 0x70, 0x42}, modules[0].buildID...))))
+	if s, err = summarize(b, dir); err != nil {
+		t.Fatalf("summarize: %v", err)
+	}
+	if !reflect.DeepEqual(s.Frames, []string{"libxul.so+0x1234"}) {
+		t.Errorf("mismatched symbols: %v", s.Frames)
+	}
+}
+
+func TestSummarizeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minidump")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := newTestDump(syscall.SIGSEGV, testXulBase+0x1234, nil, testModules)
+	dmp := filepath.Join(dir, "crash.dmp")
+	if err = ioutil.WriteFile(dmp, b, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if s, err := Summarize(dmp, ""); err != nil || s.Module != "libxul.so" {
+		t.Errorf("Summarize: %v %v", s, err)
+	}
+
+	// The browser writes the minidumps, so anything other than a regular
+	// file must be rejected, without blocking.
+	link := filepath.Join(dir, "link.dmp")
+	if err = os.Symlink(dmp, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if _, err = Summarize(link, ""); err == nil {
+		t.Errorf("Summarize followed a symlink")
+	}
+	fifo := filepath.Join(dir, "fifo.dmp")
+	if err = syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+	if _, err = Summarize(fifo, ""); err == nil || !strings.Contains(err.Error(), "regular") {
+		t.Errorf("Summarize of a FIFO: %v", err)
+	}
+
+	// Oversized minidumps are rejected, rather than read in their entirety.
+	big := filepath.Join(dir, "big.dmp")
+	if err = ioutil.WriteFile(big, b, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err = os.Truncate(big, MaxSize+1); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if _, err = Summarize(big, ""); err == nil || !strings.Contains(err.Error(), "larger") {
+		t.Errorf("Summarize of an oversized minidump: %v", err)
+	}
+}
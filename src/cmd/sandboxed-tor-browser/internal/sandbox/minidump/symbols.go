@@ -0,0 +1,153 @@
+// symbols.go - Breakpad symbol file lookups.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minidump
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cvSignatureELF   = 0x4270454c // "BpEL"
+	cvSignaturePDB70 = 0x53445352 // "RSDS"
+
+	// The longest symbol file line that will be parsed, since C++ names
+	// can be rather long.
+	maxSymLineLen = 64 * 1024
+)
+
+// debugID returns the Breakpad debug identifier of a module, given it's
+// CodeView record, or "" if it is unknown.
+func debugID(cv []byte) string {
+	if len(cv) < 4 {
+		return ""
+	}
+
+	var guid [16]byte
+	var age uint32
+	switch le.Uint32(cv) {
+	case cvSignatureELF:
+		// The identifier is the start of the ELF build ID, zero padded.
+		copy(guid[:], cv[4:])
+	case cvSignaturePDB70:
+		if len(cv) < 4+16+4 {
+			return ""
+		}
+		copy(guid[:], cv[4:])
+		age = le.Uint32(cv[20:])
+	default:
+		return ""
+	}
+
+	// The GUID is formatted as if it were a `MDGUID` on a little endian
+	// host, followed by the age.
+	return fmt.Sprintf("%08X%04X%04X%X%X", le.Uint32(guid[0:]), le.Uint16(guid[4:]), le.Uint16(guid[6:]), guid[8:], age)
+}
+
+// symbolFile returns the path to the symbol file for a module, in the
+// standard Breakpad symbol store layout under dir.
+func symbolFile(dir string, m *module) string {
+	return filepath.Join(dir, m.name, m.id, m.name+".sym")
+}
+
+// lookupSymbols returns the names of the functions containing each of the
+// offsets into the module m, from the module's symbol file under dir.
+// Offsets without a symbol are omitted.
+func lookupSymbols(dir string, m *module, offsets []uint64) (map[uint64]string, error) {
+	if m.id == "" {
+		return nil, fmt.Errorf("minidump: %v has no debug identifier", m.name)
+	}
+	if m.name == "." || m.name == ".." || m.name == "/" {
+		// The name comes from the dump, and is used in the path.
+		return nil, fmt.Errorf("minidump: invalid module name: '%v'", m.name)
+	}
+	f, err := os.Open(symbolFile(dir, m))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	funcs := make(map[uint64]string)
+	publics := make(map[uint64]string)
+	publicAddrs := make(map[uint64]uint64)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), maxSymLineLen)
+	for nLine := 0; scanner.Scan(); nLine++ {
+		sp := strings.SplitN(scanner.Text(), " ", 2)
+		if len(sp) != 2 {
+			continue
+		}
+		rest := strings.TrimPrefix(sp[1], "m ") // The multiple flag.
+
+		switch sp[0] {
+		case "MODULE":
+			// MODULE operatingsystem architecture id name
+			if fields := strings.Fields(sp[1]); nLine != 0 || len(fields) < 4 || fields[2] != m.id {
+				return nil, fmt.Errorf("minidump: %v symbol file does not match", m.name)
+			}
+		case "FUNC":
+			// FUNC [m] address size parameter_size name
+			fields := strings.SplitN(rest, " ", 4)
+			if len(fields) != 4 {
+				continue
+			}
+			addr, err1 := strconv.ParseUint(fields[0], 16, 64)
+			size, err2 := strconv.ParseUint(fields[1], 16, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			for _, off := range offsets {
+				if off >= addr && off-addr < size {
+					funcs[off] = fmt.Sprintf("%s+%#x", fields[3], off-addr)
+				}
+			}
+		case "PUBLIC":
+			// PUBLIC [m] address parameter_size name
+			fields := strings.SplitN(rest, " ", 3)
+			if len(fields) != 3 {
+				continue
+			}
+			addr, err := strconv.ParseUint(fields[0], 16, 64)
+			if err != nil {
+				continue
+			}
+			for _, off := range offsets {
+				if best, ok := publicAddrs[off]; off >= addr && (!ok || addr > best) {
+					publicAddrs[off] = addr
+					publics[off] = fmt.Sprintf("%s+%#x", fields[2], off-addr)
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Like Breakpad, PUBLIC records are only used for the addresses that no
+	// FUNC record covers.
+	for off, name := range publics {
+		if _, ok := funcs[off]; !ok {
+			funcs[off] = name
+		}
+	}
+	return funcs, nil
+}
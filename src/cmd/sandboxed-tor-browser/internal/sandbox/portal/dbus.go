@@ -0,0 +1,574 @@
+// dbus.go - Minimal D-Bus wire protocol implementation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package portal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	msgMethodCall   = 1
+	msgMethodReturn = 2
+	msgError        = 3
+	msgSignal       = 4
+
+	flagNoReplyExpected = 0x1
+
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+	fieldUnixFds     = 9
+
+	protocolVersion = 1
+
+	// The sandboxed client has no business sending large messages, so the
+	// limits are far lower than what the specification allows.
+	maxFieldsLen = 64 * 1024
+	maxBodyLen   = 1024 * 1024
+	maxDepth     = 32
+)
+
+var errMalformedMessage = errors.New("portal: malformed D-Bus message")
+
+// variant is a D-Bus variant, a value along with its signature.
+type variant struct {
+	sig string
+	v   interface{}
+}
+
+// dictEntry is a D-Bus dictionary entry, dictionaries are arrays of these.
+type dictEntry struct {
+	k interface{}
+	v interface{}
+}
+
+type message struct {
+	typ         byte
+	flags       byte
+	serial      uint32
+	replySerial uint32
+	path        string
+	iface       string
+	member      string
+	errName     string
+	dest        string
+	sender      string
+	sig         string
+	body        []interface{}
+}
+
+// nextType splits the first complete type off of the signature sig.
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errMalformedMessage
+	}
+	switch sig[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 'h', 's', 'o', 'g', 'v':
+		return sig[:1], sig[1:], nil
+	case 'a':
+		t, rest, err := nextType(sig[1:])
+		if err != nil {
+			return "", "", err
+		}
+		return "a" + t, rest, nil
+	case '(', '{':
+		closer := byte(')')
+		if sig[0] == '{' {
+			closer = '}'
+		}
+		i := 1
+		for i < len(sig) && sig[i] != closer {
+			_, rest, err := nextType(sig[i:])
+			if err != nil {
+				return "", "", err
+			}
+			i = len(sig) - len(rest)
+		}
+		if i >= len(sig) || i == 1 {
+			return "", "", errMalformedMessage
+		}
+		return sig[:i+1], sig[i+1:], nil
+	}
+	return "", "", errMalformedMessage
+}
+
+func splitTypes(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		t, rest, err := nextType(sig)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+		sig = rest
+	}
+	return types, nil
+}
+
+func alignment(t byte) int {
+	switch t {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 4
+}
+
+type decoder struct {
+	order binary.ByteOrder
+	b     []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) align(n int) error {
+	p := (d.pos + n - 1) / n * n
+	if p > len(d.b) {
+		return errMalformedMessage
+	}
+	d.pos = p
+	return nil
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.pos < n {
+		return nil, errMalformedMessage
+	}
+	b := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readUint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) readString(lenSize int) (string, error) {
+	var l int
+	if lenSize == 1 {
+		b, err := d.read(1)
+		if err != nil {
+			return "", err
+		}
+		l = int(b[0])
+	} else {
+		v, err := d.readUint32()
+		if err != nil {
+			return "", err
+		}
+		if v > maxBodyLen {
+			return "", errMalformedMessage
+		}
+		l = int(v)
+	}
+	b, err := d.read(l + 1)
+	if err != nil {
+		return "", err
+	}
+	if b[l] != 0 || bytes.IndexByte(b[:l], 0) != -1 {
+		return "", errMalformedMessage
+	}
+	return string(b[:l]), nil
+}
+
+func (d *decoder) decode(t string) (interface{}, error) {
+	if d.depth++; d.depth > maxDepth {
+		return nil, errMalformedMessage
+	}
+	defer func() { d.depth-- }()
+
+	if err := d.align(alignment(t[0])); err != nil {
+		return nil, err
+	}
+	switch t[0] {
+	case 'y':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		v, err := d.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if v > 1 {
+			return nil, errMalformedMessage
+		}
+		return v == 1, nil
+	case 'n', 'q':
+		b, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint16(b)
+		if t[0] == 'n' {
+			return int16(v), nil
+		}
+		return v, nil
+	case 'i', 'u', 'h':
+		v, err := d.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if t[0] == 'i' {
+			return int32(v), nil
+		}
+		return v, nil
+	case 'x', 't', 'd':
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(b)
+		switch t[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's', 'o':
+		return d.readString(4)
+	case 'g':
+		return d.readString(1)
+	case 'v':
+		sig, err := d.readString(1)
+		if err != nil {
+			return nil, err
+		}
+		vt, rest, err := nextType(sig)
+		if err != nil || rest != "" {
+			return nil, errMalformedMessage
+		}
+		v, err := d.decode(vt)
+		if err != nil {
+			return nil, err
+		}
+		return variant{sig, v}, nil
+	case 'a':
+		l, err := d.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if l > maxBodyLen {
+			return nil, errMalformedMessage
+		}
+		if err = d.align(alignment(t[1])); err != nil {
+			return nil, err
+		}
+		end := d.pos + int(l)
+		if end > len(d.b) {
+			return nil, errMalformedMessage
+		}
+		var a []interface{}
+		for d.pos < end {
+			v, err := d.decode(t[1:])
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if d.pos != end {
+			return nil, errMalformedMessage
+		}
+		return a, nil
+	case '(', '{':
+		types, err := splitTypes(t[1 : len(t)-1])
+		if err != nil {
+			return nil, err
+		}
+		var s []interface{}
+		for _, et := range types {
+			v, err := d.decode(et)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		}
+		if t[0] == '{' {
+			if len(s) != 2 {
+				return nil, errMalformedMessage
+			}
+			return dictEntry{s[0], s[1]}, nil
+		}
+		return s, nil
+	}
+	return nil, errMalformedMessage
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) align(n int) {
+	for e.Len()%n != 0 {
+		e.WriteByte(0)
+	}
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+// encode marshals the value v of type t.  Only the types that the portal
+// actually sends are supported, anything else is a programming error.
+func (e *encoder) encode(t string, v interface{}) {
+	e.align(alignment(t[0]))
+	switch t[0] {
+	case 'y':
+		e.WriteByte(v.(byte))
+	case 'b':
+		var u uint32
+		if v.(bool) {
+			u = 1
+		}
+		e.writeUint32(u)
+	case 'u':
+		e.writeUint32(v.(uint32))
+	case 's', 'o':
+		s := v.(string)
+		e.writeUint32(uint32(len(s)))
+		e.WriteString(s)
+		e.WriteByte(0)
+	case 'g':
+		s := v.(string)
+		e.WriteByte(byte(len(s)))
+		e.WriteString(s)
+		e.WriteByte(0)
+	case 'v':
+		vv := v.(variant)
+		e.encode("g", vv.sig)
+		e.encode(vv.sig, vv.v)
+	case 'a':
+		e.writeUint32(0)
+		lenPos := e.Len() - 4
+		e.align(alignment(t[1]))
+		start := e.Len()
+		for _, ev := range v.([]interface{}) {
+			e.encode(t[1:], ev)
+		}
+		binary.LittleEndian.PutUint32(e.Bytes()[lenPos:], uint32(e.Len()-start))
+	case '{':
+		types, _ := splitTypes(t[1 : len(t)-1])
+		de := v.(dictEntry)
+		e.encode(types[0], de.k)
+		e.encode(types[1], de.v)
+	case '(':
+		types, _ := splitTypes(t[1 : len(t)-1])
+		for i, sv := range v.([]interface{}) {
+			e.encode(types[i], sv)
+		}
+	default:
+		panic("portal: unsupported type: " + t)
+	}
+}
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errMalformedMessage
+	}
+	if fixed[3] != protocolVersion {
+		return nil, errMalformedMessage
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	if bodyLen > maxBodyLen || fieldsLen > maxFieldsLen {
+		return nil, errMalformedMessage
+	}
+
+	hdrLen := (16 + int(fieldsLen) + 7) / 8 * 8
+	b := make([]byte, hdrLen+int(bodyLen))
+	copy(b, fixed[:])
+	if _, err := io.ReadFull(r, b[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &message{
+		typ:    fixed[1],
+		flags:  fixed[2],
+		serial: order.Uint32(fixed[8:]),
+	}
+	d := &decoder{order: order, b: b[:16+fieldsLen], pos: 12}
+	fields, err := d.decode("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields.([]interface{}) {
+		s := f.([]interface{})
+		v := s[1].(variant).v
+		var ok bool
+		switch s[0].(byte) {
+		case fieldPath:
+			m.path, ok = v.(string)
+		case fieldInterface:
+			m.iface, ok = v.(string)
+		case fieldMember:
+			m.member, ok = v.(string)
+		case fieldErrorName:
+			m.errName, ok = v.(string)
+		case fieldReplySerial:
+			m.replySerial, ok = v.(uint32)
+		case fieldDestination:
+			m.dest, ok = v.(string)
+		case fieldSender:
+			m.sender, ok = v.(string)
+		case fieldSignature:
+			m.sig, ok = v.(string)
+		case fieldUnixFds:
+			// File descriptor passing is never negotiated.
+			return nil, errMalformedMessage
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errMalformedMessage
+		}
+	}
+
+	types, err := splitTypes(m.sig)
+	if err != nil {
+		return nil, err
+	}
+	d = &decoder{order: order, b: b[hdrLen:]}
+	for _, t := range types {
+		v, err := d.decode(t)
+		if err != nil {
+			return nil, err
+		}
+		m.body = append(m.body, v)
+	}
+	if d.pos != len(d.b) {
+		return nil, errMalformedMessage
+	}
+	return m, nil
+}
+
+func (m *message) marshal() []byte {
+	var body encoder
+	types, err := splitTypes(m.sig)
+	if err != nil || len(types) != len(m.body) {
+		panic(fmt.Sprintf("portal: invalid message signature: '%v'", m.sig))
+	}
+	for i, t := range types {
+		body.encode(t, m.body[i])
+	}
+
+	var fields []interface{}
+	addField := func(code byte, sig string, v interface{}) {
+		fields = append(fields, []interface{}{code, variant{sig, v}})
+	}
+	for _, f := range []struct {
+		code byte
+		sig  string
+		v    string
+	}{
+		{fieldPath, "o", m.path},
+		{fieldInterface, "s", m.iface},
+		{fieldMember, "s", m.member},
+		{fieldErrorName, "s", m.errName},
+		{fieldDestination, "s", m.dest},
+		{fieldSender, "s", m.sender},
+		{fieldSignature, "g", m.sig},
+	} {
+		if f.v != "" {
+			addField(f.code, f.sig, f.v)
+		}
+	}
+	if m.replySerial != 0 {
+		addField(fieldReplySerial, "u", m.replySerial)
+	}
+
+	var e encoder
+	e.Write([]byte{'l', m.typ, m.flags, protocolVersion})
+	e.writeUint32(uint32(body.Len()))
+	e.writeUint32(m.serial)
+	e.encode("a(yv)", fields)
+	e.align(8)
+	e.Write(body.Bytes())
+	return e.Bytes()
+}
+
+// stringDict converts a decoded `a{sv}` into a map, discarding the entries
+// with non-string keys.
+func stringDict(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	a, _ := v.([]interface{})
+	for _, e := range a {
+		de, ok := e.(dictEntry)
+		if !ok {
+			continue
+		}
+		k, ok := de.k.(string)
+		if !ok {
+			continue
+		}
+		if vv, ok := de.v.(variant); ok {
+			m[k] = vv.v
+		}
+	}
+	return m
+}
+
+// byteString converts a decoded nul terminated `ay` into a string.
+func byteString(v interface{}) string {
+	a, _ := v.([]interface{})
+	var b []byte
+	for _, e := range a {
+		c, ok := e.(byte)
+		if !ok || c == 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
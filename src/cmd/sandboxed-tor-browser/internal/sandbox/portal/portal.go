@@ -0,0 +1,669 @@
+// portal.go - File chooser portal surrogate.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package portal implements a launcher side file chooser for the sandboxed
+// browser.
+//
+// The surrogate is a tiny fake D-Bus session bus, that only provides the
+// `org.freedesktop.portal.FileChooser` interface of the desktop portal.
+// Gtk+ will use it for the browser's file choosers when `GTK_USE_PORTAL` is
+// set, and the browser is allowed to use the native file chooser.  The user
+// picks the file with a dialog outside of the sandbox, and only the chosen
+// file is made visible to the browser, via a staging directory.
+//
+// Files being opened are copied into the staging directory.  Saving files
+// anywhere on the host would bypass the download quarantine, so files being
+// saved are written to the save directory (the quarantine) without asking the
+// user, and saving is refused if there is no save directory.
+package portal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	busName     = "org.freedesktop.DBus"
+	portalName  = "org.freedesktop.portal.Desktop"
+	portalOwner = ":1.0"
+	portalPath  = "/org/freedesktop/portal/desktop"
+	requestPath = "/org/freedesktop/portal/desktop/request/"
+
+	fileChooserIface = "org.freedesktop.portal.FileChooser"
+	requestIface     = "org.freedesktop.portal.Request"
+	propertiesIface  = "org.freedesktop.DBus.Properties"
+	peerIface        = "org.freedesktop.DBus.Peer"
+
+	errUnknownMethod  = "org.freedesktop.DBus.Error.UnknownMethod"
+	errServiceUnknown = "org.freedesktop.DBus.Error.ServiceUnknown"
+	errNameHasNoOwner = "org.freedesktop.DBus.Error.NameHasNoOwner"
+	errInvalidArgs    = "org.freedesktop.DBus.Error.InvalidArgs"
+	errAccessDenied   = "org.freedesktop.DBus.Error.AccessDenied"
+
+	// Version 1 of the interface has no support for choosing directories,
+	// so Gtk+ will use the in-sandbox file chooser for those.
+	fileChooserVersion = 1
+
+	responseSuccess   = 0
+	responseCancelled = 1
+	responseOther     = 2
+
+	authTimeout  = 10 * time.Second
+	maxAuthLines = 16
+
+	maxSaveNameTries = 100
+)
+
+var errAuthFailed = errors.New("portal: authentication failed")
+
+// Request is a request from the sandboxed browser to choose a file to open.
+// Reply must be called exactly once.
+type Request struct {
+	// Title is the title the browser wants for the file chooser.
+	Title string
+
+	replyCh chan string
+}
+
+// Reply completes the request with the host path of the file that the user
+// chose, or "" if the user canceled.
+func (r *Request) Reply(path string) {
+	r.replyCh <- path
+}
+
+// Surrogate is a file chooser portal surrogate instance.
+type Surrogate struct {
+	sync.Mutex
+
+	sock           string
+	stagingDir     string
+	sandboxDir     string
+	saveDir        string
+	sandboxSaveDir string
+	guid           string
+
+	l       net.Listener
+	reqCh   chan<- *Request
+	closeCh chan struct{}
+
+	conns  map[*conn]bool
+	nextID uint64
+	closed bool
+}
+
+// New creates a new surrogate listening on the AF_LOCAL socket sock, that
+// stages the chosen files in stagingDir, which the sandbox sees as
+// sandboxDir.  Saved files go to saveDir, which the sandbox sees as
+// sandboxSaveDir, and saving is refused if saveDir is "".  File chooser
+// requests are passed to the UI via reqCh.
+func New(sock, stagingDir, sandboxDir, saveDir, sandboxSaveDir string, reqCh chan<- *Request) (*Surrogate, error) {
+	var guid [16]byte
+	if _, err := io.ReadFull(rand.Reader, guid[:]); err != nil {
+		return nil, err
+	}
+
+	// Nothing from a previous session should be visible.
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stagingDir, DirMode); err != nil {
+		return nil, err
+	}
+
+	// The staging directory is only ever walked without following symbolic
+	// links, starting from the real path.
+	realStagingDir, err := filepath.EvalSymlinks(stagingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Surrogate{
+		sock:           sock,
+		stagingDir:     realStagingDir,
+		sandboxDir:     sandboxDir,
+		saveDir:        saveDir,
+		sandboxSaveDir: sandboxSaveDir,
+		guid:           hex.EncodeToString(guid[:]),
+		reqCh:          reqCh,
+		closeCh:        make(chan struct{}),
+		conns:          make(map[*conn]bool),
+	}
+
+	os.Remove(sock)
+	if s.l, err = net.Listen("unix", sock); err != nil {
+		return nil, err
+	}
+
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Close shuts down the surrogate, and removes the staging directory.
+func (s *Surrogate) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.closeCh)
+
+	s.l.Close()
+	os.Remove(s.sock)
+	for c := range s.conns {
+		c.c.Close()
+	}
+	os.RemoveAll(s.stagingDir)
+}
+
+func (s *Surrogate) acceptLoop() {
+	defer s.l.Close()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		pc := &conn{s: s, c: c, r: bufio.NewReader(c)}
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[pc] = true
+		s.Unlock()
+
+		go func() {
+			pc.run()
+			s.Lock()
+			delete(s.conns, pc)
+			s.Unlock()
+		}()
+	}
+}
+
+func (s *Surrogate) newID() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Surrogate) serviceRequest(c *conn, handle string, req *Request) {
+	select {
+	case s.reqCh <- req:
+	case <-s.closeCh:
+		return
+	}
+
+	var path string
+	select {
+	case path = <-req.replyCh:
+	case <-s.closeCh:
+		return
+	}
+	if path == "" {
+		c.respond(handle, responseCancelled, nil)
+		return
+	}
+
+	sPath, err := s.stageOpen(path)
+	if err != nil {
+		log.Printf("sandbox: portal: Failed to stage '%v': %v", path, err)
+		c.respond(handle, responseOther, nil)
+		return
+	}
+	c.respondPath(handle, sPath)
+}
+
+// saveName returns the path, as the sandbox sees it, that the browser should
+// save the file name to, without clobbering existing files in the save
+// directory.
+func (s *Surrogate) saveName(name string) (string, error) {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "download"
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < maxSaveNameTries; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s(%d)%s", base, i, ext)
+		}
+		if _, err := os.Lstat(filepath.Join(s.saveDir, candidate)); os.IsNotExist(err) {
+			return filepath.Join(s.sandboxSaveDir, candidate), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("too many files named '%v'", name)
+}
+
+func (s *Surrogate) newStagingDir() (string, string, error) {
+	name := strconv.FormatUint(s.newID(), 10)
+	dir := filepath.Join(s.stagingDir, name)
+	if err := os.Mkdir(dir, DirMode); err != nil {
+		return "", "", err
+	}
+	return dir, filepath.Join(s.sandboxDir, name), nil
+}
+
+// stageOpen copies the file at path into the staging directory, and returns
+// the path that the sandbox sees it as.
+func (s *Surrogate) stageOpen(path string) (string, error) {
+	in, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if fi, err := in.Stat(); err != nil {
+		return "", err
+	} else if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("not a regular file")
+	}
+
+	dir, sDir, err := s.newStagingDir()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	out, err := s.openStaged(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, FileMode)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+
+	log.Printf("sandbox: portal: Staged '%v' for the browser", path)
+	return filepath.Join(sDir, name), nil
+}
+
+// openStaged opens the file at path in the staging directory, without
+// following symbolic links in any of the components of path, since the
+// staging directory is writable by the sandbox.
+func (s *Surrogate) openStaged(path string, flag int, perm os.FileMode) (*os.File, error) {
+	rel, err := filepath.Rel(s.stagingDir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("not in the staging directory: %v", path)
+	}
+
+	fd, err := syscall.Open(s.stagingDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: s.stagingDir, Err: err}
+	}
+	components := strings.Split(rel, string(filepath.Separator))
+	for _, c := range components[:len(components)-1] {
+		nfd, err := syscall.Openat(fd, c, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(fd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		fd = nfd
+	}
+	defer syscall.Close(fd)
+
+	nfd, err := syscall.Openat(fd, components[len(components)-1], flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(nfd), path), nil
+}
+
+type conn struct {
+	sync.Mutex // Serializes writes.
+
+	s      *Surrogate
+	c      net.Conn
+	r      *bufio.Reader
+	name   string
+	serial uint32
+}
+
+func (c *conn) run() {
+	defer c.c.Close()
+
+	if err := c.authenticate(); err != nil {
+		Debugf("sandbox: portal: Failed to authenticate client: %v", err)
+		return
+	}
+
+	for {
+		m, err := readMessage(c.r)
+		if err != nil {
+			if err != io.EOF {
+				Debugf("sandbox: portal: Failed to read message: %v", err)
+			}
+			return
+		}
+		if m.typ != msgMethodCall {
+			continue
+		}
+
+		// The first call on a connection must be `Hello`.
+		if c.name == "" && (m.dest != busName || m.member != "Hello") {
+			c.replyError(m, errAccessDenied, "Client tried to send a message other than Hello without being registered")
+			return
+		}
+		c.handle(m)
+	}
+}
+
+// authenticate handles the SASL exchange.  Everything in the sandbox runs as
+// the same user, so all EXTERNAL authentication attempts are accepted.
+func (c *conn) authenticate() error {
+	c.c.SetDeadline(time.Now().Add(authTimeout))
+	defer c.c.SetDeadline(time.Time{})
+
+	if b, err := c.r.ReadByte(); err != nil {
+		return err
+	} else if b != 0 {
+		return errAuthFailed
+	}
+
+	authed, waitingData := false, false
+	for i := 0; i < maxAuthLines; i++ {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		cmd := strings.Fields(string(line))
+		if len(cmd) == 0 {
+			cmd = []string{""}
+		}
+
+		var resp string
+		switch {
+		case cmd[0] == "AUTH" && len(cmd) > 1 && cmd[1] == "EXTERNAL":
+			if len(cmd) == 2 {
+				resp, waitingData = "DATA", true
+			} else {
+				resp, authed = "OK "+c.s.guid, true
+			}
+		case cmd[0] == "AUTH", cmd[0] == "CANCEL":
+			resp, authed, waitingData = "REJECTED EXTERNAL", false, false
+		case cmd[0] == "DATA" && waitingData:
+			resp, authed, waitingData = "OK "+c.s.guid, true, false
+		case cmd[0] == "BEGIN" && authed:
+			return nil
+		default:
+			// Includes `NEGOTIATE_UNIX_FD`, since there is no reason to
+			// support passing file descriptors.
+			resp = "ERROR"
+		}
+		if _, err = c.c.Write([]byte(resp + "\r\n")); err != nil {
+			return err
+		}
+	}
+	return errAuthFailed
+}
+
+func (c *conn) handle(m *message) {
+	switch {
+	case m.iface == peerIface && m.member == "Ping":
+		c.reply(m, "")
+	case m.dest == busName:
+		c.handleBus(m)
+	case m.dest == portalName || m.dest == portalOwner:
+		c.handlePortal(m)
+	default:
+		c.replyError(m, errServiceUnknown, "The name %v was not provided by any .service files", m.dest)
+	}
+}
+
+func (c *conn) handleBus(m *message) {
+	nameArg := func() (string, bool) {
+		if len(m.body) == 0 {
+			return "", false
+		}
+		s, ok := m.body[0].(string)
+		return s, ok
+	}
+	nameOwner := func(name string) string {
+		switch name {
+		case busName:
+			return busName
+		case portalName, portalOwner:
+			return portalOwner
+		case c.name:
+			return c.name
+		}
+		return ""
+	}
+
+	switch m.member {
+	case "Hello":
+		if c.name != "" {
+			c.replyError(m, errAccessDenied, "Already handled an Hello message")
+			return
+		}
+		c.name = fmt.Sprintf(":1.%d", c.s.newID())
+		c.reply(m, "s", c.name)
+	case "AddMatch", "RemoveMatch":
+		// Signals are only ever sent to the connection that is waiting for
+		// them, so match rules are irrelevant.
+		c.reply(m, "")
+	case "RequestName", "ReleaseName":
+		// Pretend to succeed, nothing else is on the bus to care.
+		c.reply(m, "u", uint32(1))
+	case "GetNameOwner":
+		name, _ := nameArg()
+		if owner := nameOwner(name); owner != "" {
+			c.reply(m, "s", owner)
+		} else {
+			c.replyError(m, errNameHasNoOwner, "Could not get owner of name '%v': no such name", name)
+		}
+	case "NameHasOwner":
+		name, _ := nameArg()
+		c.reply(m, "b", nameOwner(name) != "")
+	case "StartServiceByName":
+		if name, _ := nameArg(); name == portalName {
+			c.reply(m, "u", uint32(2)) // DBUS_START_REPLY_ALREADY_RUNNING
+		} else {
+			c.replyError(m, errServiceUnknown, "The name %v was not provided by any .service files", name)
+		}
+	case "GetId":
+		c.reply(m, "s", c.s.guid)
+	case "ListNames":
+		c.reply(m, "as", []interface{}{busName, portalName, portalOwner, c.name})
+	case "ListActivatableNames":
+		c.reply(m, "as", []interface{}{busName})
+	default:
+		c.replyError(m, errUnknownMethod, "Method %v is not supported", m.member)
+	}
+}
+
+func (c *conn) handlePortal(m *message) {
+	switch {
+	case m.path == portalPath && m.iface == propertiesIface && m.member == "Get" && m.sig == "ss":
+		if m.body[0].(string) == fileChooserIface && m.body[1].(string) == "version" {
+			c.reply(m, "v", variant{"u", uint32(fileChooserVersion)})
+		} else {
+			c.replyError(m, errInvalidArgs, "No such property '%v'", m.body[1])
+		}
+	case m.path == portalPath && m.iface == propertiesIface && m.member == "GetAll" && m.sig == "s":
+		props := []interface{}{}
+		if m.body[0].(string) == fileChooserIface {
+			props = append(props, dictEntry{"version", variant{"u", uint32(fileChooserVersion)}})
+		}
+		c.reply(m, "a{sv}", props)
+	case m.path == portalPath && (m.iface == fileChooserIface || m.iface == "") && m.sig == "ssa{sv}" && (m.member == "OpenFile" || m.member == "SaveFile"):
+		c.onFileChooser(m, m.member == "SaveFile")
+	case strings.HasPrefix(m.path, requestPath) && m.iface == requestIface && m.member == "Close":
+		// The dialog is up to the user to dismiss.
+		c.reply(m, "")
+	default:
+		c.replyError(m, errUnknownMethod, "Method %v.%v is not supported", m.iface, m.member)
+	}
+}
+
+func (c *conn) onFileChooser(m *message, save bool) {
+	opts := stringDict(m.body[2])
+	req := &Request{
+		Title:   m.body[1].(string),
+		replyCh: make(chan string, 1),
+	}
+	if save && c.s.saveDir == "" {
+		log.Printf("sandbox: portal: Refusing to save a file, saving is disabled")
+		c.replyError(m, errAccessDenied, "Saving files is disabled")
+		return
+	}
+
+	// Gtk+ subscribes to the response signal before making the call, by
+	// guessing the request handle based on the token it supplies.
+	token, _ := opts["handle_token"].(string)
+	if !isValidToken(token) {
+		token = fmt.Sprintf("stb%d", c.s.newID())
+	}
+	sender := strings.Replace(strings.TrimPrefix(c.name, ":"), ".", "_", -1)
+	handle := requestPath + sender + "/" + token
+	c.reply(m, "o", handle)
+
+	if multiple, _ := opts["multiple"].(bool); multiple {
+		Debugf("sandbox: portal: Only a single file can be chosen at a time")
+	}
+	if directory, _ := opts["directory"].(bool); directory {
+		c.respond(handle, responseOther, nil)
+		return
+	}
+	if save {
+		// There is nothing for the user to choose, the file is saved to the
+		// save directory under the name the browser suggested.
+		currentName, _ := opts["current_name"].(string)
+		sPath, err := c.s.saveName(currentName)
+		if err != nil {
+			log.Printf("sandbox: portal: Failed to pick a name for '%v': %v", currentName, err)
+			c.respond(handle, responseOther, nil)
+			return
+		}
+		c.respondPath(handle, sPath)
+		return
+	}
+	go c.s.serviceRequest(c, handle, req)
+}
+
+func isValidToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, r := range token {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *conn) send(m *message) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.serial++
+	m.serial = c.serial
+	if _, err := c.c.Write(m.marshal()); err != nil {
+		Debugf("sandbox: portal: Failed to write message: %v", err)
+		c.c.Close()
+	}
+}
+
+func (c *conn) reply(m *message, sig string, body ...interface{}) {
+	if m.flags&flagNoReplyExpected != 0 {
+		return
+	}
+	sender := busName
+	if m.dest != busName {
+		sender = portalOwner
+	}
+	c.send(&message{
+		typ:         msgMethodReturn,
+		replySerial: m.serial,
+		dest:        c.name,
+		sender:      sender,
+		sig:         sig,
+		body:        body,
+	})
+}
+
+func (c *conn) replyError(m *message, name, format string, a ...interface{}) {
+	if m.flags&flagNoReplyExpected != 0 {
+		return
+	}
+	sender := busName
+	if m.dest != busName {
+		sender = portalOwner
+	}
+	c.send(&message{
+		typ:         msgError,
+		replySerial: m.serial,
+		errName:     name,
+		dest:        c.name,
+		sender:      sender,
+		sig:         "s",
+		body:        []interface{}{fmt.Sprintf(format, a...)},
+	})
+}
+
+func (c *conn) respondPath(handle, path string) {
+	uri := &url.URL{Scheme: "file", Path: path}
+	results := []interface{}{
+		dictEntry{"uris", variant{"as", []interface{}{uri.String()}}},
+	}
+	c.respond(handle, responseSuccess, results)
+}
+
+func (c *conn) respond(handle string, response uint32, results []interface{}) {
+	if results == nil {
+		results = []interface{}{}
+	}
+	c.send(&message{
+		typ:    msgSignal,
+		path:   handle,
+		iface:  requestIface,
+		member: "Response",
+		dest:   c.name,
+		sender: portalOwner,
+		sig:    "ua{sv}",
+		body:   []interface{}{response, results},
+	})
+}
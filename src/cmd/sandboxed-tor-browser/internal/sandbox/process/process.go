@@ -28,6 +28,8 @@ import (
 type Process struct {
 	init      *os.Process
 	cmd       *exec.Cmd
+	state     *os.ProcessState
+	killed    bool
 	termHooks []func()
 }
 
@@ -47,6 +49,7 @@ func (p *Process) AddTermHook(fn func()) {
 
 // Kill terminates the bwrap instance and all of it's children.
 func (p *Process) Kill() {
+	p.killed = true
 	if p.init != nil {
 		p.init.Kill()
 		p.init = nil
@@ -63,13 +66,35 @@ func (p *Process) Kill() {
 func (p *Process) Wait() error {
 	// Can't wait on the init process since it's a grandchild.
 	if p.cmd != nil {
-		p.cmd.Process.Wait()
+		p.state, _ = p.cmd.Process.Wait()
 		p.cmd = nil
 		p.onExit()
 	}
 	return nil
 }
 
+// Signal returns the signal that terminated the sandboxed application, or 0
+// if it is still running, exited normally, or was terminated with Kill.
+func (p *Process) Signal() syscall.Signal {
+	if p.state == nil || p.killed {
+		return 0
+	}
+	ws, ok := p.state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0
+	}
+
+	// bubblewrap exits with 128 + the signal number if the application was
+	// terminated by a signal.
+	switch {
+	case ws.Signaled():
+		return ws.Signal()
+	case ws.Exited() && ws.ExitStatus() > 128 && ws.ExitStatus() < 128+65:
+		return syscall.Signal(ws.ExitStatus() - 128)
+	}
+	return 0
+}
+
 // Running returns true if the bwrap instance is running.
 func (p *Process) Running() bool {
 	wpid, err := syscall.Wait4(p.cmd.Process.Pid, nil, syscall.WNOHANG, nil)
@@ -0,0 +1,687 @@
+// profile.go - Declarative sandbox profiles.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/sandbox/egress"
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	// NetworkNone gives the application no network access at all.
+	NetworkNone = "none"
+
+	// NetworkHost gives the application the host's network.
+	NetworkHost = "host"
+
+	// NetworkTor gives the application access to tor's SOCKS and control
+	// ports at the usual Tor Browser locations, via the AF_LOCAL
+	// compatibility stub, and nothing else.
+	NetworkTor = "tor"
+
+	// ProcMount mounts a new `/proc`.
+	ProcMount = "mount"
+
+	// ProcFake provides the bare minimum of a fake `/proc` for Firefox.
+	ProcFake = "fake"
+
+	// ProcNone provides no `/proc` at all.
+	ProcNone = "none"
+
+	profileAssetDir = "profiles"
+	appDataSubDir   = "apps"
+)
+
+// Profile is a declarative description of a sandboxed application.  All of
+// the strings, other than the environment variable names, may reference
+// variables with the `${Name}` syntax.  `Arch` (eg: `amd64`), `Home` and
+// `XdgRuntimeDir` (both inside the sandbox), and `BundleInstallDir` and
+// `UserDataDir` (both on the host) are always defined, and whatever is
+// launched with the profile may define more.
+type Profile struct {
+	// Name is the name of the profile, which is also used to tag the
+	// application's log output.
+	Name string `json:"name"`
+
+	// Command is the path to the executable inside the sandbox, and Args
+	// are the arguments it is invoked with.
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+
+	// Chdir is the working directory inside the sandbox.
+	Chdir string `json:"chdir,omitempty"`
+
+	// Hostname overrides the default sandbox hostname.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Namespaces overrides which namespaces are unshared.  The PID namespace
+	// is always unshared, and the network namespace is set via Network.
+	Namespaces ProfileNamespaces `json:"namespaces"`
+
+	// Network is the network access mode (`none`, `host` or `tor`),
+	// defaulting to `none`.
+	Network string `json:"network,omitempty"`
+
+	// Proc is how `/proc` is provided (`mount`, `fake` or `none`),
+	// defaulting to `mount`.
+	Proc string `json:"proc,omitempty"`
+
+	// FakeDbus provides a fake D-Bus machine ID.
+	FakeDbus bool `json:"fakeDbus,omitempty"`
+
+	// X11 is the name of the X11 surrogate socket, under the launcher's
+	// runtime directory.  X11 is not available if this is empty.
+	X11 string `json:"x11,omitempty"`
+
+	// PulseAudio proxies the host's PulseAudio socket, if the user has
+	// enabled audio.
+	PulseAudio bool `json:"pulseAudio,omitempty"`
+
+	// Gtk2 provides the Gtk+-2.0 theme, and the theme engine libraries.
+	Gtk2 bool `json:"gtk2,omitempty"`
+
+	// Seccomp are the seccomp whitelist assets to combine, or no whitelist
+	// if empty.
+	Seccomp []string `json:"seccomp,omitempty"`
+
+	// Filesystem are the filesystem operations, in the order they are
+	// applied.
+	Filesystem []ProfileMount `json:"filesystem,omitempty"`
+
+	// Env are the environment variables.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Libraries are the libraries to resolve via the dynamic linker cache.
+	// The host's library directories are made available in their entirety
+	// if this is nil.
+	Libraries *ProfileLibraries `json:"libraries,omitempty"`
+}
+
+// ProfileNamespaces are the overrides to the default set of namespaces.
+// Fields that are not set keep the default.
+type ProfileNamespaces struct {
+	User   *bool `json:"user,omitempty"`
+	IPC    *bool `json:"ipc,omitempty"`
+	UTS    *bool `json:"uts,omitempty"`
+	Cgroup *bool `json:"cgroup,omitempty"`
+}
+
+// ProfileMount is a single filesystem operation.
+type ProfileMount struct {
+	// Type is the operation.  `bind` and `ro-bind` bind mount the host's
+	// Src at Dest (or Src if not set), `tmpfs` and `dir` create Dest,
+	// `symlink` creates Dest pointing to Src, and `file` creates Dest with
+	// the contents of the embedded Asset, or the host's Src.  `hook`
+	// applies the launcher's operations called Name, for the things that
+	// can't be described statically.
+	Type string `json:"type"`
+
+	Src  string `json:"src,omitempty"`
+	Dest string `json:"dest,omitempty"`
+
+	Asset string `json:"asset,omitempty"`
+	Name  string `json:"name,omitempty"`
+
+	// Optional skips the operation if Src does not exist.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// ProfileLibraries are the libraries to be resolved via the dynamic linker
+// cache, and bind mounted into the sandbox.
+type ProfileLibraries struct {
+	// Binaries are the host paths to the executables and libraries, whose
+	// dependencies are required.  Glob patterns are allowed.
+	Binaries []string `json:"binaries"`
+
+	// Extra are the libraries that are dlopen()ed at runtime.
+	Extra []string `json:"extra,omitempty"`
+
+	// SearchPath is the additional host library search path.
+	SearchPath []string `json:"searchPath,omitempty"`
+
+	// LdLibraryPath is the sandbox `LD_LIBRARY_PATH`, that the restricted
+	// library directory gets appended to.
+	LdLibraryPath []string `json:"ldLibraryPath,omitempty"`
+
+	// OpenGL provides the software OpenGL implementation.
+	OpenGL bool `json:"openGL,omitempty"`
+}
+
+func (p *Profile) validate() error {
+	if p.Name == "" || p.Name != filepath.Base(p.Name) || strings.HasPrefix(p.Name, ".") {
+		return fmt.Errorf("sandbox: invalid profile name: '%v'", p.Name)
+	}
+	if p.Command == "" {
+		return fmt.Errorf("sandbox: profile '%v': no command", p.Name)
+	}
+	switch p.Network {
+	case "", NetworkNone, NetworkHost, NetworkTor:
+	default:
+		return fmt.Errorf("sandbox: profile '%v': invalid network mode: '%v'", p.Name, p.Network)
+	}
+	switch p.Proc {
+	case "", ProcMount, ProcFake, ProcNone:
+	default:
+		return fmt.Errorf("sandbox: profile '%v': invalid proc mode: '%v'", p.Name, p.Proc)
+	}
+	for i, m := range p.Filesystem {
+		var ok bool
+		switch m.Type {
+		case "bind", "ro-bind":
+			ok = m.Src != ""
+		case "tmpfs", "dir":
+			ok = m.Dest != ""
+		case "symlink":
+			ok = m.Src != "" && m.Dest != ""
+		case "file":
+			ok = m.Dest != "" && (m.Src == "") != (m.Asset == "")
+		case "hook":
+			ok = m.Name != ""
+		}
+		if !ok {
+			return fmt.Errorf("sandbox: profile '%v': invalid filesystem entry %d: '%v'", p.Name, i, m.Type)
+		}
+	}
+	if p.Libraries != nil && len(p.Libraries.Binaries) == 0 {
+		return fmt.Errorf("sandbox: profile '%v': no binaries to resolve libraries for", p.Name)
+	}
+	return nil
+}
+
+func parseProfile(b []byte) (*Profile, error) {
+	p := new(Profile)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadProfile loads the profile at path.
+func LoadProfile(path string) (*Profile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfile(b)
+}
+
+func builtinProfile(name string) (*Profile, error) {
+	b, err := data.Asset(profileAssetDir + "/" + name + ".json")
+	if err != nil {
+		return nil, err
+	}
+	return parseProfile(b)
+}
+
+// profileLaunch is a hugbox being configured from a profile.
+type profileLaunch struct {
+	h    *hugbox
+	p    *Profile
+	cfg  *config.Config
+	vars map[string]string
+
+	seccompAssets   []string
+	cache           *dynlib.Cache
+	hasAdwaita      bool
+	pulseAudioWorks bool
+	termHooks       []func()
+	mode            launchMode
+	egressPolicy    *egress.Policy
+}
+
+// launchMode is what a profileLaunch is for.
+type launchMode int
+
+const (
+	// launchNormal launches the application.
+	launchNormal launchMode = iota
+
+	// launchDryRun only explains the sandbox, so tor does not need to be
+	// running, and nothing is launched.
+	launchDryRun
+
+	// launchSelfTest launches the sandbox with something other than the
+	// application, that does not need any of the surrogates.
+	launchSelfTest
+)
+
+// newProfileLaunch creates a hugbox, and applies everything in the profile,
+// other than the filesystem and the libraries, which need to be done with
+// appendFilesystem and appendLibraries respectively.  Unless mode is
+// launchNormal, tor does not need to be running.
+func newProfileLaunch(cfg *config.Config, p *Profile, vars map[string]string, t *tor.Tor, mode launchMode) (*profileLaunch, error) {
+	h, err := newHugbox(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.dryRun = mode == launchDryRun
+	h.noSurrogates = mode == launchSelfTest
+	l := &profileLaunch{
+		h:    h,
+		p:    p,
+		cfg:  cfg,
+		mode: mode,
+	}
+
+	ns := p.Namespaces
+	if ns.User != nil && !*ns.User && h.unshare.user {
+		h.unshare.user = false
+		h.runtimeDir = filepath.Join("/run", "user", fmt.Sprintf("%d", os.Getuid()))
+	}
+	if ns.IPC != nil {
+		h.unshare.ipc = *ns.IPC
+	}
+	if ns.UTS != nil {
+		h.unshare.uts = *ns.UTS
+		if !h.unshare.uts {
+			h.hostname = ""
+		}
+	}
+	if ns.Cgroup != nil {
+		h.unshare.cgroup = *ns.Cgroup
+	}
+
+	l.vars = map[string]string{
+		"Arch":             runtime.GOARCH,
+		"Home":             h.homeDir,
+		"XdgRuntimeDir":    h.runtimeDir,
+		"BundleInstallDir": cfg.BundleInstallDir,
+		"UserDataDir":      cfg.UserDataDir,
+	}
+	for k, v := range vars {
+		l.vars[k] = v
+	}
+
+	logger := newConsoleLogger(p.Name)
+	h.stdout = logger
+	h.stderr = logger
+	if p.Hostname != "" {
+		h.hostname = l.expand(p.Hostname)
+	}
+	if len(p.Seccomp) > 0 {
+		l.seccompAssets = l.expandAll(p.Seccomp)
+		h.seccompFn = func(fd *os.File) error {
+			return installSeccomp(fd, l.seccompAssets)
+		}
+	}
+	switch p.Proc {
+	case ProcFake:
+		h.mountProc = false
+		h.fakeProc = true
+	case ProcNone:
+		h.mountProc = false
+	}
+	h.fakeDbus = p.FakeDbus
+
+	switch p.Network {
+	case NetworkHost:
+		h.unshare.net = false
+	case NetworkTor:
+		switch {
+		case t != nil:
+			h.appendTorStub(t.CtrlSurrogatePath(), t.SocksSurrogatePath())
+		case mode != launchNormal:
+			h.appendTorStub(tor.SurrogatePaths(cfg))
+		default:
+			return nil, fmt.Errorf("sandbox: profile '%v': tor is not running", p.Name)
+		}
+	}
+
+	if p.Gtk2 {
+		l.hasAdwaita = h.appendGtk2Theme()
+	}
+	if p.PulseAudio && cfg.Sandbox.EnablePulseAudio {
+		if err = h.enablePulseAudio(); err != nil {
+			log.Printf("sandbox: failed to proxy PulseAudio: %v", err)
+		} else {
+			l.pulseAudioWorks = true
+		}
+	}
+
+	// Ensure that the environment is set in a consistent order.
+	var keys []string
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.setenv(k, l.expand(p.Env[k]))
+	}
+
+	h.chdir = l.expand(p.Chdir)
+	h.cmd = l.expand(p.Command)
+	h.cmdArgs = l.expandAll(p.Args)
+
+	return l, nil
+}
+
+func (l *profileLaunch) expand(s string) string {
+	return os.Expand(s, func(k string) string {
+		v, ok := l.vars[k]
+		if !ok {
+			panic(fmt.Errorf("sandbox: profile '%v': undefined variable: '%v'", l.p.Name, k))
+		}
+		return v
+	})
+}
+
+func (l *profileLaunch) expandAll(s []string) []string {
+	var ret []string
+	for _, v := range s {
+		ret = append(ret, l.expand(v))
+	}
+	return ret
+}
+
+// appendFilesystem applies the profile's filesystem operations, calling the
+// named hooks for the operations that can't be described statically.
+func (l *profileLaunch) appendFilesystem(hooks map[string]func() error) error {
+	h := l.h
+	for _, m := range l.p.Filesystem {
+		src, dest := l.expand(m.Src), l.expand(m.Dest)
+		if dest == "" {
+			dest = src
+		}
+
+		switch m.Type {
+		case "bind":
+			h.bind(src, dest, m.Optional)
+		case "ro-bind":
+			h.roBind(src, dest, m.Optional)
+		case "tmpfs":
+			h.tmpfs(dest)
+		case "dir":
+			h.dir(dest)
+		case "symlink":
+			h.symlink(src, dest)
+		case "file":
+			if m.Asset != "" {
+				h.assetFile(dest, l.expand(m.Asset))
+				continue
+			}
+			b, err := ioutil.ReadFile(src)
+			if err != nil {
+				if m.Optional && os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			h.file(dest, b)
+		case "hook":
+			fn, ok := hooks[m.Name]
+			if !ok {
+				return fmt.Errorf("sandbox: profile '%v': undefined hook: '%v'", l.p.Name, m.Name)
+			}
+			if err := fn(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// libraryCache returns the dynamic linker cache, loading it if needed.
+func (l *profileLaunch) libraryCache() (*dynlib.Cache, error) {
+	if l.cache == nil {
+		cache, err := dynlib.LoadCache()
+		if err != nil {
+			return nil, err
+		}
+		l.cache = cache
+	}
+	return l.cache, nil
+}
+
+// appendLibraries resolves and binds the profile's libraries along with
+// extraLibs, and sets `LD_LIBRARY_PATH`.
+func (l *profileLaunch) appendLibraries(extraLibs []string, filterFn dynlib.FilterFunc) error {
+	h, libs := l.h, l.p.Libraries
+	if libs == nil {
+		return nil
+	}
+
+	extraLdLibraryPath := ""
+	if dynlib.IsSupported() {
+		cache, err := l.libraryCache()
+		if err != nil {
+			return err
+		}
+
+		var binaries []string
+		for _, v := range l.expandAll(libs.Binaries) {
+			if !strings.ContainsAny(v, "*?[") {
+				binaries = append(binaries, v)
+				continue
+			}
+			matches, err := filepath.Glob(v)
+			if err != nil {
+				return err
+			}
+			binaries = append(binaries, matches...)
+		}
+		extraLibs = append(l.expandAll(libs.Extra), extraLibs...)
+		ldLibraryPath := strings.Join(l.expandAll(libs.SearchPath), ":")
+		extraLdLibraryPath = ":" + restrictedLibDir
+
+		if libs.OpenGL {
+			glExtraLibs, glLibPaths := h.appendRestrictedOpenGL()
+			extraLibs = append(extraLibs, glExtraLibs...)
+			ldLibraryPath = ldLibraryPath + glLibPaths
+		}
+
+		if l.pulseAudioWorks {
+			paLibs, paPath, paExtraPath, err := h.appendRestrictedPulseAudio(cache)
+			if err != nil {
+				log.Printf("sandbox: Failed to find PulseAudio libraries: %v", err)
+			} else {
+				extraLibs = append(extraLibs, paLibs...)
+				ldLibraryPath = ldLibraryPath + paPath
+				extraLdLibraryPath = extraLdLibraryPath + paExtraPath
+			}
+		}
+
+		// Gtk uses plugin libraries and shit for theming, and expecting
+		// them to be in consistent locations, is too much to ask for.
+		if l.p.Gtk2 {
+			gtkExtraLibs, gtkLibPaths, err := h.appendRestrictedGtk2(l.hasAdwaita)
+			if err != nil {
+				return err
+			}
+			extraLibs = append(extraLibs, gtkExtraLibs...)
+			ldLibraryPath = ldLibraryPath + gtkLibPaths
+		}
+
+		if err := h.appendLibraries(cache, binaries, extraLibs, strings.TrimPrefix(ldLibraryPath, ":"), filterFn); err != nil {
+			return err
+		}
+	}
+	h.setenv("LD_LIBRARY_PATH", strings.Join(l.expandAll(libs.LdLibraryPath), ":")+extraLdLibraryPath)
+
+	return nil
+}
+
+// addTermHook registers a function to be called when the sandbox exits, or
+// fails to launch.
+func (l *profileLaunch) addTermHook(fn func()) {
+	l.termHooks = append(l.termHooks, fn)
+}
+
+func (l *profileLaunch) runTermHooks() {
+	for _, fn := range l.termHooks {
+		fn()
+	}
+}
+
+// appendX11 sets up X11, which is done last because of the surrogate, that
+// is not launched in dry-run mode.  Self-tests do not get X11 at all.
+func (l *profileLaunch) appendX11() error {
+	h := l.h
+	if l.p.X11 == "" || l.mode == launchSelfTest {
+		return nil
+	}
+
+	x11SurrogatePath := filepath.Join(l.cfg.RuntimeDir, l.expand(l.p.X11))
+	x, err := x11.New(l.cfg.Sandbox.Display, h.hostname, x11SurrogatePath)
+	if err != nil {
+		return err
+	}
+	h.setenv("DISPLAY", x.Display)
+	h.dir(x11.SockDir)
+	if x.Xauthority != nil {
+		xauthPath := filepath.Join(h.homeDir, ".Xauthority")
+		h.setenv("XAUTHORITY", xauthPath)
+		h.file(xauthPath, x.Xauthority)
+	}
+	if h.dryRun {
+		h.surrogateBind(x11SurrogatePath, filepath.Join(x11.SockDir, "X0"))
+		return nil
+	}
+	if err = x.LaunchSurrogate(); err != nil {
+		return err
+	}
+	l.addTermHook(func() {
+		if x.Surrogate != nil {
+			Debugf("sandbox: X11: Cleaning up surrogate")
+			x.Surrogate.Close()
+		}
+	})
+	h.bind(x.Socket(), filepath.Join(x11.SockDir, "X0"), false)
+	return nil
+}
+
+// run launches the sandbox.
+func (l *profileLaunch) run() (*Process, error) {
+	if err := l.appendX11(); err != nil {
+		l.runTermHooks()
+		return nil, err
+	}
+
+	proc, err := l.h.run()
+	if err != nil {
+		l.runTermHooks()
+		return nil, err
+	}
+	for _, fn := range l.termHooks {
+		proc.AddTermHook(fn)
+	}
+	return proc, nil
+}
+
+// explain describes the sandbox instead of launching it.
+func (l *profileLaunch) explain() (*Explanation, error) {
+	defer l.runTermHooks()
+
+	if err := l.appendX11(); err != nil {
+		return nil, err
+	}
+	e, err := l.h.explain()
+	if err != nil {
+		return nil, err
+	}
+	e.Profile = l.p.Name
+	if e.Seccomp != nil {
+		e.Seccomp.Assets = l.seccompAssets
+	}
+	e.Egress = l.egressPolicy
+	return e, nil
+}
+
+// appendTorStub injects the AF_LOCAL compatibility hack stub into the
+// filesystem, and supplies the relevant args required for functionality.
+func (h *hugbox) appendTorStub(ctrlSurrogatePath, socksSurrogatePath string) {
+	const (
+		stubPath      = "/home/amnesia/.tbb_stub.so"
+		controlSocket = "control"
+		socksSocket   = "socks"
+	)
+
+	ctrlPath := filepath.Join(h.runtimeDir, controlSocket)
+	socksPath := filepath.Join(h.runtimeDir, socksSocket)
+	h.setenv("TOR_STUB_CONTROL_SOCKET", ctrlPath)
+	h.setenv("TOR_STUB_SOCKS_SOCKET", socksPath)
+	h.surrogateBind(ctrlSurrogatePath, ctrlPath)
+	h.surrogateBind(socksSurrogatePath, socksPath)
+	h.assetFile(stubPath, "tbb_stub.so")
+
+	h.setenv("LD_PRELOAD", stubPath)
+}
+
+// appendEgressStub injects the AF_LOCAL compatibility hack stub into the
+// filesystem in egress mode, where all TCP connections are made via the
+// egress surrogate.
+func (h *hugbox) appendEgressStub(egressSurrogatePath string) {
+	const (
+		stubPath     = "/home/amnesia/.tbb_stub.so"
+		egressSocket = "egress"
+	)
+
+	egressPath := filepath.Join(h.runtimeDir, egressSocket)
+	h.setenv("TOR_STUB_EGRESS_SOCKET", egressPath)
+	h.surrogateBind(egressSurrogatePath, egressPath)
+	h.assetFile(stubPath, "tbb_stub.so")
+
+	h.setenv("LD_PRELOAD", stubPath)
+}
+
+// RunProfile launches the application described by the profile p, with a
+// private persistent data directory available as `${AppDataDir}`.
+func RunProfile(cfg *config.Config, t *tor.Tor, p *Profile) (process *Process, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if err = p.validate(); err != nil {
+		return nil, err
+	}
+	realAppDataDir := filepath.Join(cfg.UserDataDir, appDataSubDir, p.Name)
+	if err = os.MkdirAll(realAppDataDir, DirMode); err != nil {
+		return nil, err
+	}
+
+	l, err := newProfileLaunch(cfg, p, map[string]string{"AppDataDir": realAppDataDir}, t, launchNormal)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.appendFilesystem(nil); err != nil {
+		return nil, err
+	}
+	if err = l.appendLibraries(nil, nil); err != nil {
+		return nil, err
+	}
+	return l.run()
+}
@@ -16,7 +16,10 @@
 
 package sandbox
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 func lowerRlimit(resource int, newHard uint64) error {
 	var lim syscall.Rlimit
@@ -40,10 +43,49 @@ func lowerRlimit(resource int, newHard uint64) error {
 	return syscall.Setrlimit(resource, &lim)
 }
 
+func prlimit(pid, resource int, newLim, oldLim *syscall.Rlimit) error {
+	_, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(newLim)), uintptr(unsafe.Pointer(oldLim)), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// lowerProcessRlimits lowers the rlimits of another process, in the same
+// manner as lowerRlimit.
+func lowerProcessRlimits(pid int, limits map[int]uint64) error {
+	for resource, newHard := range limits {
+		var lim syscall.Rlimit
+		if err := prlimit(pid, resource, nil, &lim); err != nil {
+			return err
+		}
+
+		needsSet := false
+		if newHard < lim.Max {
+			lim.Max = newHard
+			needsSet = true
+		}
+		if newHard < lim.Cur {
+			lim.Cur = newHard
+			needsSet = true
+		}
+		if !needsSet {
+			continue
+		}
+
+		if err := prlimit(pid, resource, &lim, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // SetSensibleRlimits conservatively lowers the rlimits to values that will
-// happily support firefox, the updater, tor, and obfs4proxy.
+// happily support firefox, the updater, tor, and the pluggable transports.
 //
 // XXX; In the future, this should be applied to each process individually.
+// The pluggable transports get further restricted via `hugbox.rlimits`, but
 // I still need to think about what I'll do for the things that are unset,
 // because it should be tied into the UI.
 func SetSensibleRlimits() error {
@@ -28,21 +28,17 @@ import (
 	"cmd/sandboxed-tor-browser/internal/data"
 )
 
-func installTorSeccompProfile(fd *os.File, useBridges bool) error {
+func installPluggableTransportSeccompProfile(fd *os.File, bin string) error {
+	// The pluggable transports used to run as children of tor, so their
+	// whitelists are built on top of the tor common rules.
 	commonAssetFile := "tor-common-" + runtime.GOARCH + ".seccomp"
+	assetFile := bin + "-" + runtime.GOARCH + ".seccomp"
 
-	assets := []string{commonAssetFile}
-	if useBridges {
-		assets = append(assets, "tor-obfs4-"+runtime.GOARCH+".seccomp")
-	} else {
-		assets = append(assets, "tor-"+runtime.GOARCH+".seccomp")
-	}
-
-	return installSeccomp(fd, assets)
+	return installSeccomp(fd, []string{commonAssetFile, assetFile})
 }
 
-func installTorBrowserSeccompProfile(fd *os.File) error {
-	assetFile := "torbrowser-" + runtime.GOARCH + ".seccomp"
+func installViewerSeccompProfile(fd *os.File) error {
+	assetFile := "viewer-" + runtime.GOARCH + ".seccomp"
 
 	return installSeccomp(fd, []string{assetFile})
 }
@@ -0,0 +1,222 @@
+// selftest.go - Sandbox self-test.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	probeAsset = "sandbox_probe"
+
+	probeAllowed = "allowed"
+	probeDenied  = "denied"
+	probeError   = "error"
+)
+
+// SelfTestResult is the outcome of a single self-test check.
+type SelfTestResult struct {
+	Profile  string `json:"profile"`
+	Check    string `json:"check"`
+	Expected string `json:"expected"`
+	Result   string `json:"result"`
+	Detail   string `json:"detail,omitempty"`
+	Passed   bool   `json:"passed"`
+}
+
+// probeCheck is a check done by the probe, and the expected result.
+type probeCheck struct {
+	check   string
+	allowed bool
+
+	// detail, if set, is what the probe must report for an allowed check.
+	detail string
+}
+
+func denied(check string) probeCheck {
+	return probeCheck{check: check}
+}
+
+// SelfTest launches a small static probe in place of the application in each
+// of the tor, Tor Browser, and updater sandboxes, and checks that what it can
+// and can not do is as expected.  The sandboxes are built exactly as they
+// would be normally, other than the surrogates, X11 and PaX attributes, none
+// of which the probe needs.
+func SelfTest(cfg *config.Config, manif *config.Manifest) (results []*SelfTestResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	b, err := data.Asset(probeAsset)
+	if err != nil {
+		return nil, err
+	}
+	realProbePath := filepath.Join(cfg.RuntimeDir, probeAsset)
+	if err = ioutil.WriteFile(realProbePath, b, 0700); err != nil {
+		return nil, err
+	}
+	defer os.Remove(realProbePath)
+
+	// The update directory would normally be staged with the MAR file.
+	realUpdateDir, err := ioutil.TempDir(cfg.RuntimeDir, "selftest-update")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(realUpdateDir)
+
+	checks := selfTestChecks(cfg)
+	prepares := []func() (*profileLaunch, error){
+		func() (*profileLaunch, error) {
+			return prepareTor(cfg, nil, nil, launchSelfTest)
+		},
+		func() (*profileLaunch, error) {
+			return prepareTorBrowser(cfg, manif, nil, nil, launchSelfTest)
+		},
+		func() (*profileLaunch, error) {
+			return prepareUpdate(cfg, realUpdateDir, launchSelfTest)
+		},
+	}
+	for _, prepare := range prepares {
+		l, err := prepare()
+		if err != nil {
+			return nil, err
+		}
+		r, err := l.runProbe(realProbePath, checks[l.p.Name])
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: self-test: %v: %v", l.p.Name, err)
+		}
+		results = append(results, r...)
+	}
+
+	return results, nil
+}
+
+// selfTestChecks returns the checks for each of the sandboxes, by profile
+// name.
+func selfTestChecks(cfg *config.Config) map[string][]probeCheck {
+	// Nothing in any of the sandboxes should be able to see the user's
+	// home directory.
+	var homeChecks []probeCheck
+	if home := os.Getenv("HOME"); home != "" {
+		homeChecks = append(homeChecks, denied("read="+home))
+	}
+
+	// tor only has a network namespace of it's own if the user asked for
+	// it, or a proxy or bridges are configured.
+	torChecks := []probeCheck{
+		{check: "socket-inet", allowed: true},
+		denied("proc"),
+		denied("ptrace"),
+		denied("futex-pi"),
+		denied("machine-id"),
+		denied("write=/home/amnesia/tor/bin"),
+	}
+	if cfg.IsolatesTorNetwork() {
+		torChecks = append(torChecks, denied("network"))
+	}
+
+	return map[string][]probeCheck{
+		"tor": append(torChecks, homeChecks...),
+		"torbrowser": append([]probeCheck{
+			denied("socket-inet"),
+			denied("network"),
+			denied("proc"),
+			denied("ptrace"),
+			denied("futex-pi"),
+			{check: "machine-id", allowed: true, detail: fakeMachineID()},
+			denied("write=/home/amnesia/sandboxed-tor-browser/tor-browser"),
+			denied("write=/home/amnesia/sandboxed-tor-browser/tor-browser/Browser"),
+		}, homeChecks...),
+		"update": append([]probeCheck{
+			denied("socket-inet"),
+			denied("network"),
+			denied("ptrace"),
+			denied("futex-pi"),
+		}, homeChecks...),
+	}
+}
+
+// runProbe launches the probe in place of the application, and compares
+// what it reports with checks.
+func (l *profileLaunch) runProbe(realProbePath string, checks []probeCheck) ([]*SelfTestResult, error) {
+	h := l.h
+	probePath := filepath.Join(h.homeDir, "."+probeAsset)
+	h.roBind(realProbePath, probePath, false)
+	h.cmd = probePath
+	h.cmdArgs = nil
+	for _, c := range checks {
+		h.cmdArgs = append(h.cmdArgs, c.check)
+	}
+	stdout := new(bytes.Buffer)
+	h.stdout = stdout
+
+	proc, err := l.run()
+	if err != nil {
+		return nil, err
+	}
+	proc.Wait()
+
+	return parseProbeOutput(l.p.Name, stdout, checks), nil
+}
+
+// parseProbeOutput compares the probe's output with checks.  Each line of
+// output is `<check> allowed|denied|error <detail>`, in the order that the
+// checks were given, and anything missing or malformed is an error.
+func parseProbeOutput(profile string, out io.Reader, checks []probeCheck) []*SelfTestResult {
+	var lines []string
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	var results []*SelfTestResult
+	for i, c := range checks {
+		r := &SelfTestResult{
+			Profile:  profile,
+			Check:    c.check,
+			Expected: probeDenied,
+			Result:   probeError,
+			Detail:   "no result, the probe may have been killed",
+		}
+		if c.allowed {
+			r.Expected = probeAllowed
+		}
+		if i < len(lines) && strings.HasPrefix(lines[i], c.check+" ") {
+			if v := strings.SplitN(strings.TrimPrefix(lines[i], c.check+" "), " ", 2); len(v) == 2 {
+				r.Result, r.Detail = v[0], v[1]
+			}
+		}
+		r.Passed = r.Result == r.Expected
+		if r.Passed && r.Result == probeAllowed && c.detail != "" {
+			r.Passed = r.Detail == c.detail
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,201 @@
+// selftest_test.go - Sandbox self-test tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	checks := []probeCheck{
+		denied("proc"),
+		{check: "socket-inet", allowed: true},
+		{check: "machine-id", allowed: true, detail: "0123"},
+	}
+
+	cases := []struct {
+		name    string
+		output  string
+		results []string
+		passed  []bool
+	}{
+		{
+			name:    "expected",
+			output:  "proc denied EACCES\nsocket-inet allowed fd 3\nmachine-id allowed 0123\n",
+			results: []string{probeDenied, probeAllowed, probeAllowed},
+			passed:  []bool{true, true, true},
+		},
+		{
+			name:    "unexpected",
+			output:  "proc allowed mounted\nsocket-inet denied EPERM\nmachine-id allowed 4567\n",
+			results: []string{probeAllowed, probeDenied, probeAllowed},
+			passed:  []bool{false, false, false},
+		},
+		{
+			name:    "killed",
+			output:  "proc denied EACCES\n",
+			results: []string{probeDenied, probeError, probeError},
+			passed:  []bool{true, false, false},
+		},
+		{
+			name:    "out of order",
+			output:  "socket-inet allowed fd 3\nproc denied EACCES\nmachine-id allowed 0123\n",
+			results: []string{probeError, probeError, probeAllowed},
+			passed:  []bool{false, false, true},
+		},
+		{
+			name:    "malformed",
+			output:  "proc denied\nsocket-inet\nmachine-id error open failed\n",
+			results: []string{probeError, probeError, probeError},
+			passed:  []bool{false, false, false},
+		},
+	}
+
+	for _, c := range cases {
+		results := parseProbeOutput("test", strings.NewReader(c.output), checks)
+		if len(results) != len(checks) {
+			t.Fatalf("%v: got %d results, expected %d", c.name, len(results), len(checks))
+		}
+		for i, r := range results {
+			if r.Profile != "test" || r.Check != checks[i].check {
+				t.Errorf("%v: result %d is for %v/%v", c.name, i, r.Profile, r.Check)
+			}
+			if r.Result != c.results[i] {
+				t.Errorf("%v: %v: got result '%v', expected '%v'", c.name, r.Check, r.Result, c.results[i])
+			}
+			if r.Passed != c.passed[i] {
+				t.Errorf("%v: %v: got passed %v, expected %v", c.name, r.Check, r.Passed, c.passed[i])
+			}
+		}
+	}
+}
+
+func TestSelfTestChecks(t *testing.T) {
+	const home = "/home/selftest"
+	oldHome, hadHome := os.LookupEnv("HOME")
+	os.Setenv("HOME", home)
+	defer func() {
+		if hadHome {
+			os.Setenv("HOME", oldHome)
+		} else {
+			os.Unsetenv("HOME")
+		}
+	}()
+
+	cfg := new(config.Config)
+	for _, isolate := range []bool{false, true} {
+		cfg.Sandbox.IsolateTorNetwork = isolate
+		checks := selfTestChecks(cfg)
+
+		for _, name := range []string{"tor", "torbrowser", "update"} {
+			byCheck := make(map[string]probeCheck)
+			for _, c := range checks[name] {
+				if _, ok := byCheck[c.check]; ok {
+					t.Errorf("%v: duplicate check: %v", name, c.check)
+				}
+				byCheck[c.check] = c
+			}
+
+			// Only tor may create internet sockets, and only the browser
+			// gets the fake machine ID.  Everything else must be denied.
+			for check, c := range byCheck {
+				switch {
+				case check == "socket-inet" && name == "tor":
+				case check == "machine-id" && name == "torbrowser":
+					if c.detail != fakeMachineID() {
+						t.Errorf("%v: machine-id expects '%v'", name, c.detail)
+					}
+				default:
+					if c.allowed {
+						t.Errorf("%v: %v is expected to be allowed", name, check)
+					}
+					continue
+				}
+				if !c.allowed {
+					t.Errorf("%v: %v is expected to be denied", name, check)
+				}
+			}
+
+			if _, ok := byCheck["read="+home]; !ok {
+				t.Errorf("%v: home directory is not checked", name)
+			}
+			for _, check := range []string{"ptrace", "futex-pi"} {
+				if _, ok := byCheck[check]; !ok {
+					t.Errorf("%v: %v is not checked", name, check)
+				}
+			}
+			_, hasNetwork := byCheck["network"]
+			if name != "tor" && !hasNetwork {
+				t.Errorf("%v: network is not checked", name)
+			} else if name == "tor" && hasNetwork != isolate {
+				t.Errorf("%v: network checked: %v, isolated: %v", name, hasNetwork, isolate)
+			}
+		}
+	}
+
+	// A proxy or bridges always isolate tor.
+	cfg = new(config.Config)
+	cfg.Tor.UseBridges = true
+	for _, c := range selfTestChecks(cfg)["tor"] {
+		if c.check == "network" {
+			return
+		}
+	}
+	t.Errorf("tor: network is not checked with bridges configured")
+}
+
+func TestSelfTest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the sandbox self-test in short mode")
+	}
+	if _, err := data.Asset(probeAsset); err != nil {
+		t.Skipf("%v is not available: %v", probeAsset, err)
+	}
+
+	cfg, err := config.New("selftest")
+	if err != nil {
+		t.Skipf("no usable config: %v", err)
+	}
+	if _, err = FindBwrap(cfg); err != nil {
+		t.Skipf("bubblewrap is not available: %v", err)
+	}
+	manif, err := config.LoadManifest(cfg)
+	if err != nil || manif == nil {
+		t.Skip("the bundle is not installed")
+	}
+	if err = os.MkdirAll(cfg.RuntimeDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := SelfTest(cfg, manif)
+	if err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	if len(results) == 0 {
+		t.Fatalf("SelfTest returned no results")
+	}
+	for _, r := range results {
+		if !r.Passed {
+			t.Errorf("%v: %v: expected %v, got %v (%v)", r.Profile, r.Check, r.Expected, r.Result, r.Detail)
+		}
+	}
+}
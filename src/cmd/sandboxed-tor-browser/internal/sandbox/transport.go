@@ -0,0 +1,266 @@
+// transport.go - Pluggable transport sandbox launch routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// ptArgs is the extra command line arguments passed to each pluggable
+// transport binary.
+var ptArgs = map[string][]string{
+	tor.PTSnowflake: []string{
+		"-url", "https://snowflake-broker.azureedge.net/",
+		"-front", "ajax.aspnetcdn.com",
+		"-ice", "stun:stun.l.google.com:19302",
+	},
+}
+
+// ptRlimits is the rlimits applied to each pluggable transport container, on
+// top of the ones set by SetSensibleRlimits.
+var ptRlimits = map[int]uint64{
+	syscall.RLIMIT_CORE:   0,
+	syscall.RLIMIT_FSIZE:  1024 * 1024, // 1 MiB, for the state directory.
+	syscall.RLIMIT_NOFILE: 512,
+}
+
+// RunPluggableTransport launches a pluggable transport binary in it's own
+// sandbox, as a managed proxy, and returns the map of transport to the SOCKS
+// 5 address that tor should be configured to use.
+func RunPluggableTransport(cfg *config.Config, bin string, transports []string) (process *Process, methods map[string]string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	proxyURL, err := tor.TransportProxyURL(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, err := newHugbox(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := newConsoleLogger(bin)
+	parser := newManagedProxyParser(logger, proxyURL != "")
+	h.stdout = parser
+	h.stderr = logger
+	h.seccompFn = func(fd *os.File) error { return installPluggableTransportSeccompProfile(fd, bin) }
+	h.rlimits = ptRlimits
+	h.unshare.net = false // The transports need host network access.
+
+	// Regarding `/proc`...
+	//
+	// `/proc/sys/kernel/hostname` - Go runtime uses this to determine
+	//    hostname, 99% sure this is in the binary but not used due to the
+	//    `log` package's syslog target.
+	// `/proc/sys/net/core/somaxconn` - Go runtime uses this to determine
+	//    listener backlog, but will default to `128` on errors.
+	h.mountProc = false
+
+	realPtBin := filepath.Join(cfg.BundleInstallDir, "Browser", "TorBrowser", "Tor", "PluggableTransports", bin)
+	if !FileExists(realPtBin) {
+		return nil, nil, fmt.Errorf("sandbox: pluggable transport not present in bundle: %v", bin)
+	}
+	realStateDir := filepath.Join(cfg.PtStateDir, bin)
+	if err = os.MkdirAll(realStateDir, DirMode); err != nil {
+		return
+	}
+
+	ptDir := filepath.Join(h.homeDir, "pt")
+	stateDir := filepath.Join(ptDir, "state")
+	h.dir(ptDir)
+	h.roBind(realPtBin, filepath.Join(ptDir, bin), false)
+	h.bind(realStateDir, stateDir, false)
+
+	for _, v := range transports {
+		if tor.IsDomainFronted(v) {
+			h.appendNetworkConfig()
+			break
+		}
+	}
+
+	// If we have the dynamic linker cache available, only load in the
+	// libraries that matter.
+	if dynlib.IsSupported() {
+		cache, err := dynlib.LoadCache()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := h.appendLibraries(cache, []string{realPtBin}, nil, "", nil); err != nil {
+			return nil, nil, err
+		}
+		h.setenv("LD_LIBRARY_PATH", restrictedLibDir)
+	}
+
+	// Managed proxy configuration, per the pluggable transport spec.
+	h.setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	h.setenv("TOR_PT_STATE_LOCATION", stateDir)
+	h.setenv("TOR_PT_CLIENT_TRANSPORTS", strings.Join(transports, ","))
+	if proxyURL != "" {
+		h.setenv("TOR_PT_PROXY", proxyURL)
+	}
+
+	h.cmd = filepath.Join(ptDir, bin)
+	h.cmdArgs = ptArgs[bin]
+
+	if process, err = h.run(); err != nil {
+		return nil, nil, err
+	}
+
+	// Wait for the transport to report the listener addresses.
+	hz := time.NewTicker(1 * time.Second)
+	defer hz.Stop()
+
+	err = fmt.Errorf("sandbox: timeout waiting for %v to start", bin)
+timeoutLoop:
+	for nTicks := 0; nTicks < 10; { // 10 second timeout.
+		select {
+		case err = <-parser.doneCh:
+			break timeoutLoop
+		case <-hz.C:
+			if !process.Running() {
+				err = fmt.Errorf("sandbox: %v exited unexpectedly", bin)
+				break timeoutLoop
+			}
+			nTicks++
+		}
+	}
+	if err == nil {
+		for _, v := range transports {
+			if parser.methods[v] == "" {
+				err = fmt.Errorf("sandbox: %v did not provide transport: %v", bin, v)
+				break
+			}
+		}
+	}
+	if err != nil {
+		process.Kill()
+		return nil, nil, err
+	}
+
+	return process, parser.methods, nil
+}
+
+// managedProxyParser logs a pluggable transport's stdout, and parses the
+// managed proxy configuration protocol messages out of it.
+type managedProxyParser struct {
+	sync.Mutex
+
+	logger    *consoleLogger
+	wantProxy bool
+	proxyDone bool
+	isDone    bool
+	buf       []byte
+
+	methods map[string]string
+	doneCh  chan error
+}
+
+func (p *managedProxyParser) Write(b []byte) (n int, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.logger.Write(b)
+	if p.isDone {
+		return len(b), nil
+	}
+
+	p.buf = append(p.buf, b...)
+	for !p.isDone {
+		idx := bytes.IndexByte(p.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(p.buf[:idx])
+		p.buf = p.buf[idx+1:]
+		p.onLine(strings.TrimSpace(line))
+	}
+	if p.isDone {
+		p.buf = nil
+	}
+
+	return len(b), nil
+}
+
+func (p *managedProxyParser) onLine(line string) {
+	sp := strings.Fields(line)
+	if len(sp) == 0 {
+		return
+	}
+
+	switch sp[0] {
+	case "VERSION":
+		if len(sp) != 2 || sp[1] != "1" {
+			p.finish(fmt.Errorf("sandbox: unsupported managed proxy version: %v", line))
+		}
+	case "PROXY":
+		p.proxyDone = len(sp) == 2 && sp[1] == "DONE"
+	case "CMETHOD":
+		// CMETHOD <transport> <'socks4','socks5'> <address:port> [options]
+		if len(sp) < 4 {
+			p.finish(fmt.Errorf("sandbox: malformed CMETHOD: %v", line))
+		} else if sp[2] != "socks5" {
+			p.finish(fmt.Errorf("sandbox: unsupported CMETHOD proxy type: %v", sp[2]))
+		} else {
+			p.methods[sp[1]] = sp[3]
+		}
+	case "CMETHODS":
+		if len(sp) != 2 || sp[1] != "DONE" {
+			return
+		}
+		if p.wantProxy && !p.proxyDone {
+			// Using the transport would bypass the proxy, so fail closed.
+			p.finish(fmt.Errorf("sandbox: pluggable transport does not support the upstream proxy"))
+		} else {
+			p.finish(nil)
+		}
+	case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR", "CMETHOD-ERROR":
+		p.finish(fmt.Errorf("sandbox: pluggable transport error: %v", line))
+	}
+}
+
+func (p *managedProxyParser) finish(err error) {
+	p.isDone = true
+	p.doneCh <- err
+}
+
+func newManagedProxyParser(logger *consoleLogger, wantProxy bool) *managedProxyParser {
+	p := new(managedProxyParser)
+	p.logger = logger
+	p.wantProxy = wantProxy
+	p.methods = make(map[string]string)
+	p.doneCh = make(chan error, 1)
+	return p
+}
@@ -0,0 +1,295 @@
+// viewer.go - Offline viewer sandbox.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/sandbox/x11"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// viewer is a host application that can display downloaded files.
+type viewer struct {
+	// bin is the executable, relative to appDir if set, and `/usr/bin`
+	// otherwise.
+	bin string
+
+	// args are the arguments that precede the file name.
+	args []string
+
+	// appDir is the distribution dependent library subdirectory that the
+	// application lives in, if it doesn't live in `/usr/bin`.  It is made
+	// available in its entirety.
+	appDir string
+
+	// appLibDir is the subdirectory of appDir with the application's own
+	// libraries.
+	appLibDir string
+
+	// pluginDirs are the distribution dependent library subdirectories that
+	// the application dlopen()s plugins from.
+	pluginDirs []string
+
+	// dataDirs are the `/usr/share` subdirectories the application needs.
+	dataDirs []string
+}
+
+var (
+	// viewerPluginDirs and viewerDataDirs are needed by every viewer, as
+	// they are all Gtk+ applications, or close enough.
+	viewerPluginDirs = []string{
+		"gdk-pixbuf-2.0",
+	}
+	viewerDataDirs = []string{
+		"fonts",
+		"glib-2.0/schemas",
+		"icons",
+		"mime",
+		"themes",
+		"X11/xkb",
+	}
+
+	officeViewers = []*viewer{
+		{
+			bin:       "program/soffice.bin",
+			args:      []string{"--view", "--norestore", "--nologo", "--nodefault"},
+			appDir:    "libreoffice",
+			appLibDir: "program",
+			dataDirs:  []string{"libreoffice"},
+		},
+	}
+
+	// viewers are the candidate viewers by MIME type prefix, in order of
+	// preference.
+	viewers = []struct {
+		prefix     string
+		candidates []*viewer
+	}{
+		{"application/pdf", []*viewer{
+			{bin: "evince", pluginDirs: []string{"evince"}, dataDirs: []string{"evince"}},
+			{bin: "atril", pluginDirs: []string{"atril"}, dataDirs: []string{"atril"}},
+			{bin: "xreader", pluginDirs: []string{"xreader"}, dataDirs: []string{"xreader"}},
+			{bin: "mupdf"},
+		}},
+		{"image/", []*viewer{
+			{bin: "eog", pluginDirs: []string{"eog"}, dataDirs: []string{"eog"}},
+			{bin: "ristretto", dataDirs: []string{"ristretto"}},
+			{bin: "feh"},
+		}},
+		{"application/vnd.oasis.opendocument.", officeViewers},
+		{"application/vnd.openxmlformats-officedocument.", officeViewers},
+	}
+
+	viewerCount uint32
+)
+
+// findViewer returns the first installed viewer for mimeType, and the path
+// to its executable.
+func findViewer(mimeType string) (*viewer, string, string) {
+	for _, v := range viewers {
+		if !strings.HasPrefix(mimeType, v.prefix) {
+			continue
+		}
+		for _, c := range v.candidates {
+			if c.appDir == "" {
+				binPath := filepath.Join("/usr/bin", c.bin)
+				if FileExists(binPath) {
+					return c, "", binPath
+				}
+				continue
+			}
+			if appDir := findDistributionDependentDir(nil, "", c.appDir); appDir != "" {
+				binPath := filepath.Join(appDir, c.bin)
+				if FileExists(binPath) {
+					return c, appDir, binPath
+				}
+			}
+		}
+	}
+	return nil, "", ""
+}
+
+// RunViewer launches the host's viewer application for mimeType, to display
+// the file at path.  The viewer has no network access, and can only read the
+// file itself, and the libraries and data it needs to run.
+func RunViewer(cfg *config.Config, path, mimeType string) (process *Process, err error) {
+	const x11SocketPrefix = "xorg-viewer-"
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	v, appDir, binPath := findViewer(mimeType)
+	if v == nil {
+		return nil, fmt.Errorf("sandbox: no viewer installed for '%v'", mimeType)
+	}
+	Debugf("sandbox: viewer: Using '%v' for '%v'", binPath, mimeType)
+
+	h, err := newHugbox(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := newConsoleLogger("viewer")
+	h.stdout = logger
+	h.stderr = logger
+	h.seccompFn = installViewerSeccompProfile
+	h.fakeDbus = true
+	h.mountProc = false
+	h.fakeProc = true
+	h.unshare.net = true // Not that there is anything to talk to.
+
+	// The file being viewed is the only thing from the user's home
+	// directory, and is read-only.
+	sandboxPath := filepath.Join(h.homeDir, filepath.Base(path))
+	h.roBind(path, sandboxPath, false)
+	h.chdir = h.homeDir
+
+	h.roBind("/etc/fonts", "/etc/fonts", true)
+	for _, d := range append(viewerDataDirs, v.dataDirs...) {
+		d = filepath.Join("/usr/share", d)
+		h.roBind(d, d, true)
+	}
+	if appDir == "" {
+		h.roBind(binPath, binPath, false)
+	}
+
+	// There is no session bus, dconf, or accessibility bus, and Gtk+ should
+	// not go looking for them.
+	h.setenv("GSETTINGS_BACKEND", "memory")
+	h.setenv("GIO_USE_VFS", "local")
+	h.setenv("NO_AT_BRIDGE", "yes")
+	h.setenv("GDK_BACKEND", "x11")
+	h.setenv("LIBGL_ALWAYS_SOFTWARE", "1")
+
+	var libDirs []string
+	if appDir != "" {
+		libDirs = append(libDirs, appDir)
+	}
+	ldLibraryPath := restrictedLibDir
+	if appDir != "" && v.appLibDir != "" {
+		ldLibraryPath = ldLibraryPath + ":" + filepath.Join(appDir, v.appLibDir)
+	}
+	if dynlib.IsSupported() {
+		cache, err := dynlib.LoadCache()
+		if err != nil {
+			return nil, err
+		}
+
+		binaries := []string{binPath}
+		searchPath := ""
+		if appDir != "" && v.appLibDir != "" {
+			searchPath = filepath.Join(appDir, v.appLibDir)
+			binaries = append(binaries, resolvablePlugins(cache, searchPath, searchPath)...)
+		}
+
+		for _, d := range append(viewerPluginDirs, v.pluginDirs...) {
+			if pluginDir := findDistributionDependentDir(nil, "", d); pluginDir != "" {
+				binaries = append(binaries, resolvablePlugins(cache, pluginDir, searchPath)...)
+				libDirs = append(libDirs, pluginDir)
+			}
+		}
+
+		extraLibs, glLibPaths := h.appendRestrictedOpenGL()
+		if err := h.appendLibraries(cache, binaries, extraLibs, searchPath+glLibPaths, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The application and plugin directories are made available where the
+	// application expects them, since the plugin caches (eg: gdk-pixbuf's
+	// `loaders.cache`) have the host paths.  This must happen after the
+	// libraries, which may symlink over the distribution specific library
+	// directories.
+	for _, d := range libDirs {
+		h.roBind(d, d, false)
+	}
+	h.setenv("LD_LIBRARY_PATH", ldLibraryPath)
+
+	h.cmd = binPath
+	h.cmdArgs = append(append([]string{}, v.args...), sandboxPath)
+
+	// Each viewer gets a surrogate of its own, since more than one can be
+	// running at a time.
+	x11SurrogatePath := filepath.Join(cfg.RuntimeDir, fmt.Sprintf("%s%d", x11SocketPrefix, atomic.AddUint32(&viewerCount, 1)))
+	x, err := x11.New(cfg.Sandbox.Display, h.hostname, x11SurrogatePath)
+	if err != nil {
+		return nil, err
+	} else {
+		h.setenv("DISPLAY", x.Display)
+		h.dir(x11.SockDir)
+		if x.Xauthority != nil {
+			xauthPath := filepath.Join(h.homeDir, ".Xauthority")
+			h.setenv("XAUTHORITY", xauthPath)
+			h.file(xauthPath, x.Xauthority)
+		}
+		if err = x.LaunchSurrogate(); err != nil {
+			return nil, err
+		}
+		h.bind(x.Socket(), filepath.Join(x11.SockDir, "X0"), false)
+	}
+	x11TermHook := func() {
+		if x.Surrogate != nil {
+			Debugf("sandbox: X11: Cleaning up viewer surrogate")
+			x.Surrogate.Close()
+		}
+	}
+
+	proc, err := h.run()
+	if err != nil {
+		x11TermHook()
+		return nil, err
+	} else {
+		proc.AddTermHook(x11TermHook)
+	}
+
+	return proc, nil
+}
+
+// resolvablePlugins returns the shared libraries under dir, that have all of
+// their dependencies available.  Plugins that don't are skipped, instead of
+// failing outright, since they are usually for optional features.
+func resolvablePlugins(cache *dynlib.Cache, dir, ldLibraryPath string) []string {
+	fallbackLibSearchPath := strings.Join(distributionDependentLibSearchPath, string(filepath.ListSeparator))
+
+	var plugins []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || !strings.HasSuffix(path, ".so") {
+			return nil
+		}
+		if dynlib.ValidateLibraryClass(path) != nil {
+			return nil
+		}
+		if _, err := cache.ResolveLibraries([]string{path}, nil, ldLibraryPath, fallbackLibSearchPath, nil); err != nil {
+			Debugf("sandbox: viewer: Skipping plugin '%v': %v", path, err)
+			return nil
+		}
+		plugins = append(plugins, path)
+		return nil
+	})
+	return plugins
+}
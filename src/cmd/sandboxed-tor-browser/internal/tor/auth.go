@@ -0,0 +1,176 @@
+// auth.go - System tor control port authentication.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"git.schwanenlied.me/yawning/bulb.git"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	authCookieLength = 32
+	authNonceLength  = 32
+
+	authServerHashKey = "Tor safe cookie authentication server-to-controller hash"
+	authClientHashKey = "Tor safe cookie authentication controller-to-server hash"
+)
+
+// authenticateSystem authenticates with a system tor daemon's control port,
+// using the method and credentials specified in the config.  Unlike bulb's
+// Authenticate, this supports COOKIE authentication, and overriding the
+// cookie path.
+func authenticateSystem(ctrl *bulb.Conn, cfg *config.Config) error {
+	pi, err := ctrl.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+
+	method := cfg.SystemTor.AuthMethod
+	switch method {
+	case "", config.SystemTorAuthAuto:
+		// Prefer the methods that need no user configuration, in order of
+		// strength, and only fall back to a password if one is set.
+		method = ""
+		for _, m := range []string{config.SystemTorAuthNull, config.SystemTorAuthSafeCookie, config.SystemTorAuthCookie} {
+			if pi.AuthMethods[m] {
+				method = m
+				break
+			}
+		}
+		if method == "" && pi.AuthMethods[config.SystemTorAuthPassword] && cfg.SystemTor.Password != "" {
+			method = config.SystemTorAuthPassword
+		}
+		if method == "" {
+			return fmt.Errorf("tor: no usable control port authentication methods")
+		}
+	default:
+		if !pi.AuthMethods[method] {
+			return fmt.Errorf("tor: system tor does not support %v authentication", method)
+		}
+	}
+
+	cookiePath := cfg.SystemTor.CookiePath
+	if cookiePath == "" {
+		cookiePath = pi.CookieFile
+	}
+
+	switch method {
+	case config.SystemTorAuthNull:
+		_, err = ctrl.Request("AUTHENTICATE")
+	case config.SystemTorAuthCookie:
+		var cookie []byte
+		if cookie, err = readAuthCookie(cookiePath); err != nil {
+			return err
+		}
+		_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	case config.SystemTorAuthSafeCookie:
+		var cookie []byte
+		if cookie, err = readAuthCookie(cookiePath); err != nil {
+			return err
+		}
+		err = authenticateSafeCookie(ctrl, cookie)
+	case config.SystemTorAuthPassword:
+		if cfg.SystemTor.Password == "" {
+			return fmt.Errorf("tor: HASHEDPASSWORD authentication requires a password")
+		}
+
+		// The password is sent in the clear, hex encoded to avoid having
+		// to deal with quoting.
+		_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString([]byte(cfg.SystemTor.Password)))
+	default:
+		return fmt.Errorf("tor: unsupported control port authentication method: %v", method)
+	}
+	return err
+}
+
+func readAuthCookie(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("tor: no control port authentication cookie path")
+	}
+	cookie, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tor: failed to read the control port authentication cookie: %v", err)
+	}
+	if len(cookie) != authCookieLength {
+		return nil, fmt.Errorf("tor: invalid control port authentication cookie length: %d", len(cookie))
+	}
+	return cookie, nil
+}
+
+func authenticateSafeCookie(ctrl *bulb.Conn, cookie []byte) error {
+	var clientNonce [authNonceLength]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return err
+	}
+
+	resp, err := ctrl.Request("AUTHCHALLENGE SAFECOOKIE %s", hex.EncodeToString(clientNonce[:]))
+	if err != nil {
+		return err
+	}
+
+	// 250 AUTHCHALLENGE SERVERHASH=ServerHash SERVERNONCE=ServerNonce
+	var serverHash, serverNonce []byte
+	sp := strings.Split(resp.Reply, " ")
+	if len(sp) != 3 || sp[0] != "AUTHCHALLENGE" {
+		return fmt.Errorf("tor: malformed AUTHCHALLENGE response")
+	}
+	for _, v := range sp[1:] {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("tor: malformed AUTHCHALLENGE response")
+		}
+		switch kv[0] {
+		case "SERVERHASH":
+			serverHash, err = hex.DecodeString(kv[1])
+		case "SERVERNONCE":
+			serverNonce, err = hex.DecodeString(kv[1])
+		}
+		if err != nil {
+			return fmt.Errorf("tor: malformed AUTHCHALLENGE %v: %v", kv[0], err)
+		}
+	}
+	if len(serverHash) != sha256.Size || len(serverNonce) != authNonceLength {
+		return fmt.Errorf("tor: malformed AUTHCHALLENGE response")
+	}
+
+	// Validate the ServerHash, to ensure that the daemon actually knows the
+	// cookie, before disclosing anything derived from it.
+	if !hmac.Equal(serverHash, safeCookieHash(authServerHashKey, cookie, clientNonce[:], serverNonce)) {
+		return fmt.Errorf("tor: AUTHCHALLENGE ServerHash mismatch")
+	}
+
+	clientHash := safeCookieHash(authClientHashKey, cookie, clientNonce[:], serverNonce)
+	_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString(clientHash))
+	return err
+}
+
+func safeCookieHash(key string, cookie, clientNonce, serverNonce []byte) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write(cookie)
+	m.Write(clientNonce)
+	m.Write(serverNonce)
+	return m.Sum(nil)
+}
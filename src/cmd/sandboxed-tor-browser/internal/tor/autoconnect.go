@@ -0,0 +1,153 @@
+// autoconnect.go - Automatic bridge fallback.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"errors"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	// AutoConnectDirect is the auto-connect strategy that connects to the
+	// Tor network without bridges.
+	AutoConnectDirect = "direct"
+
+	// AutoConnectCustom is the auto-connect strategy that uses the user
+	// provided bridges.
+	AutoConnectCustom = "custom"
+
+	// autoConnectStallTimeout is the number of seconds without forward
+	// bootstrap progress before a strategy is considered to have failed.
+	autoConnectStallTimeout = 60
+)
+
+// ErrBootstrapStalled is the error returned when the bootstrap process fails
+// to make forward progress.
+var ErrBootstrapStalled = errors.New("tor: timeout connecting to the tor network")
+
+// autoConnectTransports is the list of built-in bridge transports that will
+// be attempted, in order of preference, if built-in bridges are available.
+var autoConnectTransports = []string{"obfs4", "meek", "snowflake"}
+
+// AutoConnectStrategy is a bridge configuration that the auto-connect logic
+// will attempt to bootstrap with.
+type AutoConnectStrategy struct {
+	// Name is the strategy name, as persisted in the config.
+	Name string
+
+	useBridges       bool
+	useCustomBridges bool
+	bridgeType       string
+}
+
+// Apply applies the strategy to the config, marking it dirty if anything
+// changed.
+func (s *AutoConnectStrategy) Apply(cfg *config.Config) {
+	cfg.Tor.SetUseBridges(s.useBridges)
+	cfg.Tor.SetUseCustomBridges(s.useCustomBridges)
+	if s.bridgeType != "" {
+		cfg.Tor.SetInternalBridgeType(s.bridgeType)
+	}
+}
+
+func (s *AutoConnectStrategy) String() string {
+	return s.Name
+}
+
+// StrategyFromConfig returns a strategy that corresponds to the current bridge
+// configuration, suitable for restoring the config if every auto-connect
+// strategy fails.
+func StrategyFromConfig(cfg *config.Config) *AutoConnectStrategy {
+	return &AutoConnectStrategy{
+		Name:             cfg.Tor.AutoConnectStrategy,
+		useBridges:       cfg.Tor.UseBridges,
+		useCustomBridges: cfg.Tor.UseCustomBridges,
+		bridgeType:       cfg.Tor.InternalBridgeType,
+	}
+}
+
+// AutoConnectStrategies returns the list of strategies to attempt, in order
+// of increasing strength.  If a strategy has succeeded in the past, it will
+// be attempted first.
+func AutoConnectStrategies(cfg *config.Config, bridges map[string][]string) []*AutoConnectStrategy {
+	strategies := []*AutoConnectStrategy{
+		{Name: AutoConnectDirect},
+	}
+	for _, transport := range autoConnectTransports {
+		if len(bridges[transport]) == 0 {
+			continue
+		}
+		strategies = append(strategies, &AutoConnectStrategy{
+			Name:       transport,
+			useBridges: true,
+			bridgeType: transport,
+		})
+	}
+	if strings.TrimSpace(cfg.Tor.CustomBridges) != "" {
+		strategies = append(strategies, &AutoConnectStrategy{
+			Name:             AutoConnectCustom,
+			useBridges:       true,
+			useCustomBridges: true,
+		})
+	}
+
+	// Promote the last known good strategy to the front of the list.
+	for i, s := range strategies {
+		if i > 0 && s.Name == cfg.Tor.AutoConnectStrategy {
+			copy(strategies[1:i+1], strategies[:i])
+			strategies[0] = s
+			break
+		}
+	}
+
+	return strategies
+}
+
+// EnableStallDetection shortens the bootstrap timeout and treats tor's
+// bootstrap warnings as fatal, so that the caller can move on to the next
+// auto-connect strategy.
+func (t *Tor) EnableStallDetection() {
+	t.stallTimeout = autoConnectStallTimeout
+	t.abortOnBootstrapWarn = true
+}
+
+func bootstrapWarning(s string) (string, bool) {
+	const warnPrefix = "WARN BOOTSTRAP "
+	if !strings.HasPrefix(s, warnPrefix) {
+		return "", false
+	}
+
+	var warning, recommendation string
+	for _, v := range splitQuoted(strings.TrimPrefix(s, warnPrefix)) {
+		const (
+			warningPrefix        = "WARNING="
+			recommendationPrefix = "RECOMMENDATION="
+		)
+
+		if strings.HasPrefix(v, warningPrefix) {
+			warning = strings.Trim(strings.TrimPrefix(v, warningPrefix), "\"")
+		} else if strings.HasPrefix(v, recommendationPrefix) {
+			recommendation = strings.TrimPrefix(v, recommendationPrefix)
+		}
+	}
+
+	// Tor only recommends warning the user once it thinks the problem is
+	// persistent, which is a reasonable point to give up.
+	return warning, recommendation == "warn"
+}
@@ -0,0 +1,163 @@
+// guards.go - Tor entry guard state.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.schwanenlied.me/yawning/bulb.git"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	stateFile       = "state"
+	stateTimeFormat = "2006-01-02T15:04:05"
+)
+
+// EntryGuard is a tor entry guard.
+type EntryGuard struct {
+	// Fingerprint is the guard's identity key fingerprint, in upper case hex.
+	Fingerprint string
+
+	// Nickname is the guard's nickname, if known.
+	Nickname string
+
+	// Status is the guard's status as reported by tor ("up", "down",
+	// "never-connected", ...), or "" if tor is not running.
+	Status string
+
+	// SampledOn is when the guard was added to tor's guard sample, or the
+	// zero time if unknown.
+	SampledOn time.Time
+
+	// ConfirmedOn is when the guard was first used successfully, or the zero
+	// time if unknown or never.
+	ConfirmedOn time.Time
+}
+
+// Age returns how long the guard has been in tor's guard sample, or 0 if
+// unknown.
+func (g *EntryGuard) Age() time.Duration {
+	if g.SampledOn.IsZero() {
+		return 0
+	}
+	return time.Since(g.SampledOn)
+}
+
+// EntryGuards returns the tor instance's entry guards, as reported by
+// `GETINFO entry-guards`.
+func (t *Tor) EntryGuards() ([]*EntryGuard, error) {
+	resp, err := t.getinfo("entry-guards")
+	if err != nil {
+		return nil, err
+	}
+	return parseEntryGuards(resp), nil
+}
+
+// SystemEntryGuards returns the system tor daemon's entry guards, over a
+// temporary control port connection.
+func SystemEntryGuards(cfg *config.Config) ([]*EntryGuard, error) {
+	ctrl, err := bulb.Dial(cfg.SystemTorControlNet, cfg.SystemTorControlAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+
+	if err = authenticateSystem(ctrl, cfg); err != nil {
+		return nil, err
+	}
+	resp, err := ctrl.Request("GETINFO entry-guards")
+	if err != nil {
+		return nil, err
+	}
+	return parseEntryGuards(resp), nil
+}
+
+// StateEntryGuards returns the sandboxed tor's entry guards, as persisted in
+// the tor state file.  If tor has never been run, no guards and no error are
+// returned.
+func StateEntryGuards(cfg *config.Config) ([]*EntryGuard, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cfg.TorDataDir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Guard in=default rsa_id=<fpr> nickname=<nick> sampled_on=<time> ...
+	var guards []*EntryGuard
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		sp := strings.Fields(scanner.Text())
+		if len(sp) < 2 || sp[0] != "Guard" {
+			continue
+		}
+
+		g := new(EntryGuard)
+		for _, v := range sp[1:] {
+			kv := strings.SplitN(v, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "rsa_id":
+				g.Fingerprint = strings.ToUpper(kv[1])
+			case "nickname":
+				g.Nickname = kv[1]
+			case "sampled_on":
+				g.SampledOn, _ = time.Parse(stateTimeFormat, kv[1])
+			case "confirmed_on":
+				g.ConfirmedOn, _ = time.Parse(stateTimeFormat, kv[1])
+			}
+		}
+		if g.Fingerprint != "" {
+			guards = append(guards, g)
+		}
+	}
+	return guards, scanner.Err()
+}
+
+func parseEntryGuards(resp *bulb.Response) []*EntryGuard {
+	// 250+entry-guards=
+	// $<fpr>~<nick> <status>
+	// .
+	// 250 OK
+	var guards []*EntryGuard
+	for _, l := range resp.RawLines {
+		sp := strings.Fields(l)
+		if len(sp) < 2 || !strings.HasPrefix(sp[0], "$") {
+			continue
+		}
+
+		g := &EntryGuard{Status: sp[1]}
+		id := strings.TrimPrefix(sp[0], "$")
+		if idx := strings.IndexAny(id, "~="); idx != -1 {
+			id, g.Nickname = id[:idx], id[idx+1:]
+		}
+		g.Fingerprint = strings.ToUpper(id)
+		guards = append(guards, g)
+	}
+	return guards
+}
@@ -62,6 +62,9 @@ const (
 	socksAddr = "127.0.0.1:9150"
 
 	aboutAddonsUnsafeHost = "discovery.addons.mozilla.org"
+
+	ctrlSurrogateSocket  = "control"
+	socksSurrogateSocket = "socks"
 )
 
 func copyLoop(upConn, downConn net.Conn) {
@@ -137,6 +140,7 @@ type socksProxy struct {
 	sync.RWMutex
 	sPath       string
 	sNet, sAddr string
+	session     string
 	tag         string
 
 	l net.Listener
@@ -154,7 +158,13 @@ func (p *socksProxy) newTag() error {
 	if _, err := rand.Read(b[:]); err != nil {
 		return err
 	}
-	p.tag = "sandboxed-tor-browser:" + hex.EncodeToString(b[:])
+	// Named sessions share the tor instance, so include the session name
+	// to make the isolation between them explicit.
+	p.tag = "sandboxed-tor-browser:"
+	if p.session != "" {
+		p.tag += p.session + ":"
+	}
+	p.tag += hex.EncodeToString(b[:])
 
 	return nil
 }
@@ -231,6 +241,7 @@ func (p *socksProxy) rewriteTag(conn net.Conn, req *socks5.Request) error {
 
 func launchSocksProxy(cfg *config.Config, tor *Tor) (*socksProxy, error) {
 	p := new(socksProxy)
+	p.session = cfg.Session
 	if err := p.newTag(); err != nil {
 		return nil, err
 	}
@@ -241,7 +252,7 @@ func launchSocksProxy(cfg *config.Config, tor *Tor) (*socksProxy, error) {
 		return nil, err
 	}
 
-	p.sPath = filepath.Join(cfg.RuntimeDir, "socks")
+	p.sPath = filepath.Join(cfg.RuntimeDir, socksSurrogateSocket)
 	os.Remove(p.sPath)
 	p.l, err = net.Listen("unix", p.sPath)
 	if err != nil {
@@ -563,7 +574,7 @@ func launchCtrlProxy(cfg *config.Config, tor *Tor) (*ctrlProxy, error) {
 	}
 
 	var err error
-	p.cPath = filepath.Join(cfg.RuntimeDir, "control")
+	p.cPath = filepath.Join(cfg.RuntimeDir, ctrlSurrogateSocket)
 	os.Remove(p.cPath)
 	p.l, err = net.Listen("unix", p.cPath)
 	if err != nil {
@@ -28,6 +28,7 @@ import (
 	mrand "math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,6 +46,22 @@ import (
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
+const (
+	// reachablePct is the bootstrap progress (`onehop_create`) that
+	// indicates that the TLS handshake with the first hop (eg: the bridge)
+	// has completed.
+	reachablePct = 15
+
+	// reachableTimeout is the number of seconds to wait for the first hop
+	// to be reachable.
+	reachableTimeout = 30
+
+	// sharedCtrlPasswordFile is the file in the shared runtime directory
+	// that holds the control port password of the sandboxed tor instance,
+	// for the other sessions.
+	sharedCtrlPasswordFile = "control_password"
+)
+
 // ErrTorNotRunning is the error returned when the tor is not running.
 var ErrTorNotRunning = errors.New("tor not running")
 
@@ -53,9 +70,15 @@ type Tor struct {
 	sync.Mutex
 
 	isSystem       bool
+	isShared       bool
 	isBootstrapped bool
 
+	stallTimeout         int
+	abortOnBootstrapWarn bool
+	isReachabilityTest   bool
+
 	process    *process.Process
+	ptProcess  []*process.Process
 	ctrl       *bulb.Conn
 	ctrlEvents chan *bulb.Response
 
@@ -67,6 +90,8 @@ type Tor struct {
 	socksSurrogate   *socksProxy
 	socksPassthrough *passthroughProxy
 
+	vanguards *vanguardsManager
+
 	unlinkOnExit []string
 }
 
@@ -76,6 +101,12 @@ func (t *Tor) IsSystem() bool {
 	return t.isSystem
 }
 
+// IsShared returns if the tor instance is a sandboxed tor being managed by
+// another session.
+func (t *Tor) IsShared() bool {
+	return t.isShared
+}
+
 // Dialer returns a proxy.Dialer configured to use the Socks port with the
 // generic `sandboxed-tor-browser:isolation:pid` isolation settings.
 func (t *Tor) Dialer() (proxy.Dialer, error) {
@@ -143,6 +174,16 @@ func (t *Tor) getconf(arg string) (*bulb.Response, error) {
 	return t.ctrl.Request("GETCONF %s", arg)
 }
 
+func (t *Tor) setconf(arg string) (*bulb.Response, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ctrl == nil {
+		return nil, ErrTorNotRunning
+	}
+	return t.ctrl.Request("SETCONF %s", arg)
+}
+
 // Shutdown attempts to gracefully clean up the Tor instance.  If it is a
 // system tor, only the control port connection will be closed.  Otherwise,
 // the tor daemon will be terminated, gracefully if possible.
@@ -150,10 +191,15 @@ func (t *Tor) Shutdown() {
 	t.Lock()
 	defer t.Unlock()
 
+	if t.vanguards != nil {
+		t.vanguards.close()
+		t.vanguards = nil
+	}
+
 	sentHalt := false
 	if t.ctrl != nil {
 		// Try to gracefully terminate the daemon via the control port.
-		if !t.isSystem {
+		if !t.isSystem && !t.isShared {
 			t.ctrl.Request("SIGNAL HALT")
 			sentHalt = true
 		}
@@ -188,6 +234,12 @@ func (t *Tor) Shutdown() {
 		t.process = nil
 	}
 
+	// The pluggable transports are useless without tor, so just kill them.
+	for _, p := range t.ptProcess {
+		p.Kill()
+	}
+	t.ptProcess = nil
+
 	if t.ctrlSurrogate != nil {
 		t.ctrlSurrogate.close()
 		t.ctrlSurrogate = nil
@@ -208,6 +260,12 @@ func (t *Tor) Shutdown() {
 	}
 }
 
+// SurrogatePaths returns the control port and socks port surrogate AF_UNIX
+// paths that are used for cfg, without tor having to be running.
+func SurrogatePaths(cfg *config.Config) (string, string) {
+	return filepath.Join(cfg.RuntimeDir, ctrlSurrogateSocket), filepath.Join(cfg.RuntimeDir, socksSurrogateSocket)
+}
+
 // SocksSurrogatePath returns the socks port surrogate AF_UNIX path.
 func (t *Tor) SocksSurrogatePath() string {
 	return t.socksSurrogate.sPath
@@ -229,7 +287,7 @@ func (t *Tor) launchSurrogates(cfg *config.Config) error {
 		return err
 	}
 
-	if !t.IsSystem() {
+	if !t.IsSystem() && !t.IsShared() {
 		const passthroughAddr = "127.0.0.1:9150"
 
 		tNet, tAddr, _ := t.SocksPort()
@@ -273,7 +331,48 @@ func NewSystemTor(cfg *config.Config) (*Tor, error) {
 	}
 
 	// Authenticate with the control port.
-	if err = t.ctrl.Authenticate(""); err != nil {
+	if err = authenticateSystem(t.ctrl, cfg); err != nil {
+		t.ctrl.Close()
+		return nil, err
+	}
+
+	t.ctrl.StartAsyncReader()
+	go t.eventReader()
+
+	// Launch the surrogates.
+	if err = t.launchSurrogates(cfg); err != nil {
+		t.ctrl.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// NewSharedTor creates a Tor struct around a sandboxed tor instance that was
+// launched and bootstrapped by another session.  If no other session has
+// launched tor, ErrTorNotRunning is returned.
+func NewSharedTor(cfg *config.Config) (*Tor, error) {
+	passwd, err := ioutil.ReadFile(filepath.Join(cfg.SharedRuntimeDir, sharedCtrlPasswordFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrTorNotRunning
+		}
+		return nil, err
+	}
+
+	t := new(Tor)
+	t.isShared = true
+	t.isBootstrapped = true
+	t.socksNet = "unix"
+	t.socksAddr = filepath.Join(cfg.TorDataDir, "socks")
+	t.ctrlAddr = filepath.Join(cfg.TorDataDir, "control")
+	t.ctrlEvents = make(chan *bulb.Response, 16)
+
+	// Dial and authenticate with the control port.
+	if t.ctrl, err = bulb.Dial("unix", t.ctrlAddr); err != nil {
+		return nil, err
+	}
+	if err = t.ctrl.Authenticate(string(passwd)); err != nil {
 		t.ctrl.Close()
 		return nil, err
 	}
@@ -290,16 +389,19 @@ func NewSystemTor(cfg *config.Config) (*Tor, error) {
 	return t, nil
 }
 
-// NewSandboxedTor creates a Tor struct around a sandboxed tor instance.
-func NewSandboxedTor(cfg *config.Config, process *process.Process) *Tor {
+// NewSandboxedTor creates a Tor struct around a sandboxed tor instance, and
+// the sandboxed pluggable transports that it uses.
+func NewSandboxedTor(cfg *config.Config, process *process.Process, ptProcess []*process.Process) *Tor {
 	t := new(Tor)
 	t.isSystem = false
 	t.process = process
+	t.ptProcess = ptProcess
 	t.socksNet = "unix"
 	t.socksAddr = filepath.Join(cfg.TorDataDir, "socks")
 	t.ctrlAddr = filepath.Join(cfg.TorDataDir, "control")
 	t.ctrlEvents = make(chan *bulb.Response, 16)
 	t.unlinkOnExit = []string{t.socksAddr, t.ctrlAddr}
+	t.stallTimeout = 300 // 300 sec timeout (bootstrap).
 
 	return t
 }
@@ -377,7 +479,7 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 	// Wait for bootstrap to finish.
 	bootstrapFinished := false
 	pct := 0
-	for nTicks := 0; nTicks < 300 && !bootstrapFinished; { // 300 sec timeout (bootstrap).
+	for nTicks := 0; nTicks < t.stallTimeout && !bootstrapFinished; {
 		newPct := 0
 		select {
 		case ev := <-t.ctrlEvents:
@@ -388,7 +490,12 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 			if !strings.HasPrefix(ev.Reply, evPrefix) {
 				continue
 			}
-			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(ev.Reply, evPrefix))
+			s := strings.TrimPrefix(ev.Reply, evPrefix)
+			if warning, ok := bootstrapWarning(s); ok && t.abortOnBootstrapWarn {
+				log.Printf("tor: Bootstrap failing: %v", warning)
+				return ErrBootstrapStalled
+			}
+			bootstrapFinished, newPct = handleBootstrapEvent(async, s)
 		case <-async.Cancel:
 			return ErrCanceled
 		case <-hz.C:
@@ -399,6 +506,11 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 			if !t.process.Running() {
 				return fmt.Errorf("tor process appears to have crashed.")
 			}
+			for _, p := range t.ptProcess {
+				if !p.Running() {
+					return fmt.Errorf("pluggable transport process appears to have crashed.")
+				}
+			}
 
 			// Fallback in case something goes wrong, poll the bootstrap status
 			// every 10 sec.
@@ -413,6 +525,10 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 			}
 			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(resp.Data[0], statusPrefix))
 		}
+		if t.isReachabilityTest && newPct >= reachablePct {
+			return nil
+		}
+
 		// As long as forward progress is being made, reset the timer.
 		if newPct > pct {
 			pct = newPct
@@ -420,7 +536,7 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 		}
 	}
 	if !bootstrapFinished {
-		return fmt.Errorf("tor: timeout connecting to the tor network")
+		return ErrBootstrapStalled
 	}
 
 	// Squelch the events, and drain the event queue.
@@ -431,6 +547,17 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 		<-t.ctrlEvents
 	}
 
+	// Start managing the layered guards, before anything can build onion
+	// service circuits.
+	if cfg.Tor.UseLayeredGuards {
+		async.UpdateProgress("Configuring layered guards.")
+		// Never fail open, the user asked for layered guards for a reason,
+		// and the browser isn't running yet.
+		if err = t.launchVanguards(cfg); err != nil {
+			return err
+		}
+	}
+
 	// Launch the surrogates.
 	if err = t.launchSurrogates(cfg); err != nil {
 		return err
@@ -438,12 +565,32 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 
 	t.isBootstrapped = true
 
+	// Let the other sessions use this instance, unless it is using a
+	// disposable session's data directory.
+	if !cfg.Disposable {
+		p := filepath.Join(cfg.SharedRuntimeDir, sharedCtrlPasswordFile)
+		if err = ioutil.WriteFile(p, []byte(cfg.Tor.CtrlPassword), FileMode); err != nil {
+			return err
+		}
+		t.unlinkOnExit = append(t.unlinkOnExit, p)
+	}
+
 	return nil
 }
 
+// EnableReachabilityTest configures the bootstrap to finish as soon as the
+// first hop has been successfully connected to, for testing bridges.  The
+// instance is not usable past that point, and should be shutdown.
+func (t *Tor) EnableReachabilityTest() {
+	t.isReachabilityTest = true
+	t.stallTimeout = reachableTimeout
+	t.abortOnBootstrapWarn = true
+}
+
 // CfgToSandboxTorrc converts the `ui/config/Config` to a sandboxed tor ready
-// torrc.
-func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte, error) {
+// torrc.  The pluggable transports are expected to already be running, with
+// ptMethods being the map of transport to SOCKS 5 listener address.
+func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string, ptMethods map[string]string) ([]byte, error) {
 	torrc, err := data.Asset("torrc")
 	if err != nil {
 		return nil, err
@@ -456,6 +603,17 @@ func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte,
 			return nil, err
 		}
 		bridgeArgs := []string{string(torrcBridges)}
+
+		// Each pluggable transport lives in it's own container, so point
+		// tor at the already running instances.
+		var transports []string
+		for t := range ptMethods {
+			transports = append(transports, t)
+		}
+		sort.Strings(transports)
+		for _, t := range transports {
+			bridgeArgs = append(bridgeArgs, "ClientTransportPlugin "+t+" socks5 "+ptMethods[t])
+		}
 		if !cfg.Tor.UseCustomBridges {
 			// No seed was set. Generate one with math.Rand, since this is
 			// purely for load balancing and doesn't require high grade
@@ -487,7 +645,20 @@ func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte,
 		torrc = append(torrc, []byte(s)...)
 	}
 
-	if cfg.Tor.UseProxy {
+	// tor refuses to use external pluggable transports when a proxy is
+	// configured, since the transports are responsible for using the proxy.
+	// Vanilla bridges would bypass the proxy in that case, so disallow it.
+	useProxy := cfg.Tor.UseProxy
+	if useProxy && len(ptMethods) > 0 {
+		for _, sp := range bridgeLines(cfg, bridges) {
+			if isVanillaBridge(sp) {
+				return nil, fmt.Errorf("tor: Vanilla bridges can not be combined with pluggable transports when using a proxy")
+			}
+		}
+		useProxy = false
+	}
+
+	if useProxy {
 		proxyArgs := []string{}
 		proxyAddr := cfg.Tor.ProxyAddress + ":" + cfg.Tor.ProxyPort
 		proxyUser := cfg.Tor.ProxyUsername
@@ -515,6 +686,17 @@ func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte,
 		torrc = append(torrc, []byte(s)...)
 	}
 
+	// Apply the user specified options, re-validating them in case the
+	// config file was edited by hand.
+	if len(cfg.Tor.ExtraOptions) > 0 {
+		opts, err := ValidateExtraOptions(cfg.Tor.ExtraOptions)
+		if err != nil {
+			return nil, err
+		}
+		s := "\n" + FormatExtraOptions(opts) + "\n"
+		torrc = append(torrc, []byte(s)...)
+	}
+
 	// Generate a random control port password.
 	var entropy [16]byte
 	if _, err := rand.Read(entropy[:]); err != nil {
@@ -0,0 +1,168 @@
+// torrc.go - User specified torrc options.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const maxExtraOptionLen = 4096
+
+// extraOptionsAllowlist is the set of torrc options that the user may
+// specify, keyed by the lower case name.  Anything not listed here, such as
+// the ports, paths, and controller options that the sandbox depends on, is
+// rejected.
+var extraOptionsAllowlist = func() map[string]string {
+	m := make(map[string]string)
+	for _, v := range []string{
+		// Node selection.
+		"EntryNodes",
+		"ExitNodes",
+		"ExcludeNodes",
+		"ExcludeExitNodes",
+		"StrictNodes",
+		"GeoIPExcludeUnknown",
+		"NodeFamily",
+		"EnforceDistinctSubnets",
+		"NumEntryGuards",
+
+		// Firewall traversal.
+		"FascistFirewall",
+		"FirewallPorts",
+		"ReachableAddresses",
+		"ReachableDirAddresses",
+		"ReachableORAddresses",
+		"ClientUseIPv4",
+		"ClientUseIPv6",
+		"ClientPreferIPv6ORPort",
+
+		// Traffic analysis resistance.
+		"ConnectionPadding",
+		"ReducedConnectionPadding",
+
+		// Circuit behavior.
+		"CircuitBuildTimeout",
+		"LearnCircuitBuildTimeout",
+		"MaxCircuitDirtiness",
+		"NewCircuitPeriod",
+		"LongLivedPorts",
+		"KeepalivePeriod",
+		"PathsNeededToBuildCircuits",
+	} {
+		m[strings.ToLower(v)] = v
+	}
+	return m
+}()
+
+// sandboxOptions is the set of torrc options that are known to break the
+// sandbox, keyed by the lower case name, used to give a more informative
+// error.
+var sandboxOptions = map[string]bool{
+	"socksport":                 true,
+	"controlport":               true,
+	"controlportwritetofile":    true,
+	"datadirectory":             true,
+	"cachedirectory":            true,
+	"geoipfile":                 true,
+	"geoipv6file":               true,
+	"hashedcontrolpassword":     true,
+	"cookieauthentication":      true,
+	"__owningcontrollerprocess": true,
+	"disablenetwork":            true,
+	"clienttransportplugin":     true,
+	"bridge":                    true,
+	"usebridges":                true,
+}
+
+// ValidateExtraOptions validates the user specified torrc options against the
+// allowlist, and returns them with the option names canonicalized.
+func ValidateExtraOptions(opts map[string]string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for k, v := range opts {
+		lk := strings.ToLower(strings.TrimSpace(k))
+		name, ok := extraOptionsAllowlist[lk]
+		if sandboxOptions[lk] {
+			return nil, fmt.Errorf("tor: option would break the sandbox: %v", k)
+		} else if !ok {
+			return nil, fmt.Errorf("tor: option is not allowed: %v", k)
+		}
+		if _, ok = ret[name]; ok {
+			return nil, fmt.Errorf("tor: duplicate option: %v", name)
+		}
+
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return nil, fmt.Errorf("tor: option has no value: %v", name)
+		} else if len(v) > maxExtraOptionLen {
+			return nil, fmt.Errorf("tor: option value is too long: %v", name)
+		}
+		for _, r := range v {
+			// Prevent additional lines, or anything else weird from being
+			// smuggled into the torrc.
+			if unicode.IsControl(r) || r == '#' || r == '\\' {
+				return nil, fmt.Errorf("tor: option value has invalid characters: %v", name)
+			}
+		}
+		ret[name] = v
+	}
+	return ret, nil
+}
+
+// ParseExtraOptions parses newline separated `Option Value` torrc lines,
+// skipping blank lines and comments, and validates them.
+func ParseExtraOptions(s string) (map[string]string, error) {
+	opts := make(map[string]string)
+	seen := make(map[string]bool)
+	for i, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		idx := strings.IndexFunc(l, unicode.IsSpace)
+		if idx == -1 {
+			return nil, fmt.Errorf("tor: line %d: option has no value: %v", i+1, l)
+		}
+		k, v := l[:idx], l[idx+1:]
+		if lk := strings.ToLower(k); seen[lk] {
+			return nil, fmt.Errorf("tor: line %d: duplicate option: %v", i+1, k)
+		} else {
+			seen[lk] = true
+		}
+		opts[k] = v
+	}
+	return ValidateExtraOptions(opts)
+}
+
+// FormatExtraOptions returns the user specified torrc options as sorted,
+// newline separated `Option Value` lines.
+func FormatExtraOptions(opts map[string]string) string {
+	var keys []string
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, k+" "+opts[k])
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,220 @@
+// transports.go - Pluggable transport routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/egress"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	// PTObfs4proxy is the obfs4proxy pluggable transport binary.
+	PTObfs4proxy = "obfs4proxy"
+
+	// PTSnowflake is the snowflake pluggable transport binary.
+	PTSnowflake = "snowflake-client"
+
+	transportMeekLite  = "meek_lite"
+	transportSnowflake = "snowflake"
+)
+
+// Transports is the map of supported pluggable transports to the binary that
+// provides them.
+//
+// Note: meek is provided via obfs4proxy's `meek_lite` instead of via
+// `meek-client`, since the latter requires a helper browser instance, which
+// is something that will never, ever be allowed into the tor container.
+var Transports = map[string]string{
+	"obfs2":            PTObfs4proxy,
+	"obfs3":            PTObfs4proxy,
+	"obfs4":            PTObfs4proxy,
+	"scramblesuit":     PTObfs4proxy,
+	transportMeekLite:  PTObfs4proxy,
+	transportSnowflake: PTSnowflake,
+}
+
+// IsDomainFronted returns true if the pluggable transport requires DNS
+// resolution and TLS to function.
+func IsDomainFronted(transport string) bool {
+	return transport == transportMeekLite || transport == transportSnowflake
+}
+
+// BridgeTransports returns the sorted list of pluggable transports that will
+// be used by the bridge configuration.
+func BridgeTransports(cfg *config.Config, bridges map[string][]string) []string {
+	transports := make(map[string]bool)
+	for _, sp := range bridgeLines(cfg, bridges) {
+		if !isVanillaBridge(sp) {
+			transports[sp[0]] = true
+		}
+	}
+
+	var ret []string
+	for t := range transports {
+		ret = append(ret, t)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// TransportsByBinary groups the list of pluggable transports by the binary
+// that provides them.
+func TransportsByBinary(transports []string) map[string][]string {
+	ret := make(map[string][]string)
+	for _, t := range transports {
+		if bin := Transports[t]; bin != "" {
+			ret[bin] = append(ret[bin], t)
+		}
+	}
+	return ret
+}
+
+// TransportProxyURL returns the upstream proxy formatted for the managed
+// pluggable transport `TOR_PT_PROXY` environment variable, or "" if a proxy
+// is not configured.
+func TransportProxyURL(cfg *config.Config) (string, error) {
+	if !cfg.Tor.UseProxy {
+		return "", nil
+	}
+
+	u := &url.URL{Host: net.JoinHostPort(cfg.Tor.ProxyAddress, cfg.Tor.ProxyPort)}
+	switch cfg.Tor.ProxyType {
+	case "SOCKS 4":
+		u.Scheme = "socks4a"
+	case "SOCKS 5":
+		u.Scheme = "socks5"
+	case "HTTP(S)":
+		u.Scheme = "http"
+	default:
+		return "", fmt.Errorf("tor: Unsupported proxy type: %v", cfg.Tor.ProxyType)
+	}
+	if u.Scheme != "socks4a" && cfg.Tor.ProxyUsername != "" && cfg.Tor.ProxyPassword != "" {
+		u.User = url.UserPassword(cfg.Tor.ProxyUsername, cfg.Tor.ProxyPassword)
+	}
+	return u.String(), nil
+}
+
+// EgressPolicy returns the policy for the sandboxed tor's outgoing
+// connections, when it has a network namespace of it's own.  If a proxy or
+// bridges are configured, tor is only allowed to connect to the proxy, the
+// vanilla bridges and the pluggable transports, so that a misconfiguration
+// can't result in direct connections to the tor network.  Otherwise tor may
+// connect to any public address, and the proxy and pluggable transports.
+//
+// The pluggable transports run in a sandbox of their own, with the host
+// network, so where they connect to is restricted by TransportPolicy.
+func EgressPolicy(cfg *config.Config, bridges map[string][]string, ptMethods map[string]string) (*egress.Policy, error) {
+	var dests []string
+	for _, v := range ptMethods {
+		dests = append(dests, v)
+	}
+
+	// This mirrors CfgToSandboxTorrc, tor only uses the proxy itself if there
+	// are no pluggable transports.
+	useProxy := cfg.Tor.UseProxy && len(ptMethods) == 0
+	if useProxy {
+		proxyAddr := net.JoinHostPort(cfg.Tor.ProxyAddress, cfg.Tor.ProxyPort)
+		if _, err := net.ResolveTCPAddr("tcp", proxyAddr); err != nil || net.ParseIP(cfg.Tor.ProxyAddress) == nil {
+			return nil, fmt.Errorf("tor: Invalid proxy address: '%v'", proxyAddr)
+		}
+		dests = append(dests, proxyAddr)
+	}
+
+	p := new(egress.Policy)
+	if !cfg.Tor.UseBridges && !useProxy {
+		p.Exceptions = dests
+		sort.Strings(p.Exceptions)
+		return p, nil
+	}
+
+	// Vanilla bridges are connected to via the proxy, if any.
+	if !useProxy {
+		for _, sp := range bridgeLines(cfg, bridges) {
+			if !isVanillaBridge(sp) {
+				continue
+			}
+			host, _, err := net.SplitHostPort(sp[0])
+			if err != nil || net.ParseIP(host) == nil {
+				return nil, fmt.Errorf("tor: Invalid bridge address: '%v'", sp[0])
+			}
+			dests = append(dests, sp[0])
+		}
+	}
+	p.Allowed = append([]string{}, dests...)
+	sort.Strings(p.Allowed)
+	return p, nil
+}
+
+// TransportPolicy returns the policy for the SOCKS requests made to the
+// pluggable transport providing transport, which only allows the addresses of
+// the configured bridges that use it.
+func TransportPolicy(cfg *config.Config, bridges map[string][]string, transport string) (*egress.Policy, error) {
+	p := &egress.Policy{Allowed: []string{}}
+	for _, sp := range bridgeLines(cfg, bridges) {
+		if isVanillaBridge(sp) || sp[0] != transport {
+			continue
+		}
+		if len(sp) < 2 {
+			return nil, fmt.Errorf("tor: Missing bridge address: '%v'", strings.Join(sp, " "))
+		}
+		host, _, err := net.SplitHostPort(sp[1])
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("tor: Invalid bridge address: '%v'", sp[1])
+		}
+		p.Allowed = append(p.Allowed, sp[1])
+	}
+	sort.Strings(p.Allowed)
+	return p, nil
+}
+
+// bridgeLines returns the bridge lines that will be used by the bridge
+// configuration, split into fields, with the optional `Bridge` prefix
+// removed.
+func bridgeLines(cfg *config.Config, bridges map[string][]string) [][]string {
+	if !cfg.Tor.UseBridges {
+		return nil
+	}
+
+	var lines []string
+	if !cfg.Tor.UseCustomBridges {
+		lines = bridges[cfg.Tor.InternalBridgeType]
+	} else {
+		lines = strings.Split(cfg.Tor.CustomBridges, "\n")
+	}
+
+	var ret [][]string
+	for _, l := range lines {
+		sp := strings.Fields(l)
+		if len(sp) > 0 && strings.ToLower(sp[0]) == "bridge" {
+			sp = sp[1:]
+		}
+		if len(sp) != 0 {
+			ret = append(ret, sp)
+		}
+	}
+	return ret
+}
+
+func isVanillaBridge(sp []string) bool {
+	return strings.Contains(sp[0], ":")
+}
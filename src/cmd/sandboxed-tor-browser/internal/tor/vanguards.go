@@ -0,0 +1,298 @@
+// vanguards.go - Layered guard (vanguards) controller.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	vanguardsStateFile = "vanguards.json"
+	vanguardsInterval  = 1 * time.Hour
+
+	// The layer sizes and lifetimes are the same as the vanguards
+	// controller's defaults.
+	numLayer2Guards   = 4
+	numLayer3Guards   = 8
+	layer2MinLifetime = 24 * time.Hour
+	layer2MaxLifetime = 45 * 24 * time.Hour
+	layer3MinLifetime = 1 * time.Hour
+	layer3MaxLifetime = 48 * time.Hour
+)
+
+// ErrLayeredGuardsUnsupported is the error returned when the tor instance
+// does not support `HSLayer2Nodes`/`HSLayer3Nodes`.
+var ErrLayeredGuardsUnsupported = errors.New("tor: layered guards are enabled, but are not supported by this tor version, disable them to launch")
+
+type vanguard struct {
+	Fingerprint string `json:"fingerprint"`
+	Expires     int64  `json:"expires"`
+}
+
+type vanguardsState struct {
+	Layer2 []*vanguard `json:"layer2"`
+	Layer3 []*vanguard `json:"layer3"`
+}
+
+type consensusRelay struct {
+	fingerprint string
+	bandwidth   int64
+}
+
+// vanguardsManager picks and rotates the second and third hop guards used
+// for onion service circuits, applying them to tor over the control port.
+// tor does not pick the layered guards itself, so this must run for the
+// lifetime of the tor instance.
+type vanguardsManager struct {
+	tor       *Tor
+	statePath string
+	state     vanguardsState
+	closeCh   chan interface{}
+}
+
+func (m *vanguardsManager) worker() {
+	ticker := time.NewTicker(vanguardsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		if err := m.update(); err == ErrTorNotRunning {
+			return
+		} else if err != nil {
+			log.Printf("tor: Failed to update the layered guards: %v", err)
+		}
+	}
+}
+
+func (m *vanguardsManager) update() error {
+	relays, err := m.tor.consensusRelays()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m.state.Layer2, err = refillLayer(m.state.Layer2, relays, numLayer2Guards, layer2MinLifetime, layer2MaxLifetime, now)
+	if err != nil {
+		return err
+	}
+	m.state.Layer3, err = refillLayer(m.state.Layer3, relays, numLayer3Guards, layer3MinLifetime, layer3MaxLifetime, now)
+	if err != nil {
+		return err
+	}
+
+	if b, err := json.Marshal(&m.state); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(m.statePath, b, FileMode); err != nil {
+		return err
+	}
+
+	_, err = m.tor.setconf(fmt.Sprintf("HSLayer2Nodes=%s HSLayer3Nodes=%s", layerNodes(m.state.Layer2), layerNodes(m.state.Layer3)))
+	return err
+}
+
+func (m *vanguardsManager) close() {
+	close(m.closeCh)
+}
+
+// launchVanguards starts managing the layered guards.  The layers are
+// persisted in the tor data directory, so that they are only rotated when
+// they expire.
+func (t *Tor) launchVanguards(cfg *config.Config) error {
+	if _, err := t.getconf("HSLayer2Nodes"); err != nil {
+		return ErrLayeredGuardsUnsupported
+	}
+
+	m := &vanguardsManager{
+		tor:       t,
+		statePath: filepath.Join(cfg.TorDataDir, vanguardsStateFile),
+		closeCh:   make(chan interface{}),
+	}
+	if b, err := ioutil.ReadFile(m.statePath); err == nil {
+		if err = json.Unmarshal(b, &m.state); err != nil {
+			log.Printf("tor: Discarding malformed layered guard state: %v", err)
+			m.state = vanguardsState{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := m.update(); err != nil {
+		return err
+	}
+	log.Printf("tor: Layered guards enabled.")
+
+	t.vanguards = m
+	go m.worker()
+	return nil
+}
+
+func (t *Tor) consensusRelays() (map[string]*consensusRelay, error) {
+	resp, err := t.getinfo("ns/all")
+	if err != nil {
+		return nil, err
+	}
+
+	// r <nickname> <identity> <digest> <date> <time> <ip> <orport> <dirport>
+	// s <flags>
+	// w Bandwidth=<bw>
+	relays := make(map[string]*consensusRelay)
+	var r *consensusRelay
+	for _, l := range resp.RawLines {
+		sp := strings.Fields(l)
+		if len(sp) < 2 {
+			continue
+		}
+		switch sp[0] {
+		case "r":
+			r = nil
+			if len(sp) < 3 {
+				continue
+			}
+			id, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(sp[2], "="))
+			if err != nil {
+				continue
+			}
+			r = &consensusRelay{fingerprint: strings.ToUpper(hex.EncodeToString(id))}
+		case "s":
+			if r == nil {
+				continue
+			}
+			flags := make(map[string]bool)
+			for _, f := range sp[1:] {
+				flags[f] = true
+			}
+			if !flags["Fast"] || !flags["Stable"] || !flags["Valid"] || !flags["Running"] || flags["BadExit"] {
+				r = nil
+			}
+		case "w":
+			if r == nil || !strings.HasPrefix(sp[1], "Bandwidth=") {
+				continue
+			}
+			bw, err := strconv.ParseInt(strings.TrimPrefix(sp[1], "Bandwidth="), 10, 64)
+			if err == nil && bw > 0 {
+				r.bandwidth = bw
+				relays[r.fingerprint] = r
+			}
+			r = nil
+		}
+	}
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("tor: no suitable relays in the consensus")
+	}
+	return relays, nil
+}
+
+func refillLayer(layer []*vanguard, relays map[string]*consensusRelay, n int, minLifetime, maxLifetime time.Duration, now time.Time) ([]*vanguard, error) {
+	// Drop the expired guards, and the ones that are no longer suitable.
+	var ret []*vanguard
+	inUse := make(map[string]bool)
+	for _, v := range layer {
+		if v.Expires > now.Unix() && relays[v.Fingerprint] != nil && !inUse[v.Fingerprint] {
+			ret = append(ret, v)
+			inUse[v.Fingerprint] = true
+		}
+	}
+
+	for len(ret) < n && len(inUse) < len(relays) {
+		r, err := pickRelay(relays, inUse)
+		if err != nil {
+			return nil, err
+		}
+		lifetime, err := pickLifetime(minLifetime, maxLifetime)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &vanguard{Fingerprint: r.fingerprint, Expires: now.Add(lifetime).Unix()})
+		inUse[r.fingerprint] = true
+	}
+	return ret, nil
+}
+
+func pickRelay(relays map[string]*consensusRelay, exclude map[string]bool) (*consensusRelay, error) {
+	// Bandwidth weighted selection.
+	var candidates []*consensusRelay
+	// The bandwidths come from the consensus, so the total is calculated
+	// with arbitrary precision to avoid trusting them not to overflow.
+	total := new(big.Int)
+	for _, r := range relays {
+		if !exclude[r.fingerprint] {
+			candidates = append(candidates, r)
+			total.Add(total, big.NewInt(r.bandwidth))
+		}
+	}
+	if total.Sign() <= 0 {
+		return nil, fmt.Errorf("tor: no suitable relays left")
+	}
+
+	pos, err := rand.Int(rand.Reader, total)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range candidates {
+		bw := big.NewInt(r.bandwidth)
+		if pos.Cmp(bw) < 0 {
+			return r, nil
+		}
+		pos.Sub(pos, bw)
+	}
+	return nil, fmt.Errorf("tor: weighted relay selection overflowed")
+}
+
+func pickLifetime(min, max time.Duration) (time.Duration, error) {
+	// Like the vanguards controller, use the max of two uniformly random
+	// values, to skew towards longer lifetimes.
+	var d time.Duration
+	for i := 0; i < 2; i++ {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+		if err != nil {
+			return 0, err
+		}
+		if dd := min + time.Duration(v.Int64()); dd > d {
+			d = dd
+		}
+	}
+	return d, nil
+}
+
+func layerNodes(layer []*vanguard) string {
+	var s []string
+	for _, v := range layer {
+		s = append(s, v.Fingerprint)
+	}
+	return strings.Join(s, ",")
+}
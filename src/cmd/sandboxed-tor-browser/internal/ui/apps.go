@@ -0,0 +1,66 @@
+// apps.go - Sandboxed application profile command.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"log"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+const cmdRunProfile = "run-profile"
+
+// runAppProfile launches the application described by the sandbox profile
+// passed to the `run-profile` command, and waits for it to exit.  The
+// application gets the same tor instance as the browser would, if it uses
+// the `tor` network mode.
+func (c *Common) runAppProfile() error {
+	if c.appProfilePath == "" {
+		return nil
+	}
+	c.RanCommand = true
+
+	p, err := sandbox.LoadProfile(c.appProfilePath)
+	if err != nil {
+		return err
+	}
+
+	if p.Network == sandbox.NetworkTor {
+		if !c.Cfg.UseSystemTor && c.NeedsInstall() {
+			return fmt.Errorf("the bundle is not installed")
+		}
+
+		async := NewAsync()
+		async.UpdateProgress = func(s string) {
+			log.Printf("launch: %v", s)
+		}
+		if err = c.launchTor(async, false); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("launch: Starting '%v'.", p.Name)
+	proc, err := sandbox.RunProfile(c.Cfg, c.tor, p)
+	if err != nil {
+		return err
+	}
+	proc.Wait()
+	log.Printf("launch: '%v' exited.", p.Name)
+	return nil
+}
@@ -0,0 +1,86 @@
+// bridges.go - Bridge reachability testing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+
+	"cmd/sandboxed-tor-browser/internal/bridges"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+// DoTestBridges tests the reachability of each bridge by connecting to it
+// with a throwaway sandboxed tor instance, storing the per-bridge result in
+// the corresponding entry of results.  This is blocking and should be run
+// from a go routine, with the appropriate Async structure used to
+// communicate.
+func (c *Common) DoTestBridges(async *Async, bs []*bridges.Bridge, results []error) {
+	async.Err = nil
+	defer func() {
+		if len(async.Cancel) > 0 {
+			<-async.Cancel
+		}
+		runtime.GC()
+		async.Done <- true
+	}()
+
+	if len(results) != len(bs) {
+		panic("ui: bridge test results length mismatch")
+	}
+	if c.NeedsInstall() {
+		async.Err = fmt.Errorf("bridge test failed, installation required")
+		return
+	}
+
+	for i, b := range bs {
+		async.UpdateProgress(fmt.Sprintf("Testing bridge %d of %d.", i+1, len(bs)))
+		if results[i] = c.testBridge(async, b); results[i] == ErrCanceled {
+			async.Err = ErrCanceled
+			return
+		}
+		log.Printf("bridges: %v: %v", b.Addr, results[i])
+	}
+}
+
+func (c *Common) testBridge(async *Async, b *bridges.Bridge) error {
+	// Use a throwaway copy of the config, with a throwaway data directory,
+	// so that neither the persisted config nor the tor state get altered.
+	dataDir, err := ioutil.TempDir(c.Cfg.RuntimeDir, "bridgeTest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dataDir)
+
+	cfg := c.Cfg.Clone()
+	cfg.TorDataDir = dataDir
+	cfg.Tor.SetUseBridges(true)
+	cfg.Tor.SetUseCustomBridges(true)
+	cfg.Tor.SetCustomBridges(b.String())
+
+	t, err := c.runSandboxedTor(cfg, async)
+	if err != nil {
+		return err
+	}
+	defer t.Shutdown()
+
+	t.EnableReachabilityTest()
+	return t.DoBootstrap(cfg, async)
+}
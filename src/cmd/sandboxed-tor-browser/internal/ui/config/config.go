@@ -18,13 +18,17 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	gonet "net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"time"
 
 	butils "git.schwanenlied.me/yawning/bulb.git/utils"
@@ -45,11 +49,49 @@ const (
 	appDir           = "sandboxed-tor-browser"
 	bundleInstallDir = "tor-browser"
 	torDataDir       = "tor"
+	ptStateDir       = "pt_state"
+	quarantineDir    = "quarantine"
+	sessionsDir      = "sessions"
+	disposablePrefix = "disposable-"
+	storageKeyFile   = "storage.key"
+	profileVaultFile = "profile.vault"
+	torVaultFile     = "tor.vault"
+	unlockedDir      = "unlocked"
+
+	maxSessionNameLen = 32
 )
 
 // TorProxyTypes are the proxy protocols supported by tor.
 var TorProxyTypes = []string{"SOCKS 4", "SOCKS 5", "HTTP(S)"}
 
+const (
+	// SystemTorAuthAuto uses the best authentication method supported by the
+	// system tor daemon.
+	SystemTorAuthAuto = "auto"
+
+	// SystemTorAuthNull uses no authentication.
+	SystemTorAuthNull = "NULL"
+
+	// SystemTorAuthCookie uses COOKIE authentication.
+	SystemTorAuthCookie = "COOKIE"
+
+	// SystemTorAuthSafeCookie uses SAFECOOKIE authentication.
+	SystemTorAuthSafeCookie = "SAFECOOKIE"
+
+	// SystemTorAuthPassword uses HASHEDPASSWORD authentication.
+	SystemTorAuthPassword = "HASHEDPASSWORD"
+)
+
+// SystemTorAuthMethods are the control port authentication methods that can
+// be used with a system tor daemon.
+var SystemTorAuthMethods = []string{
+	SystemTorAuthAuto,
+	SystemTorAuthNull,
+	SystemTorAuthCookie,
+	SystemTorAuthSafeCookie,
+	SystemTorAuthPassword,
+}
+
 // Tor contains the Tor network config options.
 type Tor struct {
 	cfg *Config
@@ -91,6 +133,24 @@ type Tor struct {
 
 	// CustomBridges is the user provided bridge lines.
 	CustomBridges string `json:"customBridges"`
+
+	// UseAutoConnect is if the launcher should automatically try
+	// progressively stronger bridge configurations when the bootstrap
+	// stalls or fails.
+	UseAutoConnect bool `json:"useAutoConnect"`
+
+	// AutoConnectStrategy is the auto-connect strategy that last resulted
+	// in a successful bootstrap.
+	AutoConnectStrategy string `json:"autoConnectStrategy,omitempty"`
+
+	// UseLayeredGuards is if the second and third hops of onion service
+	// circuits should be restricted to long lived sets of relays
+	// (vanguards), to mitigate guard discovery attacks.
+	UseLayeredGuards bool `json:"useLayeredGuards"`
+
+	// ExtraOptions is the additional user specified torrc options, which are
+	// restricted to an allowlist.
+	ExtraOptions map[string]string `json:"extraOptions,omitempty"`
 }
 
 // SetUseProxy sets if the Tor network should be reached via a local proxy and
@@ -192,6 +252,111 @@ func (t *Tor) SetUseCustomBridges(b bool) {
 	}
 }
 
+// SetUseAutoConnect sets if the launcher should automatically pick a working
+// bridge configuration and marks the config dirty.
+func (t *Tor) SetUseAutoConnect(b bool) {
+	if t.UseAutoConnect != b {
+		t.UseAutoConnect = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetAutoConnectStrategy sets the auto-connect strategy that last resulted
+// in a successful bootstrap and marks the config dirty.
+func (t *Tor) SetAutoConnectStrategy(s string) {
+	if t.AutoConnectStrategy != s {
+		t.AutoConnectStrategy = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetUseLayeredGuards sets if layered guards should be used for onion
+// service circuits and marks the config dirty.
+func (t *Tor) SetUseLayeredGuards(b bool) {
+	if t.UseLayeredGuards != b {
+		t.UseLayeredGuards = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetExtraOptions sets the additional user specified torrc options and marks
+// the config dirty.
+func (t *Tor) SetExtraOptions(m map[string]string) {
+	if !reflect.DeepEqual(t.ExtraOptions, m) {
+		t.ExtraOptions = m
+		t.cfg.isDirty = true
+	}
+}
+
+// SystemTor contains the system tor daemon config options.
+type SystemTor struct {
+	cfg *Config
+
+	// Enable is if a system tor daemon should be used instead of launching
+	// a sandboxed tor instance.
+	Enable bool `json:"enable"`
+
+	// ControlPort is the system tor daemon control port, in the same format
+	// as the `TOR_CONTROL_PORT` environment variable.
+	ControlPort string `json:"controlPort,omitempty"`
+
+	// AuthMethod is the control port authentication method.
+	AuthMethod string `json:"authMethod,omitempty"`
+
+	// CookiePath is the optional control port authentication cookie path,
+	// overriding the one reported by the system tor daemon.
+	CookiePath string `json:"cookiePath,omitempty"`
+
+	// Password is the control port password for HASHEDPASSWORD
+	// authentication.
+	Password string `json:"password,omitempty"`
+}
+
+// SetEnable sets if a system tor daemon should be used and marks the config
+// dirty.
+func (t *SystemTor) SetEnable(b bool) {
+	if t.Enable != b {
+		t.Enable = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SetControlPort sets the system tor daemon control port and marks the
+// config dirty.
+func (t *SystemTor) SetControlPort(s string) {
+	if t.ControlPort != s {
+		t.ControlPort = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetAuthMethod sets the system tor daemon control port authentication
+// method and marks the config dirty.
+func (t *SystemTor) SetAuthMethod(s string) {
+	if t.AuthMethod != s {
+		t.AuthMethod = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetCookiePath sets the system tor daemon control port authentication
+// cookie path and marks the config dirty.
+func (t *SystemTor) SetCookiePath(s string) {
+	if t.CookiePath != s {
+		t.CookiePath = s
+		t.cfg.isDirty = true
+	}
+}
+
+// SetPassword sets the system tor daemon control port password and marks the
+// config dirty.
+func (t *SystemTor) SetPassword(s string) {
+	if t.Password != s {
+		t.Password = s
+		t.cfg.isDirty = true
+	}
+}
+
 // Sandbox contains the sandbox specific config options.
 type Sandbox struct {
 	cfg *Config
@@ -221,6 +386,31 @@ type Sandbox struct {
 	// DownloadsDir is the directory to be bind mounted instead of the default
 	// bundle Downloads directory.
 	DownloadsDir string `json:"downloadsDir,omitEmpty"`
+
+	// EnableDownloadQuarantine enables the download quarantine, where
+	// downloads land in a directory only visible to the sandbox, and must be
+	// explicitly exported to be visible on the host.
+	EnableDownloadQuarantine bool `json:"enableDownloadQuarantine"`
+
+	// ScrubDownloadMetadata enables removing the metadata from the supported
+	// file formats when exporting downloads from the quarantine.
+	ScrubDownloadMetadata bool `json:"scrubDownloadMetadata"`
+
+	// EnableLandlock enables restricting the directories that Tor Browser
+	// can write to with Landlock, on kernels that support it.
+	EnableLandlock bool `json:"enableLandlock"`
+
+	// IsolateTorNetwork runs tor in it's own network namespace, with
+	// outgoing TCP connections made by the launcher on it's behalf.
+	IsolateTorNetwork bool `json:"isolateTorNetwork"`
+
+	// EnableCrashReports enables Tor Browser's crash reporter, with the
+	// minidumps only ever summarized by the launcher, and never submitted.
+	EnableCrashReports bool `json:"enableCrashReports"`
+
+	// BwrapPath is the bubblewrap binary to use instead of the one in
+	// `PATH`.
+	BwrapPath string `json:"bwrapPath,omitEmpty"`
 }
 
 // SetDisplay sets the sandbox `DISPLAY` override and marks the config dirty.
@@ -285,6 +475,59 @@ func (sb *Sandbox) SetDesktopDir(s string) {
 	}
 }
 
+// SetEnableDownloadQuarantine sets the download quarantine enable and marks
+// the config dirty.
+func (sb *Sandbox) SetEnableDownloadQuarantine(b bool) {
+	if sb.EnableDownloadQuarantine != b {
+		sb.EnableDownloadQuarantine = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetScrubDownloadMetadata sets the download metadata scrubbing enable and
+// marks the config dirty.
+func (sb *Sandbox) SetScrubDownloadMetadata(b bool) {
+	if sb.ScrubDownloadMetadata != b {
+		sb.ScrubDownloadMetadata = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableLandlock sets the Landlock enable and marks the config dirty.
+func (sb *Sandbox) SetEnableLandlock(b bool) {
+	if sb.EnableLandlock != b {
+		sb.EnableLandlock = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetIsolateTorNetwork sets the tor network namespace enable and marks the
+// config dirty.
+func (sb *Sandbox) SetIsolateTorNetwork(b bool) {
+	if sb.IsolateTorNetwork != b {
+		sb.IsolateTorNetwork = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetEnableCrashReports sets the local crash report enable and marks the
+// config dirty.
+func (sb *Sandbox) SetEnableCrashReports(b bool) {
+	if sb.EnableCrashReports != b {
+		sb.EnableCrashReports = b
+		sb.cfg.isDirty = true
+	}
+}
+
+// SetBwrapPath sets the bubblewrap binary override and marks the config
+// dirty.
+func (sb *Sandbox) SetBwrapPath(s string) {
+	if sb.BwrapPath != s {
+		sb.BwrapPath = s
+		sb.cfg.isDirty = true
+	}
+}
+
 // Config is the sandboxed-tor-browser configuration instance.
 type Config struct {
 	// Architecture is the current architecture derived at runtime ("linux32",
@@ -313,6 +556,9 @@ type Config struct {
 	// Sandbox is the sandbox configuration.
 	Sandbox Sandbox `json:"sandbox,omitEmpty"`
 
+	// SystemTor is the system tor daemon configuration.
+	SystemTor SystemTor `json:"systemTor,omitEmpty"`
+
 	// FirstLaunch is set for the first launch post install.
 	FirstLaunch bool `json:"firstLaunch"`
 
@@ -329,9 +575,56 @@ type Config struct {
 	// SystemTorControlAddr is the system tor daemon control port address.
 	SystemTorControlAddr string `json:"-"`
 
-	// RumtineDir is `$XDG_RUNTIME_DIR/appDir`.
+	// SystemTorFromEnv indicates that the system tor daemon control port was
+	// specified via the `TOR_CONTROL_PORT` environment variable, overriding
+	// the SystemTor config.
+	SystemTorFromEnv bool `json:"-"`
+
+	// Session is the name of the browser session, or "" for the default
+	// session.
+	Session string `json:"-"`
+
+	// SharedRuntimeDir is `$XDG_RUNTIME_DIR/appDir`.
+	SharedRuntimeDir string `json:"-"`
+
+	// RumtineDir is `SharedRuntimeDir`, or `SharedRuntimeDir/sessions/Session`
+	// for named sessions.
 	RuntimeDir string `json:"-"`
 
+	// SessionDataDir is `UserDataDir/sessions/Session` for named sessions,
+	// `RuntimeDir` for disposable sessions, and "" for the default session,
+	// which uses the bundle's profile.
+	SessionDataDir string `json:"-"`
+
+	// Disposable indicates that the session is disposable, and that the
+	// profile, downloads and tor state should not outlive it.
+	Disposable bool `json:"-"`
+
+	// EncryptedStorage indicates that the profile and tor data directories
+	// are encrypted at rest, and get unlocked into `RuntimeDir` at launch.
+	EncryptedStorage bool `json:"-"`
+
+	// StorageKeyFile is `UserDataDir/storage.key`, the passphrase protected
+	// key that the profile and tor data directories are encrypted with.
+	StorageKeyFile string `json:"-"`
+
+	// ProfileVault is the encrypted profile, in `SessionDataDir` for named
+	// sessions, and `UserDataDir` otherwise.
+	ProfileVault string `json:"-"`
+
+	// TorVault is `UserDataDir/tor.vault`, the encrypted tor data directory.
+	TorVault string `json:"-"`
+
+	// UnlockedProfileDir is where the encrypted profile is unlocked to, if
+	// storage encryption is enabled.  The tor data directory is unlocked to
+	// `TorDataDir`.
+	UnlockedProfileDir string `json:"-"`
+
+	// UnlockedQuarantineDir is where the download quarantine is kept, if
+	// storage encryption is enabled, so that downloads are never written
+	// to disk unencrypted.
+	UnlockedQuarantineDir string `json:"-"`
+
 	// UserDataDir is `$XDG_USER_DATA_DIR/appDir`.
 	UserDataDir string `json:"-"`
 
@@ -341,6 +634,11 @@ type Config struct {
 	// TorDataDir is `UserDataDir/torDataDir`.
 	TorDataDir string `json:"-"`
 
+	// PtStateDir is `UserDataDir/ptStateDir`, the pluggable transport state
+	// directory, which is kept under `SharedRuntimeDir` instead for
+	// disposable sessions, and if storage encryption is enabled.
+	PtStateDir string `json:"-"`
+
 	// ConfigDir is `XDG_CONFIG_HOME/appDir`.
 	ConfigDir string `json:"-"`
 
@@ -385,6 +683,14 @@ func (cfg *Config) NeedsUpdateCheck() bool {
 	return (now > cfg.LastUpdateCheck+updateInterval) || cfg.LastUpdateCheck > now
 }
 
+// IsolatesTorNetwork returns true if tor should be run in a network namespace
+// of it's own.  This is always the case when a proxy or bridges are
+// configured, since the egress policy that prevents direct connections to the
+// tor network is only enforced for an isolated tor.
+func (cfg *Config) IsolatesTorNetwork() bool {
+	return cfg.Sandbox.IsolateTorNetwork || cfg.Tor.UseProxy || cfg.Tor.UseBridges
+}
+
 // SetLastUpdateCheck sets the last update check time and marks the config
 // dirty.
 func (cfg *Config) SetLastUpdateCheck(t int64) {
@@ -424,6 +730,11 @@ func (cfg *Config) Sanitize() {
 
 // Sync flushes config changes to disk, if the config is dirty.
 func (cfg *Config) Sync() error {
+	if cfg.path == "" {
+		// Cloned configs are never persisted.
+		cfg.isDirty = false
+		return nil
+	}
 	if cfg.isDirty {
 		// Encode to JSON and write to disk.
 		if b, err := json.Marshal(&cfg); err != nil {
@@ -437,6 +748,127 @@ func (cfg *Config) Sync() error {
 	return nil
 }
 
+// Clone returns a copy of the config that will never be written to disk,
+// suitable for launching throwaway instances of things.
+func (cfg *Config) Clone() *Config {
+	c := new(Config)
+	*c = *cfg
+	c.Tor.cfg = c
+	c.Sandbox.cfg = c
+	c.SystemTor.cfg = c
+	c.path = ""
+	return c
+}
+
+// UpdateSystemTor derives the system tor daemon control port from the
+// SystemTor config, unless it was specified via the environment.
+func (cfg *Config) UpdateSystemTor() error {
+	if cfg.SystemTorFromEnv {
+		return nil
+	}
+
+	cfg.UseSystemTor = false
+	cfg.SystemTorControlNet = ""
+	cfg.SystemTorControlAddr = ""
+	if !cfg.SystemTor.Enable {
+		return nil
+	}
+
+	net, addr, err := ParseControlPort(cfg.SystemTor.ControlPort)
+	if err != nil {
+		return err
+	}
+	cfg.UseSystemTor = true
+	cfg.SystemTorControlNet = net
+	cfg.SystemTorControlAddr = addr
+	return nil
+}
+
+// ParseControlPort parses a system tor daemon control port specification,
+// refusing TCP control ports that are not on the loopback interface.
+func ParseControlPort(s string) (net, addr string, err error) {
+	if net, addr, err = butils.ParseControlPortString(s); err != nil {
+		return "", "", fmt.Errorf("invalid control port: %v", err)
+	}
+	if net == "tcp" {
+		host, _, _ := gonet.SplitHostPort(addr)
+		if !gonet.ParseIP(host).IsLoopback() {
+			return "", "", fmt.Errorf("non-loopback control port: %v", host)
+		}
+	}
+	return
+}
+
+// UseSession switches the config to a named browser session, with it's own
+// runtime and profile directories.  The bundle, tor and the rest of the
+// config are shared with all of the other sessions.
+func (cfg *Config) UseSession(name string) error {
+	if err := ValidateSessionName(name); err != nil {
+		return err
+	}
+	cfg.Session = name
+	cfg.RuntimeDir = filepath.Join(cfg.SharedRuntimeDir, sessionsDir, name)
+	cfg.SessionDataDir = filepath.Join(cfg.UserDataDir, sessionsDir, name)
+	return nil
+}
+
+// UseDisposable switches the config to a disposable browser session, that
+// keeps everything but the bundle under `SharedRuntimeDir`, with a tor data
+// directory of it's own.  The config of a disposable session is never
+// written to disk.
+func (cfg *Config) UseDisposable() error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	name := disposablePrefix + hex.EncodeToString(b[:])
+
+	cfg.Session = name
+	cfg.Disposable = true
+	cfg.RuntimeDir = filepath.Join(cfg.SharedRuntimeDir, sessionsDir, name)
+	cfg.SessionDataDir = cfg.RuntimeDir
+	cfg.TorDataDir = filepath.Join(cfg.RuntimeDir, torDataDir)
+	cfg.PtStateDir = filepath.Join(cfg.RuntimeDir, ptStateDir)
+	cfg.path = ""
+	return nil
+}
+
+// UseEncryptedStorage switches the config to unlocking the profile and the
+// tor data directory from their vaults into the runtime directories.  The tor
+// data directory is in `SharedRuntimeDir`, so that all of the sessions can
+// share the tor instance.
+func (cfg *Config) UseEncryptedStorage() {
+	cfg.EncryptedStorage = true
+	if cfg.SessionDataDir != "" {
+		cfg.ProfileVault = filepath.Join(cfg.SessionDataDir, profileVaultFile)
+	} else {
+		cfg.ProfileVault = filepath.Join(cfg.UserDataDir, profileVaultFile)
+	}
+	cfg.UnlockedProfileDir = filepath.Join(cfg.RuntimeDir, unlockedDir, "profile")
+	cfg.UnlockedQuarantineDir = filepath.Join(cfg.RuntimeDir, unlockedDir, quarantineDir)
+	cfg.TorDataDir = filepath.Join(cfg.SharedRuntimeDir, unlockedDir, torDataDir)
+	cfg.PtStateDir = filepath.Join(cfg.SharedRuntimeDir, unlockedDir, ptStateDir)
+}
+
+// ValidateSessionName validates a browser session name, which is used as a
+// path component and as part of the isolation tag.
+func ValidateSessionName(name string) error {
+	if name == "" || len(name) > maxSessionNameLen {
+		return fmt.Errorf("invalid session name length: %d", len(name))
+	}
+	if strings.HasPrefix(name, disposablePrefix) {
+		return fmt.Errorf("session names starting with '%v' are reserved", disposablePrefix)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return fmt.Errorf("invalid character in session name: %q", r)
+		}
+	}
+	return nil
+}
+
 // ResetDirty resets the config's dirty flag, causing changes to be discarded on
 // the Sync call.  This routine should only be used immediately prior to
 // termination.
@@ -465,19 +897,13 @@ func New(version string) (*Config, error) {
 		return nil, fmt.Errorf("unsupported Arch: %v", runtime.GOARCH)
 	}
 	if env := os.Getenv(envControlPort); env != "" {
-		if net, addr, err := butils.ParseControlPortString(env); err != nil {
-			return nil, fmt.Errorf("invalid control port: %v", err)
+		if net, addr, err := ParseControlPort(env); err != nil {
+			return nil, err
 		} else {
-			// Refuse to use TCP control ports not on the loopback interface.
-			if net == "tcp" {
-				host, _, _ := gonet.SplitHostPort(addr)
-				if !gonet.ParseIP(host).IsLoopback() {
-					return nil, fmt.Errorf("non-loopback control port: %v", host)
-				}
-			}
 			cfg.UseSystemTor = true
 			cfg.SystemTorControlNet = net
 			cfg.SystemTorControlAddr = addr
+			cfg.SystemTorFromEnv = true
 		}
 	}
 
@@ -486,7 +912,8 @@ func New(version string) (*Config, error) {
 	if d := os.Getenv(envRuntimeDir); d == "" {
 		return nil, fmt.Errorf("no `%s` set in the enviornment", envRuntimeDir)
 	} else {
-		cfg.RuntimeDir = filepath.Join(d, appDir)
+		cfg.SharedRuntimeDir = filepath.Join(d, appDir)
+		cfg.RuntimeDir = cfg.SharedRuntimeDir
 	}
 	if d, err := xdg.DataHomeDirectory(); err != nil {
 		return nil, err
@@ -494,6 +921,9 @@ func New(version string) (*Config, error) {
 		cfg.UserDataDir = filepath.Join(d, appDir)
 		cfg.BundleInstallDir = filepath.Join(cfg.UserDataDir, bundleInstallDir)
 		cfg.TorDataDir = filepath.Join(cfg.UserDataDir, torDataDir)
+		cfg.PtStateDir = filepath.Join(cfg.UserDataDir, ptStateDir)
+		cfg.StorageKeyFile = filepath.Join(cfg.UserDataDir, storageKeyFile)
+		cfg.TorVault = filepath.Join(cfg.UserDataDir, torVaultFile)
 		cfg.manifestPath = filepath.Join(cfg.UserDataDir, manifestFile)
 	}
 
@@ -533,8 +963,17 @@ func New(version string) (*Config, error) {
 	if cfg.Locale == "" {
 		cfg.SetLocale(defaultLocale)
 	}
+	if cfg.SystemTor.AuthMethod == "" {
+		cfg.SystemTor.AuthMethod = SystemTorAuthAuto
+	}
 	cfg.Tor.cfg = cfg
 	cfg.Sandbox.cfg = cfg
+	cfg.SystemTor.cfg = cfg
+
+	// Use the system tor daemon if one is configured.
+	if err := cfg.UpdateSystemTor(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
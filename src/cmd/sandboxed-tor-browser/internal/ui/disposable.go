@@ -0,0 +1,56 @@
+// disposable.go - Disposable session routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DisposableDownloadsDir returns the host path of the disposable session's
+// `Downloads` directory, or "" if the session is not disposable.
+func (c *Common) DisposableDownloadsDir() string {
+	if !c.Cfg.Disposable {
+		return ""
+	}
+	return filepath.Join(c.Cfg.SessionDataDir, "Downloads")
+}
+
+// DisposableDownloads returns the names of the files in the disposable
+// session's `Downloads` directory.
+func (c *Common) DisposableDownloads() ([]string, error) {
+	dir := c.DisposableDownloadsDir()
+	if dir == "" {
+		return nil, nil
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,86 @@
+// explain.go - Sandbox dry-run routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
+)
+
+// ExplainSandboxes describes the tor (unless a system tor is used) and the
+// Tor Browser sandboxes, as they would be launched with the current config.
+func (c *Common) ExplainSandboxes() ([]*sandbox.Explanation, error) {
+	if c.Manif == nil {
+		return nil, fmt.Errorf("the bundle is not installed")
+	}
+
+	var explanations []*sandbox.Explanation
+	if !c.Cfg.UseSystemTor {
+		// The pluggable transports are only launched for real, so the torrc
+		// lacks the `ClientTransportPlugin` lines, and the egress policy
+		// lacks their addresses.
+		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, Bridges, nil)
+		if err != nil {
+			return nil, err
+		}
+		egressPolicy, err := tor.EgressPolicy(c.Cfg, Bridges, nil)
+		if err != nil {
+			return nil, err
+		}
+		e, err := sandbox.ExplainTor(c.Cfg, torrc, egressPolicy)
+		if err != nil {
+			return nil, err
+		}
+		explanations = append(explanations, e)
+	}
+
+	e, err := sandbox.ExplainTorBrowser(c.Cfg, c.Manif)
+	if err != nil {
+		return nil, err
+	}
+	return append(explanations, e), nil
+}
+
+func (c *Common) runDryRun() error {
+	if !c.dryRun {
+		return nil
+	}
+	c.RanCommand = true
+
+	explanations, err := c.ExplainSandboxes()
+	if err != nil {
+		return err
+	}
+	if c.dryRunJSON {
+		b, err := json.MarshalIndent(explanations, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", b)
+		return err
+	}
+	for _, e := range explanations {
+		if err = e.WriteText(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
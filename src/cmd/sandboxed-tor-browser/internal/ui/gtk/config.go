@@ -19,12 +19,17 @@ package gtk
 import (
 	"fmt"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	gtk3 "github.com/gotk3/gotk3/gtk"
 
+	"cmd/sandboxed-tor-browser/internal/bridges"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
 	sbui "cmd/sandboxed-tor-browser/internal/ui"
+	"cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
 )
 
@@ -54,11 +59,35 @@ type configDialog struct {
 	torBridgeCustomFrame    *gtk3.Frame
 	torBridgeCustomEntry    *gtk3.TextView
 	torBridgeCustomEntryBuf *gtk3.TextBuffer
+	torBridgeRequestButton  *gtk3.Button
+	torBridgeImportButton   *gtk3.Button
+	torBridgeTestButton     *gtk3.Button
+
+	torAutoConnectToggle   *gtk3.CheckButton
+	torLayeredGuardsToggle *gtk3.CheckButton
+	torExtraOptionsFrame   *gtk3.Frame
+	torExtraOptionsEntry   *gtk3.TextView
+	torExtraOptionsBuf     *gtk3.TextBuffer
 
 	entryInsensitive *gtk3.TextTag
+	entryError       *gtk3.TextTag
 
 	torSystemIndicator *gtk3.Box
 
+	torSystemFrame       *gtk3.Frame
+	torSystemToggle      *gtk3.CheckButton
+	torSystemConfigBox   *gtk3.Box
+	torSystemControlPort *gtk3.Entry
+	torSystemAuthMethod  *gtk3.ComboBoxText
+	torSystemCookiePath  *gtk3.Entry
+	torSystemPassword    *gtk3.Entry
+
+	// Tor state elements.
+	torStateView          *gtk3.TextView
+	torStateBuf           *gtk3.TextBuffer
+	torStateRefreshButton *gtk3.Button
+	torStateResetButton   *gtk3.Button
+
 	// Sandbox config elements.
 	pulseAudioSwitch      *gtk3.Switch
 	avCodecSwitch         *gtk3.Switch
@@ -71,6 +100,19 @@ type configDialog struct {
 	downloadsDirChooser   *gtk3.FileChooserButton
 	desktopDirBox         *gtk3.Box
 	desktopDirChooser     *gtk3.FileChooserButton
+	profileImportButton   *gtk3.Button
+	profileExportButton   *gtk3.Button
+	storageEncryptButton  *gtk3.Button
+
+	downloadQuarantineSwitch *gtk3.Switch
+	downloadQuarantineButton *gtk3.Button
+	scrubMetadataSwitch      *gtk3.Switch
+	landlockBox              *gtk3.Box
+	landlockSwitch           *gtk3.Switch
+	isolateTorNetworkBox     *gtk3.Box
+	isolateTorNetworkSwitch  *gtk3.Switch
+	crashReportsBox          *gtk3.Box
+	crashReportsSwitch       *gtk3.Switch
 }
 
 const proxySOCKS4 = "SOCKS 4"
@@ -102,11 +144,21 @@ func (d *configDialog) loadFromConfig() {
 	d.torBridgeCustom.SetActive(d.ui.Cfg.Tor.UseCustomBridges)
 	d.torBridgeCustomEntryBuf.SetText(d.ui.Cfg.Tor.CustomBridges)
 	d.onBridgeTypeChanged()
+	d.torAutoConnectToggle.SetActive(d.ui.Cfg.Tor.UseAutoConnect)
+	d.torLayeredGuardsToggle.SetActive(d.ui.Cfg.Tor.UseLayeredGuards)
+	d.torExtraOptionsBuf.SetText(tor.FormatExtraOptions(d.ui.Cfg.Tor.ExtraOptions))
+
+	d.torSystemToggle.SetActive(d.ui.Cfg.SystemTor.Enable || d.ui.Cfg.SystemTorFromEnv)
+	d.torSystemControlPort.SetText(d.ui.Cfg.SystemTor.ControlPort)
+	d.torSystemAuthMethod.SetActiveID(d.ui.Cfg.SystemTor.AuthMethod)
+	d.torSystemCookiePath.SetText(d.ui.Cfg.SystemTor.CookiePath)
+	d.torSystemPassword.SetText(d.ui.Cfg.SystemTor.Password)
 
 	// Set the sensitivity based on the toggles.
 	d.torProxyConfigBox.SetSensitive(d.torProxyToggle.GetActive())
 	d.torBridgeConfigBox.SetSensitive(d.torBridgeToggle.GetActive())
-	d.torConfigBox.SetSensitive(!d.ui.Cfg.UseSystemTor)
+	d.onSystemTorChanged()
+	d.torSystemFrame.SetSensitive(!d.ui.Cfg.SystemTorFromEnv)
 	d.torSystemIndicator.SetVisible(d.ui.Cfg.UseSystemTor)
 
 	forceAdv := false
@@ -129,11 +181,33 @@ func (d *configDialog) loadFromConfig() {
 		d.desktopDirChooser.SetCurrentFolder(d.ui.Cfg.Sandbox.DesktopDir)
 		forceAdv = true
 	}
+	d.downloadQuarantineSwitch.SetActive(d.ui.Cfg.Sandbox.EnableDownloadQuarantine)
+	d.scrubMetadataSwitch.SetActive(d.ui.Cfg.Sandbox.ScrubDownloadMetadata)
+	d.landlockSwitch.SetActive(d.ui.Cfg.Sandbox.EnableLandlock)
+	d.landlockSwitch.SetSensitive(d.ui.Cfg.Sandbox.EnableLandlock || sandbox.LandlockABI() > 0)
+	if d.ui.Cfg.Sandbox.EnableLandlock {
+		forceAdv = true
+	}
+	d.isolateTorNetworkSwitch.SetActive(d.ui.Cfg.Sandbox.IsolateTorNetwork)
+	if d.ui.Cfg.Sandbox.IsolateTorNetwork {
+		forceAdv = true
+	}
+	d.crashReportsSwitch.SetActive(d.ui.Cfg.Sandbox.EnableCrashReports)
+	if d.ui.Cfg.Sandbox.EnableCrashReports {
+		forceAdv = true
+	}
 
 	// Hide certain options from the masses, that are probably confusing.
-	for _, w := range []*gtk3.Box{d.amnesiacProfileBox, d.displayBox, d.downloadsDirBox, d.desktopDirBox} {
+	for _, w := range []*gtk3.Box{d.amnesiacProfileBox, d.displayBox, d.downloadsDirBox, d.desktopDirBox, d.landlockBox, d.isolateTorNetworkBox, d.crashReportsBox} {
 		w.SetVisible(d.ui.AdvancedConfig || forceAdv)
 	}
+	d.torLayeredGuardsToggle.SetVisible(d.ui.AdvancedConfig || d.ui.Cfg.Tor.UseLayeredGuards)
+
+	// Disposable sessions don't have a profile to import to or export from.
+	d.profileImportButton.SetSensitive(!d.ui.Cfg.Disposable)
+	d.profileExportButton.SetSensitive(!d.ui.Cfg.Disposable)
+	d.storageEncryptButton.SetSensitive(!d.ui.Cfg.Disposable && !d.ui.Cfg.EncryptedStorage)
+	d.torExtraOptionsFrame.SetVisible(d.ui.AdvancedConfig || len(d.ui.Cfg.Tor.ExtraOptions) > 0)
 	d.loaded = true
 }
 
@@ -186,15 +260,61 @@ func (d *configDialog) onOk() error {
 	d.ui.Cfg.Tor.SetInternalBridgeType(d.torBridgeInternalType.GetActiveText())
 	d.ui.Cfg.Tor.SetUseCustomBridges(d.torBridgeCustom.GetActive())
 
-	start := d.torBridgeCustomEntryBuf.GetStartIter()
-	end := d.torBridgeCustomEntryBuf.GetEndIter()
-	if s, err := d.torBridgeCustomEntryBuf.GetText(start, end, false); err != nil {
+	if s, err := d.getCustomBridges(); err != nil {
 		return err
 	} else if s, err = sbui.ValidateBridgeLines(s); err != nil {
+		d.highlightBridgeErrors(err)
 		return err
 	} else {
+		d.highlightBridgeErrors(nil)
 		d.ui.Cfg.Tor.SetCustomBridges(s)
 	}
+	d.ui.Cfg.Tor.SetUseAutoConnect(d.torAutoConnectToggle.GetActive())
+	d.ui.Cfg.Tor.SetUseLayeredGuards(d.torLayeredGuardsToggle.GetActive())
+
+	start, end := d.torExtraOptionsBuf.GetStartIter(), d.torExtraOptionsBuf.GetEndIter()
+	if s, err := d.torExtraOptionsBuf.GetText(start, end, false); err != nil {
+		return err
+	} else if opts, err := tor.ParseExtraOptions(s); err != nil {
+		return err
+	} else if len(opts) == 0 {
+		d.ui.Cfg.Tor.SetExtraOptions(nil)
+	} else {
+		d.ui.Cfg.Tor.SetExtraOptions(opts)
+	}
+
+	// The environment takes precedence over the system tor config.
+	if !d.ui.Cfg.SystemTorFromEnv {
+		useSystemTor := d.torSystemToggle.GetActive()
+		if s, err := d.torSystemControlPort.GetText(); err != nil {
+			return err
+		} else if s = strings.TrimSpace(s); s == "" && useSystemTor {
+			return fmt.Errorf("A control port must be specified to use a system tor.")
+		} else if _, _, err = config.ParseControlPort(s); s != "" && err != nil {
+			return fmt.Errorf("Malformed control port: '%v'", s)
+		} else {
+			d.ui.Cfg.SystemTor.SetControlPort(s)
+		}
+		d.ui.Cfg.SystemTor.SetAuthMethod(d.torSystemAuthMethod.GetActiveID())
+		if s, err := d.torSystemCookiePath.GetText(); err != nil {
+			return err
+		} else if s = strings.TrimSpace(s); s != "" && !filepath.IsAbs(s) {
+			return fmt.Errorf("The cookie file must be an absolute path: '%v'", s)
+		} else {
+			d.ui.Cfg.SystemTor.SetCookiePath(s)
+		}
+		if s, err := d.torSystemPassword.GetText(); err != nil {
+			return err
+		} else if s == "" && useSystemTor && d.ui.Cfg.SystemTor.AuthMethod == config.SystemTorAuthPassword {
+			return fmt.Errorf("A password must be specified for HASHEDPASSWORD authentication.")
+		} else {
+			d.ui.Cfg.SystemTor.SetPassword(s)
+		}
+		d.ui.Cfg.SystemTor.SetEnable(useSystemTor)
+		if err := d.ui.Cfg.UpdateSystemTor(); err != nil {
+			return err
+		}
+	}
 
 	d.ui.Cfg.Sandbox.SetEnablePulseAudio(d.pulseAudioSwitch.GetActive())
 	d.ui.Cfg.Sandbox.SetEnableAVCodec(d.avCodecSwitch.GetActive())
@@ -207,11 +327,17 @@ func (d *configDialog) onOk() error {
 	}
 	d.ui.Cfg.Sandbox.SetDownloadsDir(d.downloadsDirChooser.GetFilename())
 	d.ui.Cfg.Sandbox.SetDesktopDir(d.desktopDirChooser.GetFilename())
+	d.ui.Cfg.Sandbox.SetEnableDownloadQuarantine(d.downloadQuarantineSwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetScrubDownloadMetadata(d.scrubMetadataSwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetEnableLandlock(d.landlockSwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetIsolateTorNetwork(d.isolateTorNetworkSwitch.GetActive())
+	d.ui.Cfg.Sandbox.SetEnableCrashReports(d.crashReportsSwitch.GetActive())
 	return d.ui.Cfg.Sync()
 }
 
 func (d *configDialog) run() bool {
 	d.loadFromConfig()
+	d.refreshTorState()
 	defer func() {
 		d.dialog.Hide()
 		d.ui.forceRedraw()
@@ -242,6 +368,30 @@ func (d *configDialog) onProxyTypeChanged() {
 	d.torProxyAuthBox.SetSensitive(d.torProxyType.GetActiveText() != proxySOCKS4)
 }
 
+func (d *configDialog) onSystemTorChanged() {
+	useSystemTor := d.torSystemToggle.GetActive()
+	d.torConfigBox.SetSensitive(!useSystemTor)
+	d.torSystemConfigBox.SetSensitive(useSystemTor)
+	d.onSystemTorAuthChanged()
+}
+
+func (d *configDialog) onSystemTorAuthChanged() {
+	switch d.torSystemAuthMethod.GetActiveID() {
+	case config.SystemTorAuthAuto:
+		d.torSystemCookiePath.SetSensitive(true)
+		d.torSystemPassword.SetSensitive(true)
+	case config.SystemTorAuthCookie, config.SystemTorAuthSafeCookie:
+		d.torSystemCookiePath.SetSensitive(true)
+		d.torSystemPassword.SetSensitive(false)
+	case config.SystemTorAuthPassword:
+		d.torSystemCookiePath.SetSensitive(false)
+		d.torSystemPassword.SetSensitive(true)
+	default:
+		d.torSystemCookiePath.SetSensitive(false)
+		d.torSystemPassword.SetSensitive(false)
+	}
+}
+
 func (d *configDialog) onBridgeTypeChanged() {
 	isInternal := d.torBridgeInternal.GetActive()
 	d.torBridgeInternalBox.SetSensitive(isInternal)
@@ -261,6 +411,188 @@ func (d *configDialog) updateBridgeEntrySensitive() {
 	}
 }
 
+func (d *configDialog) getCustomBridges() (string, error) {
+	start := d.torBridgeCustomEntryBuf.GetStartIter()
+	end := d.torBridgeCustomEntryBuf.GetEndIter()
+	return d.torBridgeCustomEntryBuf.GetText(start, end, false)
+}
+
+func (d *configDialog) highlightBridgeErrors(err error) {
+	start := d.torBridgeCustomEntryBuf.GetStartIter()
+	end := d.torBridgeCustomEntryBuf.GetEndIter()
+	d.torBridgeCustomEntryBuf.RemoveTag(d.entryError, start, end)
+
+	perr, ok := err.(bridges.ParseError)
+	if !ok {
+		return
+	}
+	for _, e := range perr {
+		lineStart := d.torBridgeCustomEntryBuf.GetStartIter()
+		lineStart.ForwardLines(e.Line - 1)
+		lineEnd := d.torBridgeCustomEntryBuf.GetStartIter()
+		lineEnd.ForwardLines(e.Line - 1)
+		lineEnd.ForwardToLineEnd()
+		d.torBridgeCustomEntryBuf.ApplyTag(d.entryError, lineStart, lineEnd)
+	}
+}
+
+func (d *configDialog) refreshTorState() {
+	d.torStateResetButton.SetSensitive(!d.ui.Cfg.UseSystemTor)
+
+	var lines []string
+	if guards, err := d.ui.EntryGuards(); err != nil {
+		lines = append(lines, fmt.Sprintf("Failed to query the entry guards: %v", err))
+	} else if len(guards) == 0 {
+		lines = append(lines, "No entry guards have been selected yet.")
+	} else {
+		for _, g := range guards {
+			lines = append(lines, formatEntryGuard(g))
+		}
+	}
+	d.torStateBuf.SetText(strings.Join(lines, "\n"))
+}
+
+func (d *configDialog) onTorStateReset() {
+	if !d.ui.ask("Resetting the Tor state will discard the current entry guards and select new ones, which is harmful to anonymity.\n\nOnly do this if you believe that the current guards are compromised or broken.") {
+		return
+	}
+	if err := d.ui.ResetTorState(); err != nil {
+		d.ui.bitch("Failed to reset the Tor state: %v", err)
+	}
+	d.refreshTorState()
+}
+
+func (d *configDialog) onProfileImport() {
+	fn, ok := d.ui.chooseFile("Import Bookmarks and Security Settings", gtk3.FILE_CHOOSER_ACTION_OPEN, "")
+	if !ok {
+		return
+	}
+	if !d.ui.ask("Importing will replace all of the existing bookmarks, and the security settings, the next time the browser is launched.") {
+		return
+	}
+	if err := d.ui.ImportProfileData(fn); err != nil {
+		d.ui.bitch("Failed to import the profile data: %v", err)
+	}
+}
+
+func (d *configDialog) onProfileExport() {
+	fn, ok := d.ui.chooseFile("Export Bookmarks and Security Settings", gtk3.FILE_CHOOSER_ACTION_SAVE, "")
+	if !ok {
+		return
+	}
+	if err := d.ui.ExportProfileData(fn); err != nil {
+		d.ui.bitch("Failed to export the profile data: %v", err)
+	}
+}
+
+func (d *configDialog) onStorageEncrypt() {
+	if !d.ui.ask("Encrypting the profile and Tor state requires entering a passphrase on every launch, and if the passphrase is lost, so are the bookmarks and the Tor state.\n\nThe unencrypted copies get deleted on exit, but may still be recoverable from the disk.") {
+		return
+	}
+	passphrase, ok := d.ui.askPassphrase(true, "Enter a new passphrase for the encrypted profile and Tor state.")
+	if !ok {
+		return
+	}
+	err := d.ui.EnableStorageEncryption(passphrase)
+	wipeBytes(passphrase)
+	if err != nil {
+		d.ui.bitch("Failed to enable storage encryption: %v", err)
+	}
+	d.storageEncryptButton.SetSensitive(!d.ui.Cfg.EncryptedStorage)
+}
+
+func formatEntryGuard(g *tor.EntryGuard) string {
+	s := "$" + g.Fingerprint
+	if g.Nickname != "" {
+		s += " (" + g.Nickname + ")"
+	}
+	if g.Status != "" {
+		s += " " + g.Status
+	}
+	if age := g.Age(); age > 0 {
+		s += fmt.Sprintf(", added %d days ago", int(age.Hours()/24))
+	}
+	if !g.ConfirmedOn.IsZero() {
+		s += ", confirmed"
+	}
+	return s
+}
+
+func (d *configDialog) onBridgeRequest() {
+	bs, err := d.ui.requestBridges()
+	if err != nil {
+		if err != async.ErrCanceled {
+			d.ui.bitch("Failed to request bridges: %v", err)
+		}
+		return
+	}
+
+	d.torBridgeToggle.SetActive(true)
+	d.torBridgeCustom.SetActive(true)
+	d.torBridgeCustomEntryBuf.SetText(bridges.Format(bs))
+	d.highlightBridgeErrors(nil)
+	d.updateBridgeEntrySensitive()
+}
+
+func (d *configDialog) onBridgeImport() {
+	s, err := d.getCustomBridges()
+	if err != nil {
+		d.ui.bitch("Failed to import bridges: %v", err)
+		return
+	}
+	bs, err := bridges.Import(s)
+	if err != nil {
+		d.ui.bitch("Failed to import bridges: %v", err)
+		return
+	}
+	d.torBridgeCustomEntryBuf.SetText(bridges.Format(bs))
+	d.highlightBridgeErrors(nil)
+}
+
+func (d *configDialog) onBridgeTest() {
+	s, err := d.getCustomBridges()
+	if err != nil {
+		d.ui.bitch("Failed to test bridges: %v", err)
+		return
+	}
+	bs, err := bridges.Parse(s)
+	d.highlightBridgeErrors(err)
+	if err != nil {
+		d.ui.bitch("Failed to test bridges: %v", err)
+		return
+	} else if bs = bridges.Dedupe(bs); len(bs) == 0 {
+		d.ui.bitch("No bridges to test.")
+		return
+	}
+
+	results := make([]error, len(bs))
+	if err = d.ui.testBridges(bs, results); err != nil {
+		if err != async.ErrCanceled {
+			d.ui.bitch("Failed to test bridges: %v", err)
+		}
+		return
+	}
+
+	// Rewrite the entry with just the tested bridges, and highlight the
+	// ones that failed, so the line numbers are consistent.
+	d.torBridgeCustomEntryBuf.SetText(bridges.Format(bs))
+	var failed bridges.ParseError
+	var reasons []string
+	for i, err := range results {
+		if err != nil {
+			e := &bridges.LineError{Line: i + 1, Err: err}
+			failed = append(failed, e)
+			reasons = append(reasons, e.Error())
+		}
+	}
+	d.highlightBridgeErrors(failed)
+	if failed == nil {
+		d.ui.info("All %d bridge(s) are reachable.", len(bs))
+	} else {
+		d.ui.bitch("%d of %d bridge(s) are unreachable:\n\n%v", len(failed), len(bs), strings.Join(reasons, "\n"))
+	}
+}
+
 func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 	d := new(configDialog)
 	d.ui = ui
@@ -286,6 +618,36 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 		return err
 	}
 
+	// System tor config elements.
+	if d.torSystemFrame, err = getFrame(b, "torSystemFrame"); err != nil {
+		return err
+	}
+	if d.torSystemToggle, err = getCheckButton(b, "torSystemToggle"); err != nil {
+		return err
+	} else {
+		d.torSystemToggle.Connect("toggled", func() { d.onSystemTorChanged() })
+	}
+	if d.torSystemConfigBox, err = getBox(b, "torSystemConfigBox"); err != nil {
+		return err
+	}
+	if d.torSystemControlPort, err = getEntry(b, "torSystemControlPort"); err != nil {
+		return err
+	}
+	if d.torSystemAuthMethod, err = getComboBoxText(b, "torSystemAuthMethod"); err != nil {
+		return err
+	} else {
+		for _, v := range config.SystemTorAuthMethods {
+			d.torSystemAuthMethod.Append(v, v)
+		}
+		d.torSystemAuthMethod.Connect("changed", func() { d.onSystemTorAuthChanged() })
+	}
+	if d.torSystemCookiePath, err = getEntry(b, "torSystemCookiePath"); err != nil {
+		return err
+	}
+	if d.torSystemPassword, err = getEntry(b, "torSystemPassword"); err != nil {
+		return err
+	}
+
 	// Tor Proxy config elements.
 	if d.torProxyToggle, err = getCheckButton(b, "torProxyToggle"); err != nil {
 		return err
@@ -376,6 +738,70 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 		}
 		tt.Add(d.entryInsensitive)
 	}
+	if d.entryError, err = gtk3.TextTagNew("error"); err != nil {
+		return err
+	} else {
+		d.entryError.SetProperty("background", "#f5b0b0")
+		tt, err := d.torBridgeCustomEntryBuf.GetTagTable()
+		if err != nil {
+			return err
+		}
+		tt.Add(d.entryError)
+	}
+	if d.torBridgeRequestButton, err = getButton(b, "torBridgeRequestButton"); err != nil {
+		return err
+	} else {
+		d.torBridgeRequestButton.Connect("clicked", func() { d.onBridgeRequest() })
+	}
+	if d.torBridgeImportButton, err = getButton(b, "torBridgeImportButton"); err != nil {
+		return err
+	} else {
+		d.torBridgeImportButton.Connect("clicked", func() { d.onBridgeImport() })
+	}
+	if d.torBridgeTestButton, err = getButton(b, "torBridgeTestButton"); err != nil {
+		return err
+	} else {
+		d.torBridgeTestButton.Connect("clicked", func() { d.onBridgeTest() })
+	}
+	if d.torAutoConnectToggle, err = getCheckButton(b, "torAutoConnectToggle"); err != nil {
+		return err
+	}
+	if d.torLayeredGuardsToggle, err = getCheckButton(b, "torLayeredGuardsToggle"); err != nil {
+		return err
+	}
+	if d.torExtraOptionsFrame, err = getFrame(b, "torExtraOptionsFrame"); err != nil {
+		return err
+	}
+	if d.torExtraOptionsEntry, err = getTextView(b, "torExtraOptionsEntry"); err != nil {
+		return err
+	}
+	if _, err = d.torExtraOptionsEntry.GetProperty("monospace"); err == nil { // Gtk+ >= 3.16
+		d.torExtraOptionsEntry.SetProperty("monospace", true)
+	}
+	if d.torExtraOptionsBuf, err = d.torExtraOptionsEntry.GetBuffer(); err != nil {
+		return err
+	}
+
+	// Tor state elements.
+	if d.torStateView, err = getTextView(b, "torStateView"); err != nil {
+		return err
+	}
+	if _, err = d.torStateView.GetProperty("monospace"); err == nil { // Gtk+ >= 3.16
+		d.torStateView.SetProperty("monospace", true)
+	}
+	if d.torStateBuf, err = d.torStateView.GetBuffer(); err != nil {
+		return err
+	}
+	if d.torStateRefreshButton, err = getButton(b, "torStateRefreshButton"); err != nil {
+		return err
+	} else {
+		d.torStateRefreshButton.Connect("clicked", func() { d.refreshTorState() })
+	}
+	if d.torStateResetButton, err = getButton(b, "torStateResetButton"); err != nil {
+		return err
+	} else {
+		d.torStateResetButton.Connect("clicked", func() { d.onTorStateReset() })
+	}
 
 	// Sandbox config elements.
 	if d.pulseAudioSwitch, err = getSwitch(b, "pulseAudioSwitch"); err != nil {
@@ -411,6 +837,50 @@ func (ui *gtkUI) initConfigDialog(b *gtk3.Builder) error {
 	if d.desktopDirChooser, err = getFChooser(b, "desktopDirChooser"); err != nil {
 		return err
 	}
+	if d.profileImportButton, err = getButton(b, "profileImportButton"); err != nil {
+		return err
+	} else {
+		d.profileImportButton.Connect("clicked", func() { d.onProfileImport() })
+	}
+	if d.profileExportButton, err = getButton(b, "profileExportButton"); err != nil {
+		return err
+	} else {
+		d.profileExportButton.Connect("clicked", func() { d.onProfileExport() })
+	}
+	if d.storageEncryptButton, err = getButton(b, "storageEncryptButton"); err != nil {
+		return err
+	} else {
+		d.storageEncryptButton.Connect("clicked", func() { d.onStorageEncrypt() })
+	}
+	if d.downloadQuarantineSwitch, err = getSwitch(b, "downloadQuarantineSwitch"); err != nil {
+		return err
+	}
+	if d.downloadQuarantineButton, err = getButton(b, "downloadQuarantineButton"); err != nil {
+		return err
+	} else {
+		d.downloadQuarantineButton.Connect("clicked", func() { ui.downloadsDialog.run() })
+	}
+	if d.scrubMetadataSwitch, err = getSwitch(b, "scrubMetadataSwitch"); err != nil {
+		return err
+	}
+	if d.landlockBox, err = getBox(b, "landlockBox"); err != nil {
+		return err
+	}
+	if d.landlockSwitch, err = getSwitch(b, "landlockSwitch"); err != nil {
+		return err
+	}
+	if d.isolateTorNetworkBox, err = getBox(b, "isolateTorNetworkBox"); err != nil {
+		return err
+	}
+	if d.isolateTorNetworkSwitch, err = getSwitch(b, "isolateTorNetworkSwitch"); err != nil {
+		return err
+	}
+	if d.crashReportsBox, err = getBox(b, "crashReportsBox"); err != nil {
+		return err
+	}
+	if d.crashReportsSwitch, err = getSwitch(b, "crashReportsSwitch"); err != nil {
+		return err
+	}
 
 	ui.configDialog = d
 	return nil
@@ -0,0 +1,87 @@
+// disposable.go - Gtk+ disposable session routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+	"path/filepath"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+)
+
+// exportDisposableDownloads gives the user a chance to copy files out of a
+// disposable session's downloads, before they get deleted.
+func (ui *gtkUI) exportDisposableDownloads() {
+	dir := ui.DisposableDownloadsDir()
+	if dir == "" {
+		return
+	}
+
+	for {
+		names, err := ui.DisposableDownloads()
+		if err != nil {
+			log.Printf("ui: Failed to list the disposable downloads: %v", err)
+			return
+		} else if len(names) == 0 {
+			return
+		}
+
+		if !ui.ask("The disposable session has %d downloaded file(s), that will be deleted on exit.\n\nExport a file to keep it?", len(names)) {
+			return
+		}
+
+		src, ok := ui.chooseFile("Export Download", gtk3.FILE_CHOOSER_ACTION_OPEN, dir)
+		if !ok {
+			continue
+		}
+		destDir, ok := ui.chooseFile("Export To Folder", gtk3.FILE_CHOOSER_ACTION_SELECT_FOLDER, "")
+		if !ok {
+			continue
+		}
+		// The downloads directory is the quarantine for disposable sessions,
+		// and the file chooser allows wandering off from it.
+		if filepath.Dir(filepath.Clean(src)) != dir {
+			ui.bitch("Only the files in the disposable session's downloads can be exported.")
+			continue
+		}
+		if _, err = ui.ExportQuarantined(filepath.Base(src), destDir); err != nil {
+			ui.bitch("Failed to export the download: %v", err)
+		}
+	}
+}
+
+func (ui *gtkUI) chooseFile(title string, action gtk3.FileChooserAction, folder string) (string, bool) {
+	fc, err := gtk3.FileChooserDialogNewWith2Buttons(title, ui.mainWindow, action, "_Cancel", gtk3.RESPONSE_CANCEL, "_Select", gtk3.RESPONSE_ACCEPT)
+	if err != nil {
+		log.Printf("ui: Failed to create the file chooser: %v", err)
+		return "", false
+	}
+	defer func() {
+		fc.Destroy()
+		ui.forceRedraw()
+	}()
+
+	if folder != "" {
+		fc.SetCurrentFolder(folder)
+	}
+	if fc.Run() != int(gtk3.RESPONSE_ACCEPT) {
+		return "", false
+	}
+
+	fn := fc.GetFilename()
+	return fn, fn != ""
+}
@@ -0,0 +1,225 @@
+// downloads.go - Gtk+ download quarantine routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"fmt"
+	"log"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/ui/notify"
+)
+
+const actionShowDownloads = "show-downloads"
+
+type downloadsDialog struct {
+	ui *gtkUI
+
+	dialog       *gtk3.Dialog
+	listStore    *gtk3.ListStore
+	treeView     *gtk3.TreeView
+	viewButton   *gtk3.Button
+	exportButton *gtk3.Button
+	deleteButton *gtk3.Button
+}
+
+const (
+	downloadsColumnName = iota
+	downloadsColumnSize
+	downloadsColumnType
+	downloadsColumnSHA256
+	downloadsColumnMIMEType
+)
+
+func (d *downloadsDialog) run() {
+	d.refresh()
+
+	defer func() {
+		d.dialog.Hide()
+		d.ui.forceRedraw()
+	}()
+	d.dialog.Run()
+}
+
+func (d *downloadsDialog) refresh() {
+	d.listStore.Clear()
+
+	q, err := d.ui.Quarantine()
+	if err != nil {
+		d.ui.bitch("Failed to open the download quarantine: %v", err)
+		return
+	}
+	entries, err := q.Entries()
+	if err != nil {
+		d.ui.bitch("Failed to list the quarantined downloads: %v", err)
+		return
+	}
+	for _, e := range entries {
+		iter := d.listStore.Append()
+		cols := []int{downloadsColumnName, downloadsColumnSize, downloadsColumnType, downloadsColumnSHA256, downloadsColumnMIMEType}
+		if err = d.listStore.Set(iter, cols, []interface{}{e.Name, formatSize(e.Size), e.Type, e.SHA256, e.MIMEType}); err != nil {
+			log.Printf("ui: Failed to add the download to the list: %v", err)
+		}
+	}
+}
+
+// selected returns the name and MIME type of the selected download.
+func (d *downloadsDialog) selected() (string, string, bool) {
+	sel, err := d.treeView.GetSelection()
+	if err != nil {
+		return "", "", false
+	}
+	_, iter, ok := sel.GetSelected()
+	if !ok {
+		return "", "", false
+	}
+
+	var s [2]string
+	for i, col := range []int{downloadsColumnName, downloadsColumnMIMEType} {
+		v, err := d.listStore.GetValue(iter, col)
+		if err != nil {
+			return "", "", false
+		}
+		if s[i], err = v.GetString(); err != nil {
+			return "", "", false
+		}
+	}
+	return s[0], s[1], s[0] != ""
+}
+
+func (d *downloadsDialog) onView() {
+	name, mimeType, ok := d.selected()
+	if !ok {
+		return
+	}
+	if err := d.ui.ViewQuarantined(name, mimeType); err != nil {
+		d.ui.bitch("Failed to open the download: %v", err)
+	}
+}
+
+func (d *downloadsDialog) onExport() {
+	name, _, ok := d.selected()
+	if !ok {
+		return
+	}
+	destDir, ok := d.ui.chooseFile("Export To Folder", gtk3.FILE_CHOOSER_ACTION_SELECT_FOLDER, d.ui.Cfg.Sandbox.DownloadsDir)
+	if !ok {
+		return
+	}
+	if _, err := d.ui.ExportQuarantined(name, destDir); err != nil {
+		d.ui.bitch("Failed to export the download: %v", err)
+	}
+}
+
+func (d *downloadsDialog) onDelete() {
+	name, _, ok := d.selected()
+	if !ok {
+		return
+	}
+	if !d.ui.ask("Delete '%v' from the download quarantine?", name) {
+		return
+	}
+
+	q, err := d.ui.Quarantine()
+	if err == nil {
+		err = q.Remove(name)
+	}
+	if err != nil {
+		d.ui.bitch("Failed to delete the download: %v", err)
+	}
+	d.refresh()
+}
+
+// notifyDownload lets the user know that a quarantined download completed,
+// or shows the download list if desktop notifications are unavailable.
+func (ui *gtkUI) notifyDownload(name string) {
+	if ui.downloadsNotification == nil {
+		ui.downloadsDialog.run()
+		return
+	}
+	body := "'" + name + "' is in the download quarantine, and needs to be exported to be used outside of Tor Browser."
+	if ui.Cfg.Disposable {
+		body = "'" + name + "' will be deleted when the disposable session exits, unless it is exported."
+	}
+	ui.downloadsNotification.Update("Download completed.", body, ui.iconPixbuf)
+	ui.downloadsNotification.Show()
+}
+
+func (ui *gtkUI) initDownloadsNotification() {
+	ui.downloadsNotification = notify.New("", "", ui.iconPixbuf)
+	ui.downloadsNotification.SetTimeout(15 * 1000)
+	ui.downloadsNotification.AddAction(actionShowDownloads, "Show Downloads")
+	ui.downloadsNotificationCh = ui.downloadsNotification.ActionChan()
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (ui *gtkUI) initDownloadsDialog(b *gtk3.Builder) error {
+	d := new(downloadsDialog)
+	d.ui = ui
+
+	obj, err := b.GetObject("downloadsDialog")
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	if d.dialog, ok = obj.(*gtk3.Dialog); !ok {
+		return newInvalidBuilderObject(obj)
+	} else {
+		d.dialog.SetDefaultResponse(gtk3.RESPONSE_CLOSE)
+		d.dialog.SetIcon(ui.iconPixbuf)
+		d.dialog.SetTransientFor(ui.mainWindow)
+	}
+
+	if d.listStore, err = getListStore(b, "downloadsListStore"); err != nil {
+		return err
+	}
+	if d.treeView, err = getTreeView(b, "downloadsTreeView"); err != nil {
+		return err
+	}
+	if d.viewButton, err = getButton(b, "downloadsViewButton"); err != nil {
+		return err
+	} else {
+		d.viewButton.Connect("clicked", func() { d.onView() })
+	}
+	if d.exportButton, err = getButton(b, "downloadsExportButton"); err != nil {
+		return err
+	} else {
+		d.exportButton.Connect("clicked", func() { d.onExport() })
+	}
+	if d.deleteButton, err = getButton(b, "downloadsDeleteButton"); err != nil {
+		return err
+	} else {
+		d.deleteButton.Connect("clicked", func() { d.onDelete() })
+	}
+
+	ui.downloadsDialog = d
+	return nil
+}
@@ -0,0 +1,136 @@
+// moat.go - Gtk+ BridgeDB moat user interface.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"strings"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/bridges"
+	"cmd/sandboxed-tor-browser/internal/moat"
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
+	"cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+type moatDialog struct {
+	ui *gtkUI
+
+	dialog        *gtk3.Dialog
+	captchaImage  *gtk3.Image
+	solutionEntry *gtk3.Entry
+}
+
+func (d *moatDialog) run(ch *moat.Challenge) (string, bool) {
+	if pb, err := d.ui.pixbufFromBytes(ch.Image, "jpeg"); err != nil {
+		d.ui.bitch("Failed to load the CAPTCHA image: %v", err)
+		return "", false
+	} else {
+		d.captchaImage.SetFromPixbuf(pb)
+	}
+	d.solutionEntry.SetText("")
+	d.solutionEntry.GrabFocus()
+
+	defer func() {
+		d.dialog.Hide()
+		d.ui.forceRedraw()
+	}()
+	if d.dialog.Run() != int(gtk3.RESPONSE_OK) {
+		return "", false
+	}
+
+	s, err := d.solutionEntry.GetText()
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(s), true
+}
+
+func (ui *gtkUI) initMoatDialog(b *gtk3.Builder) error {
+	d := new(moatDialog)
+	d.ui = ui
+
+	obj, err := b.GetObject("moatDialog")
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	if d.dialog, ok = obj.(*gtk3.Dialog); !ok {
+		return newInvalidBuilderObject(obj)
+	} else {
+		d.dialog.SetDefaultResponse(gtk3.RESPONSE_OK)
+		d.dialog.SetIcon(ui.iconPixbuf)
+		d.dialog.SetTransientFor(ui.mainWindow)
+	}
+
+	if d.captchaImage, err = getImage(b, "moatCaptchaImage"); err != nil {
+		return err
+	}
+	if d.solutionEntry, err = getEntry(b, "moatSolutionEntry"); err != nil {
+		return err
+	}
+
+	ui.moatDialog = d
+	return nil
+}
+
+func (ui *gtkUI) moatFetch(s *sbui.MoatSession) error {
+	async := async.NewAsync()
+	ui.progressDialog.setTitle("Requesting bridges")
+	ui.progressDialog.setText("Initializing bridge request...")
+	ui.progressDialog.run(async, func() { ui.DoMoatFetch(async, s) })
+
+	return async.Err
+}
+
+func (ui *gtkUI) moatCheck(s *sbui.MoatSession, solution string) error {
+	async := async.NewAsync()
+	ui.progressDialog.setTitle("Requesting bridges")
+	ui.progressDialog.setText("Submitting the CAPTCHA solution...")
+	ui.progressDialog.run(async, func() { ui.DoMoatCheck(async, s, solution) })
+
+	return async.Err
+}
+
+// requestBridges interactively requests bridges from BridgeDB, returning
+// async.ErrCanceled if the user gives up.
+func (ui *gtkUI) requestBridges() ([]*bridges.Bridge, error) {
+	s := new(sbui.MoatSession)
+	defer s.Close()
+
+	for {
+		if err := ui.moatFetch(s); err != nil {
+			return nil, err
+		}
+
+		solution, ok := ui.moatDialog.run(s.Challenge)
+		if !ok {
+			return nil, async.ErrCanceled
+		}
+
+		// An incorrect solution invalidates the challenge, so fetch a
+		// new one and let the user try again.
+		if err := ui.moatCheck(s, solution); err == moat.ErrBadSolution {
+			ui.bitch("The CAPTCHA solution was incorrect, please try again.")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return s.Bridges, nil
+	}
+}
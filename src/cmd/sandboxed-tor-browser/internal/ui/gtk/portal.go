@@ -0,0 +1,56 @@
+// portal.go - Gtk+ file chooser portal routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox/portal"
+)
+
+// onFileChooserRequest shows a file chooser on behalf of the browser, and
+// replies with the file that the user chose.
+func (ui *gtkUI) onFileChooserRequest(req *portal.Request) {
+	var path string
+	defer func() {
+		req.Reply(path)
+	}()
+
+	title := "Tor Browser"
+	if req.Title != "" {
+		title = title + ": " + req.Title
+	}
+
+	fc, err := gtk3.FileChooserDialogNewWith2Buttons(title, ui.mainWindow, gtk3.FILE_CHOOSER_ACTION_OPEN, "_Cancel", gtk3.RESPONSE_CANCEL, "_Open", gtk3.RESPONSE_ACCEPT)
+	if err != nil {
+		log.Printf("ui: Failed to create the file chooser: %v", err)
+		return
+	}
+	defer func() {
+		fc.Destroy()
+		ui.forceRedraw()
+	}()
+
+	// The browser window will almost certainly be in front of the hidden
+	// main window.
+	fc.SetKeepAbove(true)
+	if fc.Run() == int(gtk3.RESPONSE_ACCEPT) {
+		path = fc.GetFilename()
+	}
+}
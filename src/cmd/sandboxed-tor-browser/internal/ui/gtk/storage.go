@@ -0,0 +1,104 @@
+// storage.go - Gtk+ encrypted storage routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gtk
+
+import (
+	"log"
+
+	gtk3 "github.com/gotk3/gotk3/gtk"
+
+	"cmd/sandboxed-tor-browser/internal/vault"
+)
+
+// unlockStorage prompts for the passphrase till the encrypted storage is
+// unlocked, and returns false if the user gave up.
+func (ui *gtkUI) unlockStorage() bool {
+	for ui.StorageLocked() {
+		passphrase, ok := ui.askPassphrase(false, "Enter the passphrase for the encrypted profile and Tor state.")
+		if !ok {
+			return false
+		}
+		err := ui.UnlockStorage(passphrase)
+		wipeBytes(passphrase)
+		if err == vault.ErrBadPassphrase {
+			ui.bitch("Incorrect passphrase.")
+		} else if err != nil {
+			ui.bitch("Failed to unlock the encrypted storage: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// askPassphrase prompts for a passphrase, twice if confirm is set.  The
+// caller should wipe the returned passphrase after use.
+func (ui *gtkUI) askPassphrase(confirm bool, format string, a ...interface{}) ([]byte, bool) {
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_QUESTION, gtk3.BUTTONS_OK_CANCEL, format, a...)
+	defer func() {
+		md.Destroy()
+		ui.forceRedraw()
+	}()
+	md.SetDefaultResponse(gtk3.RESPONSE_OK)
+
+	box, err := md.GetContentArea()
+	if err != nil {
+		log.Printf("ui: Failed to get the dialog content area: %v", err)
+		return nil, false
+	}
+	placeholders := []string{"Passphrase"}
+	if confirm {
+		placeholders = append(placeholders, "Confirm passphrase")
+	}
+	var entries []*gtk3.Entry
+	for _, v := range placeholders {
+		e, err := gtk3.EntryNew()
+		if err != nil {
+			log.Printf("ui: Failed to create the passphrase entry: %v", err)
+			return nil, false
+		}
+		e.SetVisibility(false)
+		e.SetActivatesDefault(true)
+		e.SetPlaceholderText(v)
+		box.PackStart(e, false, false, 0)
+		e.Show()
+		entries = append(entries, e)
+	}
+
+	for {
+		if md.Run() != int(gtk3.RESPONSE_OK) {
+			return nil, false
+		}
+
+		s, _ := entries[0].GetText()
+		if s == "" {
+			continue
+		}
+		if confirm {
+			if s2, _ := entries[1].GetText(); s != s2 {
+				ui.bitch("The passphrases do not match.")
+				continue
+			}
+		}
+		return []byte(s), true
+	}
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -26,8 +26,11 @@ import (
 	"github.com/gotk3/gotk3/gdk"
 	gtk3 "github.com/gotk3/gotk3/gtk"
 
+	"cmd/sandboxed-tor-browser/internal/bridges"
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sandbox/portal"
 	sbui "cmd/sandboxed-tor-browser/internal/ui"
 	"cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/notify"
@@ -43,12 +46,16 @@ type gtkUI struct {
 	iconPixbuf *gdk.Pixbuf
 	mainWindow *gtk3.Window // Always hidden.
 
-	installDialog  *installDialog
-	configDialog   *configDialog
-	progressDialog *progressDialog
+	installDialog   *installDialog
+	configDialog    *configDialog
+	progressDialog  *progressDialog
+	moatDialog      *moatDialog
+	downloadsDialog *downloadsDialog
 
-	updateNotification   *notify.Notification
-	updateNotificationCh chan string
+	updateNotification      *notify.Notification
+	updateNotificationCh    chan string
+	downloadsNotification   *notify.Notification
+	downloadsNotificationCh chan string
 }
 
 func (ui *gtkUI) Run() error {
@@ -63,9 +70,13 @@ func (ui *gtkUI) Run() error {
 		ui.bitch("Failed to run common UI: %v", err)
 		return err
 	}
-	if ui.PrintVersion {
+	if ui.PrintVersion || ui.RanCommand {
 		return nil
 	}
+	for _, w := range ui.BwrapWarnings {
+		ui.warn("%s", w)
+	}
+	defer ui.exportDisposableDownloads()
 	if ui.updateNotification == nil {
 		log.Printf("ui: libnotify wasn't found, no desktop notifications possible")
 	}
@@ -100,6 +111,13 @@ func (ui *gtkUI) Run() error {
 		}
 	}
 
+	// Unlock the encrypted profile, so that it's available to the config
+	// dialog and the browser.
+	if !ui.unlockStorage() {
+		ui.onDestroy()
+		return nil
+	}
+
 	for {
 		// Configuration.
 		if ui.ForceConfig || ui.Cfg.FirstLaunch {
@@ -131,6 +149,18 @@ func (ui *gtkUI) Run() error {
 			waitCh <- ui.Sandbox.Wait()
 		}()
 
+		// Watch the download quarantine for completed downloads.  The
+		// disposable session's downloads are treated the same way, so that
+		// they can be exported while the session is running.
+		var downloadCh <-chan string
+		if ui.Cfg.Sandbox.EnableDownloadQuarantine || ui.Cfg.Disposable {
+			if q, err := ui.Quarantine(); err != nil {
+				log.Printf("ui: Failed to open the download quarantine: %v", err)
+			} else {
+				downloadCh = q.Completed()
+			}
+		}
+
 		// Determine the time for the initial update check.
 		initialUpdateInterval := updateMinInterval
 		oldScheduledTime := time.Unix(ui.Cfg.LastUpdateCheck, 0).Add(updateCheckInterval)
@@ -155,12 +185,24 @@ func (ui *gtkUI) Run() error {
 		for {
 			select {
 			case err := <-waitCh:
+				ui.showCrashReport()
 				return err
 			case <-gtkPumpTicker.C:
 				// This is so stupid, but is needed for notification actions
 				// to work.
 				gtk3.MainIterationDo(false)
 				continue
+			case req := <-ui.FileChooserCh:
+				ui.onFileChooserRequest(req)
+				continue
+			case name := <-downloadCh:
+				ui.notifyDownload(name)
+				continue
+			case action := <-ui.downloadsNotificationCh:
+				if action == actionShowDownloads {
+					ui.downloadsDialog.run()
+				}
+				continue
 			case action := <-ui.updateNotificationCh:
 				// Notification action was triggered, probably a restart.
 				log.Printf("update: Received notification action: %v", action)
@@ -192,6 +234,7 @@ func (ui *gtkUI) Run() error {
 				/// Wait for the check to complete.
 				select {
 				case err := <-waitCh: // User exited browser while checking.
+					ui.showCrashReport()
 					return err
 				case <-async.Done:
 				}
@@ -230,6 +273,7 @@ func (ui *gtkUI) Run() error {
 		// https://bugzilla.mozilla.org/show_bug.cgi?id=336193
 		ui.Sandbox.Kill()
 		<-waitCh
+		ui.showCrashReport()
 
 		ui.Sandbox = nil
 		ui.PendingUpdate = update
@@ -246,6 +290,8 @@ func (ui *gtkUI) Term() {
 	if ui.updateNotification != nil {
 		ui.updateNotification.Close()
 		ui.updateNotification = nil
+		ui.downloadsNotification.Close()
+		ui.downloadsNotification = nil
 		notify.Uninit()
 	}
 }
@@ -295,6 +341,16 @@ func Init() (sbui.UI, error) {
 		if err := ui.initProgressDialog(b); err != nil {
 			return nil, err
 		}
+
+		// BridgeDB CAPTCHA dialog.
+		if err := ui.initMoatDialog(b); err != nil {
+			return nil, err
+		}
+
+		// Download quarantine dialog.
+		if err := ui.initDownloadsDialog(b); err != nil {
+			return nil, err
+		}
 	}
 
 	// Initialize the Desktop Notification interface.
@@ -303,10 +359,20 @@ func Init() (sbui.UI, error) {
 		ui.updateNotification.SetTimeout(15 * 1000)
 		ui.updateNotification.AddAction(actionRestart, "Restart Now")
 		ui.updateNotificationCh = ui.updateNotification.ActionChan()
+		ui.initDownloadsNotification()
 	} else {
 		ui.updateNotificationCh = make(chan string)
+		ui.downloadsNotificationCh = make(chan string)
 	}
 
+	// File chooser requests from the browser get serviced by the browser
+	// running loop.
+	ui.FileChooserCh = make(chan *portal.Request)
+
+	// The crash report is sent as the browser exits, before the browser
+	// running loop notices.
+	ui.CrashCh = make(chan *sandbox.CrashReport, 1)
+
 	return ui, nil
 }
 
@@ -333,6 +399,15 @@ func (ui *gtkUI) launch() error {
 	return async.Err
 }
 
+func (ui *gtkUI) testBridges(bs []*bridges.Bridge, results []error) error {
+	async := async.NewAsync()
+	ui.progressDialog.setTitle("Testing bridges")
+	ui.progressDialog.setText("Initializing bridge test...")
+	ui.progressDialog.run(async, func() { ui.DoTestBridges(async, bs, results) })
+
+	return async.Err
+}
+
 func (ui *gtkUI) bitch(format string, a ...interface{}) {
 	// XXX: Make this nicer with like, an icon and shit.
 	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_ERROR, gtk3.BUTTONS_OK, format, a...)
@@ -341,6 +416,30 @@ func (ui *gtkUI) bitch(format string, a ...interface{}) {
 	ui.forceRedraw()
 }
 
+func (ui *gtkUI) warn(format string, a ...interface{}) {
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_WARNING, gtk3.BUTTONS_OK, format, a...)
+	md.Run()
+	md.Hide()
+	ui.forceRedraw()
+}
+
+// showCrashReport shows the crash report for the browser that just exited,
+// if there is one.
+func (ui *gtkUI) showCrashReport() {
+	select {
+	case r := <-ui.CrashCh:
+		ui.warn("Tor Browser crashed.  Nothing was submitted anywhere.\n\n%v", r)
+	default:
+	}
+}
+
+func (ui *gtkUI) info(format string, a ...interface{}) {
+	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_INFO, gtk3.BUTTONS_OK, format, a...)
+	md.Run()
+	md.Hide()
+	ui.forceRedraw()
+}
+
 func (ui *gtkUI) ask(format string, a ...interface{}) bool {
 	md := gtk3.MessageDialogNew(ui.mainWindow, gtk3.DIALOG_MODAL, gtk3.MESSAGE_QUESTION, gtk3.BUTTONS_OK_CANCEL, format, a...)
 	result := md.Run()
@@ -367,7 +466,11 @@ func (ui *gtkUI) pixbufFromAsset(asset string) (*gdk.Pixbuf, error) {
 		return nil, err
 	}
 
-	l, err := gdk.PixbufLoaderNewWithType(strings.TrimLeft(filepath.Ext(asset), "."))
+	return ui.pixbufFromBytes(d, strings.TrimLeft(filepath.Ext(asset), "."))
+}
+
+func (ui *gtkUI) pixbufFromBytes(d []byte, typ string) (*gdk.Pixbuf, error) {
+	l, err := gdk.PixbufLoaderNewWithType(typ)
 	if err != nil {
 		return nil, err
 	}
@@ -180,3 +180,27 @@ func getTextView(b *gtk3.Builder, id string) (*gtk3.TextView, error) {
 	}
 	return v, nil
 }
+
+func getTreeView(b *gtk3.Builder, id string) (*gtk3.TreeView, error) {
+	obj, err := b.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := obj.(*gtk3.TreeView)
+	if !ok {
+		return nil, newInvalidBuilderObject(obj)
+	}
+	return v, nil
+}
+
+func getListStore(b *gtk3.Builder, id string) (*gtk3.ListStore, error) {
+	obj, err := b.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := obj.(*gtk3.ListStore)
+	if !ok {
+		return nil, newInvalidBuilderObject(obj)
+	}
+	return v, nil
+}
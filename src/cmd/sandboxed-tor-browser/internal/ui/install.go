@@ -21,13 +21,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
-	"os"
 	"path/filepath"
 	"runtime"
 	"time"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
@@ -55,6 +55,16 @@ func (c *Common) DoInstall(async *Async) {
 
 	log.Printf("install: Starting.")
 
+	// Installing replaces the bundle out from under any other sessions.
+	if ok, err := c.lockBundle(); err != nil {
+		async.Err = err
+		return
+	} else if !ok {
+		async.Err = fmt.Errorf("the bundle can not be installed while other sessions are running")
+		return
+	}
+	defer c.unlockBundle()
+
 	if c.tor != nil {
 		log.Printf("install: Shutting down old tor.")
 		c.tor.Shutdown()
@@ -128,8 +138,8 @@ func (c *Common) DoInstall(async *Async) {
 	log.Printf("install: Installing Tor Browser.")
 	async.UpdateProgress("Installing Tor Browser.")
 
-	os.RemoveAll(c.Cfg.TorDataDir) // Remove the tor directory.
-
+	// The tor data directory is intentionally left alone, so that the entry
+	// guards persist across reinstalls.
 	if err := installer.ExtractBundle(c.Cfg.BundleInstallDir, bundleTarXz, async.Cancel); err != nil {
 		async.Err = err
 		if async.Err == installer.ErrExtractionCanceled {
@@ -146,6 +156,12 @@ func (c *Common) DoInstall(async *Async) {
 		return
 	}
 
+	// Save the bookmarks for disposable sessions, before anything can use
+	// the bundle's profile.
+	if err := sandbox.SavePristineBookmarks(c.Cfg); err != nil {
+		log.Printf("install: Failed to save the bundle's bookmarks: %v", err)
+	}
+
 	// Set the manifest.
 	c.Manif = config.NewManifest(c.Cfg, version)
 	if async.Err = c.Manif.Sync(); async.Err != nil {
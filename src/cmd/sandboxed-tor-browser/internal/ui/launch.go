@@ -54,6 +54,10 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 		async.Err = fmt.Errorf("launch failed, installation required")
 		return
 	}
+	if c.StorageLocked() {
+		async.Err = fmt.Errorf("launch failed, the encrypted storage is locked")
+		return
+	}
 
 	// Start tor if required.
 	log.Printf("launch: Connecting to the Tor network.")
@@ -74,5 +78,5 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 	log.Printf("launch: Starting Tor Browser.")
 	async.UpdateProgress("Starting Tor Browser.")
 
-	c.Sandbox, async.Err = sandbox.RunTorBrowser(c.Cfg, c.Manif, c.tor)
+	c.Sandbox, async.Err = sandbox.RunTorBrowser(c.Cfg, c.Manif, c.tor, c.FileChooserCh, c.CrashCh)
 }
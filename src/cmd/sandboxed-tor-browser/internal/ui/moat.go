@@ -0,0 +1,203 @@
+// moat.go - BridgeDB moat bridge requests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/net/proxy"
+
+	"cmd/sandboxed-tor-browser/internal/bridges"
+	"cmd/sandboxed-tor-browser/internal/moat"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+const (
+	// The moat domain front, which is the same as Tor Browser's.
+	moatTransport = "meek_lite"
+	moatMeekURL   = "https://onion.azureedge.net/"
+	moatMeekFront = "ajax.aspnetcdn.com"
+	moatMeekAddr  = "0.0.2.0:3" // Ignored by meek_lite.
+
+	// socksAuthFieldSize is the maximum size of a RFC 1929 username or
+	// password.
+	socksAuthFieldSize = 255
+)
+
+// moatSupportedTransports is the list of transports that moat will be asked
+// to provide bridges for.
+var moatSupportedTransports = []string{"obfs4"}
+
+// MoatSession is a BridgeDB moat session, tunneled over a sandboxed domain
+// fronted transport.
+type MoatSession struct {
+	// Challenge is the most recently fetched CAPTCHA challenge.
+	Challenge *moat.Challenge
+
+	// Bridges is the list of bridges received from BridgeDB.
+	Bridges []*bridges.Bridge
+
+	process *process.Process
+	client  *moat.Client
+}
+
+// Close tears down the domain fronted transport.
+func (s *MoatSession) Close() {
+	if s.process != nil {
+		s.process.Kill()
+		s.process = nil
+	}
+	s.client = nil
+}
+
+func (s *MoatSession) do(async *Async, fn func() error) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- fn()
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-async.Cancel:
+		// Killing the transport will unblock the pending request.
+		s.Close()
+		return ErrCanceled
+	}
+}
+
+// DoMoatFetch fetches a new CAPTCHA challenge from BridgeDB, launching the
+// domain fronted transport if required.  This is blocking and should be run
+// from a go routine, with the appropriate Async structure used to
+// communicate.
+func (c *Common) DoMoatFetch(async *Async, s *MoatSession) {
+	async.Err = nil
+	defer func() {
+		if len(async.Cancel) > 0 {
+			<-async.Cancel
+		}
+		if async.Err != nil {
+			log.Printf("moat: Failed to fetch challenge: %v", async.Err)
+		}
+		async.Done <- true
+	}()
+
+	if c.NeedsInstall() {
+		async.Err = fmt.Errorf("bridge request failed, installation required")
+		return
+	}
+
+	if s.client == nil {
+		async.UpdateProgress("Launching the domain fronted transport.")
+		if async.Err = c.launchMoatTransport(s); async.Err != nil {
+			return
+		}
+	}
+
+	async.UpdateProgress("Requesting a CAPTCHA from BridgeDB.")
+	client := s.client
+	var ch *moat.Challenge
+	s.Challenge = nil
+	if async.Err = s.do(async, func() (err error) {
+		ch, err = client.Fetch(moatSupportedTransports)
+		return
+	}); async.Err != nil {
+		return
+	}
+	s.Challenge = ch
+}
+
+// DoMoatCheck submits the solution to the most recently fetched CAPTCHA
+// challenge, and on success stores the received bridges in the session.
+// This is blocking and should be run from a go routine, with the
+// appropriate Async structure used to communicate.
+func (c *Common) DoMoatCheck(async *Async, s *MoatSession, solution string) {
+	async.Err = nil
+	defer func() {
+		if len(async.Cancel) > 0 {
+			<-async.Cancel
+		}
+		if async.Err != nil {
+			log.Printf("moat: Failed to check solution: %v", async.Err)
+		}
+		async.Done <- true
+	}()
+
+	if s.client == nil || s.Challenge == nil {
+		async.Err = fmt.Errorf("moat: no outstanding challenge")
+		return
+	}
+
+	async.UpdateProgress("Requesting bridges from BridgeDB.")
+	client, challenge := s.client, s.Challenge
+	var lines []string
+	s.Challenge = nil // Challenges are single use.
+	if async.Err = s.do(async, func() (err error) {
+		lines, err = client.Check(challenge, solution)
+		return
+	}); async.Err != nil {
+		return
+	}
+
+	// Be paranoid about what BridgeDB returns, since the lines will end up
+	// in the torrc.
+	var bs []*bridges.Bridge
+	for _, l := range lines {
+		b, err := bridges.ParseLine(l)
+		if err != nil {
+			async.Err = fmt.Errorf("moat: received malformed bridge: %v", err)
+			return
+		}
+		bs = append(bs, b)
+	}
+	s.Bridges = bridges.Dedupe(bs)
+}
+
+func (c *Common) launchMoatTransport(s *MoatSession) error {
+	p, methods, err := sandbox.RunPluggableTransport(c.Cfg, tor.Transports[moatTransport], []string{moatTransport})
+	if err != nil {
+		return err
+	}
+
+	// Pluggable transport arguments are passed via the SOCKS 5 username
+	// and password, split the same way that tor does.
+	args := "url=" + moatMeekURL + ";front=" + moatMeekFront
+	auth := &proxy.Auth{User: args, Password: "\x00"}
+	if len(args) > socksAuthFieldSize {
+		auth.User, auth.Password = args[:socksAuthFieldSize], args[socksAuthFieldSize:]
+	}
+	dialer, err := proxy.SOCKS5("tcp", methods[moatTransport], auth, proxy.Direct)
+	if err != nil {
+		p.Kill()
+		return err
+	}
+
+	// The meek tunnel always terminates at BridgeDB, so the requested
+	// address is ignored, and TLS is done end to end over the tunnel.
+	dialFn := func(network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, moatMeekAddr)
+	}
+
+	s.process = p
+	s.client = moat.NewClient(moat.DefaultURL, dialFn)
+	return nil
+}
@@ -0,0 +1,130 @@
+// profile.go - Profile data import/export routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/profile"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	cmdExport = "export"
+	cmdImport = "import"
+)
+
+func (c *Common) profileDir() (string, error) {
+	dir := sandbox.ProfileDir(c.Cfg)
+	if dir == "" {
+		return "", fmt.Errorf("disposable sessions do not have a profile on disk")
+	} else if c.Cfg.EncryptedStorage && !c.storage.profileUnlocked {
+		return "", fmt.Errorf("the encrypted profile is locked")
+	}
+	return dir, nil
+}
+
+// ExportProfileData exports the bookmarks and the security settings of the
+// session's profile to a new file at path.
+func (c *Common) ExportProfileData(path string) error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("the browser must not be running")
+	}
+	dir, err := c.profileDir()
+	if err != nil {
+		return err
+	}
+
+	d, err := profile.Export(dir)
+	if err != nil {
+		return err
+	}
+	b, err := d.Marshal()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, utils.FileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	log.Printf("ui: Exported profile data: %v", path)
+	return nil
+}
+
+// ImportProfileData imports the bookmarks and the security settings from the
+// file at path into the session's profile.  The imported bookmarks replace
+// the existing bookmarks when the browser is next launched.
+func (c *Common) ImportProfileData(path string) error {
+	if c.Sandbox != nil {
+		return fmt.Errorf("the browser must not be running")
+	}
+	dir, err := c.profileDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, profile.MaxDataSize+1))
+	if err != nil {
+		return err
+	}
+
+	d, err := profile.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	if err = profile.Import(dir, d); err != nil {
+		return err
+	}
+
+	log.Printf("ui: Imported profile data: %v", path)
+	return nil
+}
+
+func (c *Common) runProfileCmd() error {
+	var err error
+	switch c.profileCmd {
+	case "":
+		return nil
+	case cmdExport:
+		err = c.ExportProfileData(c.profileCmdPath)
+	case cmdImport:
+		err = c.ImportProfileData(c.profileCmdPath)
+	}
+	c.RanCommand = true
+	return err
+}
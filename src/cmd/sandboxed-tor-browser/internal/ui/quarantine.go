@@ -0,0 +1,94 @@
+// quarantine.go - Download quarantine routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/quarantine"
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+)
+
+// Quarantine returns the session's download quarantine, opening it on first
+// use.  It is usable even if the quarantine is disabled, so that anything
+// left over from when it was enabled can be exported.
+func (c *Common) Quarantine() (*quarantine.Quarantine, error) {
+	if c.quarantine != nil {
+		return c.quarantine, nil
+	}
+
+	q, err := quarantine.Open(sandbox.QuarantineDir(c.Cfg))
+	if err != nil {
+		return nil, err
+	}
+	c.quarantine = q
+	return q, nil
+}
+
+// ExportQuarantined copies the download name out of the quarantine into
+// destDir, scrubbing the metadata if configured to do so, and returns the
+// path of the exported file.
+func (c *Common) ExportQuarantined(name, destDir string) (string, error) {
+	q, err := c.Quarantine()
+	if err != nil {
+		return "", err
+	}
+	return q.Export(name, destDir, c.Cfg.Sandbox.ScrubDownloadMetadata)
+}
+
+// ViewQuarantined opens the download name, of type mimeType, with the host's
+// viewer for the type in an offline sandbox.
+func (c *Common) ViewQuarantined(name, mimeType string) error {
+	q, err := c.Quarantine()
+	if err != nil {
+		return err
+	}
+
+	// The browser can write to the quarantine, so the viewer gets a copy of
+	// the download, in a directory of it's own.
+	stagingDir, err := ioutil.TempDir(c.Cfg.RuntimeDir, "viewer")
+	if err != nil {
+		return err
+	}
+	path, err := q.Stage(name, stagingDir)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return err
+	}
+
+	p, err := sandbox.RunViewer(c.Cfg, path, mimeType)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return err
+	}
+	log.Printf("ui: Opened '%v' in the offline viewer.", name)
+	go func() {
+		// Reap the viewer, and clean up the surrogate, and the copy.
+		p.Wait()
+		os.RemoveAll(stagingDir)
+	}()
+	return nil
+}
+
+func (c *Common) closeQuarantine() {
+	if c.quarantine != nil {
+		c.quarantine.Close()
+		c.quarantine = nil
+	}
+}
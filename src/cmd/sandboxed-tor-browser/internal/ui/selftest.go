@@ -0,0 +1,70 @@
+// selftest.go - Sandbox self-test routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+)
+
+const cmdSelfTest = "selftest"
+
+func (c *Common) runSelfTest() error {
+	if !c.selfTest {
+		return nil
+	}
+	c.RanCommand = true
+
+	if c.Manif == nil {
+		return fmt.Errorf("the bundle is not installed")
+	}
+	results, err := sandbox.SelfTest(c.Cfg, c.Manif)
+	if err != nil {
+		return err
+	}
+
+	nFailed := 0
+	for _, r := range results {
+		if !r.Passed {
+			nFailed++
+		}
+	}
+	if c.dryRunJSON {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", b)
+	} else {
+		for _, r := range results {
+			status := "PASS"
+			if !r.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(os.Stdout, "%s  %-10s %-24s expected %-7s got %s (%s)\n", status, r.Profile, r.Check, r.Expected, r.Result, r.Detail)
+		}
+		fmt.Fprintf(os.Stdout, "\n%d/%d checks passed.\n", len(results)-nFailed, len(results))
+	}
+
+	if nFailed > 0 {
+		return fmt.Errorf("%d sandbox self-test check(s) failed", nFailed)
+	}
+	return nil
+}
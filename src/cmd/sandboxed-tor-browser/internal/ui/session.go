@@ -0,0 +1,209 @@
+// session.go - Concurrent browser session routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/tor"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// All of the sessions share the bundle and the sandboxed tor instance, which
+// is coordinated with flock(2) locks in the shared runtime directory:
+//
+//   - `bundle.lock` is held shared by every running session, and exclusively
+//     while the bundle is being installed or updated.
+//   - `tor.lock` is held shared by every session that is using the sandboxed
+//     tor, so that the session that launched it can wait for the others to
+//     exit before shutting it down.
+//   - `tor-launch.lock` is held exclusively while attaching to or launching
+//     the sandboxed tor, so that only one instance uses the data directory.
+const (
+	bundleLockFileName    = "bundle.lock"
+	torLockFileName       = "tor.lock"
+	torLaunchLockFileName = "tor-launch.lock"
+)
+
+func openLockFile(dir, name string) (*lockFile, error) {
+	l := new(lockFile)
+
+	var err error
+	if l.f, err = os.OpenFile(filepath.Join(dir, name), os.O_CREATE, utils.FileMode); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *lockFile) flock(how int) error {
+	return syscall.Flock(int(l.f.Fd()), how)
+}
+
+// tryExclusive attempts to acquire an exclusive lock, without blocking.  If
+// held is true, the shared lock that is held is converted, and is still held
+// on failure.
+func (l *lockFile) tryExclusive(held bool) (bool, error) {
+	if err := l.flock(syscall.LOCK_EX | syscall.LOCK_NB); err == nil {
+		return true, nil
+	} else if err != syscall.EWOULDBLOCK {
+		return false, err
+	}
+	if !held {
+		return false, nil
+	}
+
+	// Lock conversion is not atomic, so the shared lock needs to be
+	// re-acquired.
+	return false, l.flock(syscall.LOCK_SH)
+}
+
+func (c *Common) initSessionLocks() error {
+	var err error
+	if c.bundleLock, err = openLockFile(c.Cfg.SharedRuntimeDir, bundleLockFileName); err != nil {
+		return err
+	}
+	if err = c.bundleLock.flock(syscall.LOCK_SH); err != nil {
+		return err
+	}
+	c.torLock, err = openLockFile(c.Cfg.SharedRuntimeDir, torLockFileName)
+	return err
+}
+
+func (c *Common) termSessionLocks() {
+	if c.torLock != nil {
+		c.torLock.unlock()
+		c.torLock = nil
+	}
+	if c.bundleLock != nil {
+		c.bundleLock.unlock()
+		c.bundleLock = nil
+	}
+}
+
+// lockBundle acquires exclusive access to the bundle for installation, and
+// returns false if other sessions are running.  The lock should be released
+// with unlockBundle.
+func (c *Common) lockBundle() (bool, error) {
+	if c.bundleLock == nil {
+		return true, nil
+	}
+	return c.bundleLock.tryExclusive(true)
+}
+
+func (c *Common) unlockBundle() {
+	if c.bundleLock != nil {
+		c.bundleLock.flock(syscall.LOCK_SH)
+	}
+}
+
+// torInUseByOtherSessions returns true if other sessions are using the
+// sandboxed tor instance.
+func (c *Common) torInUseByOtherSessions() bool {
+	if c.torLock == nil || c.Cfg.Disposable || (c.tor != nil && c.tor.IsSystem()) {
+		return false
+	}
+
+	// Only a session that is using tor holds the lock, and one that isn't
+	// must not be left holding it, or the session that launched tor will
+	// wait on it to exit.
+	held := c.tor != nil
+	if ok, err := c.torLock.tryExclusive(held); err != nil || !ok {
+		return true
+	}
+	if held {
+		c.torLock.flock(syscall.LOCK_SH)
+	} else {
+		c.torLock.flock(syscall.LOCK_UN)
+	}
+	return false
+}
+
+// waitForSessions blocks till the other sessions are done with the sandboxed
+// tor instance, if this session launched it.
+func (c *Common) waitForSessions() {
+	if c.torLock == nil || c.Cfg.Disposable || c.tor == nil || c.tor.IsSystem() || c.tor.IsShared() {
+		return
+	}
+
+	if ok, _ := c.torLock.tryExclusive(true); !ok {
+		log.Printf("tor: Waiting for the other sessions to exit.")
+		c.torLock.flock(syscall.LOCK_EX)
+	}
+}
+
+// launchSharedTor attaches to the sandboxed tor instance launched by another
+// session if one is running, and launches and bootstraps one otherwise.
+func (c *Common) launchSharedTor(async *Async) error {
+	if c.Cfg.Disposable {
+		// Disposable sessions have their own tor data directory, and thus
+		// need their own tor.
+		return c.launchUnsharedTor(async)
+	}
+
+	launchLock, err := openLockFile(c.Cfg.SharedRuntimeDir, torLaunchLockFileName)
+	if err != nil {
+		return err
+	}
+	defer launchLock.unlock()
+
+	hz := time.NewTicker(1 * time.Second)
+	defer hz.Stop()
+	for {
+		if err = launchLock.flock(syscall.LOCK_EX | syscall.LOCK_NB); err == nil {
+			break
+		} else if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		async.UpdateProgress("Waiting for another session to connect to Tor.")
+		select {
+		case <-hz.C:
+		case <-async.Cancel:
+			return ErrCanceled
+		}
+	}
+
+	// This will block if the session that launched tor is shutting it down,
+	// after which it's data directory is free for use.
+	if err = c.torLock.flock(syscall.LOCK_SH); err != nil {
+		return err
+	}
+
+	if c.tor, err = tor.NewSharedTor(c.Cfg); err == nil {
+		log.Printf("launch: Using the tor instance from another session.")
+		return nil
+	} else if err != tor.ErrTorNotRunning {
+		log.Printf("launch: Failed to use the tor instance from another session: %v", err)
+	}
+
+	if err = c.unlockTorState(); err != nil {
+		return err
+	}
+	return c.launchUnsharedTor(async)
+}
+
+func (c *Common) launchUnsharedTor(async *Async) error {
+	if c.Cfg.Tor.UseAutoConnect {
+		return c.autoConnectTor(async)
+	}
+	return c.launchSandboxedTor(async, false)
+}
@@ -0,0 +1,330 @@
+// storage.go - Encrypted storage routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/utils"
+	"cmd/sandboxed-tor-browser/internal/vault"
+)
+
+// When storage encryption is enabled, the profile and the tor data directory
+// are kept in vaults, that are unlocked into the runtime directory (which
+// must be a tmpfs) at launch, and re-encrypted on exit.  The profile is
+// unlocked when the passphrase is entered, and the tor data directory when
+// the session launches the sandboxed tor, since it is shared between all of
+// the sessions.  Existing plaintext directories are encrypted on the first
+// exit after storage encryption is enabled, and are then deleted.
+//
+// The download quarantine and the pluggable transport state are not worth
+// encrypting, and are only ever kept in the runtime directory.
+const (
+	profileVaultPurpose = "profile"
+	torVaultPurpose     = "tor"
+)
+
+// profileExcludes are the bundle managed parts of the profile, that are not
+// encrypted.
+var profileExcludes = []string{"preferences", "extensions"}
+
+type storageState struct {
+	key             *vault.Key
+	plainProfileDir string
+	plainTorDir     string
+	profileUnlocked bool
+	torUnlocked     bool
+
+	plainQuarantineDir string
+	plainPtStateDir    string
+}
+
+func (c *Common) initStorage() {
+	c.storage.plainProfileDir = sandbox.ProfileDir(c.Cfg)
+	c.storage.plainTorDir = c.Cfg.TorDataDir
+	c.storage.plainQuarantineDir = sandbox.QuarantineDir(c.Cfg)
+	c.storage.plainPtStateDir = c.Cfg.PtStateDir
+	c.Cfg.UseEncryptedStorage()
+}
+
+// StorageLocked returns true if storage encryption is enabled, and the
+// storage has not been unlocked yet.
+func (c *Common) StorageLocked() bool {
+	return c.Cfg.EncryptedStorage && c.storage.key == nil
+}
+
+// UnlockStorage unlocks the storage key with the passphrase, and unlocks the
+// session's profile.  vault.ErrBadPassphrase is returned if the passphrase is
+// incorrect.
+func (c *Common) UnlockStorage(passphrase []byte) error {
+	if !c.StorageLocked() {
+		return nil
+	}
+
+	key, err := vault.OpenKey(c.Cfg.StorageKeyFile, passphrase)
+	if err != nil {
+		return err
+	}
+	c.storage.key = key
+	return c.unlockProfile()
+}
+
+// EnableStorageEncryption enables storage encryption with the passphrase.
+// The profile and tor data directories are encrypted on exit.
+func (c *Common) EnableStorageEncryption(passphrase []byte) error {
+	if c.Cfg.Disposable {
+		return fmt.Errorf("disposable sessions do not have storage to encrypt")
+	}
+	if c.Cfg.EncryptedStorage {
+		return fmt.Errorf("storage encryption is already enabled")
+	}
+	if c.tor != nil && !c.tor.IsSystem() {
+		return fmt.Errorf("storage encryption can not be enabled while tor is running")
+	}
+
+	// The tor data directory moves, so none of the other sessions can be
+	// running.
+	if ok, err := c.lockBundle(); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("storage encryption can not be enabled while other sessions are running")
+	}
+	defer c.unlockBundle()
+
+	key, err := vault.CreateKey(c.Cfg.StorageKeyFile, passphrase)
+	if err != nil {
+		return err
+	}
+	log.Printf("storage: Enabled storage encryption.")
+
+	c.initStorage()
+	c.storage.key = key
+	return c.unlockProfile()
+}
+
+func (c *Common) unlockProfile() error {
+	if err := c.unlockDir(c.Cfg.ProfileVault, profileVaultPurpose, c.Cfg.UnlockedProfileDir, c.storage.plainProfileDir, profileExcludes); err != nil {
+		return err
+	}
+	c.storage.profileUnlocked = true
+
+	// Move anything left in the unencrypted quarantine into the runtime
+	// directory, which was just checked to be a tmpfs, and discard the
+	// unencrypted pluggable transport state.
+	c.closeQuarantine()
+	if err := copyDir(c.storage.plainQuarantineDir, c.Cfg.UnlockedQuarantineDir, nil); err != nil {
+		log.Printf("storage: Failed to move the unencrypted quarantine: %v", err)
+	} else if err = removeDirContents(c.storage.plainQuarantineDir, nil); err != nil {
+		log.Printf("storage: Failed to remove the unencrypted quarantine: %v", err)
+	}
+	if err := os.RemoveAll(c.storage.plainPtStateDir); err != nil {
+		log.Printf("storage: Failed to remove the unencrypted pluggable transport state: %v", err)
+	}
+	return nil
+}
+
+// unlockTorState unlocks the tor data directory.  The caller must hold the
+// tor launch lock, and no tor instance can be using the directory.
+func (c *Common) unlockTorState() error {
+	if !c.Cfg.EncryptedStorage {
+		return nil
+	}
+	if c.storage.key == nil {
+		return fmt.Errorf("the encrypted storage is locked")
+	}
+	if err := c.unlockDir(c.Cfg.TorVault, torVaultPurpose, c.Cfg.TorDataDir, c.storage.plainTorDir, nil); err != nil {
+		return err
+	}
+	c.storage.torUnlocked = true
+	return nil
+}
+
+func (c *Common) unlockDir(vaultPath, purpose, dir, plainDir string, excludes []string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), utils.DirMode); err != nil {
+		return err
+	}
+	if ok, err := vault.IsRAMBacked(filepath.Dir(dir)); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("`XDG_RUNTIME_DIR` is not a tmpfs, refusing to unlock the %v", purpose)
+	}
+
+	switch {
+	case utils.DirExists(dir):
+		// Either this session already unlocked it, or it was left behind by
+		// an unclean exit, and is newer than the vault.
+		log.Printf("storage: Using the already unlocked %v.", purpose)
+	case utils.FileExists(vaultPath):
+		log.Printf("storage: Unlocking the %v.", purpose)
+		if err := vault.Unseal(vaultPath, c.storage.key, purpose, dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	default:
+		log.Printf("storage: Unlocking the unencrypted %v.", purpose)
+		if err := copyDir(plainDir, dir, excludes); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// lockStorage re-encrypts the unlocked directories.  This must be called
+// after the tor instance has been shut down, and before the session locks
+// are released.
+func (c *Common) lockStorage() {
+	if c.storage.key == nil {
+		return
+	}
+
+	if c.storage.profileUnlocked {
+		c.lockDir(c.Cfg.ProfileVault, profileVaultPurpose, c.Cfg.UnlockedProfileDir, c.storage.plainProfileDir, profileExcludes)
+		c.storage.profileUnlocked = false
+	}
+
+	// The tor data directory is only encrypted by the session that unlocked
+	// it, if no other session is using it, which is known for certain if
+	// the tor lock can be held exclusively till the session locks are
+	// released.
+	if c.storage.torUnlocked && c.torLock != nil {
+		if ok, _ := c.torLock.tryExclusive(true); ok {
+			c.lockDir(c.Cfg.TorVault, torVaultPurpose, c.Cfg.TorDataDir, c.storage.plainTorDir, nil)
+		} else {
+			log.Printf("storage: The tor data directory is in use by another session.")
+		}
+		c.storage.torUnlocked = false
+	}
+
+	c.storage.key.Wipe()
+	c.storage.key = nil
+}
+
+func (c *Common) lockDir(vaultPath, purpose, dir, plainDir string, excludes []string) {
+	log.Printf("storage: Encrypting the %v.", purpose)
+	if err := vault.Seal(vaultPath, c.storage.key, purpose, dir, excludes); err != nil {
+		// Leave the unlocked copy, which will get used on the next launch.
+		log.Printf("storage: Failed to encrypt the %v: %v", purpose, err)
+		return
+	}
+	os.RemoveAll(dir)
+
+	// Remove the unencrypted copy, if this was the first time.  Note that
+	// this does nothing to scrub the data from the underlying disk.
+	if err := removeDirContents(plainDir, excludes); err != nil {
+		log.Printf("storage: Failed to remove the unencrypted %v: %v", purpose, err)
+	}
+}
+
+// removeTorVault discards the encrypted tor state, along with any
+// unencrypted copy of it.
+func (c *Common) removeTorVault() error {
+	if !c.Cfg.EncryptedStorage {
+		return nil
+	}
+	if err := os.Remove(c.Cfg.TorVault); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.storage.torUnlocked = false
+	return os.RemoveAll(c.storage.plainTorDir)
+}
+
+func copyDir(src, dst string, excludes []string) error {
+	if err := os.MkdirAll(dst, utils.DirMode); err != nil {
+		return err
+	}
+	if !utils.DirExists(src) {
+		return nil
+	}
+
+	excludeMap := make(map[string]bool)
+	for _, v := range excludes {
+		excludeMap[v] = true
+	}
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if excludeMap[rel] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dstPath := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dstPath, utils.DirMode)
+		case fi.Mode().IsRegular():
+		default:
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm()|0600)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		if err = out.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(dstPath, fi.ModTime(), fi.ModTime())
+	})
+}
+
+func removeDirContents(dir string, excludes []string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	excludeMap := make(map[string]bool)
+	for _, v := range excludes {
+		excludeMap[v] = true
+	}
+	for _, fi := range fis {
+		if excludeMap[fi.Name()] {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// torstate.go - Persistent tor state routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/tor"
+)
+
+// EntryGuards returns the current entry guards.  If the sandboxed tor is
+// running the guards are queried over the control port, and annotated with
+// the times from the persisted tor state, otherwise only the persisted state
+// is used.
+func (c *Common) EntryGuards() ([]*tor.EntryGuard, error) {
+	if c.tor != nil && c.tor.IsSystem() {
+		return c.tor.EntryGuards()
+	} else if c.tor == nil && c.Cfg.UseSystemTor {
+		return tor.SystemEntryGuards(c.Cfg)
+	}
+
+	state, err := tor.StateEntryGuards(c.Cfg)
+	if err != nil || c.tor == nil {
+		return state, err
+	}
+
+	guards, err := c.tor.EntryGuards()
+	if err != nil {
+		return nil, err
+	}
+	stateMap := make(map[string]*tor.EntryGuard)
+	for _, g := range state {
+		stateMap[g.Fingerprint] = g
+	}
+	for _, g := range guards {
+		if sg := stateMap[g.Fingerprint]; sg != nil {
+			g.SampledOn = sg.SampledOn
+			g.ConfirmedOn = sg.ConfirmedOn
+		}
+	}
+	return guards, nil
+}
+
+// ResetTorState shuts down the sandboxed tor if it is running, and discards
+// all of it's persistent state, including the entry guards.
+func (c *Common) ResetTorState() error {
+	if c.Cfg.UseSystemTor {
+		return fmt.Errorf("the system tor's state can not be reset")
+	}
+	if c.torInUseByOtherSessions() {
+		return fmt.Errorf("the tor state can not be reset while other sessions are using tor")
+	}
+
+	if c.tor != nil {
+		log.Printf("tor: Shutting down tor to reset the state.")
+		c.tor.Shutdown()
+		c.tor = nil
+	}
+
+	log.Printf("tor: Resetting the tor state.")
+	if err := c.removeTorVault(); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.Cfg.TorDataDir)
+}
@@ -35,9 +35,13 @@ import (
 	"git.schwanenlied.me/yawning/grab.git"
 	"git.schwanenlied.me/yawning/hpkp.git"
 
+	"cmd/sandboxed-tor-browser/internal/bridges"
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/quarantine"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sandbox/egress"
+	"cmd/sandboxed-tor-browser/internal/sandbox/portal"
 	"cmd/sandboxed-tor-browser/internal/sandbox/process"
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
@@ -79,6 +83,10 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "\n Commands:\n\n")
 	fmt.Fprintf(os.Stderr, "   install\tForce (re)installation.\n")
 	fmt.Fprintf(os.Stderr, "   config\tForce (re)configuration.\n")
+	fmt.Fprintf(os.Stderr, "   export FILE\tExport the bookmarks and security settings.\n")
+	fmt.Fprintf(os.Stderr, "   import FILE\tImport the bookmarks and security settings.\n")
+	fmt.Fprintf(os.Stderr, "   selftest\tCheck that the sandboxes deny what they should.\n")
+	fmt.Fprintf(os.Stderr, "   run-profile FILE\tRun the application described by a sandbox profile.\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	os.Exit(-1)
 }
@@ -100,18 +108,46 @@ type Common struct {
 	tor     *tor.Tor
 	lock    *lockFile
 
+	bundleLock *lockFile
+	torLock    *lockFile
+	storage    storageState
+	quarantine *quarantine.Quarantine
+
 	logQuiet bool
 	logPath  string
 	logFile  *os.File
 
+	profileCmd     string
+	profileCmdPath string
+	appProfilePath string
+
+	dryRun     bool
+	dryRunJSON bool
+	selfTest   bool
+
+	// BwrapWarnings are the problems with the bubblewrap install that the
+	// user should be told about.
+	BwrapWarnings []string
+
 	PendingUpdate *installer.UpdateEntry
 
+	// FileChooserCh is where file chooser requests from the browser are
+	// sent, if the UI supports them.
+	FileChooserCh chan *portal.Request
+
+	// CrashCh is where the crash report is sent when the browser exits, if
+	// local crash reports are enabled, and the UI supports them.
+	CrashCh chan *sandbox.CrashReport
+
 	ForceInstall   bool
 	ForceConfig    bool
 	NoKillTor      bool
 	AdvancedConfig bool
 	PrintVersion   bool
+	RanCommand     bool
 	WasHardened    bool
+	Session        string
+	Disposable     bool
 }
 
 // Init initializes the common interface state.
@@ -124,6 +160,10 @@ func (c *Common) Init() error {
 	flag.BoolVar(&c.PrintVersion, "version", false, "Print the version and exit.")
 	flag.BoolVar(&c.logQuiet, "q", false, "Suppress logging to console.")
 	flag.StringVar(&c.logPath, "l", "", "Specify a log file.")
+	flag.StringVar(&c.Session, "session", "", "Run a named browser session, with a separate profile.")
+	flag.BoolVar(&c.Disposable, "disposable", false, "Run a disposable browser session, that leaves nothing behind.")
+	flag.BoolVar(&c.dryRun, "dry-run", false, "Print the tor and browser sandboxes instead of launching them.")
+	flag.BoolVar(&c.dryRunJSON, "json", false, "Print the -dry-run or selftest output as JSON.")
 
 	// Initialize/load the config file.
 	if c.Cfg, err = config.New(Version + "-" + Revision); err != nil {
@@ -169,12 +209,27 @@ func (c *Common) Run() error {
 	if *halp {
 		flag.Usage()
 	}
-	for _, v := range flag.Args() {
-		switch strings.ToLower(v) {
+	args := flag.Args()
+	for i := 0; i < len(args); i++ {
+		switch v := strings.ToLower(args[i]); v {
 		case cmdInstall:
 			c.ForceInstall = true
 		case cmdConfig:
 			c.ForceConfig = true
+		case cmdSelfTest:
+			c.selfTest = true
+		case cmdExport, cmdImport:
+			if c.profileCmd != "" || i+1 >= len(args) {
+				flag.Usage()
+			}
+			c.profileCmd, c.profileCmdPath = v, args[i+1]
+			i++
+		case cmdRunProfile:
+			if c.appProfilePath != "" || i+1 >= len(args) {
+				flag.Usage()
+			}
+			c.appProfilePath = args[i+1]
+			i++
 		default:
 			flag.Usage()
 		}
@@ -183,6 +238,18 @@ func (c *Common) Run() error {
 		fmt.Printf("sandboxed-tor-browser %s (%s)\n", Version, Revision)
 		return nil // Skip the lock, because we will exit.
 	}
+	if c.Disposable {
+		if c.Session != "" {
+			return fmt.Errorf("`--session` and `--disposable` are mutually exclusive")
+		}
+		if err := c.Cfg.UseDisposable(); err != nil {
+			return err
+		}
+	} else if c.Session != "" {
+		if err := c.Cfg.UseSession(c.Session); err != nil {
+			return err
+		}
+	}
 
 	// Create the directories required.
 	if !utils.DirExists(c.Cfg.UserDataDir) {
@@ -200,6 +267,14 @@ func (c *Common) Run() error {
 			return err
 		}
 	}
+	if c.Cfg.SessionDataDir != "" && !utils.DirExists(c.Cfg.SessionDataDir) {
+		if err := os.MkdirAll(c.Cfg.SessionDataDir, utils.DirMode); err != nil {
+			return err
+		}
+	}
+	if !c.Cfg.Disposable && utils.FileExists(c.Cfg.StorageKeyFile) {
+		c.initStorage()
+	}
 
 	// Setup logging.
 	var err error
@@ -213,7 +288,13 @@ func (c *Common) Run() error {
 		logWriters = append(logWriters, c.logFile)
 	}
 	if !c.logQuiet {
-		logWriters = append(logWriters, os.Stdout)
+		// The dry-run and self-test output is meant to be redirected, or
+		// diffed, so keep the log out of it.
+		if c.dryRun || c.selfTest {
+			logWriters = append(logWriters, os.Stderr)
+		} else {
+			logWriters = append(logWriters, os.Stdout)
+		}
 	}
 	if len(logWriters) == 0 {
 		log.SetOutput(ioutil.Discard)
@@ -227,12 +308,40 @@ func (c *Common) Run() error {
 		return err
 	}
 
+	// Find bubblewrap up front, so that a binary that is unsafe to use is
+	// refused before anything is done.
+	if b, err := sandbox.FindBwrap(c.Cfg); err != nil {
+		return err
+	} else {
+		log.Printf("ui: Using bubblewrap %v: %v (setuid: %v, user namespaces: %v)", b.Version(), b.Path, b.Setuid, b.UserNamespaces)
+		for _, w := range b.Warnings {
+			log.Printf("ui: WARNING: %v", w)
+		}
+		c.BwrapWarnings = b.Warnings
+	}
+
 	// Acquire the lock file.
 	if c.lock, err = newLockFile(c); err != nil {
 		return err
 	}
 
-	return nil
+	// Acquire the locks shared with the other sessions.
+	if err = c.initSessionLocks(); err != nil {
+		return err
+	}
+
+	// Run the profile data commands, now that it's known that the session
+	// isn't running.
+	if err = c.runProfileCmd(); err != nil {
+		return err
+	}
+	if err = c.runSelfTest(); err != nil {
+		return err
+	}
+	if err = c.runAppProfile(); err != nil {
+		return err
+	}
+	return c.runDryRun()
 }
 
 // Term handles the common interface state cleanup, prior to termination.
@@ -243,14 +352,24 @@ func (c *Common) Term() {
 	}
 
 	if c.tor != nil {
+		c.waitForSessions()
 		c.tor.Shutdown()
 		c.tor = nil
 	}
 
+	c.closeQuarantine()
+	c.lockStorage()
+	c.termSessionLocks()
+
 	if c.lock != nil {
 		c.lock.unlock()
 		c.lock = nil
 	}
+
+	if c.Cfg != nil && c.Cfg.Disposable {
+		log.Printf("ui: Removing the disposable session.")
+		os.RemoveAll(c.Cfg.RuntimeDir)
+	}
 }
 
 // NeedsInstall returns true if the bundle needs to be (re)installed.
@@ -293,6 +412,13 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 		}
 	}()
 
+	if c.tor != nil && !c.NoKillTor && c.torInUseByOtherSessions() {
+		// Other sessions are using the tor instance, so it can't be
+		// relaunched with the new config.
+		log.Printf("launch: Reusing old tor, other sessions are using it.")
+		return nil
+	}
+
 	if c.tor != nil && !c.NoKillTor {
 		log.Printf("launch: Shutting down old tor.")
 		c.tor.Shutdown()
@@ -309,25 +435,7 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 			return err
 		}
 	} else if !onlySystem {
-		// Build the torrc.
-		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, Bridges)
-		if err != nil {
-			async.Err = err
-			return err
-		}
-
-		os.Remove(filepath.Join(c.Cfg.TorDataDir, "control_port"))
-
-		async.UpdateProgress("Launching Tor executable.")
-		process, err := sandbox.RunTor(c.Cfg, c.Manif, torrc)
-		if err != nil {
-			async.Err = err
-			return err
-		}
-
-		async.UpdateProgress("Waiting on Tor bootstrap.")
-		c.tor = tor.NewSandboxedTor(c.Cfg, process)
-		if err = c.tor.DoBootstrap(c.Cfg, async); err != nil {
+		if err = c.launchSharedTor(async); err != nil {
 			async.Err = err
 			return err
 		}
@@ -346,6 +454,110 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 	return tor.ErrTorNotRunning
 }
 
+func (c *Common) launchSandboxedTor(async *Async, detectStalls bool) error {
+	var err error
+	if c.tor, err = c.runSandboxedTor(c.Cfg, async); err != nil {
+		return err
+	}
+
+	async.UpdateProgress("Waiting on Tor bootstrap.")
+	if detectStalls {
+		c.tor.EnableStallDetection()
+	}
+	return c.tor.DoBootstrap(c.Cfg, async)
+}
+
+// runSandboxedTor launches the pluggable transports and the tor daemon,
+// configured per cfg, but does not bootstrap.
+func (c *Common) runSandboxedTor(cfg *config.Config, async *Async) (t *tor.Tor, err error) {
+	// Launch the pluggable transports, each in their own sandbox.
+	var ptProcess []*process.Process
+	defer func() {
+		if err != nil {
+			for _, p := range ptProcess {
+				p.Kill()
+			}
+		}
+	}()
+	ptMethods := make(map[string]string)
+	for bin, transports := range tor.TransportsByBinary(tor.BridgeTransports(cfg, Bridges)) {
+		async.UpdateProgress(fmt.Sprintf("Launching %v.", bin))
+		p, methods, err := sandbox.RunPluggableTransport(cfg, bin, transports)
+		if err != nil {
+			return nil, err
+		}
+		ptProcess = append(ptProcess, p)
+
+		// tor talks to the transports via shims, that only allow connecting
+		// to the configured bridges.
+		for k, v := range methods {
+			policy, err := tor.TransportPolicy(cfg, Bridges, k)
+			if err != nil {
+				return nil, err
+			}
+			shim, err := egress.NewSocksShim(v, policy)
+			if err != nil {
+				return nil, err
+			}
+			p.AddTermHook(shim.Close)
+			ptMethods[k] = shim.Addr()
+		}
+	}
+
+	// Build the torrc.
+	torrc, err := tor.CfgToSandboxTorrc(cfg, Bridges, ptMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	egressPolicy, err := tor.EgressPolicy(cfg, Bridges, ptMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	os.Remove(filepath.Join(cfg.TorDataDir, "control_port"))
+
+	async.UpdateProgress("Launching Tor executable.")
+	process, err := sandbox.RunTor(cfg, c.Manif, torrc, egressPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return tor.NewSandboxedTor(cfg, process, ptProcess), nil
+}
+
+func (c *Common) autoConnectTor(async *Async) error {
+	var err error
+
+	orig := tor.StrategyFromConfig(c.Cfg)
+	for _, s := range tor.AutoConnectStrategies(c.Cfg, Bridges) {
+		log.Printf("launch: Auto-connect: Trying '%v'.", s)
+		async.UpdateProgress(fmt.Sprintf("Auto-connect: Trying '%v'.", s))
+
+		s.Apply(c.Cfg)
+		if err = c.launchSandboxedTor(async, true); err == nil {
+			log.Printf("launch: Auto-connect: '%v' succeeded.", s)
+			c.Cfg.Tor.SetAutoConnectStrategy(s.Name)
+			return c.Cfg.Sync()
+		}
+
+		if c.tor != nil {
+			c.tor.Shutdown()
+			c.tor = nil
+		}
+		if err == ErrCanceled {
+			break
+		}
+		log.Printf("launch: Auto-connect: '%v' failed: %v", s, err)
+	}
+
+	// Nothing worked, so restore the user's bridge configuration.
+	orig.Apply(c.Cfg)
+	c.Cfg.Sync()
+
+	return err
+}
+
 type lockFile struct {
 	f *os.File
 }
@@ -368,6 +580,9 @@ func newLockFile(c *Common) (*lockFile, error) {
 	fd := int(l.f.Fd())
 	if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
 		if err == syscall.EWOULDBLOCK {
+			if c.Cfg.Session != "" {
+				return nil, fmt.Errorf("`sandboxed-tor-browser` session '%v' is already running", c.Cfg.Session)
+			}
 			return nil, fmt.Errorf("`sandboxed-tor-browser` is already running")
 		}
 		return nil, err
@@ -376,52 +591,15 @@ func newLockFile(c *Common) (*lockFile, error) {
 	return l, nil
 }
 
-// ValidateBridgeLines validates and sanitizes bridge lines.
+// ValidateBridgeLines validates, sanitizes and de-duplicates bridge lines.
+// On failure, the returned error will be a `bridges.ParseError`, identifying
+// each malformed line.
 func ValidateBridgeLines(ls string) (string, error) {
-	var ret []string
-
-	for _, l := range strings.Split(ls, "\n") {
-		l = strings.TrimSpace(l)
-		if len(l) == 0 {
-			continue
-		}
-		sp := strings.Split(l, " ")
-		if len(sp) == 0 {
-			continue
-		}
-		if strings.ToLower(sp[0]) == "bridge" { // Assume well formed...
-			ret = append(ret, l)
-			continue
-		}
-
-		// XXX: This obliterates the user's changes if there's an error,
-		// which is probably likely somewhat obnoxious.
-
-		// Validate that there is at least either:
-		if ip, _, err := net.SplitHostPort(sp[0]); err != nil {
-			if net.ParseIP(sp[0]) != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing port", l)
-			}
-			if Bridges[sp[0]] == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', unknown transport: %v", l, sp[0])
-			}
-			if len(sp) < 2 {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing IP", l)
-			}
-			if ip, _, err = net.SplitHostPort(sp[1]); err != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', bad IP/port", l)
-			} else if net.ParseIP(ip) == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v'", l)
-			}
-		} else if net.ParseIP(ip) == nil { // Or a host:port.
-			return "", fmt.Errorf("invalid Bridge IP/port: %v", sp[0])
-		}
-
-		// BridgeDB entries lack the "Bridge".
-		ret = append(ret, "Bridge "+l)
+	bs, err := bridges.Parse(ls)
+	if err != nil {
+		return "", err
 	}
-
-	return strings.Join(ret, "\n"), nil
+	return bridges.Format(bridges.Dedupe(bs)), nil
 }
 
 func newGrabClient(dialFn dialFunc, dialTLSFn dialFunc) *grab.Client {
@@ -202,6 +202,18 @@ func (c *Common) doUpdate(async *Async) {
 		c.PendingUpdate = nil
 	}
 
+	// Updating replaces the bundle out from under any other sessions, so
+	// defer it till they have exited.
+	if ok, err := c.lockBundle(); err != nil {
+		async.Err = err
+		return
+	} else if !ok {
+		log.Printf("update: Deferring the update, other sessions are running.")
+		c.PendingUpdate = update
+		return
+	}
+	defer c.unlockBundle()
+
 	// Figure out the best MAR to download.
 	patches := make(map[string]*installer.Patch)
 	for i := 0; i < len(update.Patch); i++ {
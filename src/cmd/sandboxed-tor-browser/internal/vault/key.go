@@ -0,0 +1,174 @@
+// key.go - Passphrase protected storage key.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	keyMagic = "STBKEY01"
+	keySize  = 32
+	saltSize = 32
+
+	// The scrypt parameters used for new keys (128 MiB, ~0.5s), and the
+	// upper bound on the cost that will be accepted from a key file.
+	scryptLogN    = 17
+	scryptR       = 8
+	scryptP       = 1
+	scryptMaxLogN = 20
+
+	keyFileSize = len(keyMagic) + 3 + saltSize + 24 + keySize + secretbox.Overhead
+)
+
+// ErrBadPassphrase is the error returned when the passphrase is incorrect.
+var ErrBadPassphrase = errors.New("vault: incorrect passphrase")
+
+// Key is the random master key that all of the vaults are encrypted with,
+// which is stored on disk encrypted with a key derived from the passphrase.
+type Key struct {
+	k [keySize]byte
+}
+
+// Wipe clears the key from memory.
+func (k *Key) Wipe() {
+	for i := range k.k {
+		k.k[i] = 0
+	}
+}
+
+// subkey derives the key for a given vault, so that vaults can not be
+// swapped for one another.
+func (k *Key) subkey(purpose string) (*[keySize]byte, error) {
+	var sk [keySize]byte
+	r := hkdf.New(sha256.New, k.k[:], nil, []byte("sandboxed-tor-browser vault: "+purpose))
+	if _, err := io.ReadFull(r, sk[:]); err != nil {
+		return nil, err
+	}
+	return &sk, nil
+}
+
+func passphraseKey(passphrase, salt []byte, logN, r, p int) (*[keySize]byte, error) {
+	b, err := scrypt.Key(passphrase, salt, 1<<uint(logN), r, p, keySize)
+	if err != nil {
+		return nil, err
+	}
+	var k [keySize]byte
+	copy(k[:], b)
+	for i := range b {
+		b[i] = 0
+	}
+	return &k, nil
+}
+
+// CreateKey generates a new master key, and writes it to path encrypted with
+// the passphrase.  Existing key files are never overwritten.
+func CreateKey(path string, passphrase []byte) (*Key, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("vault: empty passphrase")
+	}
+
+	k := new(Key)
+	var salt [saltSize]byte
+	var nonce [24]byte
+	for _, b := range [][]byte{k.k[:], salt[:], nonce[:]} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+	}
+	pk, err := passphraseKey(passphrase, salt[:], scryptLogN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeArray(pk)
+
+	var buf bytes.Buffer
+	buf.WriteString(keyMagic)
+	buf.Write([]byte{scryptLogN, scryptR, scryptP})
+	buf.Write(salt[:])
+	buf.Write(nonce[:])
+	b := secretbox.Seal(buf.Bytes(), k.k[:], &nonce, pk)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, utils.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return k, nil
+}
+
+// OpenKey reads the master key from path, decrypting it with the passphrase.
+func OpenKey(path string, passphrase []byte) (*Key, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != keyFileSize || !bytes.Equal(b[:len(keyMagic)], []byte(keyMagic)) {
+		return nil, fmt.Errorf("vault: malformed key file")
+	}
+	params := b[len(keyMagic) : len(keyMagic)+3]
+	logN, r, p := int(params[0]), int(params[1]), int(params[2])
+	if logN < 1 || logN > scryptMaxLogN || r < 1 || p < 1 || r*p > 16 {
+		return nil, fmt.Errorf("vault: unsupported key derivation parameters")
+	}
+	salt := b[len(keyMagic)+3 : len(keyMagic)+3+saltSize]
+	var nonce [24]byte
+	copy(nonce[:], b[len(keyMagic)+3+saltSize:])
+	box := b[len(keyMagic)+3+saltSize+24:]
+
+	pk, err := passphraseKey(passphrase, salt, logN, r, p)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeArray(pk)
+
+	k := new(Key)
+	out, ok := secretbox.Open(k.k[:0], box, &nonce, pk)
+	if !ok || len(out) != keySize {
+		k.Wipe()
+		return nil, ErrBadPassphrase
+	}
+	return k, nil
+}
+
+func wipeArray(k *[keySize]byte) {
+	for i := range k {
+		k[i] = 0
+	}
+}
@@ -0,0 +1,365 @@
+// vault.go - Encrypted directory archives.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package vault implements encrypted at rest storage of directories.
+//
+// A vault is a tar archive of a directory, split into 64 KiB chunks that are
+// each encrypted and authenticated with XSalsa20/Poly1305 (NaCl secretbox).
+// The nonce is a random per-vault prefix, a chunk counter, and a flag that
+// is only set for the final chunk, so chunks can't be reordered, dropped or
+// truncated without being detected.  The key is derived per vault from a
+// random master key, which is stored encrypted with a key derived from the
+// user's passphrase with scrypt.
+package vault
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	vaultMagic      = "STBVAULT"
+	vaultVersion    = 1
+	noncePrefixSize = 16
+	chunkSize       = 64 * 1024
+
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+var errMalformedVault = errors.New("vault: malformed or tampered with vault")
+
+// IsRAMBacked returns true if the directory is on a filesystem that is
+// backed by memory (tmpfs, ramfs), and thus suitable for holding the
+// unlocked contents of a vault.
+func IsRAMBacked(dir string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false, err
+	}
+	return st.Type == tmpfsMagic || st.Type == ramfsMagic, nil
+}
+
+type chunkWriter struct {
+	w       io.Writer
+	key     *[keySize]byte
+	nonce   [24]byte
+	counter uint64
+	buf     []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(cw.buf) == chunkSize {
+			if err := cw.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		toCopy := chunkSize - len(cw.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		cw.buf = append(cw.buf, p[:toCopy]...)
+		p = p[toCopy:]
+	}
+	return n, nil
+}
+
+func (cw *chunkWriter) flush(final bool) error {
+	setChunkNonce(&cw.nonce, cw.counter, final)
+	cw.counter++
+	b := secretbox.Seal(nil, cw.buf, &cw.nonce, cw.key)
+	cw.buf = cw.buf[:0]
+	_, err := cw.w.Write(b)
+	return err
+}
+
+func (cw *chunkWriter) Close() error {
+	return cw.flush(true)
+}
+
+type chunkReader struct {
+	r       *bufio.Reader
+	key     *[keySize]byte
+	nonce   [24]byte
+	counter uint64
+	buf     []byte
+	box     []byte
+	done    bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) next() error {
+	n, err := io.ReadFull(cr.r, cr.box)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		cr.done = true // Short chunks are always the final chunk.
+	} else if err != nil {
+		return err
+	} else if _, err = cr.r.Peek(1); err == io.EOF {
+		cr.done = true
+	}
+	if n < secretbox.Overhead {
+		return errMalformedVault
+	}
+
+	setChunkNonce(&cr.nonce, cr.counter, cr.done)
+	cr.counter++
+	var ok bool
+	if cr.buf, ok = secretbox.Open(cr.buf[:0], cr.box[:n], &cr.nonce, cr.key); !ok {
+		return errMalformedVault
+	}
+	return nil
+}
+
+func setChunkNonce(nonce *[24]byte, counter uint64, final bool) {
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], counter<<8)
+	if final {
+		nonce[23] = 1
+	}
+}
+
+// Seal archives the directory dir into a new vault at path, encrypted with
+// a key derived from k and purpose.  Top level entries named in excludes,
+// and anything that isn't a regular file or directory are skipped.  The
+// existing vault (if any) is replaced atomically.
+func Seal(path string, k *Key, purpose, dir string, excludes []string) (err error) {
+	sk, err := k.subkey(purpose)
+	if err != nil {
+		return err
+	}
+	defer wipeArray(sk)
+
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, utils.FileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	cw := &chunkWriter{w: bw, key: sk, buf: make([]byte, 0, chunkSize)}
+	if _, err = io.ReadFull(rand.Reader, cw.nonce[:noncePrefixSize]); err != nil {
+		return err
+	}
+	bw.WriteString(vaultMagic)
+	bw.WriteByte(vaultVersion)
+	bw.Write(cw.nonce[:noncePrefixSize])
+
+	tw := tar.NewWriter(cw)
+	if err = archiveDir(tw, dir, excludes); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = cw.Close(); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func archiveDir(tw *tar.Writer, dir string, excludes []string) error {
+	excludeMap := make(map[string]bool)
+	for _, v := range excludes {
+		excludeMap[v] = true
+	}
+
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if excludeMap[rel] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: fi.ModTime(),
+		}
+		switch {
+		case fi.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		case fi.Mode().IsRegular():
+		default:
+			// Sockets, lock symlinks and the like are recreated at runtime.
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// The file may change size while it's being archived, so buffer it
+		// since the header needs to be written first.
+		var buf bytes.Buffer
+		if _, err = io.Copy(&buf, f); err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(buf.Len())
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(buf.Bytes())
+		return err
+	})
+}
+
+// Unseal extracts the vault at path into the directory dir, which must be
+// empty or not exist.
+func Unseal(path string, k *Key, purpose, dir string) error {
+	sk, err := k.subkey(purpose)
+	if err != nil {
+		return err
+	}
+	defer wipeArray(sk)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	hdr := make([]byte, len(vaultMagic)+1+noncePrefixSize)
+	if _, err = io.ReadFull(br, hdr); err != nil {
+		return errMalformedVault
+	}
+	if !bytes.Equal(hdr[:len(vaultMagic)], []byte(vaultMagic)) {
+		return fmt.Errorf("vault: not a vault")
+	}
+	if v := hdr[len(vaultMagic)]; v != vaultVersion {
+		return fmt.Errorf("vault: unsupported version: %d", v)
+	}
+
+	cr := &chunkReader{r: br, key: sk, box: make([]byte, chunkSize+secretbox.Overhead)}
+	copy(cr.nonce[:], hdr[len(vaultMagic)+1:])
+
+	if err = os.MkdirAll(dir, utils.DirMode); err != nil {
+		return err
+	}
+	tr := tar.NewReader(cr)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err = extractEntry(tr, th, dir); err != nil {
+			return err
+		}
+	}
+
+	// Ensure that the entire vault was authenticated, including the padding
+	// after the end of the archive.
+	_, err = io.Copy(ioutil.Discard, cr)
+	return err
+}
+
+func extractEntry(r io.Reader, th *tar.Header, dir string) error {
+	name := filepath.Clean(filepath.FromSlash(th.Name))
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("vault: invalid entry name: '%v'", th.Name)
+	}
+	path := filepath.Join(dir, name)
+
+	switch th.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(path, utils.DirMode)
+	case tar.TypeReg, tar.TypeRegA:
+	default:
+		return fmt.Errorf("vault: invalid entry type: '%v'", th.Name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), utils.DirMode); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(th.Mode)&0700|0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, th.ModTime, th.ModTime)
+}
@@ -0,0 +1,246 @@
+/**
+ * sandbox_probe.c: Sandboxed Tor Browser sandbox self-test probe.
+ * Copyright (C) 2017  Yawning Angel.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+ * This is launched in place of the real application by the `selftest`
+ * command, and attempts each of the operations named on the command line,
+ * printing one line per operation to stdout:
+ *
+ *   <check> allowed|denied|error <detail>
+ *
+ * It deliberately does not decide if the result is what is expected, that
+ * is up to the launcher, which knows what each sandbox is supposed to allow.
+ *
+ * It is statically linked so that it does not depend on the libraries that
+ * happen to be in a given sandbox, and uses as few system calls as possible,
+ * since the seccomp whitelists are rather strict.
+ */
+
+#define _GNU_SOURCE /* Fuck *BSD and Macintoys. */
+
+#include <sys/types.h>
+#include <sys/ptrace.h>
+#include <sys/socket.h>
+#include <sys/syscall.h>
+#include <sys/wait.h>
+#include <arpa/inet.h>
+#include <linux/futex.h>
+#include <netinet/in.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <limits.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+
+#define MACHINE_ID_PATH "/etc/machine-id"
+#define WRITE_PROBE_NAME ".sandbox-probe"
+
+static void
+report(const char *check, const char *result, const char *detail)
+{
+  printf("%s %s %s\n", check, result, detail);
+  fflush(stdout);
+}
+
+static void
+report_errno(const char *check, int err)
+{
+  report(check, "denied", strerror(err));
+}
+
+/* socket-inet: Create an AF_INET socket. */
+static void
+check_socket_inet(const char *check)
+{
+  int fd;
+
+  if ((fd = socket(AF_INET, SOCK_STREAM, 0)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  close(fd);
+  report(check, "allowed", "socket(AF_INET, SOCK_STREAM)");
+}
+
+/*
+ * network: Route to an address outside the host.  A UDP connect() does not
+ * send anything, but fails if there is no route.
+ */
+static void
+check_network(const char *check)
+{
+  struct sockaddr_in addr;
+  int fd;
+
+  if ((fd = socket(AF_INET, SOCK_DGRAM, 0)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+
+  memset(&addr, 0, sizeof(addr));
+  addr.sin_family = AF_INET;
+  addr.sin_port = htons(53);
+  addr.sin_addr.s_addr = htonl(0x01010101); /* 1.1.1.1 */
+  if (connect(fd, (struct sockaddr *)&addr, sizeof(addr)) < 0) {
+    report_errno(check, errno);
+  } else {
+    report(check, "allowed", "route to 1.1.1.1");
+  }
+  close(fd);
+}
+
+/* proc: Read `/proc/self/status`. */
+static void
+check_proc(const char *check)
+{
+  int fd;
+
+  if ((fd = open("/proc/self/status", O_RDONLY | O_CLOEXEC)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  close(fd);
+  report(check, "allowed", "/proc/self/status");
+}
+
+/* read=PATH: Open PATH for reading. */
+static void
+check_read(const char *check, const char *path)
+{
+  int fd;
+
+  if ((fd = open(path, O_RDONLY | O_CLOEXEC)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  close(fd);
+  report(check, "allowed", path);
+}
+
+/* write=DIR: Create a file in DIR. */
+static void
+check_write(const char *check, const char *dir)
+{
+  char path[PATH_MAX];
+  int fd;
+
+  if (snprintf(path, sizeof(path), "%s/%s", dir, WRITE_PROBE_NAME) >= (int)sizeof(path)) {
+    report(check, "error", "path too long");
+    return;
+  }
+  if ((fd = open(path, O_WRONLY | O_CREAT | O_EXCL | O_CLOEXEC, 0600)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  close(fd);
+  unlink(path);
+  report(check, "allowed", path);
+}
+
+/* ptrace: Attach to the parent (the bubblewrap init process). */
+static void
+check_ptrace(const char *check)
+{
+  pid_t ppid = getppid();
+  int status;
+
+  if (ptrace(PTRACE_ATTACH, ppid, NULL, NULL) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  waitpid(ppid, &status, __WALL);
+  ptrace(PTRACE_DETACH, ppid, NULL, NULL);
+  report(check, "allowed", "PTRACE_ATTACH");
+}
+
+/*
+ * futex-pi: Acquire an uncontended PI futex, which PulseAudio would do if
+ * it wasn't patched by `tbb_stub.so`.
+ */
+static void
+check_futex_pi(const char *check)
+{
+  static uint32_t word = 0;
+
+  if (syscall(SYS_futex, &word, FUTEX_LOCK_PI, 0, NULL, NULL, 0) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  syscall(SYS_futex, &word, FUTEX_UNLOCK_PI, 0, NULL, NULL, 0);
+  report(check, "allowed", "FUTEX_LOCK_PI");
+}
+
+/* machine-id: Read `/etc/machine-id`, which should be the fake one. */
+static void
+check_machine_id(const char *check)
+{
+  char buf[64];
+  ssize_t n;
+  int fd;
+
+  if ((fd = open(MACHINE_ID_PATH, O_RDONLY | O_CLOEXEC)) < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  n = read(fd, buf, sizeof(buf) - 1);
+  close(fd);
+  if (n < 0) {
+    report_errno(check, errno);
+    return;
+  }
+  while (n > 0 && (buf[n-1] == '\n' || buf[n-1] == ' ')) {
+    n--;
+  }
+  buf[n] = '\0';
+  report(check, "allowed", buf);
+}
+
+int
+main(int argc, char *argv[])
+{
+  int i;
+
+  for (i = 1; i < argc; i++) {
+    const char *check = argv[i];
+    const char *arg = strchr(check, '=');
+
+    if (!strcmp(check, "socket-inet")) {
+      check_socket_inet(check);
+    } else if (!strcmp(check, "network")) {
+      check_network(check);
+    } else if (!strcmp(check, "proc")) {
+      check_proc(check);
+    } else if (!strcmp(check, "ptrace")) {
+      check_ptrace(check);
+    } else if (!strcmp(check, "futex-pi")) {
+      check_futex_pi(check);
+    } else if (!strcmp(check, "machine-id")) {
+      check_machine_id(check);
+    } else if (arg != NULL && !strncmp(check, "read=", 5)) {
+      check_read(check, arg + 1);
+    } else if (arg != NULL && !strncmp(check, "write=", 6)) {
+      check_write(check, arg + 1);
+    } else {
+      report(check, "error", "unknown check");
+    }
+  }
+
+  return 0;
+}
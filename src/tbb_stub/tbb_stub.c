@@ -33,14 +33,17 @@
 #include <sys/resource.h>
 #include <sys/socket.h>
 #include <sys/un.h>
+#include <sys/prctl.h>
 #include <arpa/inet.h>
 #include <netinet/in.h>
 #include <dlfcn.h>
 #include <errno.h>
+#include <fcntl.h>
 #include <pthread.h>
 #include <stdbool.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 #include <unistd.h>
 #include <inttypes.h>
 
@@ -50,6 +53,8 @@ static void *(*real_dlopen)(const char *, int) = NULL;
 static int (*real_pthread_attr_getstack)(const pthread_attr_t *, void **, size_t *);
 static struct sockaddr_un socks_addr;
 static struct sockaddr_un control_addr;
+static struct sockaddr_un egress_addr;
+static bool egress_mode = false;
 static void *cached_environ;
 extern char **environ;
 
@@ -58,6 +63,72 @@ extern char **environ;
 #define TBB_SOCKS_PORT 9150
 #define TBB_CONTROL_PORT 9151
 
+#define EGRESS_SOCKET_ENV "TOR_STUB_EGRESS_SOCKET"
+#define EGRESS_HDR_LEN (1 + 2 + 16)
+
+/* In egress mode, which is used for tor when it has a network namespace of
+ * it's own, every TCP connection is made via the launcher's egress
+ * surrogate.  The destination is sent as a fixed length header, consisting
+ * of the address family (4 or 6), the port and the address, both in network
+ * byte order.  The surrogate closes the connection if the destination is not
+ * allowed, or if it fails to connect, which the caller will see as the
+ * connection being closed by the peer.
+ */
+static int
+egress_connect(int fd, const struct sockaddr *address, socklen_t address_len)
+{
+  uint8_t hdr[EGRESS_HDR_LEN];
+  ssize_t n;
+
+  memset(hdr, 0, sizeof(hdr));
+  switch (address->sa_family) {
+    case AF_INET: {
+      const struct sockaddr_in *in_addr = (const struct sockaddr_in *)address;
+
+      if (address_len < sizeof(struct sockaddr_in)) {
+        errno = EINVAL;
+        return -1;
+      }
+      hdr[0] = 4;
+      memcpy(&hdr[1], &in_addr->sin_port, 2);
+      memcpy(&hdr[3], &in_addr->sin_addr, 4);
+      break;
+    }
+    case AF_INET6: {
+      const struct sockaddr_in6 *in6_addr = (const struct sockaddr_in6 *)address;
+
+      if (address_len < sizeof(struct sockaddr_in6)) {
+        errno = EINVAL;
+        return -1;
+      }
+      hdr[0] = 6;
+      memcpy(&hdr[1], &in6_addr->sin6_port, 2);
+      memcpy(&hdr[3], &in6_addr->sin6_addr, 16);
+      break;
+    }
+    default:
+      errno = EAFNOSUPPORT;
+      return -1;
+  }
+
+  if (real_connect(fd, (struct sockaddr *)&egress_addr, sizeof(struct sockaddr_un)) < 0) {
+    return -1;
+  }
+
+  /* The socket buffer is empty, so this will not block or be truncated,
+   * even if the socket is non-blocking.
+   */
+  do {
+    n = send(fd, hdr, sizeof(hdr), MSG_NOSIGNAL);
+  } while (n < 0 && errno == EINTR);
+  if (n != sizeof(hdr)) {
+    errno = ECONNREFUSED;
+    return -1;
+  }
+
+  return 0;
+}
+
 int
 connect(int fd, const struct sockaddr *address, socklen_t address_len)
 {
@@ -74,6 +145,10 @@ connect(int fd, const struct sockaddr *address, socklen_t address_len)
     return real_connect(fd, address, address_len);
   }
 
+  if (egress_mode) {
+    return egress_connect(fd, address, address_len);
+  }
+
   /* Unless something really goofy is going on, we should only ever have
    * AF_LOCAL or AF_INET sockets.  Enforce this.
    */
@@ -108,6 +183,15 @@ connect(int fd, const struct sockaddr *address, socklen_t address_len)
 int
 socket(int domain, int type, int protocol)
 {
+  /* Replace TCP sockets with AF_LOCAL, for the egress surrogate. */
+  if (egress_mode && (domain == AF_INET || domain == AF_INET6)) {
+    if ((type & ~(SOCK_NONBLOCK | SOCK_CLOEXEC)) != SOCK_STREAM) {
+      errno = EAFNOSUPPORT;
+      return -1;
+    }
+    return real_socket(AF_LOCAL, type, 0);
+  }
+
   /* Replace AF_INET with AF_LOCAL. */
   if (domain == AF_INET)
     domain = AF_LOCAL;
@@ -303,14 +387,141 @@ pthread_attr_getstack(const pthread_attr_t *attr, void **stackaddr, size_t *stac
   return ret;
 }
 
+/*
+ * Landlock is a second layer of filesystem confinement beneath the mount
+ * namespace, so that a mistake there (eg: a bind mount that should have
+ * been read-only) doesn't automatically mean write access.  Only writes are
+ * restricted, to the directories in `TOR_STUB_LANDLOCK_WRITABLE`.
+ *
+ * The definitions are here instead of coming from `<linux/landlock.h>`, so
+ * that the stub can be built on systems that predate Landlock.
+ */
+
+#define LANDLOCK_WRITABLE_ENV "TOR_STUB_LANDLOCK_WRITABLE"
+
+#ifndef __NR_landlock_create_ruleset
+#define __NR_landlock_create_ruleset 444
+#define __NR_landlock_add_rule 445
+#define __NR_landlock_restrict_self 446
+#endif
+
+#define STUB_LANDLOCK_CREATE_RULESET_VERSION (1U << 0)
+#define STUB_LANDLOCK_RULE_PATH_BENEATH 1
+
+#define STUB_LANDLOCK_ACCESS_FS_WRITE_FILE (1ULL << 1)
+#define STUB_LANDLOCK_ACCESS_FS_REMOVE_DIR (1ULL << 4)
+#define STUB_LANDLOCK_ACCESS_FS_REMOVE_FILE (1ULL << 5)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_CHAR (1ULL << 6)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_DIR (1ULL << 7)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_REG (1ULL << 8)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_SOCK (1ULL << 9)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_FIFO (1ULL << 10)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_BLOCK (1ULL << 11)
+#define STUB_LANDLOCK_ACCESS_FS_MAKE_SYM (1ULL << 12)
+#define STUB_LANDLOCK_ACCESS_FS_REFER (1ULL << 13) /* ABI >= 2 */
+#define STUB_LANDLOCK_ACCESS_FS_TRUNCATE (1ULL << 14) /* ABI >= 3 */
+
+struct stub_landlock_ruleset_attr {
+  uint64_t handled_access_fs;
+};
+
+struct stub_landlock_path_beneath_attr {
+  uint64_t allowed_access;
+  int32_t parent_fd;
+} __attribute__((packed));
+
+static void
+landlock_init(void)
+{
+  struct stub_landlock_ruleset_attr ruleset_attr;
+  struct stub_landlock_path_beneath_attr path_beneath;
+  char *writable, *paths, *path, *saveptr;
+  int abi, ruleset_fd;
+
+  if ((writable = secure_getenv(LANDLOCK_WRITABLE_ENV)) == NULL) {
+    return;
+  }
+
+  /* The launcher only sets the variable if the kernel supports Landlock, so
+   * every failure from here on is fatal.
+   */
+  abi = syscall(__NR_landlock_create_ruleset, NULL, 0, STUB_LANDLOCK_CREATE_RULESET_VERSION);
+  if (abi < 1) {
+    fprintf(stderr, "ERROR: Failed to query the Landlock ABI: %d\n", errno);
+    abort();
+  }
+
+  memset(&ruleset_attr, 0, sizeof(ruleset_attr));
+  ruleset_attr.handled_access_fs = STUB_LANDLOCK_ACCESS_FS_WRITE_FILE |
+    STUB_LANDLOCK_ACCESS_FS_REMOVE_DIR | STUB_LANDLOCK_ACCESS_FS_REMOVE_FILE |
+    STUB_LANDLOCK_ACCESS_FS_MAKE_CHAR | STUB_LANDLOCK_ACCESS_FS_MAKE_DIR |
+    STUB_LANDLOCK_ACCESS_FS_MAKE_REG | STUB_LANDLOCK_ACCESS_FS_MAKE_SOCK |
+    STUB_LANDLOCK_ACCESS_FS_MAKE_FIFO | STUB_LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+    STUB_LANDLOCK_ACCESS_FS_MAKE_SYM;
+  if (abi >= 2) {
+    ruleset_attr.handled_access_fs |= STUB_LANDLOCK_ACCESS_FS_REFER;
+  }
+  if (abi >= 3) {
+    ruleset_attr.handled_access_fs |= STUB_LANDLOCK_ACCESS_FS_TRUNCATE;
+  }
+  ruleset_fd = syscall(__NR_landlock_create_ruleset, &ruleset_attr, sizeof(ruleset_attr), 0);
+  if (ruleset_fd < 0) {
+    fprintf(stderr, "ERROR: Failed to create the Landlock ruleset: %d\n", errno);
+    abort();
+  }
+
+  if ((paths = strdup(writable)) == NULL) {
+    abort();
+  }
+  for (path = strtok_r(paths, ":", &saveptr); path != NULL; path = strtok_r(NULL, ":", &saveptr)) {
+    memset(&path_beneath, 0, sizeof(path_beneath));
+    path_beneath.allowed_access = ruleset_attr.handled_access_fs;
+
+    /* Directories that don't exist can't be written to either. */
+    if ((path_beneath.parent_fd = open(path, O_PATH | O_DIRECTORY | O_CLOEXEC)) < 0) {
+      fprintf(stderr, "WARN: Landlock: Skipping '%s': %d\n", path, errno);
+      continue;
+    }
+    if (syscall(__NR_landlock_add_rule, ruleset_fd, STUB_LANDLOCK_RULE_PATH_BENEATH, &path_beneath, 0) != 0) {
+      fprintf(stderr, "ERROR: Landlock: Failed to add '%s': %d\n", path, errno);
+      abort();
+    }
+    close(path_beneath.parent_fd);
+  }
+  free(paths);
+
+  /* bubblewrap sets this, but the kernel insists on it. */
+  prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0);
+  if (syscall(__NR_landlock_restrict_self, ruleset_fd, 0) != 0) {
+    fprintf(stderr, "ERROR: Failed to enforce the Landlock ruleset: %d\n", errno);
+    abort();
+  }
+  close(ruleset_fd);
+
+  /* The restrictions are inherited, so the child processes that also load
+   * the stub don't need to stack another identical layer.
+   */
+  unsetenv(LANDLOCK_WRITABLE_ENV);
+}
+
 /*  Initialize the stub. */
 __attribute__((constructor)) static void
 stub_init(void)
 {
   char *socks_path = secure_getenv("TOR_STUB_SOCKS_SOCKET");
   char *control_path = secure_getenv("TOR_STUB_CONTROL_SOCKET");
+  char *egress_path = secure_getenv(EGRESS_SOCKET_ENV);
   size_t dest_len = sizeof(socks_addr.sun_path);
 
+  /* Egress mode has no use for the SOCKS and control ports. */
+  if (egress_path != NULL) {
+    egress_mode = true;
+    egress_addr.sun_family = AF_LOCAL;
+    strncpy(egress_addr.sun_path, egress_path, dest_len);
+    egress_addr.sun_path[dest_len-1] = '\0';
+    socks_path = control_path = "";
+  }
+
   /* If `TOR_STUB_SOCKS_SOCKET` isn't set, bail. */
   if (socks_path == NULL) {
     fprintf(stderr, "ERROR: `TOR_STUB_SOCKS_SOCKET` enviornment variable not set.\n");
@@ -360,6 +571,9 @@ stub_init(void)
     goto out;
   }
 
+  /* Apply the Landlock ruleset if one was requested. */
+  landlock_init();
+
   /* Save this since firefox at least will overwrite it. */
   cached_environ = environ;
 